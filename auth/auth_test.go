@@ -0,0 +1,141 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv/ufs"
+)
+
+func setup(t *testing.T, keys *Keyring) string {
+	fs := ufs.New()
+	fs.Dotu = true
+	fs.Id = "ufs"
+	fs.Root = t.TempDir()
+	if keys != nil {
+		fs.Auth = NewServer(keys)
+	}
+
+	if !fs.Start(fs) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	go fs.StartListener(l)
+	return l.Addr().String()
+}
+
+func TestAuth(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	keys := NewKeyring("test")
+	keys.Add(user.Name(), "secret")
+	addr := setup(t, keys)
+
+	c, err := Mount("unix", addr, "/", 8192, user, keys)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	if _, err := c.FStat("/"); err != nil {
+		t.Errorf("FStat: %v", err)
+	}
+	c.Unmount()
+
+	if _, err := clnt.Mount("unix", addr, "/", 8192, user); err == nil {
+		t.Errorf("Mount without authentication succeeded")
+	}
+
+	bad := NewKeyring("")
+	bad.Add(user.Name(), "wrong")
+	if _, err := Mount("unix", addr, "/", 8192, user, bad); err == nil {
+		t.Errorf("Mount with a wrong secret succeeded")
+	}
+
+	// the afid is good only for the aname it was created for
+	cl, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	c, err = clnt.Connect(cl, 8192+ninep.IOHDRSZ, true)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer c.Unmount()
+
+	afid, err := keys.Authenticate(context.Background(), c, user, "/")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	if _, err := c.Attach(afid, user, "/other"); err == nil {
+		t.Errorf("Attach with a different aname succeeded")
+	}
+
+	if _, err := c.Attach(afid, user, "/"); err != nil {
+		t.Errorf("Attach: %v", err)
+	}
+}
+
+func TestNoauth(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	keys := NewKeyring("test")
+	keys.Add(user.Name(), "secret")
+	addr := setup(t, nil)
+
+	// the servers that refuse Tauth aren't trusted by default
+	if c, err := Mount("unix", addr, "/", 8192, user, keys); err == nil {
+		c.Unmount()
+		t.Fatalf("Mount to a server that refuses Tauth succeeded")
+	}
+
+	keys.AllowNoauth = true
+	c, err := Mount("unix", addr, "/", 8192, user, keys)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer c.Unmount()
+
+	if _, err := c.FStat("/"); err != nil {
+		t.Errorf("FStat: %v", err)
+	}
+}
+
+func TestReadKeyfile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "keys")
+	data := "# keys\ndom example\n\nglenda some secret\nnone\tx\n"
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadKeyfile(name); err == nil {
+		t.Errorf("ReadKeyfile accepted a world-readable keyfile")
+	}
+
+	os.Chmod(name, 0600)
+	k, err := ReadKeyfile(name)
+	if err != nil {
+		t.Fatalf("ReadKeyfile: %v", err)
+	}
+
+	if k.Domain != "example" || string(k.Key("glenda")) != "some secret" || string(k.Key("none")) != "x" {
+		t.Errorf("ReadKeyfile: got domain %q, keys %q", k.Domain, k.keys)
+	}
+
+	if k.Key("bootes") != nil {
+		t.Errorf("Key: unknown user has a key")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+)
+
+// Runs the client side of the protocol. Creates an authentication fid
+// for the user, and proves to the server that the user knows the
+// secret from the keyring. Returns the fid that should be passed to
+// Attach, or nil if the server doesn't require authentication and the
+// keyring allows that (see Keyring.AllowNoauth). Authenticate can be used as the Reauth function of the client.
+func (k *Keyring) Authenticate(ctx context.Context, c *clnt.Clnt, user ninep.User, aname string) (*clnt.Fid, error) {
+	key := k.Key(user.Name())
+	if key == nil {
+		return nil, Enokey
+	}
+
+	afid, err := c.AuthContext(ctx, user, aname)
+	if err != nil {
+		if k.AllowNoauth && noauth(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	a := &authClnt{ctx: ctx, c: c, afid: afid}
+	if err := a.run(key, user.Name(), aname); err != nil {
+		c.ClunkContext(ctx, afid)
+		return nil, err
+	}
+
+	return afid, nil
+}
+
+// Returns true if the error to Tauth says that the server doesn't
+// authenticate. The 9P2000 servers only send a string, the Plan 9 and
+// ninep servers set EINVAL, and some 9P2000.L servers ENOTSUP or ENOSYS.
+func noauth(err error) bool {
+	var e *ninep.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Errornum {
+	case 0, ninep.EINVAL, ninep.ENOTSUP, ninep.ENOSYS:
+		return true
+	}
+
+	return false
+}
+
+// Connects to a file server, authenticates with the keyring and
+// attaches to it as the specified user. If the connection breaks,
+// the client dials and authenticates again (see clnt.MountDial).
+func Mount(ntype, addr, aname string, msize uint32, user ninep.User, k *Keyring) (*clnt.Clnt, error) {
+	dial := func() (net.Conn, error) { return net.Dial(ntype, addr) }
+	c, e := dial()
+	if e != nil {
+		return nil, &ninep.Error{e.Error(), ninep.EIO}
+	}
+
+	cl, err := clnt.Connect(c, msize+ninep.IOHDRSZ, true)
+	if err != nil {
+		return nil, err
+	}
+
+	afid, err := k.Authenticate(context.Background(), cl, user, aname)
+	if err != nil {
+		cl.Unmount()
+		return nil, err
+	}
+
+	fid, err := cl.Attach(afid, user, aname)
+	if afid != nil {
+		cl.Clunk(afid)
+	}
+
+	if err != nil {
+		cl.Unmount()
+		return nil, err
+	}
+
+	cl.Lock()
+	cl.Root = fid
+	cl.Dial = dial
+	cl.Reauth = k.Authenticate
+	cl.Unlock()
+	return cl, nil
+}
+
+type authClnt struct {
+	ctx    context.Context
+	c      *clnt.Clnt
+	afid   *clnt.Fid
+	offset uint64
+}
+
+func (a *authClnt) read() ([]byte, error) {
+	b, err := a.c.ReadContext(a.ctx, a.afid, a.offset, a.afid.Iounit)
+	a.offset += uint64(len(b))
+	return b, err
+}
+
+func (a *authClnt) write(b []byte) error {
+	n, err := a.c.WriteContext(a.ctx, a.afid, b, a.offset)
+	a.offset += uint64(n)
+	if err == nil && n != len(b) {
+		err = Eproto
+	}
+
+	return err
+}
+
+func (a *authClnt) run(key []byte, user, aname string) error {
+	// choose our protocol from the offered protocols
+	b, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	var dom string
+	if !bytes.HasPrefix(b, []byte("v.2 ")) || b[len(b)-1] != 0 {
+		return Eproto
+	}
+
+	for _, p := range strings.Fields(string(b[4 : len(b)-1])) {
+		if strings.HasPrefix(p, Proto+"@") {
+			dom = p[len(Proto)+1:]
+			break
+		}
+	}
+
+	if dom == "" {
+		return Eproto
+	}
+
+	if err := a.write([]byte(Proto + " " + dom + "\x00")); err != nil {
+		return err
+	}
+
+	if b, err = a.read(); err != nil {
+		return err
+	}
+
+	if string(b) != "OK\x00" {
+		return Eproto
+	}
+
+	// answer the server's challenge with ours
+	chs, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	if len(chs) != ChalLen {
+		return Eproto
+	}
+
+	chc := make([]byte, ChalLen)
+	if _, err := rand.Read(chc); err != nil {
+		return err
+	}
+
+	m := mac(key, "client", dom, user, aname, chs, chc)
+	if err := a.write(append(chc, m...)); err != nil {
+		return err
+	}
+
+	// check that the server knows the secret too
+	if b, err = a.read(); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(b, mac(key, "server", dom, user, aname, chs, chc)) {
+		return Efailed
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The auth package implements ninep-hmac1, a shared-secret
+// challenge-response authentication protocol. The negotiation is modeled
+// after the Plan 9 p9any protocol, but the protocol isn't Plan 9's p9sk1,
+// and doesn't interoperate with Plan 9 authentication servers.
+// The server and the client share a secret per user, kept in a local
+// keyfile. The client proves it knows the secret without sending it,
+// and the server proves the same to the client.
+//
+// The protocol is run over an authentication fid. Each read and write
+// carries a single message:
+//
+//	S->C	v.2 ninep-hmac1@dom\0
+//	C->S	ninep-hmac1 dom\0
+//	S->C	OK\0
+//	S->C	CHs			(32 bytes)
+//	C->S	CHc, MAC(client)	(32 bytes each)
+//	S->C	MAC(server)		(32 bytes)
+//
+// where MAC(x) is the HMAC-SHA256 of x, dom, user, aname and both
+// challenges keyed with the user's secret.
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lionkov/ninep"
+)
+
+const (
+	Proto     = "ninep-hmac1" // Name of the protocol
+	ChalLen   = 32            // Length of the challenges
+	MacLen    = sha256.Size
+	DefDomain = "ninep" // Domain used if the Keyring doesn't set one
+)
+
+var Enokey error = &ninep.Error{"no key for user", ninep.EPERM}
+var Ephase error = &ninep.Error{"authentication protocol phase error", ninep.EPERM}
+var Eproto error = &ninep.Error{"authentication protocol botch", ninep.EPERM}
+var Efailed error = &ninep.Error{"authentication failed", ninep.EPERM}
+var Erequired error = &ninep.Error{"authentication required", ninep.EPERM}
+var Etoosmall error = &ninep.Error{"authentication read too small", ninep.EINVAL}
+
+// Keyring holds the shared secrets of the users.
+type Keyring struct {
+	Domain string // Authentication domain
+
+	// If set, the clients attach without authentication to the
+	// servers that don't authenticate. Otherwise an error to Tauth
+	// fails the authentication, as a server that refuses Tauth can't
+	// prove that it knows the secret.
+	AllowNoauth bool
+
+	keys map[string][]byte
+}
+
+// Creates an empty keyring for the domain.
+func NewKeyring(domain string) *Keyring {
+	return &Keyring{Domain: domain, keys: make(map[string][]byte)}
+}
+
+// Reads the keys from a keyfile. Each line of the file contains a user
+// name, followed by white space and the user's secret, which extends
+// to the end of the line. Empty lines and lines starting with '#' are
+// ignored. A line "dom <domain>" sets the authentication domain. Since
+// the file contains secrets, it must not be accessible by group or others.
+func ReadKeyfile(name string) (*Keyring, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Mode().Perm()&077 != 0 {
+		return nil, fmt.Errorf("%s: keyfile is accessible by group or others", name)
+	}
+
+	k := NewKeyring("")
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: missing secret", name, n)
+		}
+
+		user, secret := line[0:i], strings.TrimSpace(line[i:])
+		if user == "dom" {
+			k.Domain = secret
+		} else {
+			k.Add(user, secret)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Sets the secret of the user.
+func (k *Keyring) Add(user, secret string) {
+	k.keys[user] = []byte(secret)
+}
+
+// Returns the secret of the user, or nil if the user has no key.
+func (k *Keyring) Key(user string) []byte {
+	return k.keys[user]
+}
+
+func (k *Keyring) domain() string {
+	if k.Domain == "" {
+		return DefDomain
+	}
+
+	return k.Domain
+}
+
+// Calculates the MAC sent by side ("client" or "server").
+func mac(key []byte, side, dom, user, aname string, ch1, ch2 []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, s := range []string{Proto, side, dom, user, aname} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	h.Write(ch1)
+	h.Write(ch2)
+	return h.Sum(nil)
+}
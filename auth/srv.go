@@ -0,0 +1,157 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Protocol phases
+const (
+	phOffer   = iota // server sends the offered protocols
+	phChoose         // client chooses the protocol
+	phOK             // server acknowledges the choice
+	phChal           // server sends its challenge
+	phResp           // client sends its challenge and MAC
+	phConfirm        // server sends its MAC
+	phDone
+)
+
+// Server implements the server side of the protocol. Set it as the
+// Auth field of srv.Srv, or embed it in the file server.
+type Server struct {
+	Keys *Keyring
+
+	qpath uint64
+}
+
+// Authentication state, kept in the Aux field of the afid
+type authFid struct {
+	sync.Mutex
+	phase int
+	user  string
+	aname string
+	key   []byte
+	chs   []byte
+	chc   []byte
+}
+
+// Verify that we correctly implement AuthOps
+var _ srv.AuthOps = (*Server)(nil)
+
+func NewServer(keys *Keyring) *Server {
+	return &Server{Keys: keys}
+}
+
+func (s *Server) AuthInit(afid *srv.Fid, aname string) (*ninep.Qid, error) {
+	user := afid.User.Name()
+	key := s.Keys.Key(user)
+	if key == nil {
+		return nil, Enokey
+	}
+
+	a := &authFid{user: user, aname: aname, key: key}
+	a.chs = make([]byte, ChalLen)
+	if _, err := rand.Read(a.chs); err != nil {
+		return nil, &ninep.Error{err.Error(), ninep.EIO}
+	}
+
+	afid.Aux = a
+	return &ninep.Qid{Type: ninep.QTAUTH, Path: atomic.AddUint64(&s.qpath, 1)}, nil
+}
+
+func (s *Server) AuthDestroy(afid *srv.Fid) {
+	afid.Aux = nil
+}
+
+func (s *Server) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	if afid == nil {
+		return Erequired
+	}
+
+	a, ok := afid.Aux.(*authFid)
+	if !ok {
+		return Efailed
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.phase != phDone || a.user != fid.User.Name() || a.aname != aname {
+		return Efailed
+	}
+
+	return nil
+}
+
+func (s *Server) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	a, ok := afid.Aux.(*authFid)
+	if !ok {
+		return 0, Ephase
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	var msg []byte
+	switch a.phase {
+	case phOffer:
+		msg = []byte("v.2 " + Proto + "@" + s.Keys.domain() + "\x00")
+	case phOK:
+		msg = []byte("OK\x00")
+	case phChal:
+		msg = a.chs
+	case phConfirm:
+		msg = mac(a.key, "server", s.Keys.domain(), a.user, a.aname, a.chs, a.chc)
+	default:
+		return 0, Ephase
+	}
+
+	if len(data) < len(msg) {
+		return 0, Etoosmall
+	}
+
+	a.phase++
+	return copy(data, msg), nil
+}
+
+func (s *Server) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	a, ok := afid.Aux.(*authFid)
+	if !ok {
+		return 0, Ephase
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	switch a.phase {
+	case phChoose:
+		if string(data) != Proto+" "+s.Keys.domain()+"\x00" {
+			return 0, Eproto
+		}
+
+	case phResp:
+		if len(data) != ChalLen+MacLen {
+			return 0, Eproto
+		}
+
+		chc := data[0:ChalLen]
+		m := mac(a.key, "client", s.Keys.domain(), a.user, a.aname, a.chs, chc)
+		if !hmac.Equal(m, data[ChalLen:]) {
+			return 0, Efailed
+		}
+
+		a.chc = append([]byte(nil), chc...)
+
+	default:
+		return 0, Ephase
+	}
+
+	a.phase++
+	return len(data), nil
+}
@@ -7,18 +7,25 @@
 package clnt
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/metrics"
 	"log"
+	"log/slog"
 	"net"
+	"path"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Debug flags
 const (
-	DbgPrintFcalls  = (1 << iota) // print all 9P messages on stderr
-	DbgPrintPackets               // print the raw packets on stderr
+	DbgPrintFcalls  = (1 << iota) // print all 9P messages on stderr (or log them on Slog)
+	DbgPrintPackets               // print the raw packets on stderr (or add them to the Slog records)
 	DbgLogFcalls                  // keep the last N 9P messages (can be accessed over http)
 	DbgLogPackets                 // keep the last N 9P messages (can be accessed over http)
 )
@@ -36,21 +43,30 @@ type Clnt struct {
 	Debuglevel int    // =0 don't print anything, >0 print Fcalls, >1 print raw packets
 	Msize      uint32 // Maximum size of the 9P messages
 	Dotu       bool   // If true, 9P2000.u protocol is spoken
+	Dotl       bool   // If true, 9P2000.L protocol is spoken
 	Root       *Fid   // Fid that points to the rood directory
 	Id         string // Used when printing debug messages
 	Log        *ninep.Logger
+	Dial       DialFunc         // If set, used to reconnect when the connection breaks
+	Reauth     AuthFunc         // If set, used to authenticate after reconnecting
+	Metrics    *metrics.Metrics // If set, records the statistics of the requests
+	Slog       *slog.Logger     // If set, used for the structured log records (see Debuglevel)
 
 	conn     net.Conn
 	tagpool  *pool
 	fidpool  *pool
+	fids     map[uint32]*Fid
 	reqout   chan *Req
 	done     chan bool
+	closed   chan bool
 	reqfirst *Req
 	reqlast  *Req
 	err      error
 
+	redialLock sync.Mutex
+	restoring  bool
+
 	reqchan chan *Req
-	tchan   chan *ninep.Fcall
 
 	next, prev *Clnt
 }
@@ -61,11 +77,15 @@ type Fid struct {
 	sync.Mutex
 	Clnt       *Clnt // Client the fid belongs to
 	Iounit     uint32
-	ninep.Qid         // The Qid description for the file
-	Mode       uint8  // Open mode (one of ninep.O* values) (if file is open)
-	Fid        uint32 // Fid number
-	ninep.User        // The user the fid belongs to
-	walked     bool   // true if the fid points to a walked file on the server
+	ninep.Qid           // The Qid description for the file
+	Mode       uint8    // Open mode (one of ninep.O* values) (if file is open)
+	Fid        uint32   // Fid number
+	ninep.User          // The user the fid belongs to
+	walked     bool     // true if the fid points to a walked file on the server
+	opened     bool     // true if the fid is opened
+	auth       bool     // true if the fid is an authentication fid
+	aname      string   // aname of the attach the fid was walked from
+	path       []string // names walked from the attach fid
 }
 
 // The file is similar to the Fid, but is used in the high-level client
@@ -94,6 +114,7 @@ type Req struct {
 	tag        uint16
 	prev, next *Req
 	fid        *Fid
+	start      time.Time // when the request was queued
 }
 
 type ClntList struct {
@@ -104,8 +125,18 @@ type ClntList struct {
 var clnts *ClntList
 var DefaultDebuglevel int
 var DefaultLogger *ninep.Logger
+var DefaultMetrics *metrics.Metrics
+var DefaultSlog *slog.Logger
 
 func (clnt *Clnt) Rpcnb(r *Req) error {
+	if err := clnt.redial(); err != nil {
+		return err
+	}
+
+	return clnt.rpcnb(r)
+}
+
+func (clnt *Clnt) rpcnb(r *Req) error {
 	var tag uint16
 
 	if r.Tc.Type == ninep.Tversion {
@@ -121,6 +152,8 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 		return clnt.err
 	}
 
+	reqout := clnt.reqout
+
 	if clnt.reqlast != nil {
 		clnt.reqlast.next = r
 	} else {
@@ -131,77 +164,152 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 	clnt.reqlast = r
 	clnt.Unlock()
 
-	clnt.reqout <- r
+	r.start = time.Now()
+	reqout <- r
 	return nil
 }
 
 func (clnt *Clnt) Rpc(tc *ninep.Fcall) (rc *ninep.Fcall, err error) {
+	return clnt.RpcContext(context.Background(), tc)
+}
+
+// Sends the request and waits for the response. If ctx is done before
+// the server responds, sends Tflush for the request and waits for the
+// server to acknowledge it before the tag is reused. If the server
+// responded to the original request before the Tflush, its response
+// is returned, otherwise the error is ctx.Err().
+func (clnt *Clnt) RpcContext(ctx context.Context, tc *ninep.Fcall) (rc *ninep.Fcall, err error) {
+	if err = ctx.Err(); err != nil {
+		clnt.FreeFcall(tc)
+		return
+	}
+
+	if ctx.Value(restoreKey{}) == nil {
+		if err = clnt.redial(); err != nil {
+			return
+		}
+	}
+
 	r := clnt.ReqAlloc()
 	r.Tc = tc
 	r.Done = make(chan *Req)
-	r.Sent = make(chan bool)
-	err = clnt.Rpcnb(r)
+	r.Sent = make(chan bool, 1)
+	err = clnt.rpcnb(r)
 	if err != nil {
 		return
 	}
 
-	<-r.Done
+	select {
+	case <-r.Done:
+	case <-ctx.Done():
+		if !clnt.flush(r) {
+			r.Err = ctx.Err()
+		}
+	}
+
 	rc = r.Rc
 	err = r.Err
 	clnt.ReqFree(r)
 	return
 }
 
+// Flushes the outstanding request r. Returns true if the server
+// responded to r, false if r was cancelled.
+func (clnt *Clnt) flush(r *Req) bool {
+	f := clnt.ReqAlloc()
+	f.Tc = clnt.NewFcall()
+	f.Done = make(chan *Req)
+	f.Sent = make(chan bool, 1)
+	ninep.PackTflush(f.Tc, r.tag)
+	if clnt.rpcnb(f) != nil {
+		// the connection is closed, r will be completed with an error
+		<-r.Done
+		clnt.ReqFree(f)
+		return true
+	}
+
+	// The response to r, if any, arrives before Rflush
+	replied := false
+	rdone := r.Done
+	for fdone := f.Done; fdone != nil; {
+		select {
+		case <-rdone:
+			replied = true
+			rdone = nil
+
+		case <-fdone:
+			fdone = nil
+		}
+	}
+
+	if !replied {
+		clnt.Lock()
+		if r.prev != nil || clnt.reqfirst == r {
+			clnt.unlinkReq(r)
+		}
+		clnt.Unlock()
+	}
+
+	clnt.ReqFree(f)
+	return replied
+}
+
+// Removes the request from the list of outstanding requests.
+// Should be called with clnt locked.
+func (clnt *Clnt) unlinkReq(r *Req) {
+	switch {
+	case r.next == nil && r.prev == nil:
+		clnt.reqlast = nil
+		clnt.reqfirst = nil
+	case r.next == nil:
+		clnt.reqlast = r.prev
+		r.prev.next = nil
+		r.prev = nil
+	case r.prev == nil:
+		clnt.reqfirst = r.next
+		r.next.prev = nil
+		r.next = nil
+	default:
+		r.next.prev = r.prev
+		r.prev.next = r.next
+		r.next = nil
+		r.prev = nil
+	}
+}
+
 func (clnt *Clnt) recv() {
 	var err error
-	var buf []byte
 
-	err = nil
-	pos := 0
+	mr := ninep.NewMsgReader(clnt.conn)
 	for {
 		// Connect can change the client Msize.
-		clntmsize := int(atomic.LoadUint32(&clnt.Msize))
-		if len(buf) < clntmsize {
-			b := make([]byte, clntmsize*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
-		}
+		buf, rerr := mr.Read(atomic.LoadUint32(&clnt.Msize))
+		if rerr != nil {
+			if e, ok := rerr.(*ninep.Error); ok {
+				err = e
+				clnt.conn.Close()
+			} else {
+				err = &ninep.Error{rerr.Error(), ninep.EIO}
+			}
 
-		n, oerr := clnt.conn.Read(buf[pos:])
-		if oerr != nil || n == 0 {
-			err = &ninep.Error{oerr.Error(), ninep.EIO}
 			clnt.Lock()
 			clnt.err = err
 			clnt.Unlock()
 			goto closed
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := ninep.Gint32(buf)
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, atomic.LoadUint32(&clnt.Msize)*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
-
-				break
-			}
-
-			fc, err, fcsize := ninep.Unpack(buf, clnt.Dotu)
-			clnt.Lock()
-			if err != nil {
-				clnt.err = err
-				clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
-			}
+		fc, err, _ := ninep.Unpack(buf, clnt.Dotu || clnt.Dotl)
+		clnt.Lock()
+		if err != nil {
+			clnt.err = err
+			clnt.conn.Close()
+			clnt.Unlock()
+			goto closed
+		}
 
-			if clnt.Debuglevel > 0 {
-				clnt.logFcall(fc)
+		if clnt.Debuglevel > 0 {
+			clnt.logFcall(fc)
+			if clnt.Slog == nil {
 				if clnt.Debuglevel&DbgPrintPackets != 0 {
 					log.Println("}-}", clnt.Id, fmt.Sprint(fc.Pkt))
 				}
@@ -210,67 +318,62 @@ func (clnt *Clnt) recv() {
 					log.Println("}}}", clnt.Id, fc.String())
 				}
 			}
+		}
 
-			var r *Req = nil
-			for r = clnt.reqfirst; r != nil; r = r.next {
-				if r.Tc.Tag == fc.Tag {
-					break
-				}
-			}
-
-			if r == nil {
-				clnt.err = &ninep.Error{"unexpected response", ninep.EINVAL}
-				clnt.conn.Close()
-				clnt.Unlock()
-				goto closed
+		var r *Req = nil
+		for r = clnt.reqfirst; r != nil; r = r.next {
+			if r.Tc.Tag == fc.Tag {
+				break
 			}
+		}
 
-			// Good clean fun. There's a race where you can get the response BEFORE the loop
-			// in send() thinks it is done with the request. So we have to block on
-			// it being sent, because we really can't dequeue any more requests until
-			// this one is wrapped up. TODO: consider a goroutine per fid for this,
-			// if we need it. The reason I feel this is safe is that if we got a tag back
-			// for a request we sent, then r.Sent should be written. If we got a tag
-			// back for a request we did not sent, we won't find it here anyway.
-			<-r.Sent
-
-			r.Rc = fc
-			switch {
-			case r.next == nil && r.prev == nil:
-				clnt.reqlast = nil
-				clnt.reqfirst = nil
-			case r.next == nil:
-				clnt.reqlast = r.prev
-				r.prev.next = nil
-				r.prev = nil
-			case r.prev == nil:
-				clnt.reqfirst = r.next
-				r.next.prev = nil
-				r.next = nil
-			default:
-				r.next.prev = r.prev
-				r.prev.next = r.next
-				r.next = nil
-				r.prev = nil
-			}
+		if r == nil {
+			clnt.err = &ninep.Error{"unexpected response", ninep.EINVAL}
+			clnt.conn.Close()
 			clnt.Unlock()
+			goto closed
+		}
 
-			if r.Tc.Type != r.Rc.Type-1 {
-				if r.Rc.Type != ninep.Rerror {
-					r.Err = &ninep.Error{"invalid response", ninep.EINVAL}
-				} else {
-					if r.Err == nil {
-						r.Err = &ninep.Error{r.Rc.Error, r.Rc.Errornum}
-					}
+		// Good clean fun. There's a race where you can get the response BEFORE the loop
+		// in send() thinks it is done with the request. So we have to block on
+		// it being sent, because we really can't dequeue any more requests until
+		// this one is wrapped up. TODO: consider a goroutine per fid for this,
+		// if we need it. The reason I feel this is safe is that if we got a tag back
+		// for a request we sent, then r.Sent should be written. If we got a tag
+		// back for a request we did not sent, we won't find it here anyway.
+		<-r.Sent
+
+		if clnt.Debuglevel > 0 && clnt.Slog != nil {
+			clnt.slogFcall("received", r, fc, clnt.fidPath(r.Tc))
+		}
+
+		r.Rc = fc
+		clnt.unlinkReq(r)
+		clnt.Unlock()
+
+		if m := clnt.Metrics; m != nil {
+			m.Request(r.Tc, r.Rc, time.Since(r.start))
+		}
+
+		if r.Tc.Type != r.Rc.Type-1 {
+			switch r.Rc.Type {
+			case ninep.Rerror:
+				if r.Err == nil {
+					r.Err = &ninep.Error{r.Rc.Error, r.Rc.Errornum}
+				}
+
+			case ninep.Rlerror:
+				if r.Err == nil {
+					r.Err = &ninep.Error{syscall.Errno(r.Rc.Errornum).Error(), r.Rc.Errornum}
 				}
-			}
 
-			if r.Done != nil {
-				r.Done <- r
+			default:
+				r.Err = &ninep.Error{"invalid response", ninep.EINVAL}
 			}
+		}
 
-			pos -= fcsize
-			buf = buf[fcsize:]
+		if r.Done != nil {
+			r.Done <- r
 		}
 	}
 
@@ -326,6 +429,8 @@ closed:
 	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
 		sop.statsUnregister()
 	}
+
+	close(clnt.closed)
 }
 
 func (clnt *Clnt) send() {
@@ -337,12 +442,19 @@ func (clnt *Clnt) send() {
 		case req := <-clnt.reqout:
 			if clnt.Debuglevel > 0 {
 				clnt.logFcall(req.Tc)
-				if clnt.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("{-{", clnt.Id, fmt.Sprint(req.Tc.Pkt))
-				}
+				if clnt.Slog != nil {
+					clnt.Lock()
+					p := clnt.fidPath(req.Tc)
+					clnt.Unlock()
+					clnt.slogFcall("sent", req, req.Tc, p)
+				} else {
+					if clnt.Debuglevel&DbgPrintPackets != 0 {
+						log.Println("{-{", clnt.Id, fmt.Sprint(req.Tc.Pkt))
+					}
 
-				if clnt.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("{{{", clnt.Id, req.Tc.String())
+					if clnt.Debuglevel&DbgPrintFcalls != 0 {
+						log.Println("{{{", clnt.Id, req.Tc.String())
+					}
 				}
 			}
 
@@ -365,18 +477,32 @@ func (clnt *Clnt) send() {
 // on the wire.
 func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	clnt := new(Clnt)
-	clnt.conn = c
 	clnt.Msize = msize
 	clnt.Dotu = dotu
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
-	clnt.Id = c.RemoteAddr().String() + ":"
+	clnt.Metrics = DefaultMetrics
+	clnt.Slog = DefaultSlog
 	clnt.tagpool = newPool(uint32(ninep.NOTAG))
 	clnt.fidpool = newPool(ninep.NOFID)
+	clnt.fids = make(map[uint32]*Fid)
+	clnt.reqchan = make(chan *Req, 16)
+	clnt.start(c)
+
+	return clnt
+}
+
+// Starts the goroutines that send and receive the messages over
+// the connection, and adds the client to the client list.
+func (clnt *Clnt) start(c net.Conn) {
+	clnt.Lock()
+	clnt.conn = c
+	clnt.Id = c.RemoteAddr().String() + ":"
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
-	clnt.reqchan = make(chan *Req, 16)
-	clnt.tchan = make(chan *ninep.Fcall, 16)
+	clnt.closed = make(chan bool)
+	clnt.err = nil
+	clnt.Unlock()
 
 	go clnt.recv()
 	go clnt.send()
@@ -395,20 +521,26 @@ func NewClnt(c net.Conn, msize uint32, dotu bool) *Clnt {
 	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
 		sop.statsRegister()
 	}
-
-	return clnt
 }
 
 // Establishes a new socket connection to the 9P server and creates
 // a client object for it. Negotiates the dialect and msize for the
 // connection. Returns a Clnt object, or Error.
 func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
-	clnt := NewClnt(c, msize, dotu)
-	ver := "9P2000"
-	if clnt.Dotu {
-		ver = "9P2000.u"
+	ver := ninep.Version
+	if dotu {
+		ver = ninep.VersionU
 	}
 
+	return ConnectVersion(c, msize, ver)
+}
+
+// Establishes a new socket connection to the 9P server and creates
+// a client object for it. Proposes the ver dialect (one of
+// ninep.Version, ninep.VersionU or ninep.VersionL) and uses the one
+// the server replies with. Returns a Clnt object, or Error.
+func ConnectVersion(c net.Conn, msize uint32, ver string) (*Clnt, error) {
+	clnt := NewClnt(c, msize, ver != ninep.Version)
 	clntmsize := atomic.LoadUint32(&clnt.Msize)
 	tc := ninep.NewFcall(clntmsize)
 	err := ninep.PackTversion(tc, clntmsize, ver)
@@ -425,7 +557,8 @@ func Connect(c net.Conn, msize uint32, dotu bool) (*Clnt, error) {
 		atomic.StoreUint32(&clnt.Msize, rc.Msize)
 	}
 
-	clnt.Dotu = rc.Version == "9P2000.u" && clnt.Dotu
+	clnt.Dotl = rc.Version == ninep.VersionL && ver == ninep.VersionL
+	clnt.Dotu = rc.Version == ninep.VersionU && clnt.Dotu
 	return clnt, nil
 }
 
@@ -434,26 +567,33 @@ func (clnt *Clnt) FidAlloc() *Fid {
 	fid := new(Fid)
 	fid.Fid = clnt.fidpool.getId()
 	fid.Clnt = clnt
+	clnt.Lock()
+	clnt.fids[fid.Fid] = fid
+	clnt.Unlock()
 
 	return fid
 }
 
-func (clnt *Clnt) NewFcall() *ninep.Fcall {
-	select {
-	case tc := <-clnt.tchan:
-		return tc
-	default:
+// Releases the fid number.
+func (clnt *Clnt) fidFree(fid *Fid) {
+	clnt.Lock()
+	if clnt.fids[fid.Fid] == fid {
+		delete(clnt.fids, fid.Fid)
 	}
-	return ninep.NewFcall(atomic.LoadUint32(&clnt.Msize))
+	clnt.Unlock()
+	clnt.fidpool.putId(fid.Fid)
+}
+
+// Returns a Fcall for a T-message. Its buffer is taken from the
+// pool when the message is packed.
+func (clnt *Clnt) NewFcall() *ninep.Fcall {
+	return ninep.NewFcall(0)
 }
 
+// Returns the Fcall and its buffer to the pool.
 func (clnt *Clnt) FreeFcall(fc *ninep.Fcall) {
-	if fc != nil && len(fc.Buf) >= int(atomic.LoadUint32(&clnt.Msize)) {
-		select {
-		case clnt.tchan <- fc:
-			break
-		default:
-		}
+	if fc != nil {
+		ninep.PutFcall(fc)
 	}
 }
 
@@ -514,3 +654,49 @@ func init() {
 		sop.statsRegister()
 	}
 }
+
+// Logs a 9P message of the request on the structured logger. The
+// DbgPrintFcalls debug flag enables the records, DbgPrintPackets adds
+// the raw message to them.
+func (clnt *Clnt) slogFcall(msg string, r *Req, fc *ninep.Fcall, p string) {
+	ctx := context.Background()
+	if clnt.Debuglevel&(DbgPrintFcalls|DbgPrintPackets) == 0 || !clnt.Slog.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	tc := r.Tc
+	attrs := make([]slog.Attr, 0, 9)
+	attrs = append(attrs, slog.String("clnt", clnt.Id), slog.Int("tag", int(tc.Tag)), slog.String("type", ninep.MsgName(fc.Type)))
+	if tc.Type != ninep.Tversion && tc.Type != ninep.Tflush {
+		attrs = append(attrs, slog.Uint64("fid", uint64(tc.Fid)))
+		if p != "" {
+			attrs = append(attrs, slog.String("path", p))
+		}
+	}
+
+	if fc != tc {
+		attrs = append(attrs, slog.Duration("duration", time.Since(r.start)))
+		switch fc.Type {
+		case ninep.Rerror:
+			attrs = append(attrs, slog.String("error", fc.Error), slog.Uint64("errno", uint64(fc.Errornum)))
+		case ninep.Rlerror:
+			attrs = append(attrs, slog.Uint64("errno", uint64(fc.Errornum)))
+		}
+	}
+
+	if clnt.Debuglevel&DbgPrintPackets != 0 {
+		attrs = append(attrs, slog.String("packet", hex.EncodeToString(fc.Pkt)))
+	}
+
+	clnt.Slog.LogAttrs(ctx, slog.LevelDebug, msg, attrs...)
+}
+
+// Returns the path (from the attach root) of the fid the message
+// refers to, if known. Should be called with the client locked.
+func (clnt *Clnt) fidPath(tc *ninep.Fcall) string {
+	if fid, ok := clnt.fids[tc.Fid]; ok && fid.walked {
+		return path.Join(append([]string{"/"}, fid.path...)...)
+	}
+
+	return ""
+}
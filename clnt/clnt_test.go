@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"path"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/lionkov/ninep"
 	"github.com/lionkov/ninep/srv/nullfs"
@@ -512,3 +514,406 @@ func BenchmarkRootWalkBadFid(b *testing.B) {
 		}
 	}
 }
+
+func TestDotl(t *testing.T) {
+	var err error
+	flag.Parse()
+	tmpDir, err := ioutil.TempDir("", "dotl")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ufs := new(ufs.Ufs)
+	ufs.Dotu = true
+	ufs.Dotl = true
+	ufs.Id = "ufs"
+	ufs.Root = tmpDir
+	ufs.Debuglevel = *debug
+	ufs.Start(ufs)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go ufs.StartListener(l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	clnt, err := ConnectVersion(conn, 8192+ninep.IOHDRSZ, ninep.VersionL)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer clnt.Unmount()
+
+	if !clnt.Dotl || clnt.Dotu {
+		t.Fatalf("Connect: want 9P2000.L, got Dotl %v Dotu %v", clnt.Dotl, clnt.Dotu)
+	}
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	root, err := clnt.Attach(nil, user, "/")
+	if err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	if _, err = clnt.Mkdir(root, "dir", 0755, ninep.NOUID); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	if _, err = clnt.Symlink(root, "link", "dir", ninep.NOUID); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	f := clnt.FidAlloc()
+	if _, err = clnt.Walk(root, f, []string{"link"}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	if target, err := clnt.Readlink(f); err != nil || target != "dir" {
+		t.Fatalf("Readlink: want dir, got %v, %v", target, err)
+	}
+	clnt.Clunk(f)
+
+	f = clnt.FidAlloc()
+	if _, err = clnt.Walk(root, f, []string{"dir"}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	if err = clnt.Lcreate(f, "file", 2, 0600, ninep.NOUID); err != nil {
+		t.Fatalf("Lcreate: %v", err)
+	}
+
+	if _, err = clnt.Write(f, []byte("data"), 0); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err = clnt.Fsync(f, false); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+
+	if err = clnt.Setattr(f, &ninep.SetAttr{Valid: ninep.SetattrMode, Mode: 0640}); err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+
+	attr, err := clnt.Getattr(f, ninep.GetattrBasic)
+	if err != nil {
+		t.Fatalf("Getattr: %v", err)
+	}
+
+	if attr.Size != 4 || attr.Mode&0777 != 0640 {
+		t.Errorf("Getattr: want size 4 mode 0640, got %d %o", attr.Size, attr.Mode)
+	}
+
+	status, err := clnt.Flock(f, &ninep.Flock{Type: ninep.LockTypeWrlck, ClientId: "test"})
+	if err != nil || status != ninep.LockSuccess {
+		t.Errorf("Flock: want success, got %v, %v", status, err)
+	}
+
+	if err = clnt.Link(root, f, "hardlink"); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	clnt.Clunk(f)
+
+	if err = clnt.Renameat(root, "hardlink", root, "renamed"); err != nil {
+		t.Fatalf("Renameat: %v", err)
+	}
+
+	if _, err = clnt.Statfs(root); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+
+	d := clnt.FidAlloc()
+	if _, err = clnt.Walk(root, d, nil); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	if err = clnt.Open(d, ninep.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	names := make(map[string]bool)
+	var offset uint64
+	for {
+		dirs, err := clnt.Readdir(d, offset, 64)
+		if err != nil {
+			t.Fatalf("Readdir: %v", err)
+		}
+
+		if len(dirs) == 0 {
+			break
+		}
+
+		for _, de := range dirs {
+			names[de.Name] = true
+			offset = de.Offset
+		}
+	}
+	clnt.Clunk(d)
+
+	for _, n := range []string{".", "..", "dir", "link", "renamed"} {
+		if !names[n] {
+			t.Errorf("Readdir: %v is missing from %v", n, names)
+		}
+	}
+
+	if err = clnt.Unlinkat(root, "dir", 0); err == nil {
+		t.Errorf("Unlinkat: removing a directory without AT_REMOVEDIR succeeded")
+	} else if e, ok := err.(*ninep.Error); !ok || e.Errornum == 0 {
+		t.Errorf("Unlinkat: want an errno, got %v", err)
+	}
+
+	if err = clnt.Unlinkat(root, "renamed", 0); err != nil {
+		t.Fatalf("Unlinkat: %v", err)
+	}
+}
+
+// Reads a 9P message from the connection.
+func readFcall(c net.Conn) (*ninep.Fcall, error) {
+	buf := make([]byte, 8192)
+	if _, err := io.ReadFull(c, buf[0:4]); err != nil {
+		return nil, err
+	}
+
+	sz, _ := ninep.Gint32(buf)
+	if _, err := io.ReadFull(c, buf[4:sz]); err != nil {
+		return nil, err
+	}
+
+	fc, err, _ := ninep.Unpack(buf[0:sz], false)
+	return fc, err
+}
+
+func writeFcall(c net.Conn, tag uint16, pack func(*ninep.Fcall) error) error {
+	fc := ninep.NewFcall(8192)
+	if err := pack(fc); err != nil {
+		return err
+	}
+
+	ninep.SetTag(fc, tag)
+	_, err := c.Write(fc.Pkt)
+	return err
+}
+
+// Starts a fake server that answers Tversion and passes every other
+// message to handle.
+func fakeServer(t *testing.T, handle func(c net.Conn, tc *ninep.Fcall)) *Clnt {
+	c0, c1 := net.Pipe()
+	go func() {
+		for {
+			tc, err := readFcall(c1)
+			if err != nil {
+				return
+			}
+
+			if tc.Type == ninep.Tversion {
+				writeFcall(c1, tc.Tag, func(rc *ninep.Fcall) error {
+					return ninep.PackRversion(rc, tc.Msize, tc.Version)
+				})
+				continue
+			}
+
+			handle(c1, tc)
+		}
+	}()
+
+	clnt, err := Connect(c0, 8192, false)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	return clnt
+}
+
+func TestRpcContextFlush(t *testing.T) {
+	var flushed uint16
+	var hung *ninep.Fcall
+	clnt := fakeServer(t, func(c net.Conn, tc *ninep.Fcall) {
+		switch tc.Type {
+		case ninep.Tread:
+			if tc.Offset == 0 {
+				// never answer this one
+				hung = tc
+				return
+			}
+
+			writeFcall(c, tc.Tag, func(rc *ninep.Fcall) error { return ninep.PackRread(rc, []byte("ok")) })
+
+		case ninep.Tflush:
+			flushed = tc.Oldtag
+			writeFcall(c, tc.Tag, ninep.PackRflush)
+		}
+	})
+	defer clnt.Unmount()
+
+	fid := &Fid{Clnt: clnt, Fid: 1, Iounit: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := clnt.ReadContext(ctx, fid, 0, 10); err != context.DeadlineExceeded {
+		t.Fatalf("ReadContext: want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if hung == nil || flushed != hung.Tag {
+		t.Fatalf("Tflush: want oldtag of the hung request, got %d", flushed)
+	}
+
+	// the client keeps working after a flush
+	b, err := clnt.ReadContext(context.Background(), fid, 1, 10)
+	if err != nil || string(b) != "ok" {
+		t.Fatalf("ReadContext: want ok, got %q, %v", b, err)
+	}
+}
+
+func TestRpcContextReplyBeforeRflush(t *testing.T) {
+	var pending *ninep.Fcall
+	clnt := fakeServer(t, func(c net.Conn, tc *ninep.Fcall) {
+		switch tc.Type {
+		case ninep.Tread:
+			pending = tc
+
+		case ninep.Tflush:
+			// the request completes before the flush is processed
+			writeFcall(c, pending.Tag, func(rc *ninep.Fcall) error { return ninep.PackRread(rc, []byte("late")) })
+			writeFcall(c, tc.Tag, ninep.PackRflush)
+		}
+	})
+	defer clnt.Unmount()
+
+	fid := &Fid{Clnt: clnt, Fid: 1, Iounit: 1024}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	b, err := clnt.ReadContext(ctx, fid, 0, 10)
+	if err != nil || string(b) != "late" {
+		t.Fatalf("ReadContext: want late, got %q, %v", b, err)
+	}
+}
+
+func TestClunkContextCancel(t *testing.T) {
+	clunks := make(chan uint32, 1)
+	reply := make(chan bool)
+	clnt := fakeServer(t, func(c net.Conn, tc *ninep.Fcall) {
+		if tc.Type == ninep.Tclunk {
+			clunks <- tc.Fid
+			<-reply
+			writeFcall(c, tc.Tag, ninep.PackRclunk)
+		}
+	})
+	defer clnt.Unmount()
+
+	fid := clnt.FidAlloc()
+	fid.walked = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := clnt.ClunkContext(ctx, fid); err != context.Canceled {
+		t.Fatalf("ClunkContext: want %v, got %v", context.Canceled, err)
+	}
+
+	// the fid is clunked in the background, and isn't reused before
+	// the server clunks it
+	n := <-clunks
+	if f := clnt.FidAlloc(); f.Fid == n {
+		t.Errorf("FidAlloc: got fid %d before Rclunk", n)
+	}
+
+	close(reply)
+	for {
+		clnt.Lock()
+		_, ok := clnt.fids[n]
+		clnt.Unlock()
+		if !ok {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	flag.Parse()
+	tmpDir, err := ioutil.TempDir("", "redial")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err = ioutil.WriteFile(path.Join(tmpDir, "data"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ufs := new(ufs.Ufs)
+	ufs.Dotu = true
+	ufs.Id = "ufs"
+	ufs.Root = tmpDir
+	ufs.Debuglevel = *debug
+	ufs.Start(ufs)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go ufs.StartListener(l)
+
+	var conn net.Conn
+	ndial := 0
+	dial := func() (net.Conn, error) {
+		ndial++
+		c, err := net.Dial("unix", l.Addr().String())
+		conn = c
+		return c, err
+	}
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	clnt, err := MountDial(dial, "/", 8192, user)
+	if err != nil {
+		t.Fatalf("MountDial: %v", err)
+	}
+	defer clnt.Unmount()
+
+	f, err := clnt.FOpen("data", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if n, err := f.Read(buf); err != nil || string(buf[0:n]) != "0123" {
+		t.Fatalf("Read: want 0123, got %q, %v", buf[0:n], err)
+	}
+
+	// break the connection and wait until the client notices
+	conn.Close()
+	for i := 0; ; i++ {
+		clnt.Lock()
+		broken := clnt.err != nil
+		clnt.Unlock()
+		if broken {
+			break
+		}
+
+		if i > 100 {
+			t.Fatalf("the client didn't notice the closed connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n, err := f.Read(buf); err != nil || string(buf[0:n]) != "4567" {
+		t.Fatalf("Read after reconnect: want 4567, got %q, %v", buf[0:n], err)
+	}
+
+	if ndial != 2 {
+		t.Errorf("dial: want 2 calls, got %d", ndial)
+	}
+
+	if _, err := clnt.FStat("data"); err != nil {
+		t.Errorf("FStat after reconnect: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
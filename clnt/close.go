@@ -4,22 +4,38 @@
 
 package clnt
 
-import "github.com/lionkov/ninep"
+import (
+	"context"
+
+	"github.com/lionkov/ninep"
+)
 
 // Clunks a fid. Returns nil if successful.
 func (clnt *Clnt) Clunk(fid *Fid) (err error) {
+	return clnt.ClunkContext(context.Background(), fid)
+}
+
+// ClunkContext is like Clunk, but flushes the outstanding request when ctx is done.
+// If the clunk is cancelled, the fid is clunked again in the background.
+func (clnt *Clnt) ClunkContext(ctx context.Context, fid *Fid) (err error) {
 	err = nil
 	if fid.walked {
 		tc := clnt.NewFcall()
-		err := ninep.PackTclunk(tc, fid.Fid)
+		err = ninep.PackTclunk(tc, fid.Fid)
 		if err != nil {
 			return err
 		}
 
-		_, err = clnt.Rpc(tc)
+		_, err = clnt.RpcContext(ctx, tc)
+		if err != nil && err == ctx.Err() {
+			// the server didn't clunk the fid, it can't be
+			// reused before it does
+			go clnt.ClunkContext(context.Background(), fid)
+			return err
+		}
 	}
 
-	clnt.fidpool.putId(fid.Fid)
+	clnt.fidFree(fid)
 	fid.walked = false
 	fid.Fid = ninep.NOFID
 	return
@@ -27,6 +43,11 @@ func (clnt *Clnt) Clunk(fid *Fid) (err error) {
 
 // Closes a file. Returns nil if successful.
 func (file *File) Close() error {
+	return file.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but flushes the outstanding request when ctx is done.
+func (file *File) CloseContext(ctx context.Context) error {
 	// Should we cancel all pending requests for the File
-	return file.fid.Clnt.Clunk(file.fid)
+	return file.fid.Clnt.ClunkContext(ctx, file.fid)
 }
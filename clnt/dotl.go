@@ -0,0 +1,382 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+
+	"github.com/lionkov/ninep"
+)
+
+// Linux open(2) flags used by Tlopen and Tlcreate
+const (
+	lO_TRUNC = 01000
+)
+
+// Converts 9P2000 open mode to the flags used by Tlopen.
+func omode2lflags(mode uint8) uint32 {
+	flags := uint32(mode & 3)
+	if mode&ninep.OTRUNC != 0 {
+		flags |= lO_TRUNC
+	}
+
+	return flags
+}
+
+func (clnt *Clnt) setIounit(fid *Fid, iounit uint32) {
+	fid.Iounit = iounit
+	if fid.Iounit == 0 || fid.Iounit > clnt.Msize-ninep.IOHDRSZ {
+		fid.Iounit = clnt.Msize - ninep.IOHDRSZ
+	}
+}
+
+// Opens the file associated with the fid using the Linux open(2)
+// flags. Returns nil if the operation is successful.
+func (clnt *Clnt) Lopen(fid *Fid, flags uint32) error {
+	return clnt.LopenContext(context.Background(), fid, flags)
+}
+
+// LopenContext is like Lopen, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) LopenContext(ctx context.Context, fid *Fid, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTlopen(tc, fid.Fid, flags)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	clnt.setIounit(fid, rc.Iounit)
+	fid.Mode = uint8(flags & 3)
+	fid.opened = true
+	return nil
+}
+
+// Creates and opens a regular file in the directory associated with
+// the fid. On success the fid points to the new file.
+func (clnt *Clnt) Lcreate(fid *Fid, name string, flags, mode, gid uint32) error {
+	return clnt.LcreateContext(context.Background(), fid, name, flags, mode, gid)
+}
+
+// LcreateContext is like Lcreate, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) LcreateContext(ctx context.Context, fid *Fid, name string, flags, mode, gid uint32) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTlcreate(tc, fid.Fid, name, flags, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	clnt.setIounit(fid, rc.Iounit)
+	fid.Mode = uint8(flags & 3)
+	fid.opened = true
+	fid.path = append(fid.path[0:len(fid.path):len(fid.path)], name)
+	return nil
+}
+
+// Returns the attributes selected by mask (ninep.Getattr* values) for
+// the file associated with the fid. The server may return more or less
+// attributes than requested, Attr.Valid describes the ones that are set.
+func (clnt *Clnt) Getattr(fid *Fid, mask uint64) (*ninep.Attr, error) {
+	return clnt.GetattrContext(context.Background(), fid, mask)
+}
+
+// GetattrContext is like Getattr, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) GetattrContext(ctx context.Context, fid *Fid, mask uint64) (*ninep.Attr, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTgetattr(tc, fid.Fid, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	attr := rc.Attr
+	return &attr, nil
+}
+
+// Modifies the attributes of the file associated with the fid.
+// Only the attributes selected by attr.Valid are changed.
+func (clnt *Clnt) Setattr(fid *Fid, attr *ninep.SetAttr) error {
+	return clnt.SetattrContext(context.Background(), fid, attr)
+}
+
+// SetattrContext is like Setattr, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) SetattrContext(ctx context.Context, fid *Fid, attr *ninep.SetAttr) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTsetattr(tc, fid.Fid, attr)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.RpcContext(ctx, tc)
+	return err
+}
+
+// Reads directory entries from the opened directory associated with
+// the fid. The offset is either 0 or the Offset of the last entry
+// returned by a previous call. Returns no entries at the end of the
+// directory.
+func (clnt *Clnt) Readdir(fid *Fid, offset uint64, count uint32) ([]*ninep.Dirent, error) {
+	return clnt.ReaddirContext(context.Background(), fid, offset, count)
+}
+
+// ReaddirContext is like Readdir, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) ReaddirContext(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]*ninep.Dirent, error) {
+	if count > fid.Iounit {
+		count = fid.Iounit
+	}
+
+	tc := clnt.NewFcall()
+	err := ninep.PackTreaddir(tc, fid.Fid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []*ninep.Dirent
+	for b := rc.Data; len(b) > 0; {
+		var d *ninep.Dirent
+		d, b, _, err = ninep.UnpackDirent(b)
+		if err != nil {
+			return dirs, err
+		}
+
+		dirs = append(dirs, d)
+	}
+
+	return dirs, nil
+}
+
+// Creates a directory in the directory associated with the fid.
+// Returns the Qid of the new directory, or an Error.
+func (clnt *Clnt) Mkdir(dfid *Fid, name string, mode, gid uint32) (*ninep.Qid, error) {
+	return clnt.MkdirContext(context.Background(), dfid, name, mode, gid)
+}
+
+// MkdirContext is like Mkdir, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) MkdirContext(ctx context.Context, dfid *Fid, name string, mode, gid uint32) (*ninep.Qid, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTmkdir(tc, dfid.Fid, name, mode, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	qid := rc.Qid
+	return &qid, nil
+}
+
+// Creates a symbolic link pointing to target in the directory
+// associated with the fid. Returns the Qid of the link, or an Error.
+func (clnt *Clnt) Symlink(dfid *Fid, name, target string, gid uint32) (*ninep.Qid, error) {
+	return clnt.SymlinkContext(context.Background(), dfid, name, target, gid)
+}
+
+// SymlinkContext is like Symlink, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) SymlinkContext(ctx context.Context, dfid *Fid, name, target string, gid uint32) (*ninep.Qid, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTsymlink(tc, dfid.Fid, name, target, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	qid := rc.Qid
+	return &qid, nil
+}
+
+// Returns the target of the symbolic link associated with the fid.
+func (clnt *Clnt) Readlink(fid *Fid) (string, error) {
+	return clnt.ReadlinkContext(context.Background(), fid)
+}
+
+// ReadlinkContext is like Readlink, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) ReadlinkContext(ctx context.Context, fid *Fid) (string, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTreadlink(tc, fid.Fid)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.Target, nil
+}
+
+// Creates a hard link with the specified name in the directory dfid
+// to the file associated with fid.
+func (clnt *Clnt) Link(dfid, fid *Fid, name string) error {
+	return clnt.LinkContext(context.Background(), dfid, fid, name)
+}
+
+// LinkContext is like Link, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) LinkContext(ctx context.Context, dfid, fid *Fid, name string) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTlink(tc, dfid.Fid, fid.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.RpcContext(ctx, tc)
+	return err
+}
+
+// Renames the file oldname in the directory olddfid to newname in the
+// directory newdfid.
+func (clnt *Clnt) Renameat(olddfid *Fid, oldname string, newdfid *Fid, newname string) error {
+	return clnt.RenameatContext(context.Background(), olddfid, oldname, newdfid, newname)
+}
+
+// RenameatContext is like Renameat, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) RenameatContext(ctx context.Context, olddfid *Fid, oldname string, newdfid *Fid, newname string) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTrenameat(tc, olddfid.Fid, oldname, newdfid.Fid, newname)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.RpcContext(ctx, tc)
+	return err
+}
+
+// Removes the file name from the directory associated with dfid.
+// If flags contains ninep.AT_REMOVEDIR, the file must be a directory.
+func (clnt *Clnt) Unlinkat(dfid *Fid, name string, flags uint32) error {
+	return clnt.UnlinkatContext(context.Background(), dfid, name, flags)
+}
+
+// UnlinkatContext is like Unlinkat, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) UnlinkatContext(ctx context.Context, dfid *Fid, name string, flags uint32) error {
+	tc := clnt.NewFcall()
+	err := ninep.PackTunlinkat(tc, dfid.Fid, name, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.RpcContext(ctx, tc)
+	return err
+}
+
+// Returns information about the file system containing the file
+// associated with the fid.
+func (clnt *Clnt) Statfs(fid *Fid) (*ninep.Statfs, error) {
+	return clnt.StatfsContext(context.Background(), fid)
+}
+
+// StatfsContext is like Statfs, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) StatfsContext(ctx context.Context, fid *Fid) (*ninep.Statfs, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTstatfs(tc, fid.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	st := rc.Statfs
+	return &st, nil
+}
+
+// Flushes the data of the opened file associated with the fid to
+// stable storage. If datasync is true, only the data (and not the
+// metadata) are flushed.
+func (clnt *Clnt) Fsync(fid *Fid, datasync bool) error {
+	return clnt.FsyncContext(context.Background(), fid, datasync)
+}
+
+// FsyncContext is like Fsync, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FsyncContext(ctx context.Context, fid *Fid, datasync bool) error {
+	var ds uint32
+	if datasync {
+		ds = 1
+	}
+
+	tc := clnt.NewFcall()
+	err := ninep.PackTfsync(tc, fid.Fid, ds)
+	if err != nil {
+		return err
+	}
+
+	_, err = clnt.RpcContext(ctx, tc)
+	return err
+}
+
+// Acquires or releases a POSIX record lock on the file associated
+// with the fid. Returns the status (one of the ninep.Lock* values).
+// The method is not called Lock because Clnt embeds sync.Mutex.
+func (clnt *Clnt) Flock(fid *Fid, lock *ninep.Flock) (uint8, error) {
+	return clnt.FlockContext(context.Background(), fid, lock)
+}
+
+// FlockContext is like Flock, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FlockContext(ctx context.Context, fid *Fid, lock *ninep.Flock) (uint8, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTlock(tc, fid.Fid, lock)
+	if err != nil {
+		return ninep.LockError, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return ninep.LockError, err
+	}
+
+	return rc.Status, nil
+}
+
+// Tests for a POSIX record lock that would prevent lock from being
+// acquired. Returns the conflicting lock, or a lock with type
+// ninep.LockTypeUnlck if there is no conflict.
+func (clnt *Clnt) Getlock(fid *Fid, lock *ninep.Flock) (*ninep.Flock, error) {
+	return clnt.GetlockContext(context.Background(), fid, lock)
+}
+
+// GetlockContext is like Getlock, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) GetlockContext(ctx context.Context, fid *Fid, lock *ninep.Flock) (*ninep.Flock, error) {
+	tc := clnt.NewFcall()
+	err := ninep.PackTgetlock(tc, fid.Fid, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := rc.Flock
+	return &fl, nil
+}
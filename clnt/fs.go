@@ -0,0 +1,426 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lionkov/ninep"
+)
+
+// FS provides access to the files of a mounted client through the
+// io/fs interfaces. The names are relative to the client's Root.
+// The files are opened read-only. If the client speaks 9P2000.L, the
+// files are described by Tgetattr and the directories are read with
+// Treaddir, otherwise Tstat and Tread are used.
+type FS struct {
+	clnt *Clnt
+}
+
+// A file opened through FS. Implements fs.ReadDirFile, io.Seeker and
+// io.ReaderAt.
+type fsFile struct {
+	*File
+	fs   *FS
+	name string
+	dirs []fs.DirEntry // unread directory entries, nil if not read yet
+}
+
+// Linux st_mode bits returned by Tgetattr
+const (
+	lS_IFMT   = 0170000
+	lS_IFSOCK = 0140000
+	lS_IFLNK  = 0120000
+	lS_IFBLK  = 0060000
+	lS_IFDIR  = 0040000
+	lS_IFCHR  = 0020000
+	lS_IFIFO  = 0010000
+	lS_ISUID  = 04000
+	lS_ISGID  = 02000
+)
+
+// FileInfo for a ninep.Dir
+type dirInfo struct {
+	d    *ninep.Dir
+	name string
+}
+
+// Returns an FS that accesses the files of the client.
+func NewFS(clnt *Clnt) *FS {
+	return &FS{clnt}
+}
+
+// Converts ninep.Dir mode to fs.FileMode.
+func dirMode(d *ninep.Dir) fs.FileMode {
+	mode := fs.FileMode(d.Mode & 0777)
+	switch {
+	case d.Mode&ninep.DMDIR != 0:
+		mode |= fs.ModeDir
+	case d.Mode&ninep.DMSYMLINK != 0:
+		mode |= fs.ModeSymlink
+	case d.Mode&ninep.DMNAMEDPIPE != 0:
+		mode |= fs.ModeNamedPipe
+	case d.Mode&ninep.DMSOCKET != 0:
+		mode |= fs.ModeSocket
+	case d.Mode&ninep.DMDEVICE != 0:
+		mode |= fs.ModeDevice
+		if strings.HasPrefix(d.Ext, "c") {
+			mode |= fs.ModeCharDevice
+		}
+	}
+
+	if d.Mode&ninep.DMAPPEND != 0 {
+		mode |= fs.ModeAppend
+	}
+
+	if d.Mode&ninep.DMEXCL != 0 {
+		mode |= fs.ModeExclusive
+	}
+
+	if d.Mode&ninep.DMTMP != 0 {
+		mode |= fs.ModeTemporary
+	}
+
+	if d.Mode&ninep.DMSETUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+
+	if d.Mode&ninep.DMSETGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+
+	return mode
+}
+
+// Converts the attributes returned by Tgetattr to ninep.Dir. The
+// attributes don't include the names of the file and its owners.
+func attrDir(a *ninep.Attr, name string) *ninep.Dir {
+	d := &ninep.Dir{
+		Qid:     a.Qid,
+		Mode:    a.Mode & 0777,
+		Atime:   uint32(a.Atime),
+		Mtime:   uint32(a.Mtime),
+		Length:  a.Size,
+		Name:    name,
+		Uidnum:  a.Uid,
+		Gidnum:  a.Gid,
+		Muidnum: ninep.NOUID,
+	}
+
+	switch a.Mode & lS_IFMT {
+	case lS_IFDIR:
+		d.Mode |= ninep.DMDIR
+	case lS_IFLNK:
+		d.Mode |= ninep.DMSYMLINK
+	case lS_IFIFO:
+		d.Mode |= ninep.DMNAMEDPIPE
+	case lS_IFSOCK:
+		d.Mode |= ninep.DMSOCKET
+	case lS_IFBLK, lS_IFCHR:
+		t := 'b'
+		if a.Mode&lS_IFMT == lS_IFCHR {
+			t = 'c'
+		}
+
+		major := (a.Rdev>>8)&0xfff | (a.Rdev>>32)&^0xfff
+		minor := a.Rdev&0xff | (a.Rdev>>12)&^0xff
+		d.Mode |= ninep.DMDEVICE
+		d.Ext = fmt.Sprintf("%c %d %d", t, major, minor)
+	}
+
+	if a.Mode&lS_ISUID != 0 {
+		d.Mode |= ninep.DMSETUID
+	}
+
+	if a.Mode&lS_ISGID != 0 {
+		d.Mode |= ninep.DMSETGID
+	}
+
+	return d
+}
+
+// Returns fs.FileInfo describing the file. Name is used instead of
+// d.Name if not empty.
+func DirInfo(d *ninep.Dir, name string) fs.FileInfo {
+	if name == "" {
+		name = d.Name
+	}
+
+	return &dirInfo{d, name}
+}
+
+func (di *dirInfo) Name() string       { return di.name }
+func (di *dirInfo) Size() int64        { return int64(di.d.Length) }
+func (di *dirInfo) Mode() fs.FileMode  { return dirMode(di.d) }
+func (di *dirInfo) ModTime() time.Time { return time.Unix(int64(di.d.Mtime), 0) }
+func (di *dirInfo) IsDir() bool        { return di.d.Mode&ninep.DMDIR != 0 }
+func (di *dirInfo) Sys() interface{}   { return di.d }
+
+// Converts the errors returned by the server to the fs errors.
+func fsError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*ninep.Error); ok {
+		switch e.Errornum {
+		case ninep.ENOENT:
+			err = fs.ErrNotExist
+		case ninep.EPERM, ninep.EACCES:
+			err = fs.ErrPermission
+		case ninep.EEXIST:
+			err = fs.ErrExist
+		case 0:
+			// 9P2000 servers only send the error string
+			s := strings.ToLower(e.Err)
+			if strings.Contains(s, "not found") || strings.Contains(s, "no such file") ||
+				strings.Contains(s, "does not exist") {
+				err = fs.ErrNotExist
+			}
+		}
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Converts an fs path to the path walked on the server.
+func (fsys *FS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name == "." {
+		return "", nil
+	}
+
+	return name, nil
+}
+
+// Returns the metadata of the file associated with the fid.
+func (fsys *FS) stat(fid *Fid, name string) (*ninep.Dir, error) {
+	if !fsys.clnt.Dotl {
+		return fsys.clnt.Stat(fid)
+	}
+
+	a, err := fsys.clnt.Getattr(fid, ninep.GetattrBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	return attrDir(a, path.Base(name)), nil
+}
+
+// Opens the named file for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	p, err := fsys.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fsys.clnt.FOpen(p, ninep.OREAD)
+	if err != nil {
+		return nil, fsError("open", name, err)
+	}
+
+	return &fsFile{File: f, fs: fsys, name: name}, nil
+}
+
+// Returns the FileInfo of the named file.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	p, err := fsys.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	fid, err := fsys.clnt.FWalk(p)
+	if err != nil {
+		return nil, fsError("stat", name, err)
+	}
+
+	d, err := fsys.stat(fid, name)
+	fsys.clnt.Clunk(fid)
+	if err != nil {
+		return nil, fsError("stat", name, err)
+	}
+
+	return DirInfo(d, path.Base(name)), nil
+}
+
+// Reads the named directory and returns its entries sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dirs, err := f.(*fsFile).ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	return dirs, nil
+}
+
+// Reads the named file and returns its content.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fsError("read", name, err)
+	}
+
+	return b, nil
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	d, err := f.fs.stat(f.Fid(), f.name)
+	if err != nil {
+		return nil, fsError("stat", f.name, err)
+	}
+
+	return DirInfo(d, path.Base(f.name)), nil
+}
+
+func (f *fsFile) Read(buf []byte) (int, error) {
+	if f.Fid().Qid.Type&ninep.QTDIR != 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: Eisdir}
+	}
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.File.Read(buf)
+	if err != nil && err != io.EOF {
+		err = fsError("read", f.name, err)
+	}
+
+	return n, err
+}
+
+// Reads len(buf) bytes starting from offset, io.ReaderAt doesn't allow
+// short reads unless the end of the file is reached.
+func (f *fsFile) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: Enegoff}
+	}
+
+	ret := 0
+	for ret < len(buf) {
+		n, err := f.File.ReadAt(buf[ret:], offset+int64(ret))
+		ret += n
+		if err == io.EOF {
+			return ret, err
+		}
+
+		if err != nil {
+			return ret, fsError("read", f.name, err)
+		}
+	}
+
+	return ret, nil
+}
+
+func (f *fsFile) Close() error {
+	if f.Fid().Fid == ninep.NOFID {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+
+	return fsError("close", f.name, f.File.Close())
+}
+
+// Returns the next n entries of the directory, or all remaining
+// entries if n <= 0. The entries are sorted by name.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.dirs == nil {
+		if f.Fid().Qid.Type&ninep.QTDIR == 0 {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: &ninep.Error{"not a directory", ninep.ENOTDIR}}
+		}
+
+		var dirs []*ninep.Dir
+		var err error
+		if f.fs.clnt.Dotl {
+			dirs, err = f.readdirl()
+		} else {
+			dirs, err = f.File.Readdir(0)
+		}
+
+		if err != nil && err != io.EOF {
+			return nil, fsError("readdir", f.name, err)
+		}
+
+		f.dirs = make([]fs.DirEntry, 0, len(dirs))
+		for _, d := range dirs {
+			f.dirs = append(f.dirs, fs.FileInfoToDirEntry(DirInfo(d, "")))
+		}
+
+		sort.Slice(f.dirs, func(i, j int) bool { return f.dirs[i].Name() < f.dirs[j].Name() })
+	}
+
+	if n <= 0 {
+		dirs := f.dirs
+		f.dirs = f.dirs[len(f.dirs):]
+		return dirs, nil
+	}
+
+	if len(f.dirs) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(f.dirs) {
+		n = len(f.dirs)
+	}
+
+	dirs := f.dirs[0:n]
+	f.dirs = f.dirs[n:]
+	return dirs, nil
+}
+
+// Reads all entries of the directory with Treaddir. The opened fid
+// can't be walked, the metadata of the entries is read by walking from
+// the client's Root.
+func (f *fsFile) readdirl() ([]*ninep.Dir, error) {
+	clnt := f.fs.clnt
+	var dirs []*ninep.Dir
+	offset := uint64(0)
+	for {
+		ents, err := clnt.Readdir(f.Fid(), offset, f.Fid().Iounit)
+		if err != nil || len(ents) == 0 {
+			return dirs, err
+		}
+
+		for _, e := range ents {
+			offset = e.Offset
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+
+			fid, err := clnt.FWalk(path.Join(f.name, e.Name))
+			if err != nil {
+				return dirs, err
+			}
+
+			d, err := f.fs.stat(fid, e.Name)
+			clnt.Clunk(fid)
+			if err != nil {
+				return dirs, err
+			}
+
+			dirs = append(dirs, d)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv/ufs"
+)
+
+func TestFS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"a":       "hello",
+		"d/b":     "world",
+		"d/e/c":   "",
+		"d/e/f/g": "deep",
+	}
+	for name, data := range files {
+		p := path.Join(tmpDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ufs := new(ufs.Ufs)
+	ufs.Dotu = true
+	ufs.Id = "ufs"
+	ufs.Root = tmpDir
+	ufs.Start(ufs)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go ufs.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	clnt, err := Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer clnt.Unmount()
+
+	fsys := NewFS(clnt)
+	if err := fstest.TestFS(fsys, "a", "d/b", "d/e/c", "d/e/f/g"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(fsys, "d/b")
+	if err != nil || string(b) != "world" {
+		t.Errorf("ReadFile: want world, got %q, %v", b, err)
+	}
+
+	if _, err := fs.Stat(fsys, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat: want fs.ErrNotExist, got %v", err)
+	}
+
+	if _, err := fsys.Open("../a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open: want fs.ErrInvalid, got %v", err)
+	}
+}
+
+func TestFSDotl(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, data := range map[string]string{"a": "hello", "d/b": "world"} {
+		p := path.Join(tmpDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ufs := new(ufs.Ufs)
+	ufs.Dotu = true
+	ufs.Dotl = true
+	ufs.Id = "ufs"
+	ufs.Root = tmpDir
+	ufs.Start(ufs)
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("Can not start listener: %v", err)
+	}
+	go ufs.StartListener(l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	clnt, err := ConnectVersion(conn, 8192+ninep.IOHDRSZ, ninep.VersionL)
+	if err != nil || !clnt.Dotl {
+		t.Fatalf("Connect: want 9P2000.L, got %v", err)
+	}
+	defer clnt.Unmount()
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	if clnt.Root, err = clnt.Attach(nil, user, "/"); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	fsys := NewFS(clnt)
+	if err := fstest.TestFS(fsys, "a", "d/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat(fsys, "d")
+	if err != nil || !fi.IsDir() || fi.Mode().Perm() != 0755 {
+		t.Errorf("Stat: want a directory with mode 0755, got %v, %v", fi, err)
+	}
+
+	dirs, err := fs.ReadDir(fsys, "d")
+	if err != nil || len(dirs) != 1 || dirs[0].Name() != "b" {
+		t.Fatalf("ReadDir: want [b], got %v, %v", dirs, err)
+	}
+
+	if fi, err := dirs[0].Info(); err != nil || fi.Size() != 5 {
+		t.Errorf("Info: want size 5, got %v, %v", fi, err)
+	}
+}
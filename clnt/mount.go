@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
 	"net"
 )
@@ -12,14 +13,19 @@ import (
 // Creates an authentication fid for the specified user. Returns the fid, if
 // successful, or an Error.
 func (clnt *Clnt) Auth(user ninep.User, aname string) (*Fid, error) {
+	return clnt.AuthContext(context.Background(), user, aname)
+}
+
+// AuthContext is like Auth, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) AuthContext(ctx context.Context, user ninep.User, aname string) (*Fid, error) {
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := ninep.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := ninep.PackTauth(tc, fid.Fid, user.Name(), aname, uint32(user.Id()), clnt.Dotu || clnt.Dotl)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = clnt.Rpc(tc)
+	_, err = clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -27,6 +33,7 @@ func (clnt *Clnt) Auth(user ninep.User, aname string) (*Fid, error) {
 	fid.Iounit = clnt.Msize - ninep.IOHDRSZ
 	fid.User = user
 	fid.walked = true
+	fid.auth = true
 	return fid, nil
 }
 
@@ -34,6 +41,11 @@ func (clnt *Clnt) Auth(user ninep.User, aname string) (*Fid, error) {
 // of the file server's file tree. Returns a Fid pointing to the root,
 // if successful, or an Error.
 func (clnt *Clnt) Attach(afid *Fid, user ninep.User, aname string) (*Fid, error) {
+	return clnt.AttachContext(context.Background(), afid, user, aname)
+}
+
+// AttachContext is like Attach, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) AttachContext(ctx context.Context, afid *Fid, user ninep.User, aname string) (*Fid, error) {
 	var afno uint32
 
 	if afid != nil {
@@ -44,12 +56,12 @@ func (clnt *Clnt) Attach(afid *Fid, user ninep.User, aname string) (*Fid, error)
 
 	fid := clnt.FidAlloc()
 	tc := clnt.NewFcall()
-	err := ninep.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu)
+	err := ninep.PackTattach(tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), clnt.Dotu || clnt.Dotl)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -57,6 +69,7 @@ func (clnt *Clnt) Attach(afid *Fid, user ninep.User, aname string) (*Fid, error)
 	fid.Qid = rc.Qid
 	fid.User = user
 	fid.walked = true
+	fid.aname = aname
 	clnt.Root = fid
 	return fid, nil
 }
@@ -91,6 +104,16 @@ func MountConn(c net.Conn, aname string, msize uint32, user ninep.User) (*Clnt,
 func (clnt *Clnt) Unmount() {
 	clnt.Lock()
 	clnt.err = &ninep.Error{"connection closed", ninep.EIO}
+	clnt.Dial = nil
 	clnt.conn.Close()
 	clnt.Unlock()
 }
+
+// Returns the error that broke the connection to the file server, or
+// nil if the connection works. If the client has a Dial function, the
+// next request tries to reconnect.
+func (clnt *Clnt) Err() error {
+	clnt.Lock()
+	defer clnt.Unlock()
+	return clnt.err
+}
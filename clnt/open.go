@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
 	"strings"
 )
@@ -12,13 +13,27 @@ import (
 // Opens the file associated with the fid. Returns nil if
 // the operation is successful.
 func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
+	return clnt.OpenContext(context.Background(), fid, mode)
+}
+
+// OpenContext is like Open, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) OpenContext(ctx context.Context, fid *Fid, mode uint8) error {
+	if clnt.Dotl {
+		err := clnt.LopenContext(ctx, fid, omode2lflags(mode))
+		if err == nil {
+			fid.Mode = mode
+		}
+
+		return err
+	}
+
 	tc := clnt.NewFcall()
 	err := ninep.PackTopen(tc, fid.Fid, mode)
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
@@ -29,19 +44,25 @@ func (clnt *Clnt) Open(fid *Fid, mode uint8) error {
 		fid.Iounit = clnt.Msize - ninep.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
 	return nil
 }
 
 // Creates a file in the directory associated with the fid. Returns nil
 // if the operation is successful.
 func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext string) error {
+	return clnt.CreateContext(context.Background(), fid, name, perm, mode, ext)
+}
+
+// CreateContext is like Create, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) CreateContext(ctx context.Context, fid *Fid, name string, perm uint32, mode uint8, ext string) error {
 	tc := clnt.NewFcall()
 	err := ninep.PackTcreate(tc, fid.Fid, name, perm, mode, ext, clnt.Dotu)
 	if err != nil {
 		return err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return err
 	}
@@ -52,18 +73,25 @@ func (clnt *Clnt) Create(fid *Fid, name string, perm uint32, mode uint8, ext str
 		fid.Iounit = clnt.Msize - ninep.IOHDRSZ
 	}
 	fid.Mode = mode
+	fid.opened = true
+	fid.path = append(fid.path[0:len(fid.path):len(fid.path)], name)
 	return nil
 }
 
 // Creates and opens a named file.
 // Returns the file if the operation is successful, or an Error.
 func (clnt *Clnt) FCreate(path string, perm uint32, mode uint8) (*File, error) {
+	return clnt.FCreateContext(context.Background(), path, perm, mode)
+}
+
+// FCreateContext is like FCreate, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FCreateContext(ctx context.Context, path string, perm uint32, mode uint8) (*File, error) {
 	n := strings.LastIndex(path, "/")
 	if n < 0 {
 		n = 0
 	}
 
-	fid, err := clnt.FWalk(path[0:n])
+	fid, err := clnt.FWalkContext(ctx, path[0:n])
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +100,7 @@ func (clnt *Clnt) FCreate(path string, perm uint32, mode uint8) (*File, error) {
 		n++
 	}
 
-	err = clnt.Create(fid, path[n:], perm, mode, "")
+	err = clnt.CreateContext(ctx, fid, path[n:], perm, mode, "")
 	if err != nil {
 		clnt.Clunk(fid)
 		return nil, err
@@ -83,12 +111,17 @@ func (clnt *Clnt) FCreate(path string, perm uint32, mode uint8) (*File, error) {
 
 // Opens a named file. Returns the opened file, or an Error.
 func (clnt *Clnt) FOpen(path string, mode uint8) (*File, error) {
-	fid, err := clnt.FWalk(path)
+	return clnt.FOpenContext(context.Background(), path, mode)
+}
+
+// FOpenContext is like FOpen, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FOpenContext(ctx context.Context, path string, mode uint8) (*File, error) {
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	err = clnt.Open(fid, mode)
+	err = clnt.OpenContext(ctx, fid, mode)
 	if err != nil {
 		clnt.Clunk(fid)
 		return nil, err
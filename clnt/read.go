@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
 	"io"
 )
@@ -13,6 +14,21 @@ import (
 // Returns a slice with the data read, if the operation was successful, or an
 // Error.
 func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
+	return clnt.ReadContext(context.Background(), fid, offset, count)
+}
+
+// ReadContext is like Read, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) ReadContext(ctx context.Context, fid *Fid, offset uint64, count uint32) ([]byte, error) {
+	rc, err := clnt.read(ctx, fid, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.Data, nil
+}
+
+// Sends Tread and returns the Rread message.
+func (clnt *Clnt) read(ctx context.Context, fid *Fid, offset uint64, count uint32) (*ninep.Fcall, error) {
 	if count > fid.Iounit {
 		count = fid.Iounit
 	}
@@ -23,18 +39,18 @@ func (clnt *Clnt) Read(fid *Fid, offset uint64, count uint32) ([]byte, error) {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
-	if err != nil {
-		return nil, err
-	}
-
-	return rc.Data, nil
+	return clnt.RpcContext(ctx, tc)
 }
 
 // Reads up to len(buf) bytes from the File. Returns the number
 // of bytes read, or an Error.
 func (file *File) Read(buf []byte) (int, error) {
-	n, err := file.ReadAt(buf, int64(file.offset))
+	return file.ReadContext(context.Background(), buf)
+}
+
+// ReadContext is like Read, but flushes the outstanding request when ctx is done.
+func (file *File) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	n, err := file.ReadAtContext(ctx, buf, int64(file.offset))
 	if err == nil {
 		file.offset += uint64(n)
 	}
@@ -45,26 +61,38 @@ func (file *File) Read(buf []byte) (int, error) {
 // Reads up to len(buf) bytes from the file starting from offset.
 // Returns the number of bytes read, or an Error.
 func (file *File) ReadAt(buf []byte, offset int64) (int, error) {
-	b, err := file.fid.Clnt.Read(file.fid, uint64(offset), uint32(len(buf)))
+	return file.ReadAtContext(context.Background(), buf, offset)
+}
+
+// ReadAtContext is like ReadAt, but flushes the outstanding request when ctx is done.
+func (file *File) ReadAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	rc, err := file.fid.Clnt.read(ctx, file.fid, uint64(offset), uint32(len(buf)))
 	if err != nil {
 		return 0, err
 	}
 
-	if len(b) == 0 {
+	// the data is copied, the buffer can be reused
+	n := copy(buf, rc.Data)
+	ninep.PutFcall(rc)
+	if n == 0 {
 		return 0, io.EOF
 	}
 
-	copy(buf, b)
-	return len(b), nil
+	return n, nil
 }
 
 // Reads exactly len(buf) bytes from the File starting from offset.
 // Returns the number of bytes read (could be less than len(buf) if
 // end-of-file is reached), or an Error.
 func (file *File) Readn(buf []byte, offset uint64) (int, error) {
+	return file.ReadnContext(context.Background(), buf, offset)
+}
+
+// ReadnContext is like Readn, but flushes the outstanding request when ctx is done.
+func (file *File) ReadnContext(ctx context.Context, buf []byte, offset uint64) (int, error) {
 	ret := 0
 	for len(buf) > 0 {
-		n, err := file.ReadAt(buf, int64(offset))
+		n, err := file.ReadAtContext(ctx, buf, int64(offset))
 		if err != nil {
 			return 0, err
 		}
@@ -86,11 +114,16 @@ func (file *File) Readn(buf []byte, offset uint64) (int, error) {
 // all entries from the directory). If the operation fails, returns
 // an Error.
 func (file *File) Readdir(num int) ([]*ninep.Dir, error) {
+	return file.ReaddirContext(context.Background(), num)
+}
+
+// ReaddirContext is like Readdir, but flushes the outstanding request when ctx is done.
+func (file *File) ReaddirContext(ctx context.Context, num int) ([]*ninep.Dir, error) {
 	buf := make([]byte, file.fid.Clnt.Msize-ninep.IOHDRSZ)
 	var dirs []*ninep.Dir
 	pos := 0
 	for {
-		n, err := file.Read(buf)
+		n, err := file.ReadContext(ctx, buf)
 		if err != nil && err != io.EOF {
 			return dirs[0:pos], err
 		}
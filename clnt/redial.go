@@ -0,0 +1,241 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clnt
+
+import (
+	"context"
+	"net"
+
+	"github.com/lionkov/ninep"
+)
+
+// DialFunc establishes a new connection to the file server.
+type DialFunc func() (net.Conn, error)
+
+// AuthFunc authenticates the user on a reestablished connection.
+// It should use the ...Context methods of the client with the ctx
+// it is called with. Returns the authentication fid, or nil if the
+// server doesn't require authentication.
+type AuthFunc func(ctx context.Context, clnt *Clnt, user ninep.User, aname string) (*Fid, error)
+
+// Marks the requests sent while the fids are restored
+type restoreKey struct{}
+
+// Connects to a file server using the dial function and attaches to
+// it as the specified user. If the connection breaks, the client dials
+// again. The requests that were in flight fail, but all fids are
+// walked again to the same files, and opened with their original mode,
+// so the following requests (and Files) work as before.
+func MountDial(dial DialFunc, aname string, msize uint32, user ninep.User) (*Clnt, error) {
+	c, e := dial()
+	if e != nil {
+		return nil, &ninep.Error{e.Error(), ninep.EIO}
+	}
+
+	clnt, err := MountConn(c, aname, msize, user)
+	if err != nil {
+		return nil, err
+	}
+
+	clnt.Lock()
+	clnt.Dial = dial
+	clnt.Unlock()
+	return clnt, nil
+}
+
+// Records that the fid was walked with wnames from the from fid.
+func (fid *Fid) walkedFrom(from *Fid, wnames []string) {
+	fid.User = from.User
+	fid.aname = from.aname
+	fid.path = make([]string, 0, len(from.path)+len(wnames))
+	fid.path = append(fid.path, from.path...)
+	fid.path = append(fid.path, wnames...)
+}
+
+// If the connection is broken and the client has a Dial function,
+// reconnects to the server and restores the fids. Concurrent callers
+// wait until the fids are restored.
+func (clnt *Clnt) redial() error {
+	clnt.Lock()
+	ok := clnt.err == nil && !clnt.restoring
+	dial := clnt.Dial
+	clnt.Unlock()
+	if ok || dial == nil {
+		return nil
+	}
+
+	clnt.redialLock.Lock()
+	defer clnt.redialLock.Unlock()
+	clnt.Lock()
+	err := clnt.err
+	dial = clnt.Dial
+	clnt.Unlock()
+	if err == nil || dial == nil {
+		return nil
+	}
+
+	// wait for the receiver of the old connection to fail all
+	// outstanding requests
+	<-clnt.closed
+	c, e := dial()
+	if e != nil {
+		return &ninep.Error{e.Error(), ninep.EIO}
+	}
+
+	clnt.start(c)
+	clnt.Lock()
+	clnt.restoring = true
+	clnt.Unlock()
+
+	err = clnt.restore(context.WithValue(context.Background(), restoreKey{}, true))
+
+	clnt.Lock()
+	clnt.restoring = false
+	if err != nil && clnt.err == nil {
+		clnt.err = err
+		clnt.conn.Close()
+	}
+	clnt.Unlock()
+
+	return err
+}
+
+// Negotiates the same dialect as the broken connection and restores
+// all live fids. The fids that can't be restored are marked as not
+// walked, the server will reject the requests that use them.
+func (clnt *Clnt) restore(ctx context.Context) error {
+	ver := ninep.Version
+	switch {
+	case clnt.Dotl:
+		ver = ninep.VersionL
+	case clnt.Dotu:
+		ver = ninep.VersionU
+	}
+
+	msize := clnt.Msize
+	tc := ninep.NewFcall(msize)
+	err := ninep.PackTversion(tc, msize, ver)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	if rc.Version != ver || rc.Msize < msize {
+		return &ninep.Error{"server changed version or msize", ninep.EIO}
+	}
+
+	clnt.Lock()
+	fids := make([]*Fid, 0, len(clnt.fids))
+	for _, fid := range clnt.fids {
+		if fid.walked && !fid.auth && fid.User != nil {
+			fids = append(fids, fid)
+		}
+	}
+	clnt.Unlock()
+
+	afids := make(map[string]*Fid)
+	for _, fid := range fids {
+		if err := clnt.refid(ctx, fid, afids); err != nil {
+			fid.walked = false
+			fid.opened = false
+		}
+	}
+
+	for _, afid := range afids {
+		clnt.ClunkContext(ctx, afid)
+	}
+
+	return nil
+}
+
+// Attaches the fid number again, walks it to the recorded path and
+// opens it if it was open before.
+func (clnt *Clnt) refid(ctx context.Context, fid *Fid, afids map[string]*Fid) error {
+	afno := ninep.NOFID
+	if clnt.Reauth != nil {
+		key := fid.User.Name() + "\x00" + fid.aname
+		afid, ok := afids[key]
+		if !ok {
+			var err error
+			afid, err = clnt.Reauth(ctx, clnt, fid.User, fid.aname)
+			if err != nil {
+				return err
+			}
+
+			afids[key] = afid
+		}
+
+		if afid != nil {
+			afno = afid.Fid
+		}
+	}
+
+	tc := clnt.NewFcall()
+	err := ninep.PackTattach(tc, fid.Fid, afno, fid.User.Name(), fid.aname, uint32(fid.User.Id()), clnt.Dotu || clnt.Dotl)
+	if err != nil {
+		return err
+	}
+
+	rc, err := clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	for wnames := fid.path; len(wnames) > 0; {
+		n := len(wnames)
+		if n > 16 {
+			n = 16
+		}
+
+		tc = clnt.NewFcall()
+		err = ninep.PackTwalk(tc, fid.Fid, fid.Fid, wnames[0:n])
+		if err != nil {
+			return err
+		}
+
+		rc, err = clnt.RpcContext(ctx, tc)
+		if err != nil {
+			return err
+		}
+
+		if len(rc.Wqid) != n {
+			return &ninep.Error{"file not found", ninep.ENOENT}
+		}
+
+		fid.Qid = rc.Wqid[n-1]
+		wnames = wnames[n:]
+	}
+
+	if !fid.opened {
+		return nil
+	}
+
+	// the file exists already, don't truncate it again
+	mode := fid.Mode &^ ninep.OTRUNC
+	tc = clnt.NewFcall()
+	if clnt.Dotl {
+		err = ninep.PackTlopen(tc, fid.Fid, omode2lflags(mode))
+	} else {
+		err = ninep.PackTopen(tc, fid.Fid, mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rc, err = clnt.RpcContext(ctx, tc)
+	if err != nil {
+		return err
+	}
+
+	fid.Qid = rc.Qid
+	clnt.setIounit(fid, rc.Iounit)
+	return nil
+}
@@ -4,19 +4,35 @@
 
 package clnt
 
-import "github.com/lionkov/ninep"
+import (
+	"context"
+
+	"github.com/lionkov/ninep"
+)
 
 // Removes the file associated with the Fid. Returns nil if the
 // operation is successful.
 func (clnt *Clnt) Remove(fid *Fid) error {
+	return clnt.RemoveContext(context.Background(), fid)
+}
+
+// RemoveContext is like Remove, but flushes the outstanding request when ctx is done.
+// If the remove is cancelled, the fid is clunked in the background.
+func (clnt *Clnt) RemoveContext(ctx context.Context, fid *Fid) error {
 	tc := clnt.NewFcall()
 	err := ninep.PackTremove(tc, fid.Fid)
 	if err != nil {
 		return err
 	}
 
-	_, err = clnt.Rpc(tc)
-	clnt.fidpool.putId(fid.Fid)
+	_, err = clnt.RpcContext(ctx, tc)
+	if err != nil && err == ctx.Err() {
+		// the server didn't remove the fid, clunk it instead
+		go clnt.ClunkContext(context.Background(), fid)
+		return err
+	}
+
+	clnt.fidFree(fid)
 	fid.Fid = ninep.NOFID
 
 	return err
@@ -24,12 +40,17 @@ func (clnt *Clnt) Remove(fid *Fid) error {
 
 // Removes the named file. Returns nil if the operation is successful.
 func (clnt *Clnt) FRemove(path string) error {
+	return clnt.FRemoveContext(context.Background(), path)
+}
+
+// FRemoveContext is like FRemove, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FRemoveContext(ctx context.Context, path string) error {
 	var err error
-	fid, err := clnt.FWalk(path)
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return err
 	}
 
-	err = clnt.Remove(fid)
+	err = clnt.RemoveContext(ctx, fid)
 	return err
 }
@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
 )
 
@@ -21,6 +22,11 @@ var Enegoff = &ninep.Error{"negative i/o offset", ninep.EIO}
 // Seeking to 0 in a directory is only valid if whence is 0. Seek returns
 // Eisdir otherwise.
 func (f *File) Seek(offset int64, whence int) (int64, error) {
+	return f.SeekContext(context.Background(), offset, whence)
+}
+
+// SeekContext is like Seek, but flushes the outstanding request when ctx is done.
+func (f *File) SeekContext(ctx context.Context, offset int64, whence int) (int64, error) {
 	var off int64
 
 	switch whence {
@@ -44,11 +50,21 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 			return 0, Eisdir
 		}
 
-		dir, err := f.fid.Clnt.Stat(f.fid)
-		if err != nil {
-			return 0, &ninep.Error{"stat error in seek: " + err.Error(), ninep.EIO}
+		var length uint64
+		if f.fid.Clnt.Dotl {
+			attr, err := f.fid.Clnt.GetattrContext(ctx, f.fid, ninep.GetattrSize)
+			if err != nil {
+				return 0, &ninep.Error{"getattr error in seek: " + err.Error(), ninep.EIO}
+			}
+			length = attr.Size
+		} else {
+			dir, err := f.fid.Clnt.StatContext(ctx, f.fid)
+			if err != nil {
+				return 0, &ninep.Error{"stat error in seek: " + err.Error(), ninep.EIO}
+			}
+			length = dir.Length
 		}
-		off = int64(dir.Length) + offset
+		off = int64(length) + offset
 
 	default:
 		return 0, &ninep.Error{"bad whence in seek", ninep.EIO}
@@ -4,17 +4,26 @@
 
 package clnt
 
-import "github.com/lionkov/ninep"
+import (
+	"context"
+
+	"github.com/lionkov/ninep"
+)
 
 // Returns the metadata for the file associated with the Fid, or an Error.
 func (clnt *Clnt) Stat(fid *Fid) (*ninep.Dir, error) {
+	return clnt.StatContext(context.Background(), fid)
+}
+
+// StatContext is like Stat, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) StatContext(ctx context.Context, fid *Fid) (*ninep.Dir, error) {
 	tc := clnt.NewFcall()
 	err := ninep.PackTstat(tc, fid.Fid)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
@@ -24,37 +33,66 @@ func (clnt *Clnt) Stat(fid *Fid) (*ninep.Dir, error) {
 
 // Returns the metadata for a named file, or an Error.
 func (clnt *Clnt) FStat(path string) (*ninep.Dir, error) {
-	fid, err := clnt.FWalk(path)
+	return clnt.FStatContext(context.Background(), path)
+}
+
+// FStatContext is like FStat, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FStatContext(ctx context.Context, path string) (*ninep.Dir, error) {
+	fid, err := clnt.FWalkContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	d, err := clnt.Stat(fid)
+	d, err := clnt.StatContext(ctx, fid)
 	clnt.Clunk(fid)
 	return d, err
 }
 
 // Modifies the data of the file associated with the Fid, or an Error.
 func (clnt *Clnt) Wstat(fid *Fid, dir *ninep.Dir) error {
+	return clnt.WstatContext(context.Background(), fid, dir)
+}
+
+// WstatContext is like Wstat, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) WstatContext(ctx context.Context, fid *Fid, dir *ninep.Dir) error {
 	tc := clnt.NewFcall()
 	err := ninep.PackTwstat(tc, fid.Fid, dir, clnt.Dotu)
 	if err != nil {
 		return err
 	}
 
-	_, err = clnt.Rpc(tc)
+	_, err = clnt.RpcContext(ctx, tc)
 	return err
 }
 
 // FSync syncs the file for a fid. It does this by sending a NewWstatDir, i.e. a
-// Dir with all fields set to 'not set'.
+// Dir with all fields set to 'not set'. On 9P2000.L connections it sends Tfsync.
 func (clnt *Clnt) FSync(fid *Fid) error {
-	return clnt.Wstat(fid, ninep.NewWstatDir())
+	return clnt.FSyncContext(context.Background(), fid)
+}
+
+// FSyncContext is like FSync, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FSyncContext(ctx context.Context, fid *Fid) error {
+	if clnt.Dotl {
+		return clnt.FsyncContext(ctx, fid, false)
+	}
+
+	return clnt.WstatContext(ctx, fid, ninep.NewWstatDir())
 }
 
 // Rename renames the file for a fid.
 func (clnt *Clnt) Rename(fid *Fid, name string) error {
+	return clnt.RenameContext(context.Background(), fid, name)
+}
+
+// RenameContext is like Rename, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) RenameContext(ctx context.Context, fid *Fid, name string) error {
 	d := ninep.NewWstatDir()
 	d.Name = name
-	return clnt.Wstat(fid, d)
+	err := clnt.WstatContext(ctx, fid, d)
+	if err == nil && len(fid.path) > 0 {
+		fid.path = append(fid.path[0:len(fid.path)-1:len(fid.path)-1], name)
+	}
+
+	return err
 }
@@ -54,7 +54,7 @@ func (tag *Tag) reqproc() {
 		case r := <-tag.respchan:
 			rc := r.Rc
 			fid := r.fid
-			err := r.Rc.Type == ninep.Rerror
+			err := r.Rc.Type == ninep.Rerror || r.Rc.Type == ninep.Rlerror
 
 			switch r.Tc.Type {
 			case ninep.Tauth:
@@ -65,6 +65,7 @@ func (tag *Tag) reqproc() {
 			case ninep.Tattach:
 				if !err {
 					fid.Qid = rc.Qid
+					fid.walked = true
 				} else {
 					fid.User = nil
 				}
@@ -79,18 +80,27 @@ func (tag *Tag) reqproc() {
 					fid.User = nil
 				}
 
-			case ninep.Topen:
-			case ninep.Tcreate:
+			case ninep.Topen, ninep.Tcreate:
 				if !err {
 					fid.Iounit = rc.Iounit
 					fid.Qid = rc.Qid
+					fid.opened = true
+				} else {
+					fid.Mode = 0
+				}
+
+			case ninep.Tlopen, ninep.Tlcreate:
+				if !err {
+					tag.clnt.setIounit(fid, rc.Iounit)
+					fid.Qid = rc.Qid
+					fid.opened = true
 				} else {
 					fid.Mode = 0
 				}
 
 			case ninep.Tclunk:
 			case ninep.Tremove:
-				tag.clnt.fidpool.putId(fid.Fid)
+				tag.clnt.fidFree(fid)
 			}
 
 			tag.reqchan <- r
@@ -101,12 +111,13 @@ func (tag *Tag) reqproc() {
 func (tag *Tag) Auth(afid *Fid, user ninep.User, aname string) error {
 	req := tag.reqAlloc()
 	req.fid = afid
-	err := ninep.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := ninep.PackTauth(req.Tc, afid.Fid, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu || tag.clnt.Dotl)
 	if err != nil {
 		return err
 	}
 
 	afid.User = user
+	afid.auth = true
 	return tag.clnt.Rpcnb(req)
 }
 
@@ -121,12 +132,13 @@ func (tag *Tag) Attach(fid, afid *Fid, user ninep.User, aname string) error {
 
 	req := tag.reqAlloc()
 	req.fid = fid
-	err := ninep.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu)
+	err := ninep.PackTattach(req.Tc, fid.Fid, afno, user.Name(), aname, uint32(user.Id()), tag.clnt.Dotu || tag.clnt.Dotl)
 	if err != nil {
 		return err
 	}
 
 	fid.User = user
+	fid.aname = aname
 	return tag.clnt.Rpcnb(req)
 }
 
@@ -142,7 +154,7 @@ func (tag *Tag) Walk(fid *Fid, newfid *Fid, wnames []string) error {
 		return err
 	}
 
-	newfid.User = fid.User
+	newfid.walkedFrom(fid, wnames)
 	return tag.clnt.Rpcnb(req)
 }
 
@@ -167,6 +179,7 @@ func (tag *Tag) Create(fid *Fid, name string, perm uint32, mode uint8, ext strin
 	}
 
 	fid.Mode = mode
+	fid.path = append(fid.path[0:len(fid.path):len(fid.path)], name)
 	return tag.clnt.Rpcnb(req)
 }
 
@@ -235,3 +248,165 @@ func (tag *Tag) Wstat(fid *Fid, dir *ninep.Dir) error {
 
 	return tag.clnt.Rpcnb(req)
 }
+
+func (tag *Tag) Lopen(fid *Fid, flags uint32) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTlopen(req.Tc, fid.Fid, flags)
+	if err != nil {
+		return err
+	}
+
+	fid.Mode = uint8(flags & 3)
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Lcreate(fid *Fid, name string, flags, mode, gid uint32) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTlcreate(req.Tc, fid.Fid, name, flags, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	fid.Mode = uint8(flags & 3)
+	fid.path = append(fid.path[0:len(fid.path):len(fid.path)], name)
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Getattr(fid *Fid, mask uint64) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTgetattr(req.Tc, fid.Fid, mask)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Setattr(fid *Fid, attr *ninep.SetAttr) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTsetattr(req.Tc, fid.Fid, attr)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Readdir(fid *Fid, offset uint64, count uint32) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTreaddir(req.Tc, fid.Fid, offset, count)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Mkdir(dfid *Fid, name string, mode, gid uint32) error {
+	req := tag.reqAlloc()
+	req.fid = dfid
+	err := ninep.PackTmkdir(req.Tc, dfid.Fid, name, mode, gid)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Symlink(dfid *Fid, name, target string, gid uint32) error {
+	req := tag.reqAlloc()
+	req.fid = dfid
+	err := ninep.PackTsymlink(req.Tc, dfid.Fid, name, target, gid)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Readlink(fid *Fid) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTreadlink(req.Tc, fid.Fid)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Link(dfid, fid *Fid, name string) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTlink(req.Tc, dfid.Fid, fid.Fid, name)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Renameat(olddfid *Fid, oldname string, newdfid *Fid, newname string) error {
+	req := tag.reqAlloc()
+	req.fid = olddfid
+	err := ninep.PackTrenameat(req.Tc, olddfid.Fid, oldname, newdfid.Fid, newname)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Unlinkat(dfid *Fid, name string, flags uint32) error {
+	req := tag.reqAlloc()
+	req.fid = dfid
+	err := ninep.PackTunlinkat(req.Tc, dfid.Fid, name, flags)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Statfs(fid *Fid) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTstatfs(req.Tc, fid.Fid)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Fsync(fid *Fid, datasync bool) error {
+	var ds uint32
+	if datasync {
+		ds = 1
+	}
+
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTfsync(req.Tc, fid.Fid, ds)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
+
+func (tag *Tag) Flock(fid *Fid, lock *ninep.Flock) error {
+	req := tag.reqAlloc()
+	req.fid = fid
+	err := ninep.PackTlock(req.Tc, fid.Fid, lock)
+	if err != nil {
+		return err
+	}
+
+	return tag.clnt.Rpcnb(req)
+}
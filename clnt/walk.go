@@ -5,6 +5,7 @@
 package clnt
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
 	"strings"
 )
@@ -14,24 +15,38 @@ import (
 // were walked successfully, an Error is returned. Otherwise a slice with a
 // Qid for each walked name is returned.
 func (clnt *Clnt) Walk(fid *Fid, newfid *Fid, wnames []string) ([]ninep.Qid, error) {
+	return clnt.WalkContext(context.Background(), fid, newfid, wnames)
+}
+
+// WalkContext is like Walk, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) WalkContext(ctx context.Context, fid *Fid, newfid *Fid, wnames []string) ([]ninep.Qid, error) {
 	tc := clnt.NewFcall()
 	err := ninep.PackTwalk(tc, fid.Fid, newfid.Fid, wnames)
 	if err != nil {
 		return nil, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return nil, err
 	}
 
 	newfid.walked = true
+	if len(rc.Wqid) == len(wnames) {
+		newfid.walkedFrom(fid, wnames)
+	}
+
 	return rc.Wqid, nil
 }
 
 // Walks to a named file. Returns a Fid associated with the file,
 // or an Error.
 func (clnt *Clnt) FWalk(path string) (*Fid, error) {
+	return clnt.FWalkContext(context.Background(), path)
+}
+
+// FWalkContext is like FWalk, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) FWalkContext(ctx context.Context, path string) (*Fid, error) {
 	var err error = nil
 
 	var i, m int
@@ -62,6 +77,7 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 	}
 
 	wnames = wnames[0:m]
+	names := wnames
 	for {
 		n := len(wnames)
 		if n > 16 {
@@ -75,7 +91,7 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 		}
 
 		var rc *ninep.Fcall
-		rc, err = clnt.Rpc(tc)
+		rc, err = clnt.RpcContext(ctx, tc)
 		if err != nil {
 			goto error
 		}
@@ -99,6 +115,7 @@ func (clnt *Clnt) FWalk(path string) (*Fid, error) {
 		}
 	}
 
+	newfid.walkedFrom(clnt.Root, names)
 	return newfid, nil
 
 error:
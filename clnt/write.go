@@ -4,11 +4,20 @@
 
 package clnt
 
-import "github.com/lionkov/ninep"
+import (
+	"context"
+
+	"github.com/lionkov/ninep"
+)
 
 // Write up to len(data) bytes starting from offset. Returns the
 // number of bytes written, or an Error.
 func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
+	return clnt.WriteContext(context.Background(), fid, data, offset)
+}
+
+// WriteContext is like Write, but flushes the outstanding request when ctx is done.
+func (clnt *Clnt) WriteContext(ctx context.Context, fid *Fid, data []byte, offset uint64) (int, error) {
 	if uint32(len(data)) > fid.Iounit {
 		data = data[0:fid.Iounit]
 	}
@@ -19,7 +28,7 @@ func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
 		return 0, err
 	}
 
-	rc, err := clnt.Rpc(tc)
+	rc, err := clnt.RpcContext(ctx, tc)
 	if err != nil {
 		return 0, err
 	}
@@ -30,7 +39,12 @@ func (clnt *Clnt) Write(fid *Fid, data []byte, offset uint64) (int, error) {
 // Writes up to len(buf) bytes to a file. Returns the number of
 // bytes written, or an Error.
 func (file *File) Write(buf []byte) (int, error) {
-	n, err := file.WriteAt(buf, int64(file.offset))
+	return file.WriteContext(context.Background(), buf)
+}
+
+// WriteContext is like Write, but flushes the outstanding request when ctx is done.
+func (file *File) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	n, err := file.WriteAtContext(ctx, buf, int64(file.offset))
 	if err == nil {
 		file.offset += uint64(n)
 	}
@@ -41,16 +55,26 @@ func (file *File) Write(buf []byte) (int, error) {
 // Writes up to len(buf) bytes starting from offset. Returns the number
 // of bytes written, or an Error.
 func (file *File) WriteAt(buf []byte, offset int64) (int, error) {
-	return file.fid.Clnt.Write(file.fid, buf, uint64(offset))
+	return file.WriteAtContext(context.Background(), buf, offset)
+}
+
+// WriteAtContext is like WriteAt, but flushes the outstanding request when ctx is done.
+func (file *File) WriteAtContext(ctx context.Context, buf []byte, offset int64) (int, error) {
+	return file.fid.Clnt.WriteContext(ctx, file.fid, buf, uint64(offset))
 }
 
 // Writes exactly len(buf) bytes starting from offset. Returns the number of
 // bytes written. If Error is returned the number of bytes can be less
 // than len(buf).
 func (file *File) Writen(buf []byte, offset uint64) (int, error) {
+	return file.WritenContext(context.Background(), buf, offset)
+}
+
+// WritenContext is like Writen, but flushes the outstanding request when ctx is done.
+func (file *File) WritenContext(ctx context.Context, buf []byte, offset uint64) (int, error) {
 	ret := 0
 	for len(buf) > 0 {
-		n, err := file.WriteAt(buf, int64(offset))
+		n, err := file.WriteAtContext(ctx, buf, int64(offset))
 		if err != nil {
 			return ret, err
 		}
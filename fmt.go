@@ -4,7 +4,10 @@
 
 package ninep
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 func permToString(perm uint32) string {
 	ret := ""
@@ -155,7 +158,157 @@ func (fc *Fcall) String() string {
 		ret = fmt.Sprintf("Rremove tag %d", fc.Tag)
 	case Rwstat:
 		ret = fmt.Sprintf("Rwstat tag %d", fc.Tag)
+
+	/* 9P2000.L */
+	case Rlerror:
+		ret = fmt.Sprintf("Rlerror tag %d ecode %d", fc.Tag, fc.Errornum)
+	case Tstatfs:
+		ret = fmt.Sprintf("Tstatfs tag %d fid %d", fc.Tag, fc.Fid)
+	case Rstatfs:
+		st := &fc.Statfs
+		ret = fmt.Sprintf("Rstatfs tag %d type %x bsize %d blocks %d bfree %d bavail %d files %d ffree %d fsid %x namelen %d",
+			fc.Tag, st.Type, st.Bsize, st.Blocks, st.Bfree, st.Bavail, st.Files, st.Ffree, st.Fsid, st.Namelen)
+	case Tlopen:
+		ret = fmt.Sprintf("Tlopen tag %d fid %d flags %x", fc.Tag, fc.Fid, fc.Flags)
+	case Rlopen:
+		ret = fmt.Sprintf("Rlopen tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		ret = fmt.Sprintf("Tlcreate tag %d fid %d name '%s' flags %x mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Flags, fc.Perm, fc.Ngid)
+	case Rlcreate:
+		ret = fmt.Sprintf("Rlcreate tag %d qid %v iounit %d", fc.Tag, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		ret = fmt.Sprintf("Tsymlink tag %d fid %d name '%s' target '%s' gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Target, fc.Ngid)
+	case Rsymlink:
+		ret = fmt.Sprintf("Rsymlink tag %d qid %v", fc.Tag, &fc.Qid)
+	case Tmknod:
+		ret = fmt.Sprintf("Tmknod tag %d dfid %d name '%s' mode %o major %d minor %d gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Major, fc.Minor, fc.Ngid)
+	case Rmknod:
+		ret = fmt.Sprintf("Rmknod tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trename:
+		ret = fmt.Sprintf("Trename tag %d fid %d dfid %d name '%s'", fc.Tag, fc.Fid, fc.Dfid, fc.Name)
+	case Rrename:
+		ret = fmt.Sprintf("Rrename tag %d", fc.Tag)
+	case Treadlink:
+		ret = fmt.Sprintf("Treadlink tag %d fid %d", fc.Tag, fc.Fid)
+	case Rreadlink:
+		ret = fmt.Sprintf("Rreadlink tag %d target '%s'", fc.Tag, fc.Target)
+	case Tgetattr:
+		ret = fmt.Sprintf("Tgetattr tag %d fid %d mask %x", fc.Tag, fc.Fid, fc.Mask)
+	case Rgetattr:
+		a := &fc.Attr
+		ret = fmt.Sprintf("Rgetattr tag %d valid %x qid %v mode %o uid %d gid %d nlink %d rdev %x size %d blksize %d blocks %d atime %d.%09d mtime %d.%09d ctime %d.%09d",
+			fc.Tag, a.Valid, &a.Qid, a.Mode, a.Uid, a.Gid, a.Nlink, a.Rdev, a.Size, a.Blksize, a.Blocks,
+			a.Atime, a.AtimeNsec, a.Mtime, a.MtimeNsec, a.Ctime, a.CtimeNsec)
+	case Tsetattr:
+		a := &fc.Setattr
+		ret = fmt.Sprintf("Tsetattr tag %d fid %d valid %x mode %o uid %d gid %d size %d atime %d.%09d mtime %d.%09d",
+			fc.Tag, fc.Fid, a.Valid, a.Mode, a.Uid, a.Gid, a.Size, a.Atime, a.AtimeNsec, a.Mtime, a.MtimeNsec)
+	case Rsetattr:
+		ret = fmt.Sprintf("Rsetattr tag %d", fc.Tag)
+	case Txattrwalk:
+		ret = fmt.Sprintf("Txattrwalk tag %d fid %d newfid %d name '%s'", fc.Tag, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		ret = fmt.Sprintf("Rxattrwalk tag %d size %d", fc.Tag, fc.Xattrsize)
+	case Txattrcreate:
+		ret = fmt.Sprintf("Txattrcreate tag %d fid %d name '%s' size %d flags %x",
+			fc.Tag, fc.Fid, fc.Name, fc.Xattrsize, fc.Flags)
+	case Rxattrcreate:
+		ret = fmt.Sprintf("Rxattrcreate tag %d", fc.Tag)
+	case Treaddir:
+		ret = fmt.Sprintf("Treaddir tag %d fid %d offset %d count %d", fc.Tag, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		ret = fmt.Sprintf("Rreaddir tag %d count %d", fc.Tag, fc.Count)
+	case Tfsync:
+		ret = fmt.Sprintf("Tfsync tag %d fid %d datasync %d", fc.Tag, fc.Fid, fc.Datasync)
+	case Rfsync:
+		ret = fmt.Sprintf("Rfsync tag %d", fc.Tag)
+	case Tlock:
+		l := &fc.Flock
+		ret = fmt.Sprintf("Tlock tag %d fid %d type %d flags %x start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, l.Type, l.Flags, l.Start, l.Length, l.ProcId, l.ClientId)
+	case Rlock:
+		ret = fmt.Sprintf("Rlock tag %d status %d", fc.Tag, fc.Status)
+	case Tgetlock:
+		l := &fc.Flock
+		ret = fmt.Sprintf("Tgetlock tag %d fid %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, fc.Fid, l.Type, l.Start, l.Length, l.ProcId, l.ClientId)
+	case Rgetlock:
+		l := &fc.Flock
+		ret = fmt.Sprintf("Rgetlock tag %d type %d start %d length %d proc_id %d client_id '%s'",
+			fc.Tag, l.Type, l.Start, l.Length, l.ProcId, l.ClientId)
+	case Tlink:
+		ret = fmt.Sprintf("Tlink tag %d dfid %d fid %d name '%s'", fc.Tag, fc.Dfid, fc.Fid, fc.Name)
+	case Rlink:
+		ret = fmt.Sprintf("Rlink tag %d", fc.Tag)
+	case Tmkdir:
+		ret = fmt.Sprintf("Tmkdir tag %d dfid %d name '%s' mode %o gid %d", fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Ngid)
+	case Rmkdir:
+		ret = fmt.Sprintf("Rmkdir tag %d qid %v", fc.Tag, &fc.Qid)
+	case Trenameat:
+		ret = fmt.Sprintf("Trenameat tag %d olddirfid %d oldname '%s' newdirfid %d newname '%s'",
+			fc.Tag, fc.Fid, fc.Name, fc.Dfid, fc.Newname)
+	case Rrenameat:
+		ret = fmt.Sprintf("Rrenameat tag %d", fc.Tag)
+	case Tunlinkat:
+		ret = fmt.Sprintf("Tunlinkat tag %d dirfid %d name '%s' flags %x", fc.Tag, fc.Fid, fc.Name, fc.Flags)
+	case Runlinkat:
+		ret = fmt.Sprintf("Runlinkat tag %d", fc.Tag)
 	}
 
 	return ret
 }
+
+var msgNames = map[uint8]string{
+	Tversion:     "Tversion",
+	Tauth:        "Tauth",
+	Tattach:      "Tattach",
+	Rerror:       "Rerror",
+	Tflush:       "Tflush",
+	Twalk:        "Twalk",
+	Topen:        "Topen",
+	Tcreate:      "Tcreate",
+	Tread:        "Tread",
+	Twrite:       "Twrite",
+	Tclunk:       "Tclunk",
+	Tremove:      "Tremove",
+	Tstat:        "Tstat",
+	Twstat:       "Twstat",
+	Rlerror:      "Rlerror",
+	Tstatfs:      "Tstatfs",
+	Tlopen:       "Tlopen",
+	Tlcreate:     "Tlcreate",
+	Tsymlink:     "Tsymlink",
+	Tmknod:       "Tmknod",
+	Trename:      "Trename",
+	Treadlink:    "Treadlink",
+	Tgetattr:     "Tgetattr",
+	Tsetattr:     "Tsetattr",
+	Txattrwalk:   "Txattrwalk",
+	Txattrcreate: "Txattrcreate",
+	Treaddir:     "Treaddir",
+	Tfsync:       "Tfsync",
+	Tlock:        "Tlock",
+	Tgetlock:     "Tgetlock",
+	Tlink:        "Tlink",
+	Tmkdir:       "Tmkdir",
+	Trenameat:    "Trenameat",
+	Tunlinkat:    "Tunlinkat",
+}
+
+// Returns the name of the message type (for example "Tread"), or the
+// number if the type is unknown.
+func MsgName(t uint8) string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+
+	// R-messages follow their T-message
+	if name, ok := msgNames[t-1]; ok && t&1 == 1 && name[0] == 'T' {
+		return "R" + name[1:]
+	}
+
+	return strconv.Itoa(int(t))
+}
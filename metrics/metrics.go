@@ -0,0 +1,294 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The metrics package records statistics of the 9P requests handled by
+// servers and clients, and exports them in the OpenMetrics text format
+// that Prometheus and compatible systems scrape.
+//
+// A Metrics value is attached to a server (srv.Srv.Metrics) or a client
+// (clnt.Clnt.Metrics, clnt.DefaultMetrics) and registered in a Registry,
+// which serves the metrics of all its members over HTTP:
+//
+//	m := metrics.New("server", "ufs")
+//	metrics.DefaultRegistry.Register(m)
+//	ufs.Metrics = m
+//	http.Handle("/metrics", metrics.DefaultRegistry)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/lionkov/ninep"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in seconds) of the buckets of the latency histograms.
+var Buckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Statistics of a message type
+type typeStats struct {
+	count   uint64   // number of requests
+	buckets []uint64 // latency histogram, not cumulative
+	sum     float64  // total latency in seconds
+}
+
+// The Metrics type keeps the statistics of the requests of a server
+// or a client. It's safe for concurrent use.
+type Metrics struct {
+	sync.Mutex
+	Role string // "server" or "client", the role label
+	Name string // identifies the server or client, the name label
+
+	types  [256]*typeStats
+	errors map[uint32]uint64 // error responses by errno
+	tbytes uint64            // size of the T-messages
+	rbytes uint64            // size of the R-messages
+}
+
+// Creates a Metrics value. The role and name are added as labels to
+// all metrics.
+func New(role, name string) *Metrics {
+	m := new(Metrics)
+	m.Role = role
+	m.Name = name
+	m.errors = make(map[uint32]uint64)
+
+	return m
+}
+
+// Records a request and its response. The latency d is the time from
+// receiving (or sending) the request until the response is sent (or
+// received).
+func (m *Metrics) Request(tc, rc *ninep.Fcall, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	ts := m.types[tc.Type]
+	if ts == nil {
+		ts = &typeStats{buckets: make([]uint64, len(Buckets))}
+		m.types[tc.Type] = ts
+	}
+
+	ts.count++
+	secs := d.Seconds()
+	ts.sum += secs
+	if i := sort.SearchFloat64s(Buckets, secs); i < len(Buckets) {
+		ts.buckets[i]++
+	}
+
+	m.tbytes += uint64(tc.Size)
+	if rc == nil {
+		return
+	}
+
+	m.rbytes += uint64(rc.Size)
+	if rc.Type == ninep.Rerror || rc.Type == ninep.Rlerror {
+		m.errors[rc.Errornum]++
+	}
+}
+
+// The Registry type keeps a set of Metrics and writes them together,
+// each metric family once, as required by OpenMetrics. A Registry is
+// an http.Handler.
+type Registry struct {
+	sync.Mutex
+	ms []*Metrics
+}
+
+// The registry used if the program doesn't need more than one.
+var DefaultRegistry = new(Registry)
+
+// Adds m to the registry.
+func (r *Registry) Register(m *Metrics) {
+	r.Lock()
+	defer r.Unlock()
+	for _, m1 := range r.ms {
+		if m1 == m {
+			return
+		}
+	}
+
+	r.ms = append(r.ms, m)
+}
+
+// Removes m from the registry.
+func (r *Registry) Unregister(m *Metrics) {
+	r.Lock()
+	defer r.Unlock()
+	for i, m1 := range r.ms {
+		if m1 == m {
+			r.ms = append(r.ms[0:i], r.ms[i+1:]...)
+			return
+		}
+	}
+}
+
+// A copy of the statistics of a Metrics value, so the output can be
+// written without holding the lock.
+type snapshot struct {
+	labels string
+	types  map[uint8]typeStats
+	errors map[uint32]uint64
+	tbytes uint64
+	rbytes uint64
+}
+
+func (m *Metrics) snapshot() *snapshot {
+	s := new(snapshot)
+	s.labels = "role=\"" + escape(m.Role) + "\",name=\"" + escape(m.Name) + "\""
+	s.types = make(map[uint8]typeStats)
+	s.errors = make(map[uint32]uint64)
+
+	m.Lock()
+	defer m.Unlock()
+	for t, ts := range m.types {
+		if ts != nil {
+			c := *ts
+			c.buckets = append([]uint64(nil), ts.buckets...)
+			s.types[uint8(t)] = c
+		}
+	}
+
+	for errno, n := range m.errors {
+		s.errors[errno] = n
+	}
+
+	s.tbytes = m.tbytes
+	s.rbytes = m.rbytes
+	return s
+}
+
+// Writes the metrics of all registered Metrics values in the
+// OpenMetrics text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	ss := make([]*snapshot, len(r.ms))
+	for i, m := range r.ms {
+		ss[i] = m.snapshot()
+	}
+	r.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	family(cw, "ninep_requests", "counter", "9P requests by message type.")
+	for _, s := range ss {
+		for _, t := range sortedTypes(s) {
+			fmt.Fprintf(cw, "ninep_requests_total{%s,type=\"%s\"} %d\n", s.labels, ninep.MsgName(t), s.types[t].count)
+		}
+	}
+
+	family(cw, "ninep_errors", "counter", "Error responses by errno.")
+	for _, s := range ss {
+		errnos := make([]int, 0, len(s.errors))
+		for errno := range s.errors {
+			errnos = append(errnos, int(errno))
+		}
+
+		sort.Ints(errnos)
+		for _, errno := range errnos {
+			fmt.Fprintf(cw, "ninep_errors_total{%s,errno=\"%d\"} %d\n", s.labels, errno, s.errors[uint32(errno)])
+		}
+	}
+
+	family(cw, "ninep_request_bytes", "counter", "Size of the T-messages.")
+	for _, s := range ss {
+		fmt.Fprintf(cw, "ninep_request_bytes_total{%s} %d\n", s.labels, s.tbytes)
+	}
+
+	family(cw, "ninep_response_bytes", "counter", "Size of the R-messages.")
+	for _, s := range ss {
+		fmt.Fprintf(cw, "ninep_response_bytes_total{%s} %d\n", s.labels, s.rbytes)
+	}
+
+	family(cw, "ninep_request_duration_seconds", "histogram", "Latency of the requests by message type.")
+	for _, s := range ss {
+		for _, t := range sortedTypes(s) {
+			ts := s.types[t]
+			labels := s.labels + ",type=\"" + ninep.MsgName(t) + "\""
+			var n uint64
+			for i, le := range Buckets {
+				n += ts.buckets[i]
+				fmt.Fprintf(cw, "ninep_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(le), n)
+			}
+
+			fmt.Fprintf(cw, "ninep_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, ts.count)
+			fmt.Fprintf(cw, "ninep_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(ts.sum))
+			fmt.Fprintf(cw, "ninep_request_duration_seconds_count{%s} %d\n", labels, ts.count)
+		}
+	}
+
+	io.WriteString(cw, "# EOF\n")
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+
+	return cw.n, cw.err
+}
+
+// Serves the metrics over HTTP.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Serves the metrics over HTTP on the listener. Doesn't return
+// unless the listener fails.
+func (r *Registry) Serve(l net.Listener) error {
+	return http.Serve(l, r)
+}
+
+// Writes the metadata of a metric family.
+func family(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+}
+
+func sortedTypes(s *snapshot) []uint8 {
+	ts := make([]int, 0, len(s.types))
+	for t := range s.types {
+		ts = append(ts, int(t))
+	}
+
+	sort.Ints(ts)
+	ret := make([]uint8, len(ts))
+	for i, t := range ts {
+		ret[i] = uint8(t)
+	}
+
+	return ret
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Escapes a label value.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// Counts the bytes written, and keeps the first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,114 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"github.com/lionkov/ninep"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	m := New("server", "test")
+	r := new(Registry)
+	r.Register(m)
+	r.Register(m)
+
+	tc := ninep.NewFcall(ninep.MSIZE)
+	ninep.PackTread(tc, 1, 0, 100)
+	rc := ninep.NewFcall(ninep.MSIZE)
+	ninep.PackRread(rc, make([]byte, 100))
+	m.Request(tc, rc, 3*time.Millisecond)
+	m.Request(tc, rc, 20*time.Second)
+
+	ec := ninep.NewFcall(ninep.MSIZE)
+	ninep.PackRerror(ec, "file not found", ninep.ENOENT, true)
+	m.Request(tc, ec, 50*time.Microsecond)
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d", n, b.Len())
+	}
+
+	out := b.String()
+	lines := []string{
+		`ninep_requests_total{role="server",name="test",type="Tread"} 3`,
+		`ninep_errors_total{role="server",name="test",errno="2"} 1`,
+		`ninep_request_bytes_total{role="server",name="test"} ` + itoa(3*tc.Size),
+		`ninep_response_bytes_total{role="server",name="test"} ` + itoa(2*rc.Size+ec.Size),
+		`ninep_request_duration_seconds_bucket{role="server",name="test",type="Tread",le="0.0001"} 1`,
+		`ninep_request_duration_seconds_bucket{role="server",name="test",type="Tread",le="0.0025"} 1`,
+		`ninep_request_duration_seconds_bucket{role="server",name="test",type="Tread",le="0.005"} 2`,
+		`ninep_request_duration_seconds_bucket{role="server",name="test",type="Tread",le="10"} 2`,
+		`ninep_request_duration_seconds_bucket{role="server",name="test",type="Tread",le="+Inf"} 3`,
+		`ninep_request_duration_seconds_count{role="server",name="test",type="Tread"} 3`,
+		"# TYPE ninep_request_duration_seconds histogram",
+	}
+
+	for _, l := range lines {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("missing %q in:\n%s", l, out)
+		}
+	}
+
+	if strings.Count(out, "# TYPE ninep_requests counter") != 1 {
+		t.Errorf("metric family written more than once:\n%s", out)
+	}
+
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("output doesn't end with # EOF:\n%s", out)
+	}
+
+	r.Unregister(m)
+	b.Reset()
+	r.WriteTo(&b)
+	if strings.Contains(b.String(), "ninep_requests_total{") {
+		t.Errorf("unregistered metrics written:\n%s", b.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	m := New("client", `a "quoted" name`)
+	r := new(Registry)
+	r.Register(m)
+
+	tc := ninep.NewFcall(ninep.MSIZE)
+	ninep.PackTclunk(tc, 1)
+	rc := ninep.NewFcall(ninep.MSIZE)
+	ninep.PackRclunk(rc)
+	m.Request(tc, rc, time.Millisecond)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("bad content type: %q", ct)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	l := `ninep_requests_total{role="client",name="a \"quoted\" name",type="Tclunk"} 1`
+	if !strings.Contains(string(body), l) {
+		t.Errorf("missing %q in:\n%s", l, body)
+	}
+}
+
+func itoa(n uint32) string {
+	return strconv.Itoa(int(n))
+}
@@ -5,8 +5,11 @@
 package ninep
 
 import (
+	"bytes"
 	"flag"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 var debug = flag.Int("debug", 0, "print debug messages")
@@ -26,3 +29,233 @@ func TestUnpackDir(t *testing.T) {
 	}
 }
 
+func TestPackUnpackDotl(t *testing.T) {
+	fc := NewFcall(8192)
+	attr := &Attr{Valid: GetattrBasic, Qid: Qid{QTDIR, 3, 42}, Mode: 040755, Uid: 1000, Gid: 100,
+		Nlink: 2, Size: 4096, Blksize: 4096, Blocks: 8, Mtime: 1234567890, MtimeNsec: 999999999}
+	lock := &Flock{Type: LockTypeWrlck, Flags: LockFlagsBlock, Start: 10, Length: 20, ProcId: 7, ClientId: "host"}
+	setattr := &SetAttr{Valid: SetattrMode | SetattrSize, Mode: 0640, Size: 100}
+	statfs := &Statfs{Type: 0x01021997, Bsize: 4096, Blocks: 100, Bfree: 50, Bavail: 40, Files: 10, Ffree: 5, Namelen: 255}
+
+	tests := []struct {
+		pack  func() error
+		check func(fc *Fcall) bool
+	}{
+		{func() error { return PackTlopen(fc, 1, 0102) }, func(fc *Fcall) bool { return fc.Fid == 1 && fc.Flags == 0102 }},
+		{func() error { return PackTlcreate(fc, 1, "file", 0101, 0644, 100) },
+			func(fc *Fcall) bool {
+				return fc.Name == "file" && fc.Flags == 0101 && fc.Perm == 0644 && fc.Ngid == 100
+			}},
+		{func() error { return PackTsymlink(fc, 1, "link", "target", 100) },
+			func(fc *Fcall) bool { return fc.Name == "link" && fc.Target == "target" && fc.Ngid == 100 }},
+		{func() error { return PackTmknod(fc, 1, "dev", 020644, 1, 3, 100) },
+			func(fc *Fcall) bool { return fc.Perm == 020644 && fc.Major == 1 && fc.Minor == 3 }},
+		{func() error { return PackTrename(fc, 1, 2, "new") },
+			func(fc *Fcall) bool { return fc.Fid == 1 && fc.Dfid == 2 && fc.Name == "new" }},
+		{func() error { return PackTgetattr(fc, 1, GetattrAll) }, func(fc *Fcall) bool { return fc.Mask == GetattrAll }},
+		{func() error { return PackRgetattr(fc, attr) }, func(fc *Fcall) bool { return fc.Attr == *attr }},
+		{func() error { return PackTsetattr(fc, 1, setattr) }, func(fc *Fcall) bool { return fc.Setattr == *setattr }},
+		{func() error { return PackTxattrwalk(fc, 1, 2, "user.x") },
+			func(fc *Fcall) bool { return fc.Newfid == 2 && fc.Name == "user.x" }},
+		{func() error { return PackTxattrcreate(fc, 1, "user.x", 5, 1) },
+			func(fc *Fcall) bool { return fc.Xattrsize == 5 && fc.Flags == 1 }},
+		{func() error { return PackTreaddir(fc, 1, 77, 512) },
+			func(fc *Fcall) bool { return fc.Offset == 77 && fc.Count == 512 }},
+		{func() error { return PackRreaddir(fc, PackDirent(&Dirent{Qid{}, 1, 4, "a"})) },
+			func(fc *Fcall) bool {
+				d, b, _, err := UnpackDirent(fc.Data)
+				return err == nil && len(b) == 0 && d.Name == "a" && d.Offset == 1 && d.Type == 4
+			}},
+		{func() error { return PackTfsync(fc, 1, 1) }, func(fc *Fcall) bool { return fc.Datasync == 1 }},
+		{func() error { return PackTlock(fc, 1, lock) }, func(fc *Fcall) bool { return fc.Flock == *lock }},
+		{func() error { return PackRlock(fc, LockBlocked) }, func(fc *Fcall) bool { return fc.Status == LockBlocked }},
+		{func() error { return PackTgetlock(fc, 1, lock) },
+			func(fc *Fcall) bool { return fc.Flock.ClientId == "host" && fc.Flock.Flags == 0 }},
+		{func() error { return PackRgetlock(fc, lock) }, func(fc *Fcall) bool { return fc.Flock.Start == 10 }},
+		{func() error { return PackTlink(fc, 2, 1, "hard") },
+			func(fc *Fcall) bool { return fc.Dfid == 2 && fc.Fid == 1 && fc.Name == "hard" }},
+		{func() error { return PackTmkdir(fc, 1, "dir", 0755, 100) },
+			func(fc *Fcall) bool { return fc.Name == "dir" && fc.Perm == 0755 }},
+		{func() error { return PackRmkdir(fc, &attr.Qid) }, func(fc *Fcall) bool { return fc.Qid == attr.Qid }},
+		{func() error { return PackTrenameat(fc, 1, "old", 2, "new") },
+			func(fc *Fcall) bool { return fc.Name == "old" && fc.Dfid == 2 && fc.Newname == "new" }},
+		{func() error { return PackTunlinkat(fc, 1, "dir", AT_REMOVEDIR) },
+			func(fc *Fcall) bool { return fc.Flags == AT_REMOVEDIR }},
+		{func() error { return PackRstatfs(fc, statfs) }, func(fc *Fcall) bool { return fc.Statfs == *statfs }},
+		{func() error { return PackRreadlink(fc, "/etc") }, func(fc *Fcall) bool { return fc.Target == "/etc" }},
+		{func() error { return PackRlerror(fc, ENOENT) }, func(fc *Fcall) bool { return fc.Errornum == ENOENT }},
+	}
+
+	for i, tt := range tests {
+		if err := tt.pack(); err != nil {
+			t.Fatalf("%d: pack: %v", i, err)
+		}
+
+		nfc, err, n := Unpack(fc.Pkt, true)
+		if err != nil {
+			t.Fatalf("%d: unpack %v: %v", i, fc, err)
+		}
+
+		if n != len(fc.Pkt) || nfc.Type != fc.Type {
+			t.Errorf("%d: unpack %v: got type %d size %d", i, fc, nfc.Type, n)
+		}
+
+		if !tt.check(nfc) {
+			t.Errorf("%d: unpack %v: got %v", i, fc, nfc)
+		}
+	}
+}
+
+func TestMsgReader(t *testing.T) {
+	var wire []byte
+	var sent [][]byte
+	for _, count := range []int{0, 10, readahead, 100, 3 * readahead, 5} {
+		fc := NewFcall(0)
+		data := bytes.Repeat([]byte{byte(count)}, count)
+		if err := PackTwrite(fc, 1, 0, uint32(count), data); err != nil {
+			t.Fatalf("PackTwrite: %v", err)
+		}
+
+		wire = append(wire, fc.Pkt...)
+		sent = append(sent, append([]byte(nil), fc.Pkt...))
+		PutFcall(fc)
+	}
+
+	for _, r := range []struct {
+		name string
+		mr   *MsgReader
+	}{
+		{"whole", NewMsgReader(bytes.NewReader(wire))},
+		{"bytes", NewMsgReader(iotest.OneByteReader(bytes.NewReader(wire)))},
+	} {
+		for i, pkt := range sent {
+			msg, err := r.mr.Read(4 * readahead)
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", r.name, i, err)
+			}
+
+			if !bytes.Equal(msg, pkt) {
+				t.Errorf("%s: message %d: got %d bytes, want %d", r.name, i, len(msg), len(pkt))
+			}
+
+			PutBuf(msg)
+		}
+
+		if r.mr.buf != nil {
+			t.Errorf("%s: the read-ahead buffer is kept", r.name)
+		}
+	}
+
+	mr := NewMsgReader(bytes.NewReader(sent[4]))
+	if _, err := mr.Read(readahead); err == nil {
+		t.Errorf("Read: a message larger than msize is accepted")
+	}
+}
+
+// Messages of most types, packed as 9P2000.u
+func testMessages(t testing.TB) [][]byte {
+	var msgs [][]byte
+	dir := &Dir{Type: 1, Dev: 2, Qid: Qid{QTDIR, 3, 42}, Mode: DMDIR | 0755, Name: "dir", Uid: "glenda",
+		Gid: "sys", Muid: "glenda", Ext: "", Uidnum: 1000, Gidnum: 100, Muidnum: 1000}
+	for _, pack := range []func(fc *Fcall) error{
+		func(fc *Fcall) error { return PackTversion(fc, 8192, VersionU) },
+		func(fc *Fcall) error { return PackTattach(fc, 1, NOFID, "glenda", "/", 1000, true) },
+		func(fc *Fcall) error { return PackRattach(fc, &dir.Qid) },
+		func(fc *Fcall) error { return PackTwalk(fc, 1, 2, []string{"usr", "glenda", "lib"}) },
+		func(fc *Fcall) error { return PackRwalk(fc, []Qid{dir.Qid, dir.Qid}) },
+		func(fc *Fcall) error { return PackTcreate(fc, 2, "file", 0644, OWRITE, "", true) },
+		func(fc *Fcall) error { return PackTread(fc, 2, 100, 8192) },
+		func(fc *Fcall) error { return PackRread(fc, []byte("hello, world")) },
+		func(fc *Fcall) error { return PackTwrite(fc, 2, 100, 5, []byte("hello")) },
+		func(fc *Fcall) error { return PackRwrite(fc, 5) },
+		func(fc *Fcall) error { return PackRerror(fc, "file not found", ENOENT, true) },
+		func(fc *Fcall) error { return PackRstat(fc, dir, true) },
+		func(fc *Fcall) error { return PackTwstat(fc, 2, dir, true) },
+		func(fc *Fcall) error { return PackTflush(fc, 7) },
+		func(fc *Fcall) error { return PackRclunk(fc) },
+		func(fc *Fcall) error { return PackTlcreate(fc, 1, "file", 0101, 0644, 100) },
+		func(fc *Fcall) error { return PackRreaddir(fc, PackDirent(&Dirent{Qid{}, 1, 4, "a"})) },
+		func(fc *Fcall) error { return PackTrenameat(fc, 1, "old", 2, "new") },
+	} {
+		fc := NewFcall(8192)
+		if err := pack(fc); err != nil {
+			t.Fatalf("pack: %v", err)
+		}
+
+		SetTag(fc, uint16(len(msgs)))
+		msgs = append(msgs, fc.Pkt)
+	}
+
+	return msgs
+}
+
+func TestPackFcall(t *testing.T) {
+	var enc Encoder
+	var w bytes.Buffer
+
+	enc.Dotu = true
+	fc := new(Fcall)
+	for _, msg := range testMessages(t) {
+		if _, err := UnpackFcall(fc, msg, true); err != nil {
+			t.Fatalf("UnpackFcall %v: %v", msg, err)
+		}
+
+		w.Reset()
+		if err := enc.Encode(&w, fc); err != nil {
+			t.Fatalf("Encode %v: %v", fc, err)
+		}
+
+		if !bytes.Equal(w.Bytes(), msg) {
+			t.Errorf("Encode %v: got %v, want %v", fc, w.Bytes(), msg)
+		}
+
+		pfc := *fc
+		pfc.Buf = nil
+		pfc.pooled = false
+		if err := PackFcall(&pfc, true); err != nil {
+			t.Fatalf("PackFcall %v: %v", fc, err)
+		}
+
+		if !bytes.Equal(pfc.Pkt, msg) {
+			t.Errorf("PackFcall %v: got %v, want %v", fc, pfc.Pkt, msg)
+		}
+	}
+}
+
+func TestUnpackFcallAllocs(t *testing.T) {
+	var enc Encoder
+
+	msgs := testMessages(t)
+	fc := new(Fcall)
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, msg := range msgs {
+			UnpackFcall(fc, msg, true)
+			enc.Encode(io.Discard, fc)
+		}
+	})
+
+	if allocs != 0 {
+		t.Errorf("got %v allocations, want none", allocs)
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	msgs := testMessages(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			Unpack(msg, true)
+		}
+	}
+}
+
+func BenchmarkUnpackFcall(b *testing.B) {
+	msgs := testMessages(b)
+	fc := new(Fcall)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, msg := range msgs {
+			UnpackFcall(fc, msg, true)
+		}
+	}
+}
@@ -43,12 +43,63 @@ const (
 	Tlast
 )
 
+// 9P2000.L message types
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
 const (
 	MSIZE   = 1048576 + IOHDRSZ // default message size (1048576+IOHdrSz)
 	IOHDRSZ = 24                // the non-data size of the Twrite messages
 	PORT    = 564               // default port for 9P file servers
 )
 
+// Protocol versions (dialects) sent in Tversion and Rversion
+const (
+	Version  = "9P2000"
+	VersionU = "9P2000.u"
+	VersionL = "9P2000.L"
+)
+
 // Qid types
 const (
 	QTDIR     = 0x80 // directories
@@ -95,6 +146,59 @@ const (
 	DMEXEC      = 0x1        // mode bit for execute permission
 )
 
+// Bits in the request mask of Tgetattr and the valid mask of Rgetattr (9P2000.L)
+const (
+	GetattrMode        = 0x00000001
+	GetattrNlink       = 0x00000002
+	GetattrUid         = 0x00000004
+	GetattrGid         = 0x00000008
+	GetattrRdev        = 0x00000010
+	GetattrAtime       = 0x00000020
+	GetattrMtime       = 0x00000040
+	GetattrCtime       = 0x00000080
+	GetattrIno         = 0x00000100
+	GetattrSize        = 0x00000200
+	GetattrBlocks      = 0x00000400
+	GetattrBtime       = 0x00000800
+	GetattrGen         = 0x00001000
+	GetattrDataVersion = 0x00002000
+	GetattrBasic       = 0x000007ff // everything up to GetattrBlocks
+	GetattrAll         = 0x00003fff
+)
+
+// Bits in the valid mask of Tsetattr (9P2000.L)
+const (
+	SetattrMode     = 0x00000001
+	SetattrUid      = 0x00000002
+	SetattrGid      = 0x00000004
+	SetattrSize     = 0x00000008
+	SetattrAtime    = 0x00000010
+	SetattrMtime    = 0x00000020
+	SetattrCtime    = 0x00000040
+	SetattrAtimeSet = 0x00000080 // use the atime from the message instead of the current time
+	SetattrMtimeSet = 0x00000100 // use the mtime from the message instead of the current time
+)
+
+// Lock types, flags and status values for Tlock and Tgetlock (9P2000.L)
+const (
+	LockTypeRdlck = 0
+	LockTypeWrlck = 1
+	LockTypeUnlck = 2
+
+	LockFlagsBlock   = 1
+	LockFlagsReclaim = 2
+
+	LockSuccess = 0
+	LockBlocked = 1
+	LockError   = 2
+	LockGrace   = 3
+)
+
+// Flags for Tunlinkat (9P2000.L)
+const (
+	AT_REMOVEDIR = 0x200
+)
+
 const (
 	NOTAG uint16 = 0xFFFF     // no tag specified
 	NOFID uint32 = 0xFFFFFFFF // no fid specified
@@ -103,13 +207,24 @@ const (
 
 // Error values
 const (
-	EPERM   = 1
-	ENOENT  = 2
-	EIO     = 5
-	EACCES  = 13
-	EEXIST  = 17
-	ENOTDIR = 20
-	EINVAL  = 22
+	EPERM     = 1
+	ENOENT    = 2
+	EINTR     = 4
+	EIO       = 5
+	EBADF     = 9
+	EAGAIN    = 11
+	EACCES    = 13
+	EEXIST    = 17
+	EXDEV     = 18
+	ENOTDIR   = 20
+	EISDIR    = 21
+	EINVAL    = 22
+	ENOSPC    = 28
+	EROFS     = 30
+	ENOSYS    = 38
+	ENOTEMPTY = 39
+	ENODATA   = 61
+	ENOTSUP   = 95
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error
@@ -147,6 +262,76 @@ type Dir struct {
 	Muidnum uint32 // ID of the last user that modified the file
 }
 
+// Attr describes a file as returned by Rgetattr (9P2000.L). Only the
+// fields selected by Valid are meaningful.
+type Attr struct {
+	Valid       uint64 // mask of the valid fields (Getattr* bits)
+	Qid                // file's Qid
+	Mode        uint32 // Linux st_mode, including the file type bits
+	Uid         uint32 // owner ID
+	Gid         uint32 // group ID
+	Nlink       uint64 // number of hard links
+	Rdev        uint64 // device ID (if special file)
+	Size        uint64 // file length in bytes
+	Blksize     uint64 // block size for file system I/O
+	Blocks      uint64 // number of 512-byte blocks allocated
+	Atime       uint64 // last access time in seconds
+	AtimeNsec   uint64 // nanosecond part of Atime
+	Mtime       uint64 // last modified time in seconds
+	MtimeNsec   uint64 // nanosecond part of Mtime
+	Ctime       uint64 // last status change time in seconds
+	CtimeNsec   uint64 // nanosecond part of Ctime
+	Btime       uint64 // creation time in seconds (reserved)
+	BtimeNsec   uint64 // nanosecond part of Btime (reserved)
+	Gen         uint64 // inode generation (reserved)
+	DataVersion uint64 // data version (reserved)
+}
+
+// SetAttr describes the changes requested by Tsetattr (9P2000.L).
+// Only the fields selected by Valid should be applied.
+type SetAttr struct {
+	Valid     uint32 // mask of the fields to change (Setattr* bits)
+	Mode      uint32 // new permissions
+	Uid       uint32 // new owner ID
+	Gid       uint32 // new group ID
+	Size      uint64 // new file length
+	Atime     uint64 // new access time in seconds
+	AtimeNsec uint64 // nanosecond part of Atime
+	Mtime     uint64 // new modified time in seconds
+	MtimeNsec uint64 // nanosecond part of Mtime
+}
+
+// Statfs describes a file system as returned by Rstatfs (9P2000.L)
+type Statfs struct {
+	Type    uint32 // type of the file system
+	Bsize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in the file system
+	Bfree   uint64 // free blocks
+	Bavail  uint64 // free blocks available to unprivileged users
+	Files   uint64 // total file nodes
+	Ffree   uint64 // free file nodes
+	Fsid    uint64 // file system ID
+	Namelen uint32 // maximum length of file names
+}
+
+// Flock describes a POSIX record lock (used by Tlock, Tgetlock and Rgetlock, 9P2000.L)
+type Flock struct {
+	Type     uint8  // lock type (LockType* values)
+	Flags    uint32 // lock flags (LockFlags* values, Tlock only)
+	Start    uint64 // starting offset of the lock
+	Length   uint64 // number of bytes, 0 means until the end of the file
+	ProcId   uint32 // process ID of the lock owner
+	ClientId string // client identifier of the lock owner
+}
+
+// Dirent is a directory entry as returned by Rreaddir (9P2000.L)
+type Dirent struct {
+	Qid           // file's Qid
+	Offset uint64 // offset of the next entry
+	Type   uint8  // Linux d_type of the file
+	Name   string // file name
+}
+
 // Fcall represents a 9P2000 message
 type Fcall struct {
 	Size    uint32   // size of the message
@@ -178,8 +363,28 @@ type Fcall struct {
 	Ext      string // special file description, 9P2000.u only (used by Tcreate)
 	Unamenum uint32 // user ID, 9P2000.u only (used by Tauth, Tattach)
 
+	/* 9P2000.L extensions */
+	Dfid      uint32  // destination directory fid (used by Tlink, Trename, Trenameat)
+	Newname   string  // new file name (used by Trenameat)
+	Flags     uint32  // Linux flags (used by Tlopen, Tlcreate, Tunlinkat, Txattrcreate)
+	Ngid      uint32  // group ID of the new file (used by Tlcreate, Tmkdir, Tsymlink, Tmknod)
+	Target    string  // symbolic link target (used by Tsymlink, Rreadlink)
+	Major     uint32  // major device number (used by Tmknod)
+	Minor     uint32  // minor device number (used by Tmknod)
+	Mask      uint64  // requested attributes (used by Tgetattr)
+	Attr      Attr    // file attributes (used by Rgetattr)
+	Setattr   SetAttr // attributes to change (used by Tsetattr)
+	Statfs    Statfs  // file system description (used by Rstatfs)
+	Flock     Flock   // lock description (used by Tlock, Tgetlock, Rgetlock)
+	Status    uint8   // lock status (used by Rlock)
+	Xattrsize uint64  // size of the extended attribute (used by Rxattrwalk, Txattrcreate)
+	Datasync  uint32  // if non-zero, only flush the data (used by Tfsync)
+
 	Pkt []uint8 // raw packet data
 	Buf []uint8 // buffer to put the raw data in
+
+	pooled bool      // Buf is from the buffer pool
+	strs   *strcache // strings reused by UnpackFcall
 }
 
 // Interface for accessing users and groups
@@ -281,6 +486,49 @@ var minFcusize = [...]uint32{
 	0,  /* Rbtrunc */
 }
 
+// minimum size of a 9P2000.L message for a type
+var minFclsize = [...]uint32{
+	Rlerror:      4,  /* ecode[4] */
+	Tstatfs:      4,  /* fid[4] */
+	Rstatfs:      60, /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	Tlopen:       8,  /* fid[4] flags[4] */
+	Rlopen:       17, /* qid[13] iounit[4] */
+	Tlcreate:     18, /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	Rlcreate:     17, /* qid[13] iounit[4] */
+	Tsymlink:     12, /* fid[4] name[s] symtgt[s] gid[4] */
+	Rsymlink:     13, /* qid[13] */
+	Tmknod:       22, /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	Rmknod:       13, /* qid[13] */
+	Trename:      10, /* fid[4] dfid[4] name[s] */
+	Rrename:      0,
+	Treadlink:    4,   /* fid[4] */
+	Rreadlink:    2,   /* target[s] */
+	Tgetattr:     12,  /* fid[4] request_mask[8] */
+	Rgetattr:     153, /* valid[8] qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8] size[8] blksize[8] blocks[8] 8*time[8] gen[8] data_version[8] */
+	Tsetattr:     60,  /* fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime_sec[8] atime_nsec[8] mtime_sec[8] mtime_nsec[8] */
+	Rsetattr:     0,
+	Txattrwalk:   10, /* fid[4] newfid[4] name[s] */
+	Rxattrwalk:   8,  /* size[8] */
+	Txattrcreate: 18, /* fid[4] name[s] attr_size[8] flags[4] */
+	Rxattrcreate: 0,
+	Treaddir:     16, /* fid[4] offset[8] count[4] */
+	Rreaddir:     4,  /* count[4] */
+	Tfsync:       4,  /* fid[4] (datasync[4]) */
+	Rfsync:       0,
+	Tlock:        31, /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	Rlock:        1,  /* status[1] */
+	Tgetlock:     27, /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Rgetlock:     23, /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Tlink:        10, /* dfid[4] fid[4] name[s] */
+	Rlink:        0,
+	Tmkdir:       14, /* dfid[4] name[s] mode[4] gid[4] */
+	Rmkdir:       13, /* qid[13] */
+	Trenameat:    12, /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	Rrenameat:    0,
+	Tunlinkat:    10, /* dirfd[4] name[s] flags[4] */
+	Runlinkat:    0,
+}
+
 func gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:] }
 
 func gint16(buf []byte) (uint16, []byte) {
@@ -303,6 +551,19 @@ func gint64(buf []byte) (uint64, []byte) {
 }
 
 func gstr(buf []byte) (string, []byte) {
+	return gstrs(buf, nil)
+}
+
+// Strings recently decoded into a Fcall by UnpackFcall. They are
+// reused when they appear again, so decoding the same names doesn't
+// allocate.
+type strcache struct {
+	strs [16]string
+	next int
+}
+
+// Like gstr, but looks for the string in the cache first.
+func gstrs(buf []byte, c *strcache) (string, []byte) {
 	var n uint16
 
 	if buf == nil {
@@ -314,7 +575,24 @@ func gstr(buf []byte) (string, []byte) {
 		return "", nil
 	}
 
-	return string(buf[0:n]), buf[n:]
+	if n == 0 {
+		return "", buf
+	}
+
+	if c == nil {
+		return string(buf[0:n]), buf[n:]
+	}
+
+	for _, s := range c.strs {
+		if s == string(buf[0:n]) {
+			return s, buf[n:]
+		}
+	}
+
+	s := string(buf[0:n])
+	c.strs[c.next] = s
+	c.next = (c.next + 1) % len(c.strs)
+	return s, buf[n:]
 }
 
 func gqid(buf []byte, qid *Qid) []byte {
@@ -325,7 +603,7 @@ func gqid(buf []byte, qid *Qid) []byte {
 	return buf
 }
 
-func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
+func gstat(buf []byte, d *Dir, dotu bool, c *strcache) ([]byte, error) {
 	sz := len(buf)
 	d.Size, buf = gint16(buf)
 	d.Type, buf = gint16(buf)
@@ -335,29 +613,29 @@ func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
 	d.Atime, buf = gint32(buf)
 	d.Mtime, buf = gint32(buf)
 	d.Length, buf = gint64(buf)
-	d.Name, buf = gstr(buf)
+	d.Name, buf = gstrs(buf, c)
 	if buf == nil {
 		s := fmt.Sprintf("Buffer too short for basic 9p: need %d, have %d",
 			49, sz)
 		return nil, &Error{s, EINVAL}
 	}
 
-	d.Uid, buf = gstr(buf)
+	d.Uid, buf = gstrs(buf, c)
 	if buf == nil {
 		return nil, &Error{"d.Uid failed", EINVAL}
 	}
-	d.Gid, buf = gstr(buf)
+	d.Gid, buf = gstrs(buf, c)
 	if buf == nil {
 		return nil, &Error{"d.Gid failed", EINVAL}
 	}
 
-	d.Muid, buf = gstr(buf)
+	d.Muid, buf = gstrs(buf, c)
 	if buf == nil {
 		return nil, &Error{"d.Muid failed", EINVAL}
 	}
 
 	if dotu {
-		d.Ext, buf = gstr(buf)
+		d.Ext, buf = gstrs(buf, c)
 		if buf == nil {
 			return nil, &Error{"d.Ext failed", EINVAL}
 		}
@@ -366,6 +644,7 @@ func gstat(buf []byte, d *Dir, dotu bool) ([]byte, error) {
 		d.Gidnum, buf = gint32(buf)
 		d.Muidnum, buf = gint32(buf)
 	} else {
+		d.Ext = ""
 		d.Uidnum = NOUID
 		d.Gidnum = NOUID
 		d.Muidnum = NOUID
@@ -408,8 +687,7 @@ func pint64(val uint64, buf []byte) []byte {
 func pstr(val string, buf []byte) []byte {
 	n := uint16(len(val))
 	buf = pint16(n, buf)
-	b := []byte(val)
-	copy(buf, b)
+	copy(buf, val)
 	return buf[n:]
 }
 
@@ -480,7 +758,7 @@ func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
 	}
 
 	d = new(Dir)
-	b, err = gstat(buf, d, dotu)
+	b, err = gstat(buf, d, dotu, nil)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -489,6 +767,39 @@ func UnpackDir(buf []byte, dotu bool) (d *Dir, b []byte, amt int, err error) {
 
 }
 
+// Converts a Dirent value to its on-the-wire representation, as
+// returned in the data of Rreaddir messages.
+func PackDirent(d *Dirent) []byte {
+	buf := make([]byte, 13+8+1+2+len(d.Name)) /* qid[13] offset[8] type[1] name[s] */
+	p := pqid(&d.Qid, buf)
+	p = pint64(d.Offset, p)
+	p = pint8(d.Type, p)
+	p = pstr(d.Name, p)
+	return buf
+}
+
+// Converts the on-the-wire representation of a directory entry (as
+// returned by Rreaddir) to a Dirent value. Returns the entry, the rest
+// of the buffer and the number of bytes used, or an error.
+func UnpackDirent(buf []byte) (d *Dirent, b []byte, amt int, err error) {
+	sz := 13 + 8 + 1 + 2 /* qid[13] offset[8] type[1] name[s] */
+	if len(buf) < sz {
+		s := fmt.Sprintf("short buffer: Need %d and have %v", sz, len(buf))
+		return nil, nil, 0, &Error{s, EINVAL}
+	}
+
+	d = new(Dirent)
+	b = gqid(buf, &d.Qid)
+	d.Offset, b = gint64(b)
+	d.Type, b = gint8(b)
+	d.Name, b = gstr(b)
+	if b == nil {
+		return nil, nil, 0, &Error{"d.Name failed", EINVAL}
+	}
+
+	return d, b, len(buf) - len(b), nil
+}
+
 // ChangeMode returns true if Dir contains a mode change value. This should be used in
 // conjunction with Twstat and Rwstat.
 func (d *Dir) ChangeMode() bool {
@@ -526,8 +837,14 @@ func (d *Dir) ChangeIllegalFields() bool {
 	return d.Type != ^uint16(0) || d.Dev != ^uint32(0) || d.Qid.Type != ^uint8(0) || d.Qid.Version != ^uint32(0) || d.Qid.Path != ^uint64(0) || d.Atime != ^uint32(0) || d.Uid != "" || d.Muid != ""
 }
 
-// Allocates a new Fcall.
+// Allocates a new Fcall. If sz is 0, the buffer is taken from the
+// pool when a message is packed, and grows as needed. It should be
+// returned with PutFcall.
 func NewFcall(sz uint32) *Fcall {
+	if sz == 0 {
+		return fcpool.Get().(*Fcall)
+	}
+
 	fc := new(Fcall)
 	fc.Buf = make([]byte, sz)
 
@@ -543,7 +860,17 @@ func SetTag(fc *Fcall, tag uint16) {
 func packCommon(fc *Fcall, size int, id uint8) ([]byte, error) {
 	size += 4 + 1 + 2 /* size[4] id[1] tag[2] */
 	if len(fc.Buf) < int(size) {
-		return nil, &Error{"buffer too small", EINVAL}
+		if len(fc.Buf) > 0 && !fc.pooled {
+			return nil, &Error{"buffer too small", EINVAL}
+		}
+
+		if fc.pooled {
+			PutBuf(fc.Buf)
+		}
+
+		fc.Buf = GetBuf(size)
+		fc.Buf = fc.Buf[0:cap(fc.Buf)]
+		fc.pooled = true
 	}
 
 	fc.Size = uint32(size)
@@ -0,0 +1,226 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+import (
+	"io"
+	"net"
+)
+
+// Packs the message described by the fields of fc (Type, Tag and the
+// fields used by the message type) into fc.Buf. If dotu is true,
+// creates 9P2000.u messages. Can be used to forward a message created
+// by Unpack, possibly in a different dialect.
+func PackFcall(fc *Fcall, dotu bool) error {
+	tag := fc.Tag
+	if err := packFcall(fc, fc, fc.Data, dotu); err != nil {
+		return err
+	}
+
+	SetTag(fc, tag)
+	return nil
+}
+
+// Packs the message described by fc into dst. The payload of the
+// Twrite, Rread and Rreaddir messages is data.
+func packFcall(dst, fc *Fcall, data []byte, dotu bool) error {
+	switch fc.Type {
+	default:
+		return &Error{"invalid message id", EINVAL}
+
+	case Tversion:
+		return PackTversion(dst, fc.Msize, fc.Version)
+	case Rversion:
+		return PackRversion(dst, fc.Msize, fc.Version)
+	case Tauth:
+		return PackTauth(dst, fc.Afid, fc.Uname, fc.Aname, fc.Unamenum, dotu)
+	case Rauth:
+		return PackRauth(dst, &fc.Qid)
+	case Tattach:
+		return PackTattach(dst, fc.Fid, fc.Afid, fc.Uname, fc.Aname, fc.Unamenum, dotu)
+	case Rattach:
+		return PackRattach(dst, &fc.Qid)
+	case Rerror:
+		return PackRerror(dst, fc.Error, fc.Errornum, dotu)
+	case Tflush:
+		return PackTflush(dst, fc.Oldtag)
+	case Rflush:
+		return PackRflush(dst)
+	case Twalk:
+		return PackTwalk(dst, fc.Fid, fc.Newfid, fc.Wname)
+	case Rwalk:
+		return PackRwalk(dst, fc.Wqid)
+	case Topen:
+		return PackTopen(dst, fc.Fid, fc.Mode)
+	case Ropen:
+		return PackRopen(dst, &fc.Qid, fc.Iounit)
+	case Tcreate:
+		return PackTcreate(dst, fc.Fid, fc.Name, fc.Perm, fc.Mode, fc.Ext, dotu)
+	case Rcreate:
+		return PackRcreate(dst, &fc.Qid, fc.Iounit)
+	case Tread:
+		return PackTread(dst, fc.Fid, fc.Offset, fc.Count)
+	case Rread:
+		return PackRread(dst, data)
+	case Twrite:
+		return PackTwrite(dst, fc.Fid, fc.Offset, uint32(len(data)), data)
+	case Rwrite:
+		return PackRwrite(dst, fc.Count)
+	case Tclunk:
+		return PackTclunk(dst, fc.Fid)
+	case Rclunk:
+		return PackRclunk(dst)
+	case Tremove:
+		return PackTremove(dst, fc.Fid)
+	case Rremove:
+		return PackRremove(dst)
+	case Tstat:
+		return PackTstat(dst, fc.Fid)
+	case Rstat:
+		return PackRstat(dst, &fc.Dir, dotu)
+	case Twstat:
+		return PackTwstat(dst, fc.Fid, &fc.Dir, dotu)
+	case Rwstat:
+		return PackRwstat(dst)
+
+	/* 9P2000.L messages */
+	case Rlerror:
+		return PackRlerror(dst, fc.Errornum)
+	case Tstatfs:
+		return PackTstatfs(dst, fc.Fid)
+	case Rstatfs:
+		return PackRstatfs(dst, &fc.Statfs)
+	case Tlopen:
+		return PackTlopen(dst, fc.Fid, fc.Flags)
+	case Rlopen:
+		return PackRlopen(dst, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		return PackTlcreate(dst, fc.Fid, fc.Name, fc.Flags, fc.Perm, fc.Ngid)
+	case Rlcreate:
+		return PackRlcreate(dst, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		return PackTsymlink(dst, fc.Fid, fc.Name, fc.Target, fc.Ngid)
+	case Rsymlink:
+		return PackRsymlink(dst, &fc.Qid)
+	case Tmknod:
+		return PackTmknod(dst, fc.Fid, fc.Name, fc.Perm, fc.Major, fc.Minor, fc.Ngid)
+	case Rmknod:
+		return PackRmknod(dst, &fc.Qid)
+	case Trename:
+		return PackTrename(dst, fc.Fid, fc.Dfid, fc.Name)
+	case Rrename:
+		return PackRrename(dst)
+	case Treadlink:
+		return PackTreadlink(dst, fc.Fid)
+	case Rreadlink:
+		return PackRreadlink(dst, fc.Target)
+	case Tgetattr:
+		return PackTgetattr(dst, fc.Fid, fc.Mask)
+	case Rgetattr:
+		return PackRgetattr(dst, &fc.Attr)
+	case Tsetattr:
+		return PackTsetattr(dst, fc.Fid, &fc.Setattr)
+	case Rsetattr:
+		return PackRsetattr(dst)
+	case Txattrwalk:
+		return PackTxattrwalk(dst, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		return PackRxattrwalk(dst, fc.Xattrsize)
+	case Txattrcreate:
+		return PackTxattrcreate(dst, fc.Fid, fc.Name, fc.Xattrsize, fc.Flags)
+	case Rxattrcreate:
+		return PackRxattrcreate(dst)
+	case Treaddir:
+		return PackTreaddir(dst, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		return PackRreaddir(dst, data)
+	case Tfsync:
+		return PackTfsync(dst, fc.Fid, fc.Datasync)
+	case Rfsync:
+		return PackRfsync(dst)
+	case Tlock:
+		return PackTlock(dst, fc.Fid, &fc.Flock)
+	case Rlock:
+		return PackRlock(dst, fc.Status)
+	case Tgetlock:
+		return PackTgetlock(dst, fc.Fid, &fc.Flock)
+	case Rgetlock:
+		return PackRgetlock(dst, &fc.Flock)
+	case Tlink:
+		return PackTlink(dst, fc.Dfid, fc.Fid, fc.Name)
+	case Rlink:
+		return PackRlink(dst)
+	case Tmkdir:
+		return PackTmkdir(dst, fc.Fid, fc.Name, fc.Perm, fc.Ngid)
+	case Rmkdir:
+		return PackRmkdir(dst, &fc.Qid)
+	case Trenameat:
+		return PackTrenameat(dst, fc.Fid, fc.Name, fc.Dfid, fc.Newname)
+	case Rrenameat:
+		return PackRrenameat(dst)
+	case Tunlinkat:
+		return PackTunlinkat(dst, fc.Fid, fc.Name, fc.Flags)
+	case Runlinkat:
+		return PackRunlinkat(dst)
+	}
+}
+
+// An Encoder writes 9P messages without building them in a buffer of
+// the message size. The fixed part of the message is packed into a
+// small buffer kept by the Encoder, and the payload of the Twrite,
+// Rread and Rreaddir messages is written directly from the Data field
+// of the Fcall. An Encoder shouldn't be used by multiple goroutines
+// at the same time.
+type Encoder struct {
+	Dotu bool // if true, creates 9P2000.u messages
+
+	hdr  Fcall
+	bufs [2][]byte
+	vec  net.Buffers
+}
+
+// Packs the message described by the fields of fc (Type, Tag and the
+// fields used by the message type) and returns it as a set of buffers
+// that can be written with a single writev. The buffers are valid
+// until the next call to the Encoder.
+func (enc *Encoder) Buffers(fc *Fcall) (net.Buffers, error) {
+	var data []byte
+
+	switch fc.Type {
+	case Twrite, Rread, Rreaddir:
+		data = fc.Data
+	}
+
+	hdr := &enc.hdr
+	if err := packFcall(hdr, fc, nil, enc.Dotu); err != nil {
+		return nil, err
+	}
+
+	SetTag(hdr, fc.Tag)
+	enc.bufs[0] = hdr.Pkt
+	if data == nil {
+		return enc.bufs[0:1], nil
+	}
+
+	// the count is the last field before the payload
+	hdr.Size += uint32(len(data))
+	pint32(hdr.Size, hdr.Pkt)
+	pint32(uint32(len(data)), hdr.Pkt[len(hdr.Pkt)-4:])
+	enc.bufs[1] = data
+	return enc.bufs[0:2], nil
+}
+
+// Writes the message described by fc to w.
+func (enc *Encoder) Encode(w io.Writer, fc *Fcall) error {
+	bufs, err := enc.Buffers(fc)
+	if err != nil {
+		return err
+	}
+
+	enc.vec = bufs
+	_, err = enc.vec.WriteTo(w)
+	enc.vec = nil
+	return err
+}
@@ -87,9 +87,8 @@ func PackRwalk(fc *Fcall, wqids []Qid) error {
 	}
 
 	p = pint16(uint16(nwqid), p)
-	fc.Wqid = make([]Qid, nwqid)
+	fc.Wqid = append(fc.Wqid[0:0], wqids...)
 	for i := 0; i < nwqid; i++ {
-		fc.Wqid[i] = wqids[i]
 		p = pqid(&wqids[i], p)
 	}
 
@@ -0,0 +1,250 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+// Create a Rlerror message in the specified Fcall. The 9P2000.L
+// error contains only the Linux errno value.
+func PackRlerror(fc *Fcall, errornum uint32) error {
+	p, err := packCommon(fc, 4, Rlerror) /* ecode[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Errornum = errornum
+	p = pint32(errornum, p)
+	return nil
+}
+
+// Create a Rstatfs message in the specified Fcall.
+func PackRstatfs(fc *Fcall, st *Statfs) error {
+	size := 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 4 /* type[4] bsize[4] blocks[8] bfree[8] bavail[8] files[8] ffree[8] fsid[8] namelen[4] */
+	p, err := packCommon(fc, size, Rstatfs)
+	if err != nil {
+		return err
+	}
+
+	fc.Statfs = *st
+	p = pint32(st.Type, p)
+	p = pint32(st.Bsize, p)
+	p = pint64(st.Blocks, p)
+	p = pint64(st.Bfree, p)
+	p = pint64(st.Bavail, p)
+	p = pint64(st.Files, p)
+	p = pint64(st.Ffree, p)
+	p = pint64(st.Fsid, p)
+	p = pint32(st.Namelen, p)
+	return nil
+}
+
+// Create a Rlopen message in the specified Fcall.
+func PackRlopen(fc *Fcall, qid *Qid, iounit uint32) error {
+	p, err := packCommon(fc, 13+4, Rlopen) /* qid[13] iounit[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+// Create a Rlcreate message in the specified Fcall.
+func PackRlcreate(fc *Fcall, qid *Qid, iounit uint32) error {
+	p, err := packCommon(fc, 13+4, Rlcreate) /* qid[13] iounit[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	fc.Iounit = iounit
+	p = pqid(qid, p)
+	p = pint32(iounit, p)
+	return nil
+}
+
+func packRqid(fc *Fcall, qid *Qid, id uint8) error {
+	p, err := packCommon(fc, 13, id) /* qid[13] */
+	if err != nil {
+		return err
+	}
+
+	fc.Qid = *qid
+	p = pqid(qid, p)
+	return nil
+}
+
+// Create a Rsymlink message in the specified Fcall.
+func PackRsymlink(fc *Fcall, qid *Qid) error {
+	return packRqid(fc, qid, Rsymlink)
+}
+
+// Create a Rmknod message in the specified Fcall.
+func PackRmknod(fc *Fcall, qid *Qid) error {
+	return packRqid(fc, qid, Rmknod)
+}
+
+// Create a Rmkdir message in the specified Fcall.
+func PackRmkdir(fc *Fcall, qid *Qid) error {
+	return packRqid(fc, qid, Rmkdir)
+}
+
+// Create a Rrename message in the specified Fcall.
+func PackRrename(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrename)
+	return err
+}
+
+// Create a Rreadlink message in the specified Fcall.
+func PackRreadlink(fc *Fcall, target string) error {
+	p, err := packCommon(fc, 2+len(target), Rreadlink) /* target[s] */
+	if err != nil {
+		return err
+	}
+
+	fc.Target = target
+	p = pstr(target, p)
+	return nil
+}
+
+// Create a Rgetattr message in the specified Fcall.
+func PackRgetattr(fc *Fcall, attr *Attr) error {
+	size := 8 + 13 + 4 + 4 + 4 + 8*15 /* valid[8] qid[13] mode[4] uid[4] gid[4] ... data_version[8] */
+	p, err := packCommon(fc, size, Rgetattr)
+	if err != nil {
+		return err
+	}
+
+	fc.Attr = *attr
+	p = pint64(attr.Valid, p)
+	p = pqid(&attr.Qid, p)
+	p = pint32(attr.Mode, p)
+	p = pint32(attr.Uid, p)
+	p = pint32(attr.Gid, p)
+	p = pint64(attr.Nlink, p)
+	p = pint64(attr.Rdev, p)
+	p = pint64(attr.Size, p)
+	p = pint64(attr.Blksize, p)
+	p = pint64(attr.Blocks, p)
+	p = pint64(attr.Atime, p)
+	p = pint64(attr.AtimeNsec, p)
+	p = pint64(attr.Mtime, p)
+	p = pint64(attr.MtimeNsec, p)
+	p = pint64(attr.Ctime, p)
+	p = pint64(attr.CtimeNsec, p)
+	p = pint64(attr.Btime, p)
+	p = pint64(attr.BtimeNsec, p)
+	p = pint64(attr.Gen, p)
+	p = pint64(attr.DataVersion, p)
+	return nil
+}
+
+// Create a Rsetattr message in the specified Fcall.
+func PackRsetattr(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rsetattr)
+	return err
+}
+
+// Create a Rxattrwalk message in the specified Fcall.
+func PackRxattrwalk(fc *Fcall, size uint64) error {
+	p, err := packCommon(fc, 8, Rxattrwalk) /* size[8] */
+	if err != nil {
+		return err
+	}
+
+	fc.Xattrsize = size
+	p = pint64(size, p)
+	return nil
+}
+
+// Create a Rxattrcreate message in the specified Fcall.
+func PackRxattrcreate(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rxattrcreate)
+	return err
+}
+
+// Initializes the specified Fcall value to contain Rreaddir message.
+// The user should pack the directory entries (see PackDirent) in the
+// slice pointed by fc.Data and call SetRreadCount to update the data
+// size to the actual value.
+func InitRreaddir(fc *Fcall, count uint32) error {
+	size := int(4 + count) /* count[4] data[count] */
+	p, err := packCommon(fc, size, Rreaddir)
+	if err != nil {
+		return err
+	}
+
+	fc.Count = count
+	fc.Data = p[4 : fc.Count+4]
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Rreaddir message in the specified Fcall. The data should
+// contain whole directory entries.
+func PackRreaddir(fc *Fcall, data []byte) error {
+	err := InitRreaddir(fc, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	copy(fc.Data, data)
+	return nil
+}
+
+// Create a Rfsync message in the specified Fcall.
+func PackRfsync(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rfsync)
+	return err
+}
+
+// Create a Rlock message in the specified Fcall.
+func PackRlock(fc *Fcall, status uint8) error {
+	p, err := packCommon(fc, 1, Rlock) /* status[1] */
+	if err != nil {
+		return err
+	}
+
+	fc.Status = status
+	p = pint8(status, p)
+	return nil
+}
+
+// Create a Rgetlock message in the specified Fcall.
+func PackRgetlock(fc *Fcall, lock *Flock) error {
+	size := 1 + 8 + 8 + 4 + 2 + len(lock.ClientId) /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Rgetlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Flock = *lock
+	fc.Flock.Flags = 0
+	p = pint8(lock.Type, p)
+	p = pint64(lock.Start, p)
+	p = pint64(lock.Length, p)
+	p = pint32(lock.ProcId, p)
+	p = pstr(lock.ClientId, p)
+	return nil
+}
+
+// Create a Rlink message in the specified Fcall.
+func PackRlink(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rlink)
+	return err
+}
+
+// Create a Rrenameat message in the specified Fcall.
+func PackRrenameat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Rrenameat)
+	return err
+}
+
+// Create a Runlinkat message in the specified Fcall.
+func PackRunlinkat(fc *Fcall) error {
+	_, err := packCommon(fc, 0, Runlinkat)
+	return err
+}
@@ -106,9 +106,8 @@ func PackTwalk(fc *Fcall, fid uint32, newfid uint32, wnames []string) error {
 	p = pint32(fid, p)
 	p = pint32(newfid, p)
 	p = pint16(uint16(nwname), p)
-	fc.Wname = make([]string, nwname)
+	fc.Wname = append(fc.Wname[0:0], wnames...)
 	for i := 0; i < nwname; i++ {
-		fc.Wname[i] = wnames[i]
 		p = pstr(wnames[i], p)
 	}
 
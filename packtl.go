@@ -0,0 +1,345 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+// Create a Tstatfs message in the specified Fcall.
+func PackTstatfs(fc *Fcall, fid uint32) error {
+	p, err := packCommon(fc, 4, Tstatfs) /* fid[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	p = pint32(fid, p)
+	return nil
+}
+
+// Create a Tlopen message in the specified Fcall. The flags are
+// the Linux open(2) flags.
+func PackTlopen(fc *Fcall, fid uint32, flags uint32) error {
+	p, err := packCommon(fc, 4+4, Tlopen) /* fid[4] flags[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flags = flags
+	p = pint32(fid, p)
+	p = pint32(flags, p)
+	return nil
+}
+
+// Create a Tlcreate message in the specified Fcall.
+func PackTlcreate(fc *Fcall, fid uint32, name string, flags uint32, mode uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 + 4 /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	p, err := packCommon(fc, size, Tlcreate)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Flags = flags
+	fc.Perm = mode
+	fc.Ngid = gid
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pint32(flags, p)
+	p = pint32(mode, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Tsymlink message in the specified Fcall.
+func PackTsymlink(fc *Fcall, fid uint32, name string, target string, gid uint32) error {
+	size := 4 + 2 + len(name) + 2 + len(target) + 4 /* fid[4] name[s] symtgt[s] gid[4] */
+	p, err := packCommon(fc, size, Tsymlink)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Target = target
+	fc.Ngid = gid
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pstr(target, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Tmknod message in the specified Fcall.
+func PackTmknod(fc *Fcall, dfid uint32, name string, mode uint32, major uint32, minor uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 + 4 + 4 /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	p, err := packCommon(fc, size, Tmknod)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dfid
+	fc.Name = name
+	fc.Perm = mode
+	fc.Major = major
+	fc.Minor = minor
+	fc.Ngid = gid
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	p = pint32(mode, p)
+	p = pint32(major, p)
+	p = pint32(minor, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Trename message in the specified Fcall.
+func PackTrename(fc *Fcall, fid uint32, dfid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* fid[4] dfid[4] name[s] */
+	p, err := packCommon(fc, size, Trename)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Dfid = dfid
+	fc.Name = name
+	p = pint32(fid, p)
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Treadlink message in the specified Fcall.
+func PackTreadlink(fc *Fcall, fid uint32) error {
+	p, err := packCommon(fc, 4, Treadlink) /* fid[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	p = pint32(fid, p)
+	return nil
+}
+
+// Create a Tgetattr message in the specified Fcall. The mask selects
+// the attributes (Getattr* bits) the client is interested in.
+func PackTgetattr(fc *Fcall, fid uint32, mask uint64) error {
+	p, err := packCommon(fc, 4+8, Tgetattr) /* fid[4] request_mask[8] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Mask = mask
+	p = pint32(fid, p)
+	p = pint64(mask, p)
+	return nil
+}
+
+// Create a Tsetattr message in the specified Fcall.
+func PackTsetattr(fc *Fcall, fid uint32, attr *SetAttr) error {
+	size := 4 + 4 + 4 + 4 + 4 + 8 + 8 + 8 + 8 + 8 /* fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime[16] mtime[16] */
+	p, err := packCommon(fc, size, Tsetattr)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Setattr = *attr
+	p = pint32(fid, p)
+	p = pint32(attr.Valid, p)
+	p = pint32(attr.Mode, p)
+	p = pint32(attr.Uid, p)
+	p = pint32(attr.Gid, p)
+	p = pint64(attr.Size, p)
+	p = pint64(attr.Atime, p)
+	p = pint64(attr.AtimeNsec, p)
+	p = pint64(attr.Mtime, p)
+	p = pint64(attr.MtimeNsec, p)
+	return nil
+}
+
+// Create a Txattrwalk message in the specified Fcall. If name is
+// empty, the newfid can be used to read the list of attributes.
+func PackTxattrwalk(fc *Fcall, fid uint32, newfid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* fid[4] newfid[4] name[s] */
+	p, err := packCommon(fc, size, Txattrwalk)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Newfid = newfid
+	fc.Name = name
+	p = pint32(fid, p)
+	p = pint32(newfid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Txattrcreate message in the specified Fcall.
+func PackTxattrcreate(fc *Fcall, fid uint32, name string, size uint64, flags uint32) error {
+	sz := 4 + 2 + len(name) + 8 + 4 /* fid[4] name[s] attr_size[8] flags[4] */
+	p, err := packCommon(fc, sz, Txattrcreate)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Name = name
+	fc.Xattrsize = size
+	fc.Flags = flags
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	p = pint64(size, p)
+	p = pint32(flags, p)
+	return nil
+}
+
+// Create a Treaddir message in the specified Fcall. The offset is
+// either 0 or the Offset of the last Dirent returned by the server.
+func PackTreaddir(fc *Fcall, fid uint32, offset uint64, count uint32) error {
+	size := 4 + 8 + 4 /* fid[4] offset[8] count[4] */
+	p, err := packCommon(fc, size, Treaddir)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Offset = offset
+	fc.Count = count
+	p = pint32(fid, p)
+	p = pint64(offset, p)
+	p = pint32(count, p)
+	return nil
+}
+
+// Create a Tfsync message in the specified Fcall.
+func PackTfsync(fc *Fcall, fid uint32, datasync uint32) error {
+	p, err := packCommon(fc, 4+4, Tfsync) /* fid[4] datasync[4] */
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Datasync = datasync
+	p = pint32(fid, p)
+	p = pint32(datasync, p)
+	return nil
+}
+
+// Create a Tlock message in the specified Fcall.
+func PackTlock(fc *Fcall, fid uint32, lock *Flock) error {
+	size := 4 + 1 + 4 + 8 + 8 + 4 + 2 + len(lock.ClientId) /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Tlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flock = *lock
+	p = pint32(fid, p)
+	p = pint8(lock.Type, p)
+	p = pint32(lock.Flags, p)
+	p = pint64(lock.Start, p)
+	p = pint64(lock.Length, p)
+	p = pint32(lock.ProcId, p)
+	p = pstr(lock.ClientId, p)
+	return nil
+}
+
+// Create a Tgetlock message in the specified Fcall. The Flags field
+// of the lock is ignored.
+func PackTgetlock(fc *Fcall, fid uint32, lock *Flock) error {
+	size := 4 + 1 + 8 + 8 + 4 + 2 + len(lock.ClientId) /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	p, err := packCommon(fc, size, Tgetlock)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = fid
+	fc.Flock = *lock
+	fc.Flock.Flags = 0
+	p = pint32(fid, p)
+	p = pint8(lock.Type, p)
+	p = pint64(lock.Start, p)
+	p = pint64(lock.Length, p)
+	p = pint32(lock.ProcId, p)
+	p = pstr(lock.ClientId, p)
+	return nil
+}
+
+// Create a Tlink message in the specified Fcall. A new link to the
+// file associated with fid is created in the directory dfid.
+func PackTlink(fc *Fcall, dfid uint32, fid uint32, name string) error {
+	size := 4 + 4 + 2 + len(name) /* dfid[4] fid[4] name[s] */
+	p, err := packCommon(fc, size, Tlink)
+	if err != nil {
+		return err
+	}
+
+	fc.Dfid = dfid
+	fc.Fid = fid
+	fc.Name = name
+	p = pint32(dfid, p)
+	p = pint32(fid, p)
+	p = pstr(name, p)
+	return nil
+}
+
+// Create a Tmkdir message in the specified Fcall.
+func PackTmkdir(fc *Fcall, dfid uint32, name string, mode uint32, gid uint32) error {
+	size := 4 + 2 + len(name) + 4 + 4 /* dfid[4] name[s] mode[4] gid[4] */
+	p, err := packCommon(fc, size, Tmkdir)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dfid
+	fc.Name = name
+	fc.Perm = mode
+	fc.Ngid = gid
+	p = pint32(dfid, p)
+	p = pstr(name, p)
+	p = pint32(mode, p)
+	p = pint32(gid, p)
+	return nil
+}
+
+// Create a Trenameat message in the specified Fcall.
+func PackTrenameat(fc *Fcall, olddirfid uint32, oldname string, newdirfid uint32, newname string) error {
+	size := 4 + 2 + len(oldname) + 4 + 2 + len(newname) /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	p, err := packCommon(fc, size, Trenameat)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = olddirfid
+	fc.Name = oldname
+	fc.Dfid = newdirfid
+	fc.Newname = newname
+	p = pint32(olddirfid, p)
+	p = pstr(oldname, p)
+	p = pint32(newdirfid, p)
+	p = pstr(newname, p)
+	return nil
+}
+
+// Create a Tunlinkat message in the specified Fcall.
+func PackTunlinkat(fc *Fcall, dirfid uint32, name string, flags uint32) error {
+	size := 4 + 2 + len(name) + 4 /* dirfd[4] name[s] flags[4] */
+	p, err := packCommon(fc, size, Tunlinkat)
+	if err != nil {
+		return err
+	}
+
+	fc.Fid = dirfid
+	fc.Name = name
+	fc.Flags = flags
+	p = pint32(dirfid, p)
+	p = pstr(name, p)
+	p = pint32(flags, p)
+	return nil
+}
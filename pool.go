@@ -0,0 +1,183 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ninep
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// The buffers for the messages are kept in pools shared by all
+// servers and clients. The buffers are grouped in size classes
+// (powers of two), each class keeps a limited number of free
+// buffers.
+const (
+	minBufShift = 9       // the smallest pooled buffer is 512 bytes
+	maxBufShift = 24      // the largest pooled buffer is 16 MiB
+	maxPoolSize = 8 << 20 // maximum size of the free buffers of a class
+	maxPoolBufs = 64      // maximum number of free buffers of a class
+	readahead   = 8192    // size of the MsgReader read-ahead buffer
+)
+
+var bufpool [maxBufShift - minBufShift + 1]chan []byte
+
+// Free Fcall values
+var fcpool = sync.Pool{New: func() interface{} { return new(Fcall) }}
+
+func init() {
+	for i := range bufpool {
+		n := maxPoolSize >> uint(minBufShift+i)
+		if n > maxPoolBufs {
+			n = maxPoolBufs
+		}
+
+		bufpool[i] = make(chan []byte, n)
+	}
+}
+
+// Returns the size class of a buffer of sz bytes.
+func bufClass(sz int) int {
+	if sz <= 1<<minBufShift {
+		return 0
+	}
+
+	return bits.Len(uint(sz-1)) - minBufShift
+}
+
+// Returns a buffer of sz bytes. The buffer is taken from the pool
+// if there is a free one in the size class, and should be returned
+// with PutBuf when it isn't used anymore.
+func GetBuf(sz int) []byte {
+	c := bufClass(sz)
+	if c >= len(bufpool) {
+		return make([]byte, sz)
+	}
+
+	select {
+	case b := <-bufpool[c]:
+		return b[0:sz]
+	default:
+		return make([]byte, sz, 1<<uint(minBufShift+c))
+	}
+}
+
+// Returns the buffer to the pool. Buffers that don't match any of the
+// size classes are dropped. The buffer shouldn't be used after that.
+func PutBuf(b []byte) {
+	c := bufClass(cap(b))
+	if c >= len(bufpool) || cap(b) != 1<<uint(minBufShift+c) {
+		return
+	}
+
+	select {
+	case bufpool[c] <- b[0:cap(b)]:
+	default:
+	}
+}
+
+// Returns the Fcall and its buffers to the pool. The Fcall, and the
+// slices pointing to its raw data (Pkt, Data), shouldn't be used
+// after that.
+func PutFcall(fc *Fcall) {
+	switch {
+	case fc.pooled:
+		PutBuf(fc.Buf)
+
+	case fc.Buf == nil && fc.Pkt != nil:
+		// unpacked from a buffer returned by MsgReader
+		PutBuf(fc.Pkt)
+	}
+
+	*fc = Fcall{strs: fc.strs}
+	fcpool.Put(fc)
+}
+
+// A MsgReader reads 9P messages from a connection. Every message is
+// returned in its own buffer from the pool. The reader uses a buffer
+// only while it has data read ahead, so idle connections don't hold
+// any memory.
+type MsgReader struct {
+	r   io.Reader
+	buf []byte // data read ahead is buf[pos:end]
+	pos int
+	end int
+	hdr [4]byte
+}
+
+// Creates a MsgReader that reads the messages from r.
+func NewMsgReader(r io.Reader) *MsgReader {
+	return &MsgReader{r: r}
+}
+
+// Reads the next message. Returns a buffer from the pool with the
+// message at its beginning, it should be returned with PutBuf (or
+// PutFcall on the unpacked message) when it's not used anymore.
+// Messages larger than msize are refused.
+func (m *MsgReader) Read(msize uint32) ([]byte, error) {
+	if err := m.fill(4); err != nil {
+		return nil, err
+	}
+
+	sz, _ := gint32(m.buf[m.pos:])
+	if sz < 7 || sz > msize {
+		return nil, &Error{fmt.Sprintf("bad message size: %d", sz), EINVAL}
+	}
+
+	msg := GetBuf(int(sz))
+	if int(sz) <= len(m.buf) {
+		if err := m.fill(int(sz)); err != nil {
+			PutBuf(msg)
+			return nil, err
+		}
+
+		m.pos += copy(msg, m.buf[m.pos:m.pos+int(sz)])
+	} else {
+		// large message, read the rest directly into its buffer
+		n := copy(msg, m.buf[m.pos:m.end])
+		m.pos += n
+		if _, err := io.ReadFull(m.r, msg[n:]); err != nil {
+			PutBuf(msg)
+			return nil, err
+		}
+	}
+
+	if m.pos == m.end {
+		PutBuf(m.buf)
+		m.buf = nil
+		m.pos = 0
+		m.end = 0
+	}
+
+	return msg, nil
+}
+
+// Makes sure there are at least n bytes read ahead.
+func (m *MsgReader) fill(n int) error {
+	if m.end-m.pos >= n {
+		return nil
+	}
+
+	if m.buf == nil {
+		// wait for the next message without holding a buffer
+		if _, err := io.ReadFull(m.r, m.hdr[:]); err != nil {
+			return err
+		}
+
+		m.buf = GetBuf(readahead)
+		m.end = copy(m.buf, m.hdr[:])
+		if m.end >= n {
+			return nil
+		}
+	} else if m.pos > 0 {
+		m.end = copy(m.buf, m.buf[m.pos:m.end])
+		m.pos = 0
+	}
+
+	k, err := io.ReadAtLeast(m.r, m.buf[m.end:], n-m.end)
+	m.end += k
+	return err
+}
@@ -5,10 +5,14 @@
 package srv
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/lionkov/ninep"
 	"log"
+	"log/slog"
 	"net"
+	"time"
 )
 
 func (srv *Srv) NewConn(c net.Conn) {
@@ -22,9 +26,20 @@ func (srv *Srv) NewConn(c net.Conn) {
 	conn.Reqs = make(map[uint16]*Req)
 	conn.Reqout = make(chan *Req, srv.Maxpend)
 	conn.done = make(chan bool)
-	conn.rchan = make(chan *ninep.Fcall, 64)
+	conn.forced = make(chan bool)
+	conn.closed = make(chan bool)
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	if srv.Maxreqs > 0 {
+		conn.slots = make(chan bool, srv.Maxreqs)
+	}
 
 	srv.Lock()
+	if srv.shutdown {
+		srv.Unlock()
+		c.Close()
+		return
+	}
+
 	if srv.conns == nil {
 		srv.conns = make(map[*Conn]*Conn)
 	}
@@ -32,6 +47,10 @@ func (srv *Srv) NewConn(c net.Conn) {
 	srv.Unlock()
 
 	conn.Id = c.RemoteAddr().String()
+	if srv.Slog != nil {
+		conn.Slog = srv.Slog.With("conn", conn.Id, "remote", c.RemoteAddr().String())
+	}
+
 	if op, ok := (conn.Srv.ops).(ConnOps); ok {
 		op.ConnOpened(conn)
 	}
@@ -44,8 +63,24 @@ func (srv *Srv) NewConn(c net.Conn) {
 	go conn.send()
 }
 
+// Waits until all requests read from the connection are responded
+// (unless forced), and closes the connection. The requests are only
+// drained after stop, if the peer is gone the connection is forced.
 func (conn *Conn) close() {
-	conn.done <- true
+	drained := make(chan bool)
+	go func() {
+		conn.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-conn.forced:
+	}
+
+	close(conn.done)
+	conn.cancel()
+	conn.conn.Close()
 	conn.Srv.Lock()
 	delete(conn.Srv.conns, conn)
 	conn.Srv.Unlock()
@@ -58,74 +93,117 @@ func (conn *Conn) close() {
 	}
 
 	/* call FidDestroy for all remaining fids */
-	if op, ok := (conn.Srv.ops).(FidOps); ok {
-		for _, fid := range conn.Fidpool {
+	aop := conn.Srv.authOps()
+	op, ok := (conn.Srv.ops).(FidOps)
+	for _, fid := range conn.Fidpool {
+		// the authentication state isn't the file server's
+		if aop != nil && (fid.Type&ninep.QTAUTH) != 0 {
+			aop.AuthDestroy(fid)
+		}
+
+		if ok {
 			op.FidDestroy(fid)
 		}
 	}
+
+	close(conn.closed)
 }
 
-func (conn *Conn) recv() {
-	var err error
-	var n int
+// Called when the response to the request is sent, or dropped.
+// Returns the buffers of the request to the pool.
+func (conn *Conn) reqDone(req *Req) {
+	ninep.PutFcall(req.Tc)
+	ninep.PutFcall(req.Rc)
+	if req.slot {
+		<-conn.slots
+	}
+
+	conn.inflight.Done()
+}
 
-	buf := make([]byte, conn.Msize*8)
-	pos := 0
+// Stops reading new requests from the connection. The connection
+// is closed once the in-flight requests are responded.
+func (conn *Conn) stop() {
+	conn.Lock()
+	conn.stopped = true
+	conn.Unlock()
+	if conn.conn.SetReadDeadline(time.Now()) != nil {
+		conn.force()
+	}
+}
+
+// Closes the connection without waiting for the in-flight requests.
+func (conn *Conn) force() {
+	conn.Lock()
+	select {
+	case <-conn.forced:
+	default:
+		close(conn.forced)
+	}
+	conn.Unlock()
+	conn.cancel()
+	conn.conn.Close()
+}
+
+func (conn *Conn) recv() {
+	mr := ninep.NewMsgReader(conn.conn)
 	for {
-		if len(buf) < int(conn.Msize) {
-			b := make([]byte, conn.Msize*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
-		}
+		buf, err := mr.Read(conn.Msize)
+		if err != nil {
+			conn.Lock()
+			stopped := conn.stopped
+			conn.Unlock()
+			if _, ok := err.(*ninep.Error); ok {
+				conn.warn("bad client connection", "error", err)
+				conn.conn.Close()
+			}
+
+			if !stopped {
+				// the peer is gone, nobody is waiting for the
+				// responses anymore
+				conn.force()
+			}
 
-		n, err = conn.conn.Read(buf[pos:])
-		if err != nil || n == 0 {
 			conn.close()
 			return
 		}
 
-		pos += n
-		for pos > 4 {
-			sz, _ := ninep.Gint32(buf)
-			if sz > conn.Msize {
-				log.Println("bad client connection: ", conn.conn.RemoteAddr())
-				conn.conn.Close()
-				conn.close()
-				return
-			}
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, conn.Msize*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
+		fc, err, _ := ninep.Unpack(buf, conn.Dotu || conn.Dotl)
+		if err != nil {
+			conn.warn("invalid packet", "error", err, "packet", hex.EncodeToString(buf))
+			ninep.PutBuf(buf)
+			conn.force()
+			conn.close()
+			return
+		}
 
-				break
-			}
-			fc, err, fcsize := ninep.Unpack(buf, conn.Dotu)
-			if err != nil {
-				log.Println(fmt.Sprintf("invalid packet : %v %v", err, buf))
-				conn.conn.Close()
+		// Wait for a free slot before accepting the request, so the
+		// client can't make us buffer more. Tflush and Tversion
+		// don't need one, they don't block.
+		slot := conn.slots != nil && fc.Type != ninep.Tflush && fc.Type != ninep.Tversion
+		if slot {
+			select {
+			case conn.slots <- true:
+			case <-conn.forced:
 				conn.close()
 				return
 			}
+		}
 
-			tag := fc.Tag
-			req := new(Req)
-			select {
-			case req.Rc = <-conn.rchan:
-				break
-			default:
-				req.Rc = ninep.NewFcall(conn.Msize)
-			}
-
-			req.Conn = conn
-			req.Tc = fc
-			//			req.Rc = rc
-			if conn.Debuglevel > 0 {
-				conn.logFcall(req.Tc)
+		tag := fc.Tag
+		req := new(Req)
+		req.slot = slot
+		req.Conn = conn
+		req.Tc = fc
+		req.Rc = ninep.NewFcall(0)
+		req.start = time.Now()
+		req.ctx, req.cancel = context.WithCancel(conn.ctx)
+		conn.inflight.Add(1)
+		if conn.Debuglevel > 0 {
+			conn.logFcall(req.Tc)
+			if conn.Slog != nil {
+				conn.slogFcall("received", req, req.Tc)
+			} else {
 				if conn.Debuglevel&DbgPrintPackets != 0 {
 					log.Println(">->", conn.Id, fmt.Sprint(req.Tc.Pkt))
 				}
@@ -134,36 +212,46 @@ func (conn *Conn) recv() {
 					log.Println(">>>", conn.Id, req.Tc.String())
 				}
 			}
+		}
 
-			conn.Lock()
-			conn.nreqs++
-			conn.tsz += uint64(fc.Size)
-			conn.npend++
-			if conn.npend > conn.maxpend {
-				conn.maxpend = conn.npend
-			}
+		conn.Lock()
+		conn.nreqs++
+		conn.tsz += uint64(fc.Size)
+		conn.npend++
+		if conn.npend > conn.maxpend {
+			conn.maxpend = conn.npend
+		}
 
-			req.next = conn.Reqs[tag]
-			conn.Reqs[tag] = req
-			process := req.next == nil
-			if req.next != nil {
-				req.next.prev = req
-			}
-			conn.Unlock()
-			if process {
-				// Tversion may change some attributes of the
-				// connection, so we block on it. Otherwise,
-				// we may loop back to reading and that is a race.
-				// This fix brought to you by the race detector.
-				if req.Tc.Type == ninep.Tversion {
-					req.process()
-				} else {
-					go req.process()
+		req.next = conn.Reqs[tag]
+		conn.Reqs[tag] = req
+		process := req.next == nil
+		if req.next != nil {
+			req.next.prev = req
+		}
+		conn.Unlock()
+		if process {
+			// Tversion may change some attributes of the
+			// connection, so we block on it. Otherwise,
+			// we may loop back to reading and that is a race.
+			// This fix brought to you by the race detector.
+			// Tflush is processed right away too, it can't
+			// wait for a worker that may be blocked in the
+			// request it flushes.
+			switch {
+			case req.Tc.Type == ninep.Tversion || req.Tc.Type == ninep.Tflush:
+				req.process()
+
+			case conn.Srv.work != nil:
+				select {
+				case conn.Srv.work <- req:
+				case <-conn.forced:
+					conn.close()
+					return
 				}
-			}
 
-			buf = buf[fcsize:]
-			pos -= fcsize
+			default:
+				go req.process()
+			}
 		}
 	}
 }
@@ -182,12 +270,16 @@ func (conn *Conn) send() {
 			conn.Unlock()
 			if conn.Debuglevel > 0 {
 				conn.logFcall(req.Rc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("<-<", conn.Id, fmt.Sprint(req.Rc.Pkt))
-				}
+				if conn.Slog != nil {
+					conn.slogFcall("sent", req, req.Rc)
+				} else {
+					if conn.Debuglevel&DbgPrintPackets != 0 {
+						log.Println("<-<", conn.Id, fmt.Sprint(req.Rc.Pkt))
+					}
 
-				if conn.Debuglevel&DbgPrintFcalls != 0 {
-					log.Println("<<<", conn.Id, req.Rc.String())
+					if conn.Debuglevel&DbgPrintFcalls != 0 {
+						log.Println("<<<", conn.Id, req.Rc.String())
+					}
 				}
 			}
 
@@ -195,7 +287,7 @@ func (conn *Conn) send() {
 				n, err := conn.conn.Write(buf)
 				if err != nil {
 					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
+					conn.warn("error while writing", "error", err)
 					conn.conn.Close()
 					break
 				}
@@ -203,11 +295,11 @@ func (conn *Conn) send() {
 				buf = buf[n:]
 			}
 
-			select {
-			case conn.rchan <- req.Rc:
-				break
-			default:
+			if m := conn.Srv.Metrics; m != nil {
+				m.Request(req.Tc, req.Rc, time.Since(req.start))
 			}
+
+			conn.reqDone(req)
 		}
 	}
 }
@@ -247,14 +339,171 @@ func (srv *Srv) StartNetListener(ntype, addr string) error {
 // Start listening on the specified network and address for incoming
 // connections. Once a connection is established, create a new Conn
 // value, read messages from the socket, send them to the specified
-// server, and send back responses received from the server.
+// server, and send back responses received from the server. Returns
+// Eclosed after the server is shut down.
 func (srv *Srv) StartListener(l net.Listener) error {
+	srv.Lock()
+	if srv.shutdown {
+		srv.Unlock()
+		l.Close()
+		return Eclosed
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]bool)
+	}
+	srv.listeners[l] = true
+	srv.Unlock()
+
+	defer func() {
+		srv.Lock()
+		delete(srv.listeners, l)
+		srv.Unlock()
+	}()
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			srv.Lock()
+			shutdown := srv.shutdown
+			srv.Unlock()
+			if shutdown {
+				return Eclosed
+			}
+
 			return &ninep.Error{err.Error(), ninep.EIO}
 		}
 
 		srv.NewConn(c)
 	}
 }
+
+// Shutdown gracefully shuts down the server. It closes the listeners,
+// stops reading new requests, waits for the in-flight requests to be
+// responded and closes the connections, calling ConnClosed and
+// FidDestroy as usual, and stops the workers. If ctx is done before
+// that, the remaining connections are closed without waiting and
+// Shutdown returns the error of the context. The server can't be
+// restarted.
+func (srv *Srv) Shutdown(ctx context.Context) error {
+	srv.Lock()
+	srv.shutdown = true
+	for l := range srv.listeners {
+		l.Close()
+	}
+
+	conns := make([]*Conn, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.Unlock()
+
+	for _, conn := range conns {
+		conn.stop()
+	}
+
+	var err error
+	for _, conn := range conns {
+		select {
+		case <-conn.closed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			for _, c := range conns {
+				c.force()
+			}
+
+			<-conn.closed
+		}
+	}
+
+	// stop the workers, and wait for them unless the connections
+	// were forced and some are still in the file server
+	srv.Lock()
+	work := srv.work
+	srv.work = nil
+	srv.Unlock()
+	if work != nil {
+		close(work)
+		stopped := make(chan bool)
+		go func() {
+			srv.workers.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// Close closes the listeners and all connections immediately,
+// without waiting for the in-flight requests. The workers stop once
+// they are done with their requests.
+func (srv *Srv) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Shutdown(ctx)
+	return nil
+}
+
+// Logs a 9P message of the request on the structured logger. The
+// DbgPrintFcalls debug flag enables the records, DbgPrintPackets adds
+// the raw message to them.
+func (conn *Conn) slogFcall(msg string, req *Req, fc *ninep.Fcall) {
+	ctx := context.Background()
+	if conn.Debuglevel&(DbgPrintFcalls|DbgPrintPackets) == 0 || !conn.Slog.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	tc := req.Tc
+	attrs := make([]slog.Attr, 0, 8)
+	attrs = append(attrs, slog.Int("tag", int(tc.Tag)), slog.String("type", ninep.MsgName(fc.Type)))
+	if tc.Fid != ninep.NOFID {
+		attrs = append(attrs, slog.Uint64("fid", uint64(tc.Fid)))
+		if p := conn.fidPath(tc.Fid); p != "" {
+			attrs = append(attrs, slog.String("path", p))
+		}
+	}
+
+	if fc == req.Rc {
+		attrs = append(attrs, slog.Duration("duration", time.Since(req.start)))
+		switch fc.Type {
+		case ninep.Rerror:
+			attrs = append(attrs, slog.String("error", fc.Error), slog.Uint64("errno", uint64(fc.Errornum)))
+		case ninep.Rlerror:
+			attrs = append(attrs, slog.Uint64("errno", uint64(fc.Errornum)))
+		}
+	}
+
+	if conn.Debuglevel&DbgPrintPackets != 0 {
+		attrs = append(attrs, slog.String("packet", hex.EncodeToString(fc.Pkt)))
+	}
+
+	conn.Slog.LogAttrs(ctx, slog.LevelDebug, msg, attrs...)
+}
+
+// Returns the path of the fid, if it exists.
+func (conn *Conn) fidPath(fidno uint32) string {
+	conn.Lock()
+	defer conn.Unlock()
+	if fid, ok := conn.Fidpool[fidno]; ok {
+		return fid.Pathname()
+	}
+
+	return ""
+}
+
+// Logs a problem with the connection. The arguments are key-value
+// pairs as accepted by slog.
+func (conn *Conn) warn(msg string, args ...interface{}) {
+	if conn.Slog != nil {
+		conn.Slog.Warn(msg, args...)
+		return
+	}
+
+	log.Println(append([]interface{}{msg + ":", conn.Id}, args...)...)
+}
@@ -0,0 +1,389 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+// A file server with a single file. Reading it blocks until
+// the release channel is closed, or the request is cancelled.
+type blockFS struct {
+	srv.Srv
+	release    chan bool
+	reading    chan bool
+	connClosed int32
+	fidDestroy int32
+	stubborn   int32 // if set, Read ignores the cancellation
+}
+
+func (b *blockFS) Attach(req *srv.Req) {
+	req.RespondRattach(&ninep.Qid{Type: ninep.QTDIR})
+}
+
+func (b *blockFS) Walk(req *srv.Req) {
+	var wqids []ninep.Qid
+	if len(req.Tc.Wname) > 0 {
+		wqids = append(wqids, ninep.Qid{Path: 1})
+	}
+
+	req.RespondRwalk(wqids)
+}
+
+func (b *blockFS) Open(req *srv.Req) { req.RespondRopen(&ninep.Qid{Path: 1}, 0) }
+
+func (b *blockFS) Read(req *srv.Req) {
+	b.reading <- true
+	select {
+	case <-b.release:
+		req.RespondRread([]byte("done"))
+	case <-req.Context().Done():
+		if atomic.LoadInt32(&b.stubborn) != 0 {
+			<-b.release
+		}
+
+		req.RespondError(srv.Eintr)
+	}
+}
+
+func (b *blockFS) Create(req *srv.Req) { req.RespondError(srv.Eperm) }
+func (b *blockFS) Write(req *srv.Req)  { req.RespondError(srv.Eperm) }
+func (b *blockFS) Clunk(req *srv.Req)  { req.RespondRclunk() }
+func (b *blockFS) Remove(req *srv.Req) { req.RespondError(srv.Eperm) }
+func (b *blockFS) Stat(req *srv.Req)   { req.RespondError(srv.Eperm) }
+func (b *blockFS) Wstat(req *srv.Req)  { req.RespondError(srv.Eperm) }
+
+func (b *blockFS) ConnOpened(conn *srv.Conn) {}
+func (b *blockFS) ConnClosed(conn *srv.Conn) { atomic.AddInt32(&b.connClosed, 1) }
+func (b *blockFS) FidDestroy(fid *srv.Fid)   { atomic.AddInt32(&b.fidDestroy, 1) }
+
+// Starts the server, mounts it and starts reading the file with ctx.
+// Returns after the server got the read request.
+func startBlockFS(t *testing.T, ctx context.Context) (*blockFS, *clnt.Clnt, chan error, chan error) {
+	b := &blockFS{release: make(chan bool), reading: make(chan bool, 1)}
+	b.Id = "block"
+	b.Dotu = true
+	if !b.Start(b) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	lerr := make(chan error, 1)
+	go func() { lerr <- b.StartListener(l) }()
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	f, err := c.FOpen("file", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	rerr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, err := f.ReadAtContext(ctx, buf, 0)
+		if err == nil && string(buf[0:n]) != "done" {
+			err = &ninep.Error{"bad data", ninep.EIO}
+		}
+		rerr <- err
+	}()
+
+	<-b.reading
+	return b, c, rerr, lerr
+}
+
+func TestShutdown(t *testing.T) {
+	b, _, rerr, lerr := startBlockFS(t, context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- b.Shutdown(context.Background()) }()
+
+	if err := <-lerr; err != srv.Eclosed {
+		t.Errorf("StartListener: want Eclosed, got %v", err)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(b.release)
+	if err := <-rerr; err != nil {
+		t.Errorf("Read: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	if b.connClosed != 1 || b.fidDestroy != 2 {
+		t.Errorf("want 1 ConnClosed and 2 FidDestroy calls, got %d and %d", b.connClosed, b.fidDestroy)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b, _, rerr, _ := startBlockFS(t, context.Background())
+
+	// the request is cancelled when the connection is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: want DeadlineExceeded, got %v", err)
+	}
+
+	if err := <-rerr; err == nil {
+		t.Errorf("Read succeeded after the connection was closed")
+	}
+
+	if b.connClosed != 1 {
+		t.Errorf("want 1 ConnClosed call, got %d", b.connClosed)
+	}
+}
+
+func TestFlushCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b, c, rerr, _ := startBlockFS(t, ctx)
+	defer b.Close()
+
+	// the server responds to the flushed read before Rflush
+	cancel()
+	if err, ok := (<-rerr).(*ninep.Error); !ok || err.Errornum != ninep.EINTR {
+		t.Errorf("Read: want EINTR, got %v", err)
+	}
+
+	// the connection still works
+	if _, err := c.FStat("/"); err == nil {
+		t.Errorf("Stat: want an error from blockFS")
+	}
+
+	// a request is cancelled when the client goes away
+	go func() {
+		f, err := c.FOpen("file", ninep.OREAD)
+		if err == nil {
+			f.ReadAt(make([]byte, 16), 0)
+		}
+	}()
+
+	<-b.reading
+	c.Unmount()
+	for i := 0; atomic.LoadInt32(&b.connClosed) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("the connection wasn't closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerGone(t *testing.T) {
+	b, c, _, _ := startBlockFS(t, context.Background())
+	defer b.Close()
+	defer close(b.release)
+
+	// the connection is closed even if a request doesn't
+	// stop when it is cancelled
+	atomic.StoreInt32(&b.stubborn, 1)
+	c.Unmount()
+	for i := 0; atomic.LoadInt32(&b.connClosed) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("the connection wasn't closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&b.fidDestroy); n != 2 {
+		t.Errorf("want 2 FidDestroy calls, got %d", n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, limit := range []string{"Maxreqs", "Workers"} {
+		b := &blockFS{release: make(chan bool), reading: make(chan bool, 10)}
+		b.Id = "block"
+		b.Dotu = true
+		if limit == "Maxreqs" {
+			b.Maxreqs = 2
+		} else {
+			b.Workers = 2
+		}
+
+		if !b.Start(b) {
+			t.Fatalf("Starting the server failed")
+		}
+
+		c1, c2 := net.Pipe()
+		b.NewConn(c1)
+		user := ninep.OsUsers.Uid2User(os.Geteuid())
+		c, err := clnt.MountConn(c2, "/", 8192, user)
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		var files []*clnt.File
+		for i := 0; i < 3; i++ {
+			f, err := c.FOpen("file", ninep.OREAD)
+			if err != nil {
+				t.Fatalf("FOpen: %v", err)
+			}
+
+			files = append(files, f)
+		}
+
+		rerr := make(chan error, 3)
+		for _, f := range files {
+			go func(f *clnt.File) {
+				_, err := f.ReadAt(make([]byte, 16), 0)
+				rerr <- err
+			}(f)
+		}
+
+		// only two reads get to the file server
+		<-b.reading
+		<-b.reading
+		select {
+		case <-b.reading:
+			t.Errorf("%s: a third request is processed", limit)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// once one of them is done, the third one gets in
+		b.release <- true
+		<-b.reading
+		close(b.release)
+		for i := 0; i < 3; i++ {
+			if err := <-rerr; err != nil {
+				t.Errorf("%s: Read: %v", limit, err)
+			}
+		}
+
+		b.Close()
+	}
+}
+
+func TestWorkersStop(t *testing.T) {
+	for _, shutdown := range []bool{false, true} {
+		before := runtime.NumGoroutine()
+		b := &blockFS{release: make(chan bool)}
+		b.Id = "block"
+		b.Workers = 100
+		if !b.Start(b) {
+			t.Fatalf("Starting the server failed")
+		}
+
+		if shutdown {
+			if err := b.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+		} else {
+			b.Close()
+		}
+
+		n := runtime.NumGoroutine()
+		for i := 0; i < 100 && n >= before+b.Workers; i++ {
+			time.Sleep(10 * time.Millisecond)
+			n = runtime.NumGoroutine()
+		}
+
+		if n >= before+b.Workers {
+			t.Errorf("shutdown %v: %d goroutines before, %d after", shutdown, before, n)
+		}
+	}
+}
+
+// Starts blockFS with reads that don't block, and connects to it
+// with net.Pipe.
+func startBench(b *testing.B, msize uint32) (*blockFS, func() *clnt.Clnt) {
+	fs := &blockFS{release: make(chan bool), reading: make(chan bool, 1)}
+	fs.Id = "block"
+	fs.Dotu = true
+	fs.Msize = msize + ninep.IOHDRSZ
+	close(fs.release)
+	go func() {
+		for range fs.reading {
+		}
+	}()
+	if !fs.Start(fs) {
+		b.Fatalf("Starting the server failed")
+	}
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	mount := func() *clnt.Clnt {
+		c1, c2 := net.Pipe()
+		fs.NewConn(c1)
+		c, err := clnt.MountConn(c2, "/", msize, user)
+		if err != nil {
+			b.Fatalf("Mount: %v", err)
+		}
+
+		return c
+	}
+
+	return fs, mount
+}
+
+// Memory used by an idle connection, both on the server and the
+// client side, with 1 MiB msize.
+func BenchmarkIdleConns(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		fs, mount := startBench(b, 1<<20)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		clnts := make([]*clnt.Clnt, 1000)
+		for j := range clnts {
+			clnts[j] = mount()
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		used := (after.HeapInuse + after.StackInuse) - (before.HeapInuse + before.StackInuse)
+		b.ReportMetric(float64(used)/float64(len(clnts)), "B/conn")
+		for _, c := range clnts {
+			c.Unmount()
+		}
+
+		fs.Close()
+	}
+}
+
+// Allocations per Tread/Rread, both on the server and the client side.
+func BenchmarkRead(b *testing.B) {
+	fs, mount := startBench(b, 8192)
+	defer fs.Close()
+	c := mount()
+	f, err := c.FOpen("file", ninep.OREAD)
+	if err != nil {
+		b.Fatalf("FOpen: %v", err)
+	}
+
+	buf := make([]byte, 8192)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			b.Fatalf("Read: %v", err)
+		}
+	}
+}
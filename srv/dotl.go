@@ -0,0 +1,228 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"path"
+
+	"github.com/lionkov/ninep"
+)
+
+// Dispatches the 9P2000.L specific messages. Called by Process only
+// if the connection negotiated 9P2000.L.
+func (srv *Srv) processL(req *Req) {
+	ops := (srv.ops).(ReqOpsL)
+	switch req.Tc.Type {
+	default:
+		req.RespondError(&ninep.Error{"unknown message type", ninep.ENOSYS})
+
+	case ninep.Tstatfs:
+		ops.Statfs(req)
+
+	case ninep.Tlopen:
+		srv.lopen(req)
+
+	case ninep.Tlcreate:
+		srv.lcreate(req)
+
+	case ninep.Tsymlink:
+		if srv.checkDir(req) {
+			ops.Symlink(req)
+		}
+
+	case ninep.Tmknod:
+		if srv.checkDir(req) {
+			ops.Mknod(req)
+		}
+
+	case ninep.Trename:
+		if srv.dfid(req) {
+			ops.Rename(req)
+		}
+
+	case ninep.Treadlink:
+		ops.Readlink(req)
+
+	case ninep.Tgetattr:
+		ops.Getattr(req)
+
+	case ninep.Tsetattr:
+		ops.Setattr(req)
+
+	case ninep.Txattrwalk:
+		srv.xattrwalk(req)
+
+	case ninep.Txattrcreate:
+		srv.xattrcreate(req)
+
+	case ninep.Treaddir:
+		srv.readdir(req)
+
+	case ninep.Tfsync:
+		ops.Fsync(req)
+
+	case ninep.Tlock:
+		ops.Flock(req)
+
+	case ninep.Tgetlock:
+		ops.Getlock(req)
+
+	case ninep.Tlink:
+		if srv.dfid(req) {
+			ops.Link(req)
+		}
+
+	case ninep.Tmkdir:
+		if srv.checkDir(req) {
+			ops.Mkdir(req)
+		}
+
+	case ninep.Trenameat:
+		if srv.checkDir(req) && srv.dfid(req) {
+			ops.Renameat(req)
+		}
+
+	case ninep.Tunlinkat:
+		if srv.checkDir(req) {
+			ops.Unlinkat(req)
+		}
+	}
+}
+
+// Checks that the request's Fid points to a directory.
+func (srv *Srv) checkDir(req *Req) bool {
+	if (req.Fid.Type & ninep.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return false
+	}
+
+	return true
+}
+
+// Checks the destination directory fid of the request (looked up by
+// Process).
+func (srv *Srv) dfid(req *Req) bool {
+	if (req.Dfid.Type & ninep.QTDIR) == 0 {
+		req.RespondError(Enotdir)
+		return false
+	}
+
+	return true
+}
+
+func (srv *Srv) lopen(req *Req) {
+	fid := req.Fid
+	tc := req.Tc
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	fid.Omode = uint8(tc.Flags & 3)
+	(srv.ops).(ReqOpsL).Lopen(req)
+}
+
+func (srv *Srv) lopenPost(req *Req) {
+	if req.Fid != nil {
+		req.Fid.opened = req.Rc != nil && req.Rc.Type == ninep.Rlopen
+	}
+}
+
+func (srv *Srv) lcreate(req *Req) {
+	fid := req.Fid
+	tc := req.Tc
+	if fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	if !srv.checkDir(req) {
+		return
+	}
+
+	fid.Omode = uint8(tc.Flags & 3)
+	(srv.ops).(ReqOpsL).Lcreate(req)
+}
+
+func (srv *Srv) lcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == ninep.Rlcreate && req.Fid != nil {
+		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.setPath(path.Join(req.Fid.Pathname(), req.Tc.Name))
+		req.Fid.opened = true
+	}
+}
+
+func (srv *Srv) xattrwalk(req *Req) {
+	conn := req.Conn
+	tc := req.Tc
+	fid := req.Fid
+
+	if tc.Fid != tc.Newfid {
+		req.Newfid = conn.FidNew(tc.Newfid)
+		if req.Newfid == nil {
+			req.Conn.warn("xattrwalk: fid in use", "fid", tc.Newfid)
+			req.RespondError(Einuse)
+			return
+		}
+
+		req.Newfid.User = fid.User
+		req.Newfid.setPath(fid.Pathname())
+	} else {
+		req.Newfid = req.Fid
+		req.Newfid.IncRef()
+	}
+
+	(srv.ops).(ReqOpsL).Xattrwalk(req)
+}
+
+func (srv *Srv) xattrwalkPost(req *Req) {
+	rc := req.Rc
+	if rc == nil || rc.Type != ninep.Rxattrwalk || req.Newfid == nil {
+		return
+	}
+
+	// the new fid can only be used to read the attribute value
+	req.Newfid.Type = 0
+	req.Newfid.Omode = ninep.OREAD
+	req.Newfid.opened = true
+	if req.Newfid.fid != req.Fid.fid {
+		req.Newfid.IncRef()
+	}
+}
+
+func (srv *Srv) xattrcreate(req *Req) {
+	if req.Fid.opened {
+		req.RespondError(Eopen)
+		return
+	}
+
+	(srv.ops).(ReqOpsL).Xattrcreate(req)
+}
+
+func (srv *Srv) xattrcreatePost(req *Req) {
+	if req.Rc != nil && req.Rc.Type == ninep.Rxattrcreate && req.Fid != nil {
+		// the fid now refers to the attribute value, written by
+		// Twrite and committed on Tclunk
+		req.Fid.Type = 0
+		req.Fid.Omode = ninep.OWRITE
+		req.Fid.opened = true
+	}
+}
+
+func (srv *Srv) readdir(req *Req) {
+	tc := req.Tc
+	fid := req.Fid
+	if tc.Count+ninep.IOHDRSZ > req.Conn.Msize {
+		req.RespondError(Etoolarge)
+		return
+	}
+
+	if !fid.opened || (fid.Type&ninep.QTDIR) == 0 {
+		req.RespondError(Ebaduse)
+		return
+	}
+
+	(srv.ops).(ReqOpsL).Readdir(req)
+}
@@ -0,0 +1,85 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The 9pproxy command listens for 9P clients and forwards their
+// requests to an upstream 9P file server over a single connection.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+	"github.com/lionkov/ninep/srv/proxy"
+)
+
+var (
+	debug    = flag.Int("d", 0, "print debug messages")
+	addr     = flag.String("addr", ":5640", "network address to listen on")
+	upstream = flag.String("upstream", "", "network address of the upstream server")
+	msize    = flag.Uint("msize", 8192, "maximum size of the data in the 9P messages")
+	plain    = flag.Bool("plain", false, "speak 9P2000 instead of 9P2000.u with the upstream server")
+	rdonly   = flag.Bool("ro", false, "refuse the requests that modify the files")
+	access   = flag.Bool("log", false, "log the requests")
+	deny     = flag.String("deny", "", "comma-separated list of paths the clients can't access")
+	cdir     = flag.String("cache", "", "cache the files in the directory")
+	csize    = flag.Int64("cachesize", 0, "maximum size of the cached data in bytes (0 means no limit)")
+	offline  = flag.Bool("offline", false, "serve the cached files when the upstream server is unreachable")
+)
+
+func main() {
+	flag.Parse()
+	if *upstream == "" {
+		log.Fatal("no upstream server (-upstream)")
+	}
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", *upstream) }
+	conn, err := dial()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := clnt.Connect(conn, uint32(*msize)+ninep.IOHDRSZ, !*plain)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// reconnect if the upstream server restarts
+	c.Lock()
+	c.Dial = dial
+	c.Unlock()
+
+	p := proxy.New(c)
+	p.Id = "9pproxy"
+	p.Debuglevel = *debug
+	if *cdir != "" {
+		p.Cache, err = proxy.NewCache(*cdir, *csize)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		p.Cache.Offline = *offline
+	}
+
+	if *access {
+		p.Use(&srv.AccessLog{})
+	}
+
+	if *deny != "" {
+		p.Use(srv.NewDenyList(strings.Split(*deny, ",")...))
+	}
+
+	if *rdonly {
+		p.Use(srv.ReadOnly{})
+	}
+
+	p.Start(p)
+	if err := p.StartNetListener("tcp", *addr); err != nil {
+		log.Println(err)
+	}
+}
@@ -7,7 +7,10 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 
+	"github.com/lionkov/ninep/auth"
+	"github.com/lionkov/ninep/metrics"
 	"github.com/lionkov/ninep/srv/ufs"
 )
 
@@ -15,14 +18,41 @@ var (
 	debug = flag.Int("d", 0, "print debug messages")
 	addr = flag.String("addr", ":5640", "network address")
 	user = flag.String("user", "", "user name")
+	perms = flag.Bool("perms", false, "check the permissions of the attached users")
+	fsuid = flag.Bool("fsuid", false, "switch fsuid/fsgid to the attached users (root only)")
+	keyfile = flag.String("keys", "", "require ninep-hmac1 authentication with the keys from the file")
+	maddr = flag.String("metrics", "", "serve OpenMetrics statistics over HTTP on the network address")
 )
 
 func main() {
 	flag.Parse()
 	ufs := ufs.New()
 	ufs.Dotu = true
+	ufs.Dotl = true
 	ufs.Id = "ufs"
 	ufs.Debuglevel = *debug
+	ufs.Perms = *perms || *fsuid
+	ufs.Fsuid = *fsuid
+	if *keyfile != "" {
+		keys, err := auth.ReadKeyfile(*keyfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ufs.Auth = auth.NewServer(keys)
+	}
+
+	if *maddr != "" {
+		l, err := net.Listen("tcp", *maddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ufs.Metrics = metrics.New("server", ufs.Id)
+		metrics.DefaultRegistry.Register(ufs.Metrics)
+		go metrics.DefaultRegistry.Serve(l)
+	}
+
 	ufs.Start(ufs)
 	if *user != "" {
 		u := ufs.Upool.Uname2User(*user)
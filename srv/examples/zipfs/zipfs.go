@@ -0,0 +1,43 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Serves the content of a zip archive.
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"log"
+
+	"github.com/lionkov/ninep/srv/iofs"
+)
+
+var (
+	debug = flag.Int("d", 0, "print debug messages")
+	addr  = flag.String("addr", ":5640", "network address")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: zipfs [-d debuglevel] [-addr addr] archive.zip")
+	}
+
+	z, err := zip.OpenReader(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer z.Close()
+
+	fs := iofs.New(z)
+	fs.Dotu = true
+	fs.Id = "zipfs"
+	fs.Debuglevel = *debug
+	fs.Start(fs)
+
+	err = fs.StartNetListener("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+	}
+}
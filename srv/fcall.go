@@ -5,7 +5,7 @@
 package srv
 
 import (
-	"log"
+	"path"
 	"sync/atomic"
 
 	"github.com/lionkov/ninep"
@@ -24,10 +24,15 @@ func (srv *Srv) version(req *Req) {
 		conn.Msize = tc.Msize
 	}
 
-	conn.Dotu = tc.Version == "9P2000.u" && srv.Dotu
-	ver := "9P2000"
-	if conn.Dotu {
-		ver = "9P2000.u"
+	_, opsl := (srv.ops).(ReqOpsL)
+	conn.Dotl = tc.Version == ninep.VersionL && srv.Dotl && opsl
+	conn.Dotu = tc.Version == ninep.VersionU && srv.Dotu
+	ver := ninep.Version
+	switch {
+	case conn.Dotl:
+		ver = ninep.VersionL
+	case conn.Dotu:
+		ver = ninep.VersionU
 	}
 
 	/* make sure that the responses of all current requests will be ignored */
@@ -59,13 +64,13 @@ func (srv *Srv) auth(req *Req) {
 
 	req.Afid = conn.FidNew(tc.Afid)
 	if req.Afid == nil {
-		log.Printf("in auth(): Fid %v in use?", tc.Afid)
+		req.Conn.warn("auth: fid in use", "fid", tc.Afid)
 		req.RespondError(Einuse)
 		return
 	}
 
 	var user ninep.User = nil
-	if tc.Unamenum != ninep.NOUID && conn.Dotu {
+	if tc.Unamenum != ninep.NOUID && (conn.Dotu || conn.Dotl) {
 		user = srv.Upool.Uid2User(int(tc.Unamenum))
 	} else if tc.Uname != "" {
 		user = srv.Upool.Uname2User(tc.Uname)
@@ -78,7 +83,7 @@ func (srv *Srv) auth(req *Req) {
 
 	req.Afid.User = user
 	req.Afid.Type = ninep.QTAUTH
-	if aop, ok := (srv.ops).(AuthOps); ok {
+	if aop := srv.authOps(); aop != nil {
 		aqid, err := aop.AuthInit(req.Afid, tc.Aname)
 		if err != nil {
 			req.RespondError(err)
@@ -108,7 +113,7 @@ func (srv *Srv) attach(req *Req) {
 
 	req.Fid = conn.FidNew(tc.Fid)
 	if req.Fid == nil {
-		log.Printf("attach: Fid %v in use? ", tc.Fid)
+		req.Conn.warn("attach: fid in use", "fid", tc.Fid)
 		req.RespondError(Einuse)
 		return
 	}
@@ -117,11 +122,12 @@ func (srv *Srv) attach(req *Req) {
 		req.Afid = conn.FidGet(tc.Afid)
 		if req.Afid == nil {
 			req.RespondError(Eunknownfid)
+			return
 		}
 	}
 
 	var user ninep.User = nil
-	if tc.Unamenum != ninep.NOUID && conn.Dotu {
+	if tc.Unamenum != ninep.NOUID && (conn.Dotu || conn.Dotl) {
 		user = srv.Upool.Uid2User(int(tc.Unamenum))
 	} else if tc.Uname != "" {
 		user = srv.Upool.Uname2User(tc.Uname)
@@ -133,7 +139,7 @@ func (srv *Srv) attach(req *Req) {
 	}
 
 	req.Fid.User = user
-	if aop, ok := (srv.ops).(AuthOps); ok {
+	if aop := srv.authOps(); aop != nil {
 		err := aop.AuthCheck(req.Fid, req.Afid, tc.Aname)
 		if err != nil {
 			req.RespondError(err)
@@ -147,6 +153,7 @@ func (srv *Srv) attach(req *Req) {
 func (srv *Srv) attachPost(req *Req) {
 	if req.Rc != nil && req.Rc.Type == ninep.Rattach {
 		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.setPath("/")
 		req.Fid.IncRef()
 	}
 }
@@ -180,6 +187,10 @@ func (srv *Srv) flush(req *Req) {
 	if (status & (reqWork | reqSaved)) == 0 {
 		r.Respond()
 	} else {
+		if r.cancel != nil {
+			r.cancel()
+		}
+
 		if op, ok := (srv.ops).(FlushOp); ok {
 			op.Flush(r)
 		}
@@ -206,7 +217,7 @@ func (srv *Srv) walk(req *Req) {
 	if tc.Fid != tc.Newfid {
 		req.Newfid = conn.FidNew(tc.Newfid)
 		if req.Newfid == nil {
-			log.Printf("walk: fid %v in use? ", tc.Newfid)
+			req.Conn.warn("walk: fid in use", "fid", tc.Newfid)
 			req.RespondError(Einuse)
 			return
 		}
@@ -239,11 +250,41 @@ func (srv *Srv) walkPost(req *Req) {
 		return
 	}
 
+	if n > 0 {
+		req.Newfid.setPath(walkPath(req.Fid.Pathname(), req.Tc.Wname))
+	} else {
+		req.Newfid.setPath(req.Fid.Pathname())
+	}
+
 	if req.Newfid.fid != req.Fid.fid {
 		req.Newfid.IncRef()
 	}
 }
 
+// Returns the path of the file reached by walking the names from dir.
+func walkPath(dir string, names []string) string {
+	elems := make([]string, 0, len(names)+1)
+	elems = append(elems, dir)
+	return path.Join(append(elems, names...)...)
+}
+
+// Returns the length of the packed directory entries at the start of
+// b that fit in count bytes. The directory reads return only whole
+// entries. An entry that isn't whole in b isn't counted.
+func DirEntries(b []byte, count uint32) int {
+	n := 0
+	for n+2 <= len(b) {
+		sz := 2 + (int(b[n]) | int(b[n+1])<<8)
+		if n+sz > len(b) || n+sz > int(count) {
+			break
+		}
+
+		n += sz
+	}
+
+	return n
+}
+
 func (srv *Srv) open(req *Req) {
 	fid := req.Fid
 	tc := req.Tc
@@ -299,6 +340,7 @@ func (srv *Srv) create(req *Req) {
 func (srv *Srv) createPost(req *Req) {
 	if req.Rc != nil && req.Rc.Type == ninep.Rcreate && req.Fid != nil {
 		req.Fid.Type = req.Rc.Qid.Type
+		req.Fid.setPath(path.Join(req.Fid.Pathname(), req.Tc.Name))
 		req.Fid.opened = true
 	}
 }
@@ -321,7 +363,7 @@ func (srv *Srv) read(req *Req) {
 			return
 		}
 
-		if op, ok := (req.Conn.Srv.ops).(AuthOps); ok {
+		if op := req.Conn.Srv.authOps(); op != nil {
 			n, err = op.AuthRead(fid, tc.Offset, rc.Data)
 			if err != nil {
 				req.RespondError(err)
@@ -374,7 +416,7 @@ func (srv *Srv) write(req *Req) {
 	tc := req.Tc
 	if (fid.Type & ninep.QTAUTH) != 0 {
 		tc := req.Tc
-		if op, ok := (req.Conn.Srv.ops).(AuthOps); ok {
+		if op := req.Conn.Srv.authOps(); op != nil {
 			n, err := op.AuthWrite(req.Fid, tc.Offset, tc.Data)
 			if err != nil {
 				req.RespondError(err)
@@ -404,7 +446,7 @@ func (srv *Srv) write(req *Req) {
 func (srv *Srv) clunk(req *Req) {
 	fid := req.Fid
 	if (fid.Type & ninep.QTAUTH) != 0 {
-		if op, ok := (req.Conn.Srv.ops).(AuthOps); ok {
+		if op := req.Conn.Srv.authOps(); op != nil {
 			op.AuthDestroy(fid)
 			req.RespondRclunk()
 		} else {
@@ -5,9 +5,13 @@
 package srv
 
 import (
+	"context"
+	"encoding/binary"
 	"github.com/lionkov/ninep"
-	"log"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,11 +42,26 @@ type FReadOp interface {
 // If the FWriteOp interface is implemented, the Write operation will be called
 // to write to the file. If not implemented, "permission denied" error will
 // be send back. The operation returns the number of bytes written, or the
-// error occured while writing.
+// error occured while writing. The data is reused for other messages
+// after the operation returns, it should be copied if it is kept.
 type FWriteOp interface {
 	Write(fid *FFid, data []byte, offset uint64) (int, error)
 }
 
+// If the FReadContextOp interface is implemented, it is used instead of
+// FReadOp. The context is done when the request is flushed, or the
+// connection is closed. A blocking Read should return the context's
+// error then.
+type FReadContextOp interface {
+	ReadContext(ctx context.Context, fid *FFid, buf []byte, offset uint64) (int, error)
+}
+
+// If the FWriteContextOp interface is implemented, it is used instead of
+// FWriteOp, with the same semantics as FReadContextOp.
+type FWriteContextOp interface {
+	WriteContext(ctx context.Context, fid *FFid, data []byte, offset uint64) (int, error)
+}
+
 // If the FCreateOp interface is implemented, the Create operation will be called
 // when the client attempts to create a file in the File implementing the interface.
 // If not implemented, "permission denied" error will be send back. If successful,
@@ -61,6 +80,32 @@ type FRemoveOp interface {
 	Remove(*FFid) error
 }
 
+// If the FLookupOp interface is implemented by a directory, the Lookup
+// operation is called when a walk doesn't find the name among the files
+// added to the directory. The operation should return a file initialized
+// with (*File)Init, or an error if there is no such file. The directory
+// doesn't keep the returned file, it lives while there are fids that
+// refer to it.
+type FLookupOp interface {
+	Lookup(fid *FFid, name string) (*File, error)
+}
+
+// If the FReaddirOp interface is implemented by a directory, the Readdir
+// operation is called when the client starts reading the directory. The
+// returned files, initialized with (*File)Init, are listed after the files
+// added to the directory.
+type FReaddirOp interface {
+	Readdir(fid *FFid) ([]*File, error)
+}
+
+// If the FReleaseOp interface is implemented by a file returned by a
+// FLookupOp, the Release operation is called when the last fid that
+// refers to the file is destroyed. The file can't be used after that.
+// The files that no fid referred to are dropped without a call.
+type FReleaseOp interface {
+	Release(f *File)
+}
+
 type FOpenOp interface {
 	Open(fid *FFid, mode uint8) error
 }
@@ -77,6 +122,7 @@ type FFlags int
 
 const (
 	Fremoved FFlags = 1 << iota
+	Fgenerated
 )
 
 // The File type represents a file (or directory) served by the file server.
@@ -84,28 +130,47 @@ type File struct {
 	sync.Mutex
 	ninep.Dir
 	flags FFlags
+	refs  int // fids referring to a generated file
 
-	Parent        *File // parent
-	next, prev    *File // siblings, guarded by parent.Lock
-	cfirst, clast *File // children (if directory)
-	Ops           interface{}
+	Parent *File // parent
+	Ops    interface{}
+
+	seq    uint64         // position in the parent's children
+	qpaths *atomic.Uint64 // allocates the Qid paths of the tree
+
+	// children (if directory), in the order they were added
+	clock  sync.RWMutex
+	cnames map[string]*File
+	clist  []dirent
+	cseq   uint64 // seq of the next child
+	cdead  int    // removed entries in clist
+}
+
+// An entry of a directory's children list. The entries of the removed
+// files have nil f until the list is compacted.
+type dirent struct {
+	seq uint64
+	f   *File
 }
 
 type FFid struct {
 	F    *File
 	Fid  *Fid
-	dirs []*File // used for readdir
+	dseq uint64  // seq of the next child to read
+	doff uint64  // offset of the next directory read
+	dirs []*File // generated files left to read
 }
 
 // The Fsrv can be used to create file servers that serve
-// simple trees of synthetic files.
+// simple trees of synthetic files. The directories implementing
+// FLookupOp and FReaddirOp can generate their files on demand.
 type Fsrv struct {
 	Srv
 	Root *File
 }
 
-var lock sync.Mutex
-var qnext uint64
+// Allocates the Qid paths of the trees whose root wasn't added with Add.
+var qpaths atomic.Uint64
 var Eexist = &ninep.Error{"file already exists", ninep.EEXIST}
 var Enoent = &ninep.Error{"file not found", ninep.ENOENT}
 var Enotempty = &ninep.Error{"directory not empty", ninep.EPERM}
@@ -120,14 +185,62 @@ func NewFileSrv(root *File) *Fsrv {
 }
 
 // Initializes the fields of a file and add it to a directory.
-// Returns nil if successful, or an error.
+// Returns nil if successful, or an error. The files added to a
+// tree get their Qid paths from the tree's root (added with nil
+// dir), so each tree has its own Qid paths.
 func (f *File) Add(dir *File, name string, uid ninep.User, gid ninep.Group, mode uint32, ops interface{}) error {
+	if dir == nil {
+		f.qpaths = new(atomic.Uint64)
+	} else if f.qpaths = dir.qpaths; f.qpaths == nil {
+		f.qpaths = &qpaths
+	}
 
-	lock.Lock()
-	qpath := qnext
-	qnext++
-	lock.Unlock()
+	f.init(f.qpaths.Add(1)-1, name, uid, gid, mode)
+	f.Ops = ops
+	if dir == nil {
+		f.Parent = f
+		return nil
+	}
 
+	f.Parent = dir
+	dir.clock.Lock()
+	defer dir.clock.Unlock()
+	if dir.cnames[name] != nil {
+		return Eexist
+	}
+
+	if dir.cnames == nil {
+		dir.cnames = make(map[string]*File)
+	}
+
+	f.seq = dir.cseq
+	dir.cseq++
+	dir.cnames[name] = f
+	dir.clist = append(dir.clist, dirent{f.seq, f})
+	return nil
+}
+
+// Initializes the fields of a file generated by a FLookupOp or FReaddirOp
+// of the directory dir. The file isn't added to the directory. Its Qid path
+// is derived from the directory's and the name, so the file gets the same
+// Qid every time it's generated.
+func (f *File) Init(dir *File, name string, uid ninep.User, gid ninep.Group, mode uint32, ops interface{}) {
+	var b [8]byte
+
+	h := fnv.New64a()
+	binary.LittleEndian.PutUint64(b[:], dir.Qid.Path)
+	h.Write(b[:])
+	h.Write([]byte(name))
+
+	// keep the generated paths apart from the ones of added files
+	f.init(h.Sum64()|1<<63, name, uid, gid, mode)
+	f.flags = Fgenerated
+	f.Parent = dir
+	f.qpaths = dir.qpaths
+	f.Ops = ops
+}
+
+func (f *File) init(qpath uint64, name string, uid ninep.User, gid ninep.Group, mode uint32) {
 	f.Qid.Type = uint8(mode >> 24)
 	f.Qid.Version = 0
 	f.Qid.Path = qpath
@@ -156,32 +269,62 @@ func (f *File) Add(dir *File, name string, uid ninep.User, gid ninep.Group, mode
 	f.Muidnum = ninep.NOUID
 	f.Ext = ""
 
-	if dir != nil {
-		f.Parent = dir
-		dir.Lock()
-		for p := dir.cfirst; p != nil; p = p.next {
-			if name == p.Name {
-				dir.Unlock()
-				return Eexist
-			}
-		}
+}
 
-		if dir.clast != nil {
-			dir.clast.next = f
-		} else {
-			dir.cfirst = f
+// Adds a fid reference to a generated file. The first one adds a
+// reference to the file's directory.
+func (f *File) incRef() {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	if f.flags&Fgenerated == 0 {
+		f.Unlock()
+		return
+	}
+
+	f.refs++
+	first := f.refs == 1
+	f.Unlock()
+
+	if first {
+		f.Parent.incRef()
+	}
+}
+
+// Removes a fid reference from a generated file. The last one releases
+// the file.
+func (f *File) decRef() {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	if f.flags&Fgenerated == 0 {
+		f.Unlock()
+		return
+	}
+
+	f.refs--
+	last := f.refs == 0
+	f.Unlock()
+
+	if last {
+		if op, ok := (f.Ops).(FReleaseOp); ok {
+			op.Release(f)
 		}
 
-		f.prev = dir.clast
-		f.next = nil
-		dir.clast = f
-		dir.Unlock()
-	} else {
-		f.Parent = f
+		f.Parent.decRef()
 	}
+}
 
-	f.Ops = ops
-	return nil
+// Makes the fid refer to the file.
+func (fid *FFid) setFile(f *File) {
+	f.incRef()
+	old := fid.F
+	fid.F = f
+	old.decRef()
 }
 
 // Removes a file from its parent directory.
@@ -193,35 +336,59 @@ func (f *File) Remove() {
 	}
 
 	f.flags |= Fremoved
+	generated := f.flags&Fgenerated != 0
 	f.Unlock()
 
+	// generated files aren't in the directory
+	if generated {
+		return
+	}
+
 	p := f.Parent
-	p.Lock()
-	if f.next != nil {
-		f.next.prev = f.prev
-	} else {
-		p.clast = f.prev
+	p.clock.Lock()
+	defer p.clock.Unlock()
+	if p.cnames[f.Name] == f {
+		delete(p.cnames, f.Name)
 	}
 
-	if f.prev != nil {
-		f.prev.next = f.next
-	} else {
-		p.cfirst = f.next
+	i := p.search(f.seq)
+	if i == len(p.clist) || p.clist[i].f != f {
+		return
+	}
+
+	p.clist[i].f = nil
+	p.cdead++
+	if p.cdead > 32 && p.cdead > len(p.clist)/2 {
+		// compact the list
+		list := make([]dirent, 0, len(p.clist)-p.cdead)
+		for _, d := range p.clist {
+			if d.f != nil {
+				list = append(list, d)
+			}
+		}
+
+		p.clist = list
+		p.cdead = 0
 	}
+}
 
-	f.next = nil
-	f.prev = nil
-	p.Unlock()
+// Returns the index of the first child with seq not less than the
+// specified. Called with p.clock locked.
+func (p *File) search(seq uint64) int {
+	return sort.Search(len(p.clist), func(i int) bool { return p.clist[i].seq >= seq })
 }
 
 func (f *File) Rename(name string) error {
 	p := f.Parent
-	p.Lock()
-	defer p.Unlock()
-	for c := p.cfirst; c != nil; c = c.next {
-		if name == c.Name {
-			return Eexist
-		}
+	p.clock.Lock()
+	defer p.clock.Unlock()
+	if p.cnames[name] != nil {
+		return Eexist
+	}
+
+	if p.cnames[f.Name] == f {
+		delete(p.cnames, f.Name)
+		p.cnames[name] = f
 	}
 
 	f.Name = name
@@ -230,16 +397,30 @@ func (f *File) Rename(name string) error {
 
 // Looks for a file in a directory. Returns nil if the file is not found.
 func (p *File) Find(name string) *File {
-	var f *File
+	p.clock.RLock()
+	defer p.clock.RUnlock()
+	return p.cnames[name]
+}
 
-	p.Lock()
-	for f = p.cfirst; f != nil; f = f.next {
-		if name == f.Name {
-			break
+// Returns the files in a directory, in the order they were added.
+func (p *File) Children() []*File {
+	p.clock.RLock()
+	defer p.clock.RUnlock()
+	files := make([]*File, 0, len(p.cnames))
+	for _, d := range p.clist {
+		if d.f != nil {
+			files = append(files, d.f)
 		}
 	}
-	p.Unlock()
-	return f
+
+	return files
+}
+
+// Returns true if files were added to the directory, and not removed.
+func (p *File) hasChildren() bool {
+	p.clock.RLock()
+	defer p.clock.RUnlock()
+	return len(p.cnames) != 0
 }
 
 // Checks if the specified user has permission to perform
@@ -293,6 +474,29 @@ func (s *Fsrv) Attach(req *Req) {
 	req.RespondRattach(&s.Root.Qid)
 }
 
+// Looks for a file in the directory, or asks its FLookupOp for it.
+func lookup(dir *File, fid *Fid, name string) (*File, error) {
+	if f := dir.Find(name); f != nil {
+		return f, nil
+	}
+
+	lop, ok := (dir.Ops).(FLookupOp)
+	if !ok {
+		return nil, Enoent
+	}
+
+	f, err := lop.Lookup(&FFid{F: dir, Fid: fid}, name)
+	if err == nil && f == nil {
+		err = Enoent
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func (*Fsrv) Walk(req *Req) {
 	fid := req.Fid.Aux.(*FFid)
 	tc := req.Tc
@@ -320,8 +524,13 @@ func (*Fsrv) Walk(req *Req) {
 			}
 		}
 
-		p := f.Find(tc.Wname[i])
+		p, err := lookup(f, req.Fid, tc.Wname[i])
 		if p == nil {
+			if i == 0 {
+				req.RespondError(err)
+				return
+			}
+
 			break
 		}
 
@@ -334,7 +543,11 @@ func (*Fsrv) Walk(req *Req) {
 		return
 	}
 
-	nfid.F = f
+	// a partial walk doesn't change the fid
+	if i == len(tc.Wname) {
+		nfid.setFile(f)
+	}
+
 	req.RespondRwalk(wqids[0:i])
 }
 
@@ -391,7 +604,7 @@ func (*Fsrv) Create(req *Req) {
 		if err != nil {
 			req.RespondError(err)
 		} else {
-			fid.F = f
+			fid.setFile(f)
 			req.RespondRcreate(&fid.F.Qid, 0)
 		}
 	} else {
@@ -410,33 +623,57 @@ func (*Fsrv) Read(req *Req) {
 	ninep.InitRread(rc, tc.Count)
 
 	if f.Mode&ninep.DMDIR != 0 {
-		// directory
-		f.Lock()
-		if tc.Offset == 0 {
-			var g *File
-			for n, g = 0, f.cfirst; g != nil; n, g = n+1, g.next {
+		// directory, the reads continue where the previous ones
+		// stopped, at the next child that is still in the directory
+		var gen []*File
+		if rop, ok := (f.Ops).(FReaddirOp); ok && tc.Offset == 0 {
+			gen, err = rop.Readdir(fid)
+			if err != nil {
+				req.RespondError(err)
+				return
 			}
+		}
 
-			fid.dirs = make([]*File, n)
-			for n, g = 0, f.cfirst; g != nil; n, g = n+1, g.next {
-				fid.dirs[n] = g
-			}
+		f.Lock()
+		if tc.Offset == 0 {
+			fid.dseq = 0
+			fid.doff = 0
+			fid.dirs = gen
+		} else if tc.Offset != fid.doff {
+			f.Unlock()
+			req.RespondError(Ebadoffset)
+			return
 		}
 
 		n = 0
 		b := rc.Data
+		full := false
+
 		// only return whole entries.
-		for i = 0; i < len(fid.dirs); i++ {
-			g := fid.dirs[i]
-			g.Lock()
-			if (g.flags & Fremoved) != 0 {
-				g.Unlock()
+		f.clock.RLock()
+		for i = f.search(fid.dseq); i < len(f.clist); i++ {
+			g := f.clist[i].f
+			if g == nil {
 				continue
 			}
 
+			g.Lock()
 			nd := ninep.PackDir(&g.Dir, req.Conn.Dotu)
 			g.Unlock()
 
+			if len(nd) > len(b) {
+				full = true
+				break
+			}
+			copy(b, nd)
+			b = b[len(nd):]
+			n += len(nd)
+			fid.dseq = f.clist[i].seq + 1
+		}
+		f.clock.RUnlock()
+
+		for i = 0; !full && i < len(fid.dirs); i++ {
+			nd := ninep.PackDir(&fid.dirs[i].Dir, req.Conn.Dotu)
 			if len(nd) > len(b) {
 				break
 			}
@@ -445,17 +682,26 @@ func (*Fsrv) Read(req *Req) {
 			n += len(nd)
 		}
 		fid.dirs = fid.dirs[i:]
+		fid.doff += uint64(n)
 		f.Unlock()
 	} else {
 		// file
-		if rop, ok := f.Ops.(FReadOp); ok {
+		ctx := req.Context()
+		if ctx.Err() != nil {
+			req.RespondError(Eintr)
+			return
+		}
+
+		if rop, ok := f.Ops.(FReadContextOp); ok {
+			n, err = rop.ReadContext(ctx, fid, rc.Data, tc.Offset)
+		} else if rop, ok := f.Ops.(FReadOp); ok {
 			n, err = rop.Read(fid, rc.Data, tc.Offset)
-			if err != nil {
-				req.RespondError(err)
-				return
-			}
 		} else {
-			req.RespondError(Eperm)
+			err = Eperm
+		}
+
+		if err != nil {
+			req.RespondError(ctxError(ctx, err))
 			return
 		}
 	}
@@ -469,17 +715,36 @@ func (*Fsrv) Write(req *Req) {
 	f := fid.F
 	tc := req.Tc
 
-	if wop, ok := (f.Ops).(FWriteOp); ok {
-		n, err := wop.Write(fid, tc.Data, tc.Offset)
-		if err != nil {
-			req.RespondError(err)
-		} else {
-			req.RespondRwrite(uint32(n))
-		}
+	ctx := req.Context()
+	if ctx.Err() != nil {
+		req.RespondError(Eintr)
+		return
+	}
+
+	var n int
+	var err error
+	if wop, ok := (f.Ops).(FWriteContextOp); ok {
+		n, err = wop.WriteContext(ctx, fid, tc.Data, tc.Offset)
+	} else if wop, ok := (f.Ops).(FWriteOp); ok {
+		n, err = wop.Write(fid, tc.Data, tc.Offset)
 	} else {
-		req.RespondError(Eperm)
+		err = Eperm
 	}
 
+	if err != nil {
+		req.RespondError(ctxError(ctx, err))
+	} else {
+		req.RespondRwrite(uint32(n))
+	}
+}
+
+// Returns Eintr if err is the error of the (done) context.
+func ctxError(ctx context.Context, err error) error {
+	if err == ctx.Err() {
+		return Eintr
+	}
+
+	return err
 }
 
 func (*Fsrv) Clunk(req *Req) {
@@ -498,7 +763,7 @@ func (*Fsrv) Remove(req *Req) {
 	fid := req.Fid.Aux.(*FFid)
 	f := fid.F
 	f.Lock()
-	if f.cfirst != nil {
+	if f.hasChildren() {
 		f.Unlock()
 		req.RespondError(Enotempty)
 		return
@@ -514,7 +779,7 @@ func (*Fsrv) Remove(req *Req) {
 			req.RespondRremove()
 		}
 	} else {
-		log.Println("remove not implemented")
+		req.Conn.warn("remove not implemented", "path", req.Fid.Pathname())
 		req.RespondError(Eperm)
 	}
 }
@@ -566,4 +831,6 @@ func (*Fsrv) FidDestroy(ffid *Fid) {
 	if op, ok := (f.Ops).(FDestroyOp); ok {
 		op.FidDestroy(fid)
 	}
+
+	fid.setFile(nil)
 }
@@ -0,0 +1,403 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Starts a file server for the tree, and mounts it.
+func startFsrv(tb testing.TB, root *srv.File) *clnt.Clnt {
+	s := srv.NewFileSrv(root)
+	s.Dotu = true
+	s.Id = "fsrv"
+	if !s.Start(s) {
+		tb.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		tb.Fatalf("net.Listen: %v", err)
+	}
+	go s.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		tb.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+// Returns a tree with a directory of n files.
+func bigTree(tb testing.TB, n int) (*srv.File, *srv.File) {
+	root := new(srv.File)
+	if err := root.Add(nil, "/", nil, nil, ninep.DMDIR|0777, nil); err != nil {
+		tb.Fatalf("Add: %v", err)
+	}
+
+	dir := new(srv.File)
+	if err := dir.Add(root, "dir", nil, nil, ninep.DMDIR|0777, nil); err != nil {
+		tb.Fatalf("Add: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		f := new(srv.File)
+		if err := f.Add(dir, fmt.Sprintf("file%d", i), nil, nil, 0666, nil); err != nil {
+			tb.Fatalf("Add: %v", err)
+		}
+	}
+
+	return root, dir
+}
+
+func TestFsrvReaddir(t *testing.T) {
+	root, dir := bigTree(t, 1000)
+	if f := new(srv.File); f.Add(dir, "file10", nil, nil, 0666, nil) == nil {
+		t.Errorf("added an existing file")
+	}
+
+	// each tree has its own Qid paths
+	other, _ := bigTree(t, 0)
+	if other.Qid.Path != root.Qid.Path || dir.Find("file0").Qid.Path != 2 {
+		t.Errorf("Qid paths: %d %d", other.Qid.Path, dir.Find("file0").Qid.Path)
+	}
+
+	c := startFsrv(t, root)
+	defer c.Unmount()
+
+	fid, err := c.FOpen("dir", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	defer fid.Close()
+
+	// the files are read in the order they were added, the changes
+	// during the reads don't make the files be returned twice
+	var dirs []*ninep.Dir
+	off := uint64(0)
+	read := func() int {
+		b, err := c.Read(fid.Fid(), off, 1000)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		off += uint64(len(b))
+		n := 0
+		for ; len(b) > 0; n++ {
+			var d *ninep.Dir
+			d, b, _, err = ninep.UnpackDir(b, true)
+			if err != nil {
+				t.Fatalf("UnpackDir: %v", err)
+			}
+
+			dirs = append(dirs, d)
+		}
+
+		return n
+	}
+
+	read()
+	for _, name := range []string{"file0", "file500", "file999"} {
+		dir.Find(name).Remove()
+	}
+
+	f := new(srv.File)
+	f.Add(dir, "new", nil, nil, 0666, nil)
+	dir.Find("file1").Rename("renamed")
+	for read() > 0 {
+	}
+
+	if len(dirs) != 999 {
+		t.Fatalf("read %d files", len(dirs))
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range dirs {
+		if seen[d.Name] {
+			t.Errorf("%s read twice", d.Name)
+		}
+
+		seen[d.Name] = true
+		if i > 1 && i < 10 && d.Name != fmt.Sprintf("file%d", i) {
+			t.Errorf("entry %d: %s", i, d.Name)
+		}
+	}
+
+	if seen["file500"] || !seen["new"] || dirs[998].Name != "new" {
+		t.Errorf("removed or added files: %v %v %s", seen["file500"], seen["new"], dirs[998].Name)
+	}
+
+	// the reads at other offsets fail
+	if _, err := c.Read(fid.Fid(), off-10, 1000); err == nil {
+		t.Errorf("read at a bad offset succeeded")
+	}
+}
+
+func benchmarkWalk(b *testing.B, n int) {
+	root, _ := bigTree(b, n)
+	c := startFsrv(b, root)
+	defer c.Unmount()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fid, err := c.FWalk(fmt.Sprintf("dir/file%d", i%n))
+		if err != nil {
+			b.Fatalf("FWalk: %v", err)
+		}
+
+		c.Clunk(fid)
+	}
+}
+
+func benchmarkReaddir(b *testing.B, n int) {
+	root, _ := bigTree(b, n)
+	c := startFsrv(b, root)
+	defer c.Unmount()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fid, err := c.FOpen("dir", ninep.OREAD)
+		if err != nil {
+			b.Fatalf("FOpen: %v", err)
+		}
+
+		m := 0
+		for {
+			d, err := fid.Readdir(0)
+			if err != nil && err != io.EOF {
+				b.Fatalf("Readdir: %v", err)
+			}
+
+			if len(d) == 0 {
+				break
+			}
+
+			m += len(d)
+		}
+
+		fid.Close()
+		if m != n {
+			b.Fatalf("read %d files", m)
+		}
+	}
+}
+
+func BenchmarkFsrvWalk1k(b *testing.B)      { benchmarkWalk(b, 1000) }
+func BenchmarkFsrvWalk100k(b *testing.B)    { benchmarkWalk(b, 100000) }
+func BenchmarkFsrvReaddir1k(b *testing.B)   { benchmarkReaddir(b, 1000) }
+func BenchmarkFsrvReaddir100k(b *testing.B) { benchmarkReaddir(b, 100000) }
+
+// A directory with a subdirectory for each job, generated on demand.
+// Each job directory has a generated status file.
+type jobs struct {
+	sync.Mutex
+	status   map[string]string
+	released map[string]int
+}
+
+type jobDir struct {
+	j    *jobs
+	name string
+}
+
+type statusFile struct {
+	j    *jobs
+	name string
+}
+
+func (j *jobs) job(dir *srv.File, name string) *srv.File {
+	f := new(srv.File)
+	f.Init(dir, name, nil, nil, ninep.DMDIR|0555, &jobDir{j, name})
+	return f
+}
+
+func (j *jobs) Lookup(fid *srv.FFid, name string) (*srv.File, error) {
+	j.Lock()
+	defer j.Unlock()
+	if _, ok := j.status[name]; !ok {
+		return nil, srv.Enoent
+	}
+
+	return j.job(fid.F, name), nil
+}
+
+func (j *jobs) Readdir(fid *srv.FFid) ([]*srv.File, error) {
+	j.Lock()
+	defer j.Unlock()
+	var files []*srv.File
+	for name := range j.status {
+		files = append(files, j.job(fid.F, name))
+	}
+
+	return files, nil
+}
+
+func (d *jobDir) status(dir *srv.File) *srv.File {
+	f := new(srv.File)
+	f.Init(dir, "status", nil, nil, 0444, &statusFile{d.j, d.name})
+	return f
+}
+
+func (d *jobDir) Lookup(fid *srv.FFid, name string) (*srv.File, error) {
+	if name != "status" {
+		return nil, srv.Enoent
+	}
+
+	return d.status(fid.F), nil
+}
+
+func (d *jobDir) Readdir(fid *srv.FFid) ([]*srv.File, error) {
+	return []*srv.File{d.status(fid.F)}, nil
+}
+
+func (d *jobDir) Release(f *srv.File) {
+	d.j.Lock()
+	d.j.released[d.name]++
+	d.j.Unlock()
+}
+
+func (s *statusFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	s.j.Lock()
+	b := []byte(s.j.status[s.name])
+	s.j.Unlock()
+	if offset > uint64(len(b)) {
+		return 0, nil
+	}
+
+	return copy(buf, b[offset:]), nil
+}
+
+func (s *statusFile) Release(f *srv.File) {
+	s.j.Lock()
+	s.j.released[s.name+"/status"]++
+	s.j.Unlock()
+}
+
+// Waits for the clunks to release the files.
+func (j *jobs) waitReleased(t *testing.T, name string, n int) {
+	t.Helper()
+	m := 0
+	for i := 0; i < 100; i++ {
+		j.Lock()
+		m = j.released[name]
+		j.Unlock()
+		if m == n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("%s released %d times, expected %d", name, m, n)
+}
+
+func TestFsrvDynamic(t *testing.T) {
+	j := &jobs{
+		status:   map[string]string{"1": "running", "2": "done"},
+		released: make(map[string]int),
+	}
+
+	root := new(srv.File)
+	if err := root.Add(nil, "/", nil, nil, ninep.DMDIR|0555, nil); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	dir := new(srv.File)
+	if err := dir.Add(root, "jobs", nil, nil, ninep.DMDIR|0555, j); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	c := startFsrv(t, root)
+	defer c.Unmount()
+
+	fsys := clnt.NewFS(c)
+	des, err := fs.ReadDir(fsys, "jobs")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+
+	sort.Strings(names)
+	if s := strings.Join(names, " "); s != "1 2" {
+		t.Errorf("jobs: got %q", s)
+	}
+
+	b, err := fs.ReadFile(fsys, "jobs/1/status")
+	if err != nil || string(b) != "running" {
+		t.Errorf("jobs/1/status: %q %v", b, err)
+	}
+
+	if _, err := c.FStat("jobs/3"); err == nil {
+		t.Errorf("jobs/3 exists")
+	}
+
+	// the generated files get the same Qids, in walks and reads
+	d1, err := c.FStat("jobs/2")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	d2, err := c.FStat("jobs/2")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	d3, err := c.FStat("jobs/1")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if d1.Qid != d2.Qid || d1.Qid == d3.Qid {
+		t.Errorf("Qids: %v %v %v", d1.Qid, d2.Qid, d3.Qid)
+	}
+
+	for _, de := range des {
+		fi, _ := de.Info()
+		if d := fi.Sys().(*ninep.Dir); d.Name == "2" && d.Qid != d1.Qid {
+			t.Errorf("Qid in readdir: %v, walk: %v", d.Qid, d1.Qid)
+		}
+	}
+
+	// the job directory is kept while its status file is used
+	j.waitReleased(t, "2", 2)
+	f, err := c.FOpen("jobs/2/status", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	j.Lock()
+	j.status["2"] = "archived"
+	j.Unlock()
+
+	buf := make([]byte, 100)
+	n, err := f.ReadAt(buf, 0)
+	if string(buf[0:n]) != "archived" {
+		t.Errorf("jobs/2/status: %q %v", buf[0:n], err)
+	}
+
+	j.waitReleased(t, "2", 2)
+	f.Close()
+	j.waitReleased(t, "2/status", 1)
+	j.waitReleased(t, "2", 3)
+}
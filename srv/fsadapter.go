@@ -0,0 +1,380 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+
+	"github.com/lionkov/ninep"
+)
+
+// Node identifies a file of a FileSystem. The FileSystem decides what
+// the Node values are, the adapter only passes them back.
+type Node interface{}
+
+// FileSystem is a higher level interface for implementing file servers.
+// FSAdapter converts it to ReqOps, keeping track of the fids, directory
+// offsets and converting the returned errors to ninep.Error.
+type FileSystem interface {
+	// Attach returns the root of the file tree selected by aname.
+	Attach(user ninep.User, aname string) (Node, error)
+
+	// Lookup returns the file name in the directory dir. The name
+	// ".." is the parent of dir, the root is its own parent.
+	Lookup(dir Node, name string) (Node, error)
+
+	// Getattr returns the metadata of the file. The Qid must
+	// identify the file.
+	Getattr(n Node) (*ninep.Dir, error)
+
+	// Setattr changes the metadata of the file. The fields of dir
+	// that have the "don't touch" values (see ninep.NewWstatDir)
+	// are not changed. Name is always empty, renames are done by
+	// Rename. If all fields are "don't touch", the file should be
+	// synced to stable storage.
+	Setattr(n Node, dir *ninep.Dir) error
+
+	// Open checks if the file can be opened in mode (ninep.O*
+	// values) and truncates it if the mode includes OTRUNC.
+	Open(n Node, mode uint8) error
+
+	// Create creates and opens a file in the directory dir.
+	Create(dir Node, name string, perm uint32, mode uint8) (Node, error)
+
+	// Mkdir creates a directory in dir.
+	Mkdir(dir Node, name string, perm uint32) (Node, error)
+
+	// ReadAt reads from the opened file n. Returns 0 at the end
+	// of the file.
+	ReadAt(n Node, buf []byte, offset int64) (int, error)
+
+	// WriteAt writes to the opened file n. Like with io.WriterAt,
+	// buf must not be kept after WriteAt returns.
+	WriteAt(n Node, buf []byte, offset int64) (int, error)
+
+	// Readdir returns all entries of the opened directory n. It is
+	// called when a client reads the directory from offset 0.
+	Readdir(n Node) ([]*ninep.Dir, error)
+
+	// Remove removes the file.
+	Remove(n Node) error
+
+	// Rename changes the name of the file, the file stays in the
+	// same directory.
+	Rename(n Node, newname string) error
+}
+
+// This interface should be implemented if the FileSystem needs to be
+// called when an opened file is closed.
+type FileSystemCloser interface {
+	Close(n Node) error
+}
+
+// FSAdapter serves a FileSystem.
+type FSAdapter struct {
+	Srv
+	FS FileSystem
+}
+
+type fsFid struct {
+	node   Node
+	opened bool
+	dirs   []*ninep.Dir // directory entries not read yet
+	diroff uint64       // offset of the next directory read
+}
+
+// Verify that we correctly implement ReqOps
+var _ = ReqOps(&FSAdapter{})
+
+// Returns an adapter serving the FileSystem.
+func NewFSAdapter(fs FileSystem) *FSAdapter {
+	return &FSAdapter{FS: fs}
+}
+
+// Converts a Go error to ninep.Error. The ninep.Errors are returned
+// unchanged, syscall.Errno values keep their number, and the errors
+// matching the io/fs errors get the corresponding error number.
+func ToError(err error) *ninep.Error {
+	var nerr *ninep.Error
+	var errno syscall.Errno
+
+	switch {
+	case errors.As(err, &nerr):
+		return nerr
+	case errors.As(err, &errno):
+		return &ninep.Error{errno.Error(), uint32(errno)}
+	case errors.Is(err, fs.ErrNotExist):
+		return &ninep.Error{err.Error(), ninep.ENOENT}
+	case errors.Is(err, fs.ErrExist):
+		return &ninep.Error{err.Error(), ninep.EEXIST}
+	case errors.Is(err, fs.ErrPermission):
+		return &ninep.Error{err.Error(), ninep.EPERM}
+	case errors.Is(err, fs.ErrInvalid):
+		return &ninep.Error{err.Error(), ninep.EINVAL}
+	}
+
+	return &ninep.Error{err.Error(), ninep.EIO}
+}
+
+func (a *FSAdapter) qid(n Node) (*ninep.Qid, error) {
+	d, err := a.FS.Getattr(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d.Qid, nil
+}
+
+func (a *FSAdapter) FidDestroy(sfid *Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*fsFid)
+	if c, ok := a.FS.(FileSystemCloser); ok && fid.opened {
+		c.Close(fid.node)
+	}
+}
+
+func (a *FSAdapter) Attach(req *Req) {
+	if req.Afid != nil && a.Auth == nil {
+		req.RespondError(Enoauth)
+		return
+	}
+
+	n, err := a.FS.Attach(req.Fid.User, req.Tc.Aname)
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	qid, err := a.qid(n)
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.Fid.Aux = &fsFid{node: n}
+	req.RespondRattach(qid)
+}
+
+func (*FSAdapter) Flush(req *Req) {}
+
+func (a *FSAdapter) Walk(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	tc := req.Tc
+
+	wqids := make([]ninep.Qid, len(tc.Wname))
+	n := fid.node
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		nn, err := a.FS.Lookup(n, tc.Wname[i])
+		var qid *ninep.Qid
+		if err == nil {
+			qid, err = a.qid(nn)
+		}
+
+		if err != nil {
+			if i == 0 {
+				req.RespondError(ToError(err))
+				return
+			}
+
+			break
+		}
+
+		wqids[i] = *qid
+		n = nn
+	}
+
+	req.Newfid.Aux = &fsFid{node: n}
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (a *FSAdapter) Open(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	if err := a.FS.Open(fid.node, req.Tc.Mode); err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	fid.opened = true
+	qid, err := a.qid(fid.node)
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.RespondRopen(qid, 0)
+}
+
+func (a *FSAdapter) Create(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	tc := req.Tc
+
+	var n Node
+	var err error
+	if tc.Perm&ninep.DMDIR != 0 {
+		n, err = a.FS.Mkdir(fid.node, tc.Name, tc.Perm)
+		if err == nil {
+			err = a.FS.Open(n, tc.Mode)
+		}
+	} else {
+		n, err = a.FS.Create(fid.node, tc.Name, tc.Perm, tc.Mode)
+	}
+
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	fid.node = n
+	fid.opened = true
+	qid, err := a.qid(n)
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.RespondRcreate(qid, 0)
+}
+
+func (a *FSAdapter) Read(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	tc := req.Tc
+	rc := req.Rc
+
+	ninep.InitRread(rc, tc.Count)
+	if req.Fid.Type&ninep.QTDIR == 0 {
+		n, err := a.FS.ReadAt(fid.node, rc.Data, int64(tc.Offset))
+		if err != nil && err != io.EOF {
+			req.RespondError(ToError(err))
+			return
+		}
+
+		ninep.SetRreadCount(rc, uint32(n))
+		req.Respond()
+		return
+	}
+
+	if tc.Offset == 0 {
+		dirs, err := a.FS.Readdir(fid.node)
+		if err != nil {
+			req.RespondError(ToError(err))
+			return
+		}
+
+		fid.dirs = dirs
+		fid.diroff = 0
+	} else if tc.Offset != fid.diroff {
+		req.RespondError(Ebadoffset)
+		return
+	}
+
+	// only return whole entries
+	n := 0
+	b := rc.Data
+	for len(fid.dirs) > 0 {
+		nd := ninep.PackDir(fid.dirs[0], req.Conn.Dotu)
+		if len(nd) > len(b) {
+			break
+		}
+
+		copy(b, nd)
+		b = b[len(nd):]
+		n += len(nd)
+		fid.dirs = fid.dirs[1:]
+	}
+
+	if n == 0 && len(fid.dirs) > 0 {
+		req.RespondError(&ninep.Error{"too small read size for dir entry", ninep.EINVAL})
+		return
+	}
+
+	fid.diroff += uint64(n)
+	ninep.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+func (a *FSAdapter) Write(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	tc := req.Tc
+
+	n, err := a.FS.WriteAt(fid.node, tc.Data, int64(tc.Offset))
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (*FSAdapter) Clunk(req *Req) { req.RespondRclunk() }
+
+func (a *FSAdapter) Remove(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	if err := a.FS.Remove(fid.node); err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (a *FSAdapter) Stat(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	d, err := a.FS.Getattr(fid.node)
+	if err != nil {
+		req.RespondError(ToError(err))
+		return
+	}
+
+	req.RespondRstat(d)
+}
+
+func (a *FSAdapter) Wstat(req *Req) {
+	fid := req.Fid.Aux.(*fsFid)
+	dir := req.Tc.Dir
+	if !req.Conn.Dotu {
+		// the 9P2000 stats don't have the numeric ids
+		dir.Ext = ""
+		dir.Uidnum, dir.Gidnum, dir.Muidnum = ninep.NOUID, ninep.NOUID, ninep.NOUID
+	}
+
+	// a wstat that only changes the name doesn't call Setattr
+	setattr := true
+	if dir.Name != "" {
+		d, err := a.FS.Getattr(fid.node)
+		if err != nil {
+			req.RespondError(ToError(err))
+			return
+		}
+
+		if dir.Name != d.Name {
+			if err := a.FS.Rename(fid.node, dir.Name); err != nil {
+				req.RespondError(ToError(err))
+				return
+			}
+		}
+
+		wd := ninep.NewWstatDir()
+		wd.Name = dir.Name
+		wd.Size = dir.Size
+		setattr = dir != *wd
+		dir.Name = ""
+	}
+
+	if setattr {
+		if err := a.FS.Setattr(fid.node, &dir); err != nil {
+			req.RespondError(ToError(err))
+			return
+		}
+	}
+
+	req.RespondRwstat()
+}
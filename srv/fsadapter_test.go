@@ -0,0 +1,322 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+// A small in-memory FileSystem
+type memNode struct {
+	dir      ninep.Dir
+	data     []byte
+	parent   *memNode
+	children map[string]*memNode
+}
+
+type memFS struct {
+	root     *memNode
+	qpath    uint64
+	setattrs int
+}
+
+func newMemFS() *memFS {
+	m := new(memFS)
+	m.root = m.newNode(nil, "/", ninep.DMDIR|0777)
+	m.root.parent = m.root
+	return m
+}
+
+func (m *memFS) newNode(parent *memNode, name string, perm uint32) *memNode {
+	m.qpath++
+	n := &memNode{parent: parent}
+	n.dir.Name = name
+	n.dir.Mode = perm
+	n.dir.Qid.Path = m.qpath
+	n.dir.Uid, n.dir.Gid, n.dir.Muid = "none", "none", "none"
+	if perm&ninep.DMDIR != 0 {
+		n.dir.Qid.Type = ninep.QTDIR
+		n.children = make(map[string]*memNode)
+	}
+
+	if parent != nil {
+		parent.children[name] = n
+	}
+
+	return n
+}
+
+func (m *memFS) Attach(user ninep.User, aname string) (srv.Node, error) { return m.root, nil }
+
+func (m *memFS) Lookup(dir srv.Node, name string) (srv.Node, error) {
+	d := dir.(*memNode)
+	if name == ".." {
+		return d.parent, nil
+	}
+
+	if n, ok := d.children[name]; ok {
+		return n, nil
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+func (m *memFS) Getattr(n srv.Node) (*ninep.Dir, error) {
+	d := n.(*memNode).dir
+	d.Length = uint64(len(n.(*memNode).data))
+	return &d, nil
+}
+
+func (m *memFS) Setattr(n srv.Node, dir *ninep.Dir) error {
+	m.setattrs++
+	mn := n.(*memNode)
+	if dir.Mode != ^uint32(0) {
+		mn.dir.Mode = mn.dir.Mode&ninep.DMDIR | dir.Mode&0777
+	}
+
+	if dir.Length != ^uint64(0) {
+		mn.data = mn.data[0:dir.Length]
+	}
+
+	return nil
+}
+
+func (m *memFS) Open(n srv.Node, mode uint8) error {
+	if mode&ninep.OTRUNC != 0 {
+		n.(*memNode).data = nil
+	}
+
+	return nil
+}
+
+func (m *memFS) Create(dir srv.Node, name string, perm uint32, mode uint8) (srv.Node, error) {
+	if _, ok := dir.(*memNode).children[name]; ok {
+		return nil, fs.ErrExist
+	}
+
+	return m.newNode(dir.(*memNode), name, perm), nil
+}
+
+func (m *memFS) Mkdir(dir srv.Node, name string, perm uint32) (srv.Node, error) {
+	return m.Create(dir, name, perm, 0)
+}
+
+func (m *memFS) ReadAt(n srv.Node, buf []byte, offset int64) (int, error) {
+	data := n.(*memNode).data
+	if offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+
+	return copy(buf, data[offset:]), nil
+}
+
+func (m *memFS) WriteAt(n srv.Node, buf []byte, offset int64) (int, error) {
+	mn := n.(*memNode)
+	if end := int(offset) + len(buf); end > len(mn.data) {
+		mn.data = append(mn.data, make([]byte, end-len(mn.data))...)
+	}
+
+	return copy(mn.data[offset:], buf), nil
+}
+
+func (m *memFS) Readdir(n srv.Node) ([]*ninep.Dir, error) {
+	var dirs []*ninep.Dir
+	for _, c := range n.(*memNode).children {
+		d, _ := m.Getattr(c)
+		dirs = append(dirs, d)
+	}
+
+	return dirs, nil
+}
+
+func (m *memFS) Remove(n srv.Node) error {
+	mn := n.(*memNode)
+	if len(mn.children) > 0 {
+		return &ninep.Error{"directory not empty", ninep.ENOTEMPTY}
+	}
+
+	delete(mn.parent.children, mn.dir.Name)
+	return nil
+}
+
+func (m *memFS) Rename(n srv.Node, newname string) error {
+	mn := n.(*memNode)
+	delete(mn.parent.children, mn.dir.Name)
+	mn.dir.Name = newname
+	mn.parent.children[newname] = mn
+	return nil
+}
+
+func TestFSAdapter(t *testing.T) {
+	a := srv.NewFSAdapter(newMemFS())
+	a.Dotu = true
+	a.Id = "memfs"
+	if !a.Start(a) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go a.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer c.Unmount()
+
+	d, err := c.FCreate("dir", ninep.DMDIR|0755, ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FCreate dir: %v", err)
+	}
+	d.Close()
+
+	names := []string{"dir/a", "dir/b", "dir/c"}
+	for _, name := range names {
+		f, err := c.FCreate(name, 0644, ninep.OWRITE)
+		if err != nil {
+			t.Fatalf("FCreate %v: %v", name, err)
+		}
+
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatalf("Write %v: %v", name, err)
+		}
+		f.Close()
+	}
+
+	if _, err := c.FCreate("dir/a", 0644, ninep.OWRITE); err == nil {
+		t.Errorf("FCreate of an existing file succeeded")
+	} else if e, ok := err.(*ninep.Error); !ok || e.Errornum != ninep.EEXIST {
+		t.Errorf("FCreate: want EEXIST, got %v", err)
+	}
+
+	f, err := c.FOpen("dir/b", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != "dir/b" {
+		t.Errorf("Read: want dir/b, got %q, %v", b, err)
+	}
+	f.Close()
+
+	// rename and truncate with one wstat
+	fid, err := c.FWalk("dir/c")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+
+	wd := ninep.NewWstatDir()
+	wd.Name = "z"
+	wd.Length = 1
+	if err := c.Wstat(fid, wd); err != nil {
+		t.Fatalf("Wstat: %v", err)
+	}
+	c.Clunk(fid)
+
+	st, err := c.FStat("dir/z")
+	if err != nil || st.Length != 1 {
+		t.Errorf("FStat: want length 1, got %v, %v", st, err)
+	}
+
+	// read the directory with a small buffer to exercise the offsets
+	f, err = c.FOpen("dir", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	var got []string
+	var offset uint64
+	for {
+		b, err := c.Read(f.Fid(), offset, 100)
+		if err != nil {
+			t.Fatalf("Read dir: %v", err)
+		}
+
+		if len(b) == 0 {
+			break
+		}
+
+		offset += uint64(len(b))
+		for len(b) > 0 {
+			var d *ninep.Dir
+			d, b, _, err = ninep.UnpackDir(b, true)
+			if err != nil {
+				t.Fatalf("UnpackDir: %v", err)
+			}
+
+			got = append(got, d.Name)
+		}
+	}
+	f.Close()
+
+	sort.Strings(got)
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "z" {
+		t.Errorf("Readdir: want [a b z], got %v", got)
+	}
+
+	if err := c.FRemove("dir"); err == nil {
+		t.Errorf("FRemove of a non-empty directory succeeded")
+	}
+
+	if _, err := c.FStat("dir/missing"); err == nil {
+		t.Errorf("FStat of a missing file succeeded")
+	} else if e, ok := err.(*ninep.Error); !ok || e.Errornum != ninep.ENOENT {
+		t.Errorf("FStat: want ENOENT, got %v", err)
+	}
+}
+
+func TestFSAdapterRename(t *testing.T) {
+	m := newMemFS()
+	m.newNode(m.root, "file", 0644)
+	a := srv.NewFSAdapter(m)
+	a.Id = "memfs"
+	if !a.Start(a) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go a.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer c.Unmount()
+
+	// a 9P2000 rename doesn't call Setattr
+	fid, err := c.FWalk("file")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+
+	wd := ninep.NewWstatDir()
+	wd.Name = "renamed"
+	if err := c.Wstat(fid, wd); err != nil {
+		t.Fatalf("Wstat: %v", err)
+	}
+
+	if _, err := c.FStat("renamed"); err != nil || m.setattrs != 0 {
+		t.Errorf("renamed: %v, Setattr calls: %d", err, m.setattrs)
+	}
+}
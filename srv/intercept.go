@@ -0,0 +1,343 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lionkov/ninep"
+)
+
+// Interceptors observe the requests before they are passed to the
+// file server, and their responses before they are sent back to the
+// client. Unlike ReqProcessOps, any number of interceptors can be
+// added to a server (see (*Srv) Use). They are called in the order
+// they were added for the requests, and in reverse order for the
+// responses.
+//
+// The interceptors are called from (*Req) Process, if the file server
+// implements ReqProcessOps and doesn't call Process, they are not
+// called.
+type Interceptor interface {
+	// Called before the request is passed to the next interceptor,
+	// or to the file server. The Fid (and Dfid) fields of the
+	// request are set, the Afid and Newfid fields are not. If the
+	// interceptor responds to the request, it is not passed further.
+	Request(req *Req)
+
+	// Called when the request is responded, before the post
+	// processing of the request and before the response is sent.
+	// Only the interceptors that were called for the request are
+	// called for the response. The interceptor can inspect or
+	// change req.Rc.
+	Response(req *Req)
+}
+
+// Adds interceptors at the end of the server's chain. Should be
+// called before the server is started.
+func (srv *Srv) Use(ics ...Interceptor) {
+	srv.interceptors = append(srv.interceptors, ics...)
+}
+
+// Passes the request through the interceptors. Returns false if one
+// of them responded to it.
+func (req *Req) intercept() bool {
+	for _, ic := range req.Conn.Srv.interceptors {
+		req.nicpt++
+		ic.Request(req)
+
+		req.Lock()
+		responded := req.status&reqResponded != 0
+		req.Unlock()
+		if responded {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Passes the response through the interceptors that saw the request.
+func (req *Req) interceptResponse() {
+	ics := req.Conn.Srv.interceptors
+	for i := req.nicpt - 1; i >= 0; i-- {
+		ics[i].Response(req)
+	}
+}
+
+// Returns the paths of the files the request refers to. The first
+// path is the one of the request's fid, the next ones (if any) are the
+// files the request creates, removes or walks to.
+func reqPaths(req *Req) []string {
+	if req.Fid == nil {
+		return nil
+	}
+
+	tc := req.Tc
+	fpath := req.Fid.Pathname()
+	switch tc.Type {
+	case ninep.Twalk:
+		if len(tc.Wname) > 0 {
+			return []string{fpath, walkPath(fpath, tc.Wname)}
+		}
+
+	case ninep.Tcreate, ninep.Tlcreate, ninep.Tsymlink, ninep.Tmknod, ninep.Tmkdir, ninep.Tunlinkat:
+		return []string{fpath, path.Join(fpath, tc.Name)}
+
+	case ninep.Trenameat:
+		if req.Dfid != nil {
+			return []string{fpath, path.Join(fpath, tc.Name), path.Join(req.Dfid.Pathname(), tc.Newname)}
+		}
+
+	case ninep.Trename, ninep.Tlink:
+		if req.Dfid != nil {
+			return []string{fpath, path.Join(req.Dfid.Pathname(), tc.Name)}
+		}
+
+	case ninep.Twstat:
+		if tc.Dir.Name != "" {
+			return []string{fpath, wstatPath(fpath, tc.Dir.Name)}
+		}
+	}
+
+	return []string{fpath}
+}
+
+// Returns the path a Twstat renames the file to. Some servers (ufs)
+// take an absolute name as a path from the root.
+func wstatPath(fpath, name string) string {
+	if strings.HasPrefix(name, "/") {
+		return path.Clean(name)
+	}
+
+	return path.Join(path.Dir(fpath), name)
+}
+
+// Returns the path of the file the request removes or renames, if any.
+func removedPath(req *Req) string {
+	tc := req.Tc
+	switch tc.Type {
+	case ninep.Tremove, ninep.Trename:
+		return req.Fid.Pathname()
+
+	case ninep.Tunlinkat, ninep.Trenameat:
+		return path.Join(req.Fid.Pathname(), tc.Name)
+
+	case ninep.Twstat:
+		if tc.Dir.Name != "" {
+			return req.Fid.Pathname()
+		}
+	}
+
+	return ""
+}
+
+// Returns the path a symbolic link created by the request points to,
+// if any. Relative targets are resolved from the link's directory,
+// absolute ones from the root.
+func symlinkPath(req *Req) string {
+	tc := req.Tc
+	var target string
+	switch {
+	case tc.Type == ninep.Tsymlink:
+		target = tc.Target
+
+	case tc.Type == ninep.Tcreate && tc.Perm&ninep.DMSYMLINK != 0:
+		target = tc.Ext
+
+	default:
+		return ""
+	}
+
+	if strings.HasPrefix(target, "/") {
+		return path.Clean(target)
+	}
+
+	return path.Join(req.Fid.Pathname(), target)
+}
+
+// The AccessLog interceptor logs a line for each request with the
+// client's address, the user, the message type, the paths of the
+// files, the result and the time it took. If Log is nil and the
+// connection has a structured logger (Conn.Slog), an Info record with
+// the same fields is logged on it instead.
+type AccessLog struct {
+	Log *log.Logger // If nil, the standard logger is used
+}
+
+func (*AccessLog) Request(req *Req) {}
+
+func (a *AccessLog) Response(req *Req) {
+	user := "-"
+	if req.Fid != nil && req.Fid.User != nil {
+		user = req.Fid.User.Name()
+	} else if req.Tc.Uname != "" {
+		user = req.Tc.Uname
+	}
+
+	p := "-"
+	if ps := reqPaths(req); ps != nil && ps[0] != "" {
+		p = strings.Join(ps, " -> ")
+	}
+
+	var result string
+	req.Lock()
+	flushed := req.status&reqFlush != 0
+	req.Unlock()
+	switch {
+	case flushed:
+		result = "flushed"
+	case req.Rc.Type == ninep.Rerror:
+		result = fmt.Sprintf("error %q (%d)", req.Rc.Error, req.Rc.Errornum)
+	case req.Rc.Type == ninep.Rlerror:
+		result = fmt.Sprintf("error %d", req.Rc.Errornum)
+	default:
+		result = "ok"
+	}
+
+	d := time.Since(req.start)
+	if a.Log == nil && req.Conn.Slog != nil {
+		req.Conn.Slog.LogAttrs(context.Background(), slog.LevelInfo, "access", slog.String("user", user),
+			slog.Int("tag", int(req.Tc.Tag)), slog.String("type", ninep.MsgName(req.Tc.Type)),
+			slog.String("path", p), slog.String("result", result), slog.Duration("duration", d))
+		return
+	}
+
+	msg := fmt.Sprintf("%s %s %s %s %s %v", req.Conn.Id, user, ninep.MsgName(req.Tc.Type), p, result, d)
+	if a.Log != nil {
+		a.Log.Println(msg)
+	} else {
+		log.Println(msg)
+	}
+}
+
+// 9P2000.L open flags
+const (
+	lO_ACCMODE = 03
+	lO_TRUNC   = 01000
+)
+
+// The ReadOnly interceptor refuses all requests that modify the
+// files, or open them for writing, with Erofs.
+type ReadOnly struct{}
+
+func (ReadOnly) Request(req *Req) {
+	tc := req.Tc
+	deny := false
+	switch tc.Type {
+	case ninep.Tcreate, ninep.Tremove, ninep.Twstat,
+		ninep.Tlcreate, ninep.Tsymlink, ninep.Tmknod, ninep.Trename, ninep.Tsetattr,
+		ninep.Txattrcreate, ninep.Tlink, ninep.Tmkdir, ninep.Trenameat, ninep.Tunlinkat:
+		deny = true
+
+	case ninep.Twrite:
+		// writes to the authentication fids are part of the protocol
+		deny = req.Fid == nil || req.Fid.Type&ninep.QTAUTH == 0
+
+	case ninep.Topen:
+		m := tc.Mode & 3
+		deny = m == ninep.OWRITE || m == ninep.ORDWR || tc.Mode&(ninep.OTRUNC|ninep.ORCLOSE) != 0
+
+	case ninep.Tlopen:
+		deny = tc.Flags&lO_ACCMODE != 0 || tc.Flags&lO_TRUNC != 0
+	}
+
+	if deny {
+		req.RespondError(Erofs)
+	}
+}
+
+func (ReadOnly) Response(req *Req) {}
+
+// The DenyList interceptor refuses access, with Eperm, to the listed
+// files and everything under them. The paths are relative to the
+// root of the attach, the same for all attach names.
+//
+// The files are recognized by the paths the clients walk, the
+// interceptor doesn't know about the symbolic links in the tree. A
+// symbolic link that was there before, pointing to a denied file, can
+// be used to access it. The clients can't create such links, and
+// can't remove or rename the directories the denied files are in.
+type DenyList struct {
+	paths []string
+}
+
+// Creates a DenyList interceptor for the paths.
+func NewDenyList(paths ...string) *DenyList {
+	d := new(DenyList)
+	for _, p := range paths {
+		d.paths = append(d.paths, path.Join("/", p))
+	}
+
+	return d
+}
+
+// Returns true if the file is one of the denied files, or under them.
+func (d *DenyList) Denied(p string) bool {
+	for _, dp := range d.paths {
+		if p == dp || dp == "/" || (strings.HasPrefix(p, dp) && p[len(dp)] == '/') {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if a denied file is under the directory.
+func (d *DenyList) ancestor(p string) bool {
+	for _, dp := range d.paths {
+		if p == "/" || strings.HasPrefix(dp, p+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *DenyList) Request(req *Req) {
+	if req.Fid == nil {
+		return
+	}
+
+	denied := false
+	if tc := req.Tc; tc.Type == ninep.Twalk {
+		// check the files the walk goes through too
+		p := req.Fid.Pathname()
+		denied = d.Denied(p)
+		for i := 0; !denied && i < len(tc.Wname); i++ {
+			p = path.Join(p, tc.Wname[i])
+			denied = d.Denied(p)
+		}
+	} else {
+		for _, p := range reqPaths(req) {
+			if d.Denied(p) {
+				denied = true
+				break
+			}
+		}
+
+		// moving a directory would move the denied files out of the
+		// list, a link to it would give access to them
+		if p := removedPath(req); p != "" && d.ancestor(p) {
+			denied = true
+		}
+
+		if p := symlinkPath(req); p != "" && (d.Denied(p) || d.ancestor(p)) {
+			denied = true
+		}
+	}
+
+	if denied {
+		req.RespondError(Eperm)
+	}
+}
+
+func (*DenyList) Response(req *Req) {}
@@ -0,0 +1,287 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package srv_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Records the requests and responses it sees.
+type recorder struct {
+	name   string
+	events *events
+}
+
+type events struct {
+	sync.Mutex
+	list []string
+	buf  bytes.Buffer
+}
+
+func (e *events) add(ev string) {
+	e.Lock()
+	e.list = append(e.list, ev)
+	e.Unlock()
+}
+
+func (e *events) Write(p []byte) (int, error) {
+	e.Lock()
+	defer e.Unlock()
+	return e.buf.Write(p)
+}
+
+func (e *events) String() string {
+	e.Lock()
+	defer e.Unlock()
+	return strings.Join(e.list, " ") + "\n" + e.buf.String()
+}
+
+func (r *recorder) Request(req *srv.Req) {
+	r.events.add(r.name + ">" + ninep.MsgName(req.Tc.Type))
+}
+
+func (r *recorder) Response(req *srv.Req) {
+	r.events.add(r.name + "<" + ninep.MsgName(req.Tc.Type))
+}
+
+// Starts a memFS server with the interceptors and mounts it.
+func mountMemFS(t *testing.T, m *memFS, ics ...srv.Interceptor) *clnt.Clnt {
+	a := srv.NewFSAdapter(m)
+	a.Use(ics...)
+	return mountFS(t, a)
+}
+
+// Starts the server and mounts it.
+func mountFS(t *testing.T, a *srv.FSAdapter) *clnt.Clnt {
+	a.Dotu = true
+	a.Id = "memfs"
+	if !a.Start(a) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go a.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+func TestInterceptors(t *testing.T) {
+	m := newMemFS()
+	m.newNode(m.newNode(m.root, "secret", ninep.DMDIR|0755), "key", 0644)
+	ev := new(events)
+	c := mountMemFS(t, m,
+		&srv.AccessLog{Log: log.New(ev, "", 0)},
+		&recorder{"a", ev},
+		&recorder{"b", ev},
+		srv.NewDenyList("secret"),
+		&recorder{"c", ev})
+	defer c.Unmount()
+
+	f, err := c.FCreate("pub", 0644, ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+
+	for _, name := range []string{"secret", "secret/key", "pub/../secret"} {
+		ev.Lock()
+		ev.list = nil
+		ev.Unlock()
+		if _, err := c.FWalk(name); err == nil {
+			t.Errorf("FWalk %v succeeded", name)
+		} else if e, ok := err.(*ninep.Error); !ok || e.Errornum != ninep.EPERM {
+			t.Errorf("FWalk %v: want EPERM, got %v", name, err)
+		}
+
+		// the deny list stops the request before c
+		want := "a>Twalk b>Twalk b<Twalk a<Twalk\n"
+		if s := ev.String(); !strings.HasPrefix(s, want) {
+			t.Errorf("FWalk %v: want events %q, got %q", name, want, s)
+		}
+	}
+
+	ev.Lock()
+	ev.list = nil
+	ev.Unlock()
+	if _, err := c.FStat("pub"); err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	s := ev.String()
+	if !strings.HasPrefix(s, "a>Twalk b>Twalk c>Twalk c<Twalk b<Twalk a<Twalk a>Tstat b>Tstat c>Tstat c<Tstat b<Tstat a<Tstat") {
+		t.Errorf("bad order of the interceptors: %q", s)
+	}
+
+	for _, l := range []string{
+		" Tattach - ok ",
+		" Tcreate / -> /pub ok ",
+		" Twalk / -> /secret error ",
+		" Tstat /pub ok ",
+	} {
+		if !strings.Contains(s, l) {
+			t.Errorf("access log doesn't contain %q:\n%s", l, s)
+		}
+	}
+}
+
+func TestDenyList(t *testing.T) {
+	m := newMemFS()
+	dir := m.newNode(m.root, "dir", ninep.DMDIR|0755)
+	m.newNode(m.newNode(dir, "secret", ninep.DMDIR|0755), "key", 0644)
+	m.newNode(dir, "pub", 0644)
+	c := mountMemFS(t, m, srv.NewDenyList("dir/secret"))
+	defer c.Unmount()
+
+	eperm := func(what string, err error) {
+		if e, ok := err.(*ninep.Error); !ok || e.Errornum != ninep.EPERM {
+			t.Errorf("%s: want EPERM, got %v", what, err)
+		}
+	}
+
+	rename := func(name, newname string) error {
+		fid, err := c.FWalk(name)
+		if err != nil {
+			return err
+		}
+		defer c.Clunk(fid)
+
+		d := ninep.NewWstatDir()
+		d.Name = newname
+		return c.Wstat(fid, d)
+	}
+
+	symlink := func(name, target string) error {
+		fid, err := c.FWalk("dir")
+		if err != nil {
+			return err
+		}
+		defer c.Clunk(fid)
+
+		return c.Create(fid, name, ninep.DMSYMLINK|0777, ninep.OREAD, target)
+	}
+
+	// the directories with denied files can't be moved away
+	eperm("rename dir", rename("dir", "moved"))
+	eperm("remove dir", c.FRemove("dir"))
+	eperm("rename to secret", rename("dir/pub", "secret"))
+	eperm("rename to /dir/secret/pub", rename("dir/pub", "/dir/secret/pub"))
+	if err := rename("dir/pub", "pub2"); err != nil {
+		t.Errorf("rename dir/pub: %v", err)
+	}
+
+	// and the links to them can't be created
+	eperm("symlink to secret", symlink("l1", "secret/key"))
+	eperm("symlink to ..", symlink("l2", ".."))
+	eperm("symlink to /dir", symlink("l3", "/dir"))
+}
+
+func TestReadOnly(t *testing.T) {
+	m := newMemFS()
+	f := m.newNode(m.root, "file", 0666)
+	f.data = []byte("data")
+	f.dir.Length = 4
+	c := mountMemFS(t, m, srv.ReadOnly{})
+	defer c.Unmount()
+
+	rf, err := c.FOpen("file", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	b, err := io.ReadAll(rf)
+	if err != nil || string(b) != "data" {
+		t.Errorf("Read: want data, got %q, %v", b, err)
+	}
+	rf.Close()
+
+	erofs := func(op string, err error) {
+		if err == nil {
+			t.Errorf("%v succeeded", op)
+		} else if e, ok := err.(*ninep.Error); !ok || e.Errornum != ninep.EROFS {
+			t.Errorf("%v: want EROFS, got %v", op, err)
+		}
+	}
+
+	_, err = c.FOpen("file", ninep.OWRITE)
+	erofs("FOpen OWRITE", err)
+	_, err = c.FOpen("file", ninep.OREAD|ninep.OTRUNC)
+	erofs("FOpen OTRUNC", err)
+	_, err = c.FCreate("new", 0644, ninep.OWRITE)
+	erofs("FCreate", err)
+	erofs("FRemove", c.FRemove("file"))
+
+	fid, err := c.FWalk("file")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+
+	wd := ninep.NewWstatDir()
+	wd.Name = "other"
+	erofs("Wstat", c.Wstat(fid, wd))
+	c.Clunk(fid)
+}
+
+func TestSlog(t *testing.T) {
+	ev := new(events)
+	logger := slog.New(slog.NewTextHandler(ev, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	m := newMemFS()
+	f := m.newNode(m.root, "file", 0644)
+	f.data = []byte("data")
+	a := srv.NewFSAdapter(m)
+	a.Slog = logger
+	a.Debuglevel = srv.DbgPrintFcalls
+	a.Use(&srv.AccessLog{})
+
+	clnt.DefaultSlog = logger
+	clnt.DefaultDebuglevel = clnt.DbgPrintFcalls | clnt.DbgPrintPackets
+	c := mountFS(t, a)
+	clnt.DefaultSlog = nil
+	clnt.DefaultDebuglevel = 0
+	defer c.Unmount()
+
+	if _, err := c.FStat("file"); err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if _, err := c.FStat("nonexistent"); err == nil {
+		t.Fatalf("FStat of a nonexistent file succeeded")
+	}
+
+	out := ev.String()
+	for _, re := range []string{
+		`level=DEBUG msg=received conn=@ remote=@ tag=\d+ type=Tstat fid=\d+ path=/file\n`,
+		`level=DEBUG msg=sent conn=@ remote=@ tag=\d+ type=Rstat fid=\d+ path=/file duration=\S+\n`,
+		`level=DEBUG msg=sent conn=@ remote=@ tag=\d+ type=Rerror fid=\d+ path=/ duration=\S+ error="[^"]+" errno=2\n`,
+		`level=INFO msg=access conn=@ remote=@ user=\S+ tag=\d+ type=Twalk path="/ -> /nonexistent" result="error .*" duration=\S+\n`,
+		`level=DEBUG msg=sent clnt=\S+ tag=\d+ type=Tstat fid=\d+ path=/file packet=[0-9a-f]+\n`,
+		`level=DEBUG msg=received clnt=\S+ tag=\d+ type=Rstat fid=\d+ path=/file duration=\S+ packet=[0-9a-f]+\n`,
+	} {
+		if !regexp.MustCompile(re).MatchString(out) {
+			t.Errorf("no record matching %q in:\n%s", re, out)
+		}
+	}
+}
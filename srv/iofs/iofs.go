@@ -0,0 +1,385 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The iofs package provides a read-only 9P2000 file server that
+// exports an io/fs.FS, for example an embed.FS or a zip archive.
+package iofs
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+// The IOFS type serves the files of FS. All files are reported as
+// owned by User and Group.
+type IOFS struct {
+	srv.Srv
+	FS    fs.FS
+	User  string
+	Group string
+}
+
+type Fid struct {
+	path   string
+	file   fs.File
+	offset uint64        // offset of the next sequential read
+	dirs   []fs.DirEntry // directory entries read but not sent yet
+	eof    bool          // no more directory entries
+}
+
+var Enoent = &ninep.Error{"file not found", ninep.ENOENT}
+
+// Verify that we correctly implement ReqOps
+var _ = srv.ReqOps(&IOFS{})
+
+// Returns a server for the files of fsys.
+func New(fsys fs.FS) *IOFS {
+	return &IOFS{FS: fsys, User: "none", Group: "none"}
+}
+
+func toError(err error) *ninep.Error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return Enoent
+	case errors.Is(err, fs.ErrPermission):
+		return srv.Eperm.(*ninep.Error)
+	}
+
+	return &ninep.Error{err.Error(), ninep.EIO}
+}
+
+// Returns the Qid for the file. The path is derived from the name of
+// the file, so it doesn't change as long as the file isn't renamed.
+func fi2Qid(name string, fi fs.FileInfo) *ninep.Qid {
+	var qid ninep.Qid
+
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	qid.Path = h.Sum64()
+	qid.Version = uint32(fi.ModTime().Unix())
+	if fi.IsDir() {
+		qid.Type |= ninep.QTDIR
+	}
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		qid.Type |= ninep.QTSYMLINK
+	}
+
+	return &qid
+}
+
+func fi2Npmode(fi fs.FileInfo, dotu bool) uint32 {
+	ret := uint32(fi.Mode() & 0777)
+	if fi.IsDir() {
+		ret |= ninep.DMDIR
+	}
+
+	if dotu {
+		mode := fi.Mode()
+		if mode&fs.ModeSymlink != 0 {
+			ret |= ninep.DMSYMLINK
+		}
+
+		if mode&fs.ModeSocket != 0 {
+			ret |= ninep.DMSOCKET
+		}
+
+		if mode&fs.ModeNamedPipe != 0 {
+			ret |= ninep.DMNAMEDPIPE
+		}
+
+		if mode&fs.ModeDevice != 0 {
+			ret |= ninep.DMDEVICE
+		}
+	}
+
+	return ret
+}
+
+func (u *IOFS) fi2Dir(name string, fi fs.FileInfo, dotu bool) *ninep.Dir {
+	dir := new(ninep.Dir)
+	dir.Qid = *fi2Qid(name, fi)
+	dir.Mode = fi2Npmode(fi, dotu)
+	dir.Atime = uint32(fi.ModTime().Unix())
+	dir.Mtime = dir.Atime
+	if !fi.IsDir() {
+		dir.Length = uint64(fi.Size())
+	}
+
+	dir.Name = path.Base(name)
+	if name == "." {
+		dir.Name = "/"
+	}
+
+	dir.Uid = u.User
+	dir.Gid = u.Group
+	dir.Muid = "none"
+	if dotu {
+		dir.Uidnum = ninep.NOUID
+		dir.Gidnum = ninep.NOUID
+		dir.Muidnum = ninep.NOUID
+	}
+
+	return dir
+}
+
+func (*IOFS) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*Fid)
+	if fid.file != nil {
+		fid.file.Close()
+	}
+}
+
+func (u *IOFS) Attach(req *srv.Req) {
+	if req.Afid != nil && u.Auth == nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	// the aname selects a directory of the file system
+	name := strings.TrimPrefix(path.Clean("/"+req.Tc.Aname), "/")
+	if name == "" {
+		name = "."
+	}
+
+	fi, err := fs.Stat(u.FS, name)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.Fid.Aux = &Fid{path: name}
+	req.RespondRattach(fi2Qid(name, fi))
+}
+
+func (*IOFS) Flush(req *srv.Req) {}
+
+func (u *IOFS) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	wqids := make([]ninep.Qid, len(tc.Wname))
+	name := fid.path
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		var err error
+		var fi fs.FileInfo
+
+		n := path.Join(name, tc.Wname[i])
+		if n == ".." || strings.HasPrefix(n, "../") {
+			// can't go above the root
+			n = "."
+		}
+
+		if strings.Contains(tc.Wname[i], "/") {
+			err = fs.ErrNotExist
+		} else {
+			fi, err = fs.Stat(u.FS, n)
+		}
+
+		if err != nil {
+			if i == 0 {
+				req.RespondError(toError(err))
+				return
+			}
+
+			break
+		}
+
+		wqids[i] = *fi2Qid(n, fi)
+		name = n
+	}
+
+	req.Newfid.Aux = &Fid{path: name}
+	req.RespondRwalk(wqids[0:i])
+}
+
+func (u *IOFS) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if req.Tc.Mode&3 != ninep.OREAD && req.Tc.Mode&3 != ninep.OEXEC || req.Tc.Mode&(ninep.OTRUNC|ninep.ORCLOSE) != 0 {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	f, err := u.FS.Open(fid.path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		req.RespondError(toError(err))
+		return
+	}
+
+	fid.file = f
+	req.RespondRopen(fi2Qid(fid.path, fi), 0)
+}
+
+func (*IOFS) Create(req *srv.Req) { req.RespondError(srv.Eperm) }
+
+// Reopens the file, fs.File can't be rewound.
+func (u *IOFS) reopen(fid *Fid) *ninep.Error {
+	f, err := u.FS.Open(fid.path)
+	if err != nil {
+		return toError(err)
+	}
+
+	fid.file.Close()
+	fid.file = f
+	fid.offset = 0
+	fid.dirs = nil
+	fid.eof = false
+	return nil
+}
+
+func (u *IOFS) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	ninep.InitRread(rc, tc.Count)
+	if req.Fid.Type&ninep.QTDIR != 0 {
+		u.readdir(req, fid)
+		return
+	}
+
+	var n int
+	var err error
+	if ra, ok := fid.file.(io.ReaderAt); ok {
+		n, err = ra.ReadAt(rc.Data, int64(tc.Offset))
+	} else {
+		if tc.Offset != fid.offset {
+			if sk, ok := fid.file.(io.Seeker); ok {
+				_, err = sk.Seek(int64(tc.Offset), io.SeekStart)
+			} else if tc.Offset == 0 {
+				if e := u.reopen(fid); e != nil {
+					req.RespondError(e)
+					return
+				}
+			} else {
+				err = &ninep.Error{"non-sequential read", ninep.EINVAL}
+			}
+		}
+
+		if err == nil {
+			n, err = io.ReadFull(fid.file, rc.Data)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+		}
+
+		fid.offset = tc.Offset + uint64(n)
+	}
+
+	if err != nil && err != io.EOF {
+		req.RespondError(toError(err))
+		return
+	}
+
+	ninep.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+// Sends the directory entries that fit in the response. Only whole
+// entries are sent, the rest are kept for the next read, which must be
+// at the offset where this one ended, or at 0.
+func (u *IOFS) readdir(req *srv.Req, fid *Fid) {
+	rc := req.Rc
+	if req.Tc.Offset == 0 && (fid.offset != 0 || fid.dirs != nil || fid.eof) {
+		if err := u.reopen(fid); err != nil {
+			req.RespondError(err)
+			return
+		}
+	} else if req.Tc.Offset != fid.offset {
+		req.RespondError(srv.Ebadoffset)
+		return
+	}
+
+	df, ok := fid.file.(fs.ReadDirFile)
+	if !ok {
+		req.RespondError(srv.Enotdir)
+		return
+	}
+
+	n := 0
+	b := rc.Data
+	for {
+		if len(fid.dirs) == 0 {
+			if fid.eof {
+				break
+			}
+
+			dirs, err := df.ReadDir(16)
+			if err == io.EOF || err == nil && len(dirs) == 0 {
+				fid.eof = true
+			} else if err != nil {
+				req.RespondError(toError(err))
+				return
+			}
+
+			fid.dirs = dirs
+			continue
+		}
+
+		de := fid.dirs[0]
+		fi, err := de.Info()
+		if err != nil {
+			// the entry is gone
+			fid.dirs = fid.dirs[1:]
+			continue
+		}
+
+		nd := ninep.PackDir(u.fi2Dir(path.Join(fid.path, de.Name()), fi, req.Conn.Dotu), req.Conn.Dotu)
+		if len(nd) > len(b) {
+			break
+		}
+
+		copy(b, nd)
+		b = b[len(nd):]
+		n += len(nd)
+		fid.dirs = fid.dirs[1:]
+	}
+
+	if n == 0 && len(fid.dirs) > 0 {
+		req.RespondError(&ninep.Error{"too small read size for dir entry", ninep.EINVAL})
+		return
+	}
+
+	fid.offset = req.Tc.Offset + uint64(n)
+	ninep.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+func (*IOFS) Write(req *srv.Req) { req.RespondError(srv.Eperm) }
+
+func (*IOFS) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (*IOFS) Remove(req *srv.Req) { req.RespondError(srv.Eperm) }
+
+func (u *IOFS) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	fi, err := fs.Stat(u.FS, fid.path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRstat(u.fi2Dir(fid.path, fi, req.Conn.Dotu))
+}
+
+func (*IOFS) Wstat(req *srv.Req) { req.RespondError(srv.Eperm) }
@@ -0,0 +1,160 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package iofs
+
+import (
+	"net"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+)
+
+func setup(t *testing.T, fsys fstest.MapFS) *clnt.Clnt {
+	u := New(fsys)
+	u.Dotu = true
+	u.Id = "iofs"
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go u.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+func TestIOFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hello":     {Data: []byte("hello, world"), ModTime: time.Unix(1000, 0)},
+		"dir/a":     {Data: []byte("a")},
+		"dir/sub/b": {Data: make([]byte, 20000)},
+		"dir/empty": {Mode: os.ModeDir | 0755},
+		"exec":      {Data: []byte("#!/bin/sh"), Mode: 0755},
+	}
+
+	// enough entries to need several reads
+	for i := 0; i < 200; i++ {
+		fsys["many/file"+string(rune('a'+i%26))+string(rune('a'+i/26))] = &fstest.MapFile{}
+	}
+
+	c := setup(t, fsys)
+	defer c.Unmount()
+
+	expected := make([]string, 0, len(fsys))
+	for name := range fsys {
+		expected = append(expected, name)
+	}
+
+	if err := fstest.TestFS(clnt.NewFS(c), expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Qid paths don't change between walks
+	f1, err := c.FWalk("dir/a")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(f1)
+
+	f2, err := c.FWalk("dir/a")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(f2)
+
+	if f1.Qid.Path != f2.Qid.Path {
+		t.Errorf("Qid paths differ: %x %x", f1.Qid.Path, f2.Qid.Path)
+	}
+
+	d, err := c.FStat("hello")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if d.Mtime != 1000 || d.Length != 12 {
+		t.Errorf("FStat: want mtime 1000 length 12, got %d %d", d.Mtime, d.Length)
+	}
+}
+
+func TestIOFSDirOffset(t *testing.T) {
+	c := setup(t, fstest.MapFS{"a": {}, "b": {}, "c": {}})
+	defer c.Unmount()
+
+	fid, err := c.FWalk("/")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+
+	if err := c.Open(fid, ninep.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if _, err := c.Read(fid, 5, 8192); err == nil {
+		t.Errorf("read at a bad directory offset succeeded")
+	}
+
+	b, err := c.Read(fid, 0, 8192)
+	if err != nil || len(b) < 2 {
+		t.Fatalf("directory read: %v", err)
+	}
+
+	// one entry at a time
+	sz := 2 + (int(b[0]) | int(b[1])<<8)
+	if b, err = c.Read(fid, 0, uint32(sz)); err != nil || len(b) != sz {
+		t.Fatalf("directory read: %d, %v", len(b), err)
+	}
+
+	if _, err := c.Read(fid, 1, 8192); err == nil {
+		t.Errorf("read at an old directory offset succeeded")
+	}
+
+	if b, err := c.Read(fid, uint64(len(b)), 8192); err != nil || len(b) == 0 {
+		t.Errorf("directory read at the next offset: %d, %v", len(b), err)
+	}
+
+	if _, err := c.Read(fid, 0, 10); err == nil {
+		t.Errorf("directory read with a small count succeeded")
+	}
+}
+
+func TestIOFSReadOnly(t *testing.T) {
+	c := setup(t, fstest.MapFS{"file": {Data: []byte("data")}})
+	defer c.Unmount()
+
+	if _, err := c.FOpen("file", ninep.OWRITE); err == nil {
+		t.Errorf("FOpen for writing succeeded")
+	}
+
+	if _, err := c.FCreate("new", 0644, ninep.OWRITE); err == nil {
+		t.Errorf("FCreate succeeded")
+	}
+
+	if err := c.FRemove("file"); err == nil {
+		t.Errorf("FRemove succeeded")
+	}
+
+	fid, err := c.FWalk("file")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+
+	if err := c.Rename(fid, "other"); err == nil {
+		t.Errorf("Rename succeeded")
+	}
+}
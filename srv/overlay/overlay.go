@@ -0,0 +1,850 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The overlay package provides a 9P2000 file server that layers a
+// writable directory (the upper layer) over a read-only file tree (the
+// lower layer, an io/fs.FS). The clients see the files of both layers,
+// the upper ones hide the lower ones with the same names. The lower
+// layer is never modified:
+//
+//   - a lower file is copied up, with the directories leading to it,
+//     when it's opened for writing or its stat is changed;
+//   - removing a lower file creates a whiteout (a .wh.<name> file in the
+//     upper directory) that hides it;
+//   - a directory created in place of a removed lower directory is
+//     opaque (has a .wh..wh..opq file), the lower directory's files
+//     don't show through it;
+//   - reading a directory returns the files of both layers.
+//
+// The whiteout files are the ones used by aufs and Docker image layers,
+// so an upper directory can be inspected or reused with those tools.
+// The names starting with .wh. are reserved, the clients can't see or
+// create them.
+//
+// A disposable view of a tree can be created with:
+//
+//	upper, _ := os.MkdirTemp("", "job")
+//	o := overlay.New(upper, os.DirFS("/golden"))
+//	o.Start(o)
+package overlay
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+const (
+	whPrefix = ".wh."         // prefix of the whiteout files
+	opaque   = ".wh..wh..opq" // marks opaque directories
+)
+
+// The Overlay type serves the merged files of Upper and Lower. All
+// files are reported as owned by User and Group.
+type Overlay struct {
+	srv.Srv
+	Upper string // writable directory
+	Lower fs.FS  // read-only file tree
+	User  string
+	Group string
+
+	mu sync.Mutex // serializes the changes of the layers
+}
+
+type Fid struct {
+	path   string
+	file   *os.File // open upper file
+	lfile  fs.File  // open lower file
+	offset uint64   // offset of the next sequential read of lfile
+	dirbuf []byte   // merged directory entries not read yet
+	doff   uint64   // offset of the next directory read
+}
+
+var Enoent = &ninep.Error{"file not found", ninep.ENOENT}
+var Eexist = &ninep.Error{"file already exists", ninep.EEXIST}
+var Enotempty = &ninep.Error{"directory not empty", ninep.ENOTEMPTY}
+var Exdev = &ninep.Error{"can't rename a lower directory", ninep.EXDEV}
+
+// Verify that we correctly implement ReqOps
+var _ = srv.ReqOps(&Overlay{})
+
+// Returns a server for the files of upper over lower.
+func New(upper string, lower fs.FS) *Overlay {
+	return &Overlay{Upper: upper, Lower: lower, User: "none", Group: "none"}
+}
+
+func toError(err error) *ninep.Error {
+	var nerr *ninep.Error
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &nerr):
+		return nerr
+	case errors.Is(err, fs.ErrNotExist):
+		return Enoent
+	case errors.Is(err, fs.ErrExist):
+		return Eexist
+	case errors.Is(err, fs.ErrPermission):
+		return srv.Eperm.(*ninep.Error)
+	case errors.As(err, &errno):
+		return &ninep.Error{err.Error(), uint32(errno)}
+	}
+
+	return &ninep.Error{err.Error(), ninep.EIO}
+}
+
+// Returns the name of the upper file.
+func (o *Overlay) upath(p string) string {
+	return filepath.Join(o.Upper, filepath.FromSlash(p))
+}
+
+func (o *Overlay) exists(p string) bool {
+	_, err := os.Lstat(o.upath(p))
+	return err == nil
+}
+
+// Returns true if the lower file is hidden by a whiteout, or by an
+// opaque directory.
+func (o *Overlay) hidden(p string) bool {
+	if p == "." {
+		return false
+	}
+
+	dir := "."
+	for _, name := range strings.Split(p, "/") {
+		if o.exists(path.Join(dir, whPrefix+name)) || o.exists(path.Join(dir, opaque)) {
+			return true
+		}
+
+		dir = path.Join(dir, name)
+	}
+
+	return false
+}
+
+// Returns the lower file, if it isn't hidden.
+func (o *Overlay) lower(p string) (fs.FileInfo, error) {
+	if o.hidden(p) {
+		return nil, fs.ErrNotExist
+	}
+
+	return fs.Stat(o.Lower, p)
+}
+
+// Returns the file that the clients see, and true if it's an upper
+// file.
+func (o *Overlay) lookup(p string) (fs.FileInfo, bool, error) {
+	fi, err := os.Lstat(o.upath(p))
+	if err == nil {
+		return fi, true, nil
+	} else if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	fi, err = o.lower(p)
+	return fi, false, err
+}
+
+// Copies the lower file, and the directories leading to it, to the
+// upper layer. The copied directories are writable by the server.
+// Should be called with o.mu locked.
+func (o *Overlay) copyUp(p string) error {
+	fi, upper, err := o.lookup(p)
+	if err != nil || upper {
+		return err
+	}
+
+	if err := o.copyUp(path.Dir(p)); err != nil {
+		return err
+	}
+
+	name := o.upath(p)
+	if fi.IsDir() {
+		return os.Mkdir(name, fi.Mode().Perm()|0200)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return &ninep.Error{"can't copy up a special file", ninep.EPERM}
+	}
+
+	src, err := o.Lower.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(name), whPrefix+"tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+
+	// keep the modification time, so the Qid version doesn't change
+	if err == nil {
+		err = os.Chmod(dst.Name(), fi.Mode().Perm())
+	}
+
+	if err == nil {
+		err = os.Chtimes(dst.Name(), fi.ModTime(), fi.ModTime())
+	}
+
+	if err == nil {
+		err = os.Rename(dst.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+
+	return err
+}
+
+// Creates a whiteout for the lower file. Should be called with o.mu
+// locked.
+func (o *Overlay) whiteout(p string) error {
+	if err := o.copyUp(path.Dir(p)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.upath(path.Join(path.Dir(p), whPrefix+path.Base(p))), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Returns the Qid for the file. The path is derived from the name of
+// the file, so it doesn't change when the file is copied up.
+func fi2Qid(name string, fi fs.FileInfo) *ninep.Qid {
+	var qid ninep.Qid
+
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	qid.Path = h.Sum64()
+	qid.Version = uint32(fi.ModTime().Unix())
+	if fi.IsDir() {
+		qid.Type |= ninep.QTDIR
+	}
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		qid.Type |= ninep.QTSYMLINK
+	}
+
+	return &qid
+}
+
+func fi2Npmode(fi fs.FileInfo, dotu bool) uint32 {
+	ret := uint32(fi.Mode() & 0777)
+	if fi.IsDir() {
+		ret |= ninep.DMDIR
+	}
+
+	if dotu {
+		mode := fi.Mode()
+		if mode&fs.ModeSymlink != 0 {
+			ret |= ninep.DMSYMLINK
+		}
+
+		if mode&fs.ModeSocket != 0 {
+			ret |= ninep.DMSOCKET
+		}
+
+		if mode&fs.ModeNamedPipe != 0 {
+			ret |= ninep.DMNAMEDPIPE
+		}
+
+		if mode&fs.ModeDevice != 0 {
+			ret |= ninep.DMDEVICE
+		}
+	}
+
+	return ret
+}
+
+func (o *Overlay) fi2Dir(name string, fi fs.FileInfo, dotu bool) *ninep.Dir {
+	dir := new(ninep.Dir)
+	dir.Qid = *fi2Qid(name, fi)
+	dir.Mode = fi2Npmode(fi, dotu)
+	dir.Atime = uint32(fi.ModTime().Unix())
+	dir.Mtime = dir.Atime
+	if !fi.IsDir() {
+		dir.Length = uint64(fi.Size())
+	}
+
+	dir.Name = path.Base(name)
+	if name == "." {
+		dir.Name = "/"
+	}
+
+	dir.Uid = o.User
+	dir.Gid = o.Group
+	dir.Muid = "none"
+	if dotu {
+		dir.Uidnum = ninep.NOUID
+		dir.Gidnum = ninep.NOUID
+		dir.Muidnum = ninep.NOUID
+	}
+
+	return dir
+}
+
+// Returns the merged entries of the directory.
+func (o *Overlay) readdir(p string) (map[string]fs.FileInfo, error) {
+	fis := make(map[string]fs.FileInfo)
+	hide := make(map[string]bool)
+	opq := false
+	des, err := os.ReadDir(o.upath(p))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, de := range des {
+		name := de.Name()
+		if name == opaque {
+			opq = true
+		} else if strings.HasPrefix(name, whPrefix) {
+			hide[name[len(whPrefix):]] = true
+		} else if fi, err := de.Info(); err == nil {
+			fis[name] = fi
+		}
+	}
+
+	if opq || o.hidden(p) {
+		return fis, nil
+	}
+
+	des, err = fs.ReadDir(o.Lower, p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, de := range des {
+		name := de.Name()
+		if fis[name] != nil || hide[name] || strings.HasPrefix(name, whPrefix) {
+			continue
+		}
+
+		if fi, err := de.Info(); err == nil {
+			fis[name] = fi
+		}
+	}
+
+	return fis, nil
+}
+
+func (*Overlay) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*Fid)
+	if fid.file != nil {
+		fid.file.Close()
+	}
+
+	if fid.lfile != nil {
+		fid.lfile.Close()
+	}
+}
+
+func (o *Overlay) Attach(req *srv.Req) {
+	if req.Afid != nil && o.Auth == nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	// the aname selects a directory of the file system
+	name := strings.TrimPrefix(path.Clean("/"+req.Tc.Aname), "/")
+	if name == "" {
+		name = "."
+	}
+
+	fi, _, err := o.lookup(name)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.Fid.Aux = &Fid{path: name}
+	req.RespondRattach(fi2Qid(name, fi))
+}
+
+func (o *Overlay) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	wqids := make([]ninep.Qid, len(tc.Wname))
+	name := fid.path
+	i := 0
+	for ; i < len(tc.Wname); i++ {
+		var err error
+		var fi fs.FileInfo
+
+		n := path.Join(name, tc.Wname[i])
+		if n == ".." || strings.HasPrefix(n, "../") {
+			// can't go above the root
+			n = "."
+		}
+
+		if strings.Contains(tc.Wname[i], "/") || strings.HasPrefix(tc.Wname[i], whPrefix) {
+			err = fs.ErrNotExist
+		} else {
+			fi, _, err = o.lookup(n)
+		}
+
+		if err != nil {
+			if i == 0 {
+				req.RespondError(toError(err))
+				return
+			}
+
+			break
+		}
+
+		wqids[i] = *fi2Qid(n, fi)
+		name = n
+	}
+
+	req.Newfid.Aux = &Fid{path: name}
+	req.RespondRwalk(wqids[0:i])
+}
+
+// Converts the 9P open mode to os.OpenFile flags.
+func omode2flags(mode uint8) int {
+	flags := os.O_RDONLY
+	switch mode & 3 {
+	case ninep.OWRITE:
+		flags = os.O_WRONLY
+	case ninep.ORDWR:
+		flags = os.O_RDWR
+	}
+
+	if mode&ninep.OTRUNC != 0 {
+		flags |= os.O_TRUNC
+	}
+
+	return flags
+}
+
+func (o *Overlay) Open(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	mode := req.Tc.Mode
+	write := mode&3 == ninep.OWRITE || mode&3 == ninep.ORDWR || mode&ninep.OTRUNC != 0
+
+	o.mu.Lock()
+	fi, upper, err := o.lookup(fid.path)
+	if err == nil && write && !upper {
+		err = o.copyUp(fid.path)
+		upper = true
+	}
+	o.mu.Unlock()
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	switch {
+	case fi.IsDir():
+		fid.dirbuf, fid.doff = nil, 0
+
+	case upper:
+		fid.file, err = os.OpenFile(o.upath(fid.path), omode2flags(mode), 0)
+		if err == nil {
+			fi, err = fid.file.Stat()
+		}
+
+	default:
+		fid.lfile, err = o.Lower.Open(fid.path)
+	}
+
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRopen(fi2Qid(fid.path, fi), 0)
+}
+
+func (o *Overlay) Create(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	if tc.Name == "." || tc.Name == ".." || strings.Contains(tc.Name, "/") || strings.HasPrefix(tc.Name, whPrefix) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if tc.Perm&(ninep.DMNAMEDPIPE|ninep.DMSYMLINK|ninep.DMLINK|ninep.DMDEVICE|ninep.DMSOCKET) != 0 {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	p := path.Join(fid.path, tc.Name)
+	name := o.upath(p)
+
+	o.mu.Lock()
+	err := o.create(fid.path, p, tc.Perm)
+	o.mu.Unlock()
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	var fi fs.FileInfo
+	var file *os.File
+	if tc.Perm&ninep.DMDIR != 0 {
+		fi, err = os.Stat(name)
+	} else {
+		file, err = os.OpenFile(name, omode2flags(tc.Mode), 0)
+		if err == nil {
+			fi, err = file.Stat()
+		}
+	}
+
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+
+		req.RespondError(toError(err))
+		return
+	}
+
+	fid.path = p
+	fid.file = file
+	req.RespondRcreate(fi2Qid(p, fi), 0)
+}
+
+// Creates the upper file p in the directory dir. Should be called
+// with o.mu locked.
+func (o *Overlay) create(dir, p string, perm uint32) error {
+	if _, _, err := o.lookup(p); err == nil {
+		return Eexist
+	}
+
+	if err := o.copyUp(dir); err != nil {
+		return err
+	}
+
+	// a removed lower file is replaced
+	wh := path.Join(dir, whPrefix+path.Base(p))
+	replaced := o.exists(wh)
+	if replaced {
+		if err := os.Remove(o.upath(wh)); err != nil {
+			return err
+		}
+	}
+
+	name := o.upath(p)
+	if perm&ninep.DMDIR == 0 {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(perm&0777))
+		if err != nil {
+			return err
+		}
+
+		return f.Close()
+	}
+
+	if err := os.Mkdir(name, os.FileMode(perm&0777)); err != nil {
+		return err
+	}
+
+	if _, err := o.lower(p); err == nil || replaced {
+		// hide the files of the removed lower directory
+		f, err := os.OpenFile(filepath.Join(name, opaque), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		return f.Close()
+	}
+
+	return nil
+}
+
+func (o *Overlay) Read(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	ninep.InitRread(rc, tc.Count)
+	if req.Fid.Type&ninep.QTDIR != 0 {
+		if tc.Offset == 0 {
+			fis, err := o.readdir(fid.path)
+			if err != nil {
+				req.RespondError(toError(err))
+				return
+			}
+
+			fid.dirbuf, fid.doff = []byte{}, 0
+			for name, fi := range fis {
+				d := o.fi2Dir(path.Join(fid.path, name), fi, req.Conn.Dotu)
+				fid.dirbuf = append(fid.dirbuf, ninep.PackDir(d, req.Conn.Dotu)...)
+			}
+		} else if tc.Offset != fid.doff {
+			req.RespondError(srv.Ebadoffset)
+			return
+		}
+
+		n := srv.DirEntries(fid.dirbuf, tc.Count)
+		if n == 0 && len(fid.dirbuf) > 0 {
+			req.RespondError(srv.Etoosmall)
+			return
+		}
+
+		copy(rc.Data, fid.dirbuf[0:n])
+		fid.dirbuf = fid.dirbuf[n:]
+		fid.doff += uint64(n)
+		ninep.SetRreadCount(rc, uint32(n))
+		req.Respond()
+		return
+	}
+
+	var n int
+	var err error
+	switch {
+	case fid.file != nil:
+		n, err = fid.file.ReadAt(rc.Data, int64(tc.Offset))
+
+	case fid.lfile != nil:
+		if ra, ok := fid.lfile.(io.ReaderAt); ok {
+			n, err = ra.ReadAt(rc.Data, int64(tc.Offset))
+			break
+		}
+
+		if tc.Offset != fid.offset {
+			if sk, ok := fid.lfile.(io.Seeker); ok {
+				_, err = sk.Seek(int64(tc.Offset), io.SeekStart)
+			} else {
+				err = &ninep.Error{"non-sequential read", ninep.EINVAL}
+			}
+		}
+
+		if err == nil {
+			n, err = io.ReadFull(fid.lfile, rc.Data)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+		}
+
+		fid.offset = tc.Offset + uint64(n)
+
+	default:
+		err = srv.Ebaduse
+	}
+
+	if err != nil && err != io.EOF {
+		req.RespondError(toError(err))
+		return
+	}
+
+	ninep.SetRreadCount(rc, uint32(n))
+	req.Respond()
+}
+
+func (o *Overlay) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	n, err := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (*Overlay) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (o *Overlay) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.path == "." {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	o.mu.Lock()
+	err := o.remove(fid.path)
+	o.mu.Unlock()
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRremove()
+}
+
+// Removes the file. Should be called with o.mu locked.
+func (o *Overlay) remove(p string) error {
+	fi, upper, err := o.lookup(p)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		fis, err := o.readdir(p)
+		if err != nil {
+			return err
+		}
+
+		if len(fis) != 0 {
+			return Enotempty
+		}
+	}
+
+	if upper {
+		// the directory may have whiteouts
+		if err := os.RemoveAll(o.upath(p)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := o.lower(p); err == nil {
+		return o.whiteout(p)
+	}
+
+	return nil
+}
+
+func (o *Overlay) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	fi, _, err := o.lookup(fid.path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRstat(o.fi2Dir(fid.path, fi, req.Conn.Dotu))
+}
+
+func (o *Overlay) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dir := &req.Tc.Dir
+
+	o.mu.Lock()
+	err := o.wstat(fid, dir, req.Conn.Dotu)
+	o.mu.Unlock()
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRwstat()
+}
+
+// Changes the stat of the file. Should be called with o.mu locked.
+func (o *Overlay) wstat(fid *Fid, dir *ninep.Dir, dotu bool) error {
+	fi, _, err := o.lookup(fid.path)
+	if err != nil {
+		return err
+	}
+
+	// the owners can't be changed
+	if dir.Uid != "" || dir.Gid != "" || (dotu && (dir.Uidnum != ninep.NOUID || dir.Gidnum != ninep.NOUID)) {
+		return srv.Eperm
+	}
+
+	if dir.Name != "" && dir.Name != path.Base(fid.path) {
+		if err := o.rename(fid, fi, dir.Name); err != nil {
+			return err
+		}
+	}
+
+	chmod := dir.Mode != 0xFFFFFFFF
+	chtimes := dir.Mtime != ^uint32(0)
+	truncate := dir.Length != 0xFFFFFFFFFFFFFFFF
+	if !chmod && !chtimes && !truncate {
+		return nil
+	}
+
+	if err := o.copyUp(fid.path); err != nil {
+		return err
+	}
+
+	name := o.upath(fid.path)
+	if chmod {
+		if err := os.Chmod(name, os.FileMode(dir.Mode&0777)); err != nil {
+			return err
+		}
+	}
+
+	if truncate {
+		if err := os.Truncate(name, int64(dir.Length)); err != nil {
+			return err
+		}
+	}
+
+	if chtimes {
+		mt := time.Unix(int64(dir.Mtime), 0)
+		if err := os.Chtimes(name, mt, mt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Renames the file in its directory. Should be called with o.mu
+// locked.
+func (o *Overlay) rename(fid *Fid, fi fs.FileInfo, name string) error {
+	if fid.path == "." || name == "." || name == ".." || strings.Contains(name, "/") || strings.HasPrefix(name, whPrefix) {
+		return srv.Eperm
+	}
+
+	p := path.Join(path.Dir(fid.path), name)
+	if _, _, err := o.lookup(p); err == nil {
+		return Eexist
+	}
+
+	_, lerr := o.lower(fid.path)
+	inLower := lerr == nil
+	if inLower && fi.IsDir() {
+		// the lower files would have to be copied up
+		return Exdev
+	}
+
+	if err := o.copyUp(fid.path); err != nil {
+		return err
+	}
+
+	wh := path.Join(path.Dir(p), whPrefix+name)
+	if o.exists(wh) {
+		if err := os.Remove(o.upath(wh)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(o.upath(fid.path), o.upath(p)); err != nil {
+		return err
+	}
+
+	if inLower {
+		if err := o.whiteout(fid.path); err != nil {
+			return err
+		}
+	}
+
+	fid.path = p
+	return nil
+}
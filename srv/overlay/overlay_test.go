@@ -0,0 +1,286 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package overlay
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+)
+
+func setup(t *testing.T, lower fstest.MapFS) (*clnt.Clnt, string) {
+	upper := t.TempDir()
+	o := New(upper, lower)
+	o.Dotu = true
+	o.Id = "overlay"
+	if !o.Start(o) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go o.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c, upper
+}
+
+func lowerFS() fstest.MapFS {
+	return fstest.MapFS{
+		"hello":     {Data: []byte("hello, world"), ModTime: time.Unix(1000, 0), Mode: 0644},
+		"dir/a":     {Data: []byte("a"), Mode: 0644},
+		"dir/sub/b": {Data: []byte("b"), Mode: 0644},
+	}
+}
+
+func readFile(t *testing.T, c *clnt.Clnt, name string) string {
+	t.Helper()
+	b, err := fs.ReadFile(clnt.NewFS(c), name)
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", name, err)
+	}
+
+	return string(b)
+}
+
+func readDir(t *testing.T, c *clnt.Clnt, name string) string {
+	t.Helper()
+	des, err := fs.ReadDir(clnt.NewFS(c), name)
+	if err != nil {
+		t.Fatalf("ReadDir %s: %v", name, err)
+	}
+
+	names := make([]string, 0, len(des))
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func writeFile(t *testing.T, c *clnt.Clnt, name, data string) {
+	t.Helper()
+	f, err := c.FOpen(name, ninep.OWRITE|ninep.OTRUNC)
+	if err != nil {
+		t.Fatalf("FOpen %s: %v", name, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatalf("Write %s: %v", name, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	lower := lowerFS()
+	c, upper := setup(t, lower)
+	defer c.Unmount()
+
+	if err := fstest.TestFS(clnt.NewFS(c), "hello", "dir/a", "dir/sub/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is copied up by reads
+	if s := readFile(t, c, "dir/sub/b"); s != "b" {
+		t.Errorf("dir/sub/b: got %q", s)
+	}
+
+	if _, err := os.Stat(filepath.Join(upper, "dir")); err == nil {
+		t.Errorf("dir was copied up by a read")
+	}
+
+	// writes copy up the file and its directories, the Qid doesn't change
+	d1, err := c.FStat("dir/sub/b")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	writeFile(t, c, "dir/sub/b", "modified")
+	if s := readFile(t, c, "dir/sub/b"); s != "modified" {
+		t.Errorf("dir/sub/b: got %q", s)
+	}
+
+	if string(lower["dir/sub/b"].Data) != "b" {
+		t.Errorf("the lower file was modified")
+	}
+
+	if b, err := os.ReadFile(filepath.Join(upper, "dir/sub/b")); err != nil || string(b) != "modified" {
+		t.Errorf("upper dir/sub/b: %q %v", b, err)
+	}
+
+	d2, err := c.FStat("dir/sub/b")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if d1.Qid.Path != d2.Qid.Path {
+		t.Errorf("Qid path changed after copy up: %x %x", d1.Qid.Path, d2.Qid.Path)
+	}
+
+	if s := readDir(t, c, "dir"); s != "a sub" {
+		t.Errorf("dir: got %q", s)
+	}
+
+	if err := c.FRemove("hello"); err != nil {
+		t.Fatalf("FRemove: %v", err)
+	}
+
+	if _, err := c.FStat("hello"); err == nil {
+		t.Errorf("hello wasn't removed")
+	}
+
+	if _, err := os.Stat(filepath.Join(upper, ".wh.hello")); err != nil {
+		t.Errorf("no whiteout for hello: %v", err)
+	}
+
+	if s := readDir(t, c, "."); s != "dir" {
+		t.Errorf("root: got %q", s)
+	}
+
+	// the whiteouts can't be seen or walked to
+	if _, err := c.FStat(".wh.hello"); err == nil {
+		t.Errorf("whiteout is visible")
+	}
+
+	// recreating a removed file
+	f, err := c.FCreate("hello", 0644, ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+
+	f.Write([]byte("again"))
+	f.Close()
+	if s := readFile(t, c, "hello"); s != "again" {
+		t.Errorf("hello: got %q", s)
+	}
+
+	if _, err := os.Stat(filepath.Join(upper, ".wh.hello")); err == nil {
+		t.Errorf("whiteout for hello wasn't removed")
+	}
+
+	if _, err := c.FCreate("hello", 0644, ninep.OWRITE); err == nil {
+		t.Errorf("created an existing file")
+	}
+}
+
+func TestOverlayDirs(t *testing.T) {
+	c, upper := setup(t, lowerFS())
+	defer c.Unmount()
+
+	// create in a lower directory
+	f, err := c.FCreate("dir/new", 0644, ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+
+	if s := readDir(t, c, "dir"); s != "a new sub" {
+		t.Errorf("dir: got %q", s)
+	}
+
+	if err := c.FRemove("dir/sub"); err == nil {
+		t.Errorf("removed a non-empty directory")
+	}
+
+	// remove a lower directory and create it again
+	for _, name := range []string{"dir/sub/b", "dir/sub"} {
+		if err := c.FRemove(name); err != nil {
+			t.Fatalf("FRemove %s: %v", name, err)
+		}
+	}
+
+	if s := readDir(t, c, "dir"); s != "a new" {
+		t.Errorf("dir: got %q", s)
+	}
+
+	f, err = c.FCreate("dir/sub", ninep.DMDIR|0755, ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Close()
+
+	if s := readDir(t, c, "dir/sub"); s != "" {
+		t.Errorf("dir/sub: lower files show through: %q", s)
+	}
+
+	if _, err := os.Stat(filepath.Join(upper, "dir/sub", opaque)); err != nil {
+		t.Errorf("dir/sub isn't opaque: %v", err)
+	}
+
+	// rename a lower file
+	fid, err := c.FWalk("dir/a")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+
+	if err := c.Rename(fid, "b"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	c.Clunk(fid)
+
+	if s := readDir(t, c, "dir"); s != "b new sub" {
+		t.Errorf("dir: got %q", s)
+	}
+
+	if s := readFile(t, c, "dir/b"); s != "a" {
+		t.Errorf("dir/b: got %q", s)
+	}
+
+	// lower directories can't be renamed
+	fid, err = c.FWalk("dir")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+
+	if err := c.Rename(fid, "other"); err == nil {
+		t.Errorf("renamed a lower directory")
+	}
+
+	// the directories are read only at the offsets of their entries
+	dfid, err := c.FWalk("dir")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(dfid)
+
+	if err := c.Open(dfid, ninep.OREAD); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if _, err := c.Read(dfid, 5, 8192); err == nil {
+		t.Errorf("read at a bad directory offset succeeded")
+	}
+
+	b, err := c.Read(dfid, 0, 8192)
+	if err != nil || len(b) == 0 {
+		t.Fatalf("directory read: %v", err)
+	}
+
+	if b, err := c.Read(dfid, uint64(len(b)), 8192); err != nil || len(b) != 0 {
+		t.Errorf("directory read at the end: %d, %v", len(b), err)
+	}
+
+	if _, err := c.Read(dfid, 0, 10); err == nil {
+		t.Errorf("directory read with a small count succeeded")
+	}
+}
@@ -0,0 +1,731 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+var Eoffline = &ninep.Error{"file not cached", ninep.EIO}
+var Eauthoffline = &ninep.Error{"can't authenticate while offline", ninep.EPERM}
+
+// The Cache type keeps the data of the files read through the proxy on
+// local disk (see the Cache field of Proxy). The entries are keyed by
+// the Qid paths of the root of the attach and of the file, as the trees
+// of different attach names can have the same Qid paths. They are valid
+// while the Qid version and the modification time of the file don't
+// change. The data of a
+// directory is its entries, in the 9P2000.u format.
+//
+// Only the regular files with a length that fits in the cache are
+// cached, when they are read from start to end in order. The data of
+// the synthetic files, usually with length 0, isn't cached.
+//
+// For each file the cache directory has a .stat file with the stat of
+// the file when it was cached, and a .data file with its data. The
+// cache survives restarts of the proxy.
+type Cache struct {
+	sync.Mutex
+	Dir     string // directory that keeps the cache files
+	MaxSize int64  // maximum size of the cached data, 0 means no limit
+
+	// If set, the cached files are served (read-only, even if they
+	// are stale) when the upstream server is unreachable. The users
+	// can attach offline only if the proxy authenticates them (see
+	// Srv.Auth), or if the upstream server let the users attach to
+	// the attach name without authentication. The groups of the users
+	// aren't known offline, so only the permissions of the owner and
+	// of the others are checked.
+	Offline bool
+
+	size    int64
+	lru     *list.List // of *centry, the front is the most recently used
+	entries map[ckey]*centry
+	roots   map[string]croot
+}
+
+// The root of an attach name
+type croot struct {
+	qpath  uint64
+	noauth bool // the upstream server allowed attaching without authentication
+}
+
+// The key of a cached file
+type ckey struct {
+	root  uint64 // Qid path of the root of the attach
+	qpath uint64
+}
+
+// A cached file
+type centry struct {
+	key  ckey
+	d    *ninep.Dir // stat of the file when the data was cached
+	size int64      // size of the data
+	elem *list.Element
+}
+
+// Creates a cache that keeps the files in dir, and loads the files
+// that are already there.
+func NewCache(dir string, maxsize int64) (*Cache, error) {
+	c := new(Cache)
+	c.Dir = dir
+	c.MaxSize = maxsize
+	c.lru = list.New()
+	c.entries = make(map[ckey]*centry)
+	c.roots = make(map[string]croot)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Returns the name of the cache file of the key.
+func (c *Cache) name(k ckey, ext string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%016x-%016x%s", k.root, k.qpath, ext))
+}
+
+// Loads the cached files, the least recently used are the ones
+// with the oldest .data files.
+func (c *Cache) load() error {
+	tmps, _ := filepath.Glob(filepath.Join(c.Dir, "tmp*"))
+	for _, name := range tmps {
+		os.Remove(name)
+	}
+
+	names, err := filepath.Glob(filepath.Join(c.Dir, "*.stat"))
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		e     *centry
+		mtime int64
+	}
+
+	var ls []loaded
+	for _, name := range names {
+		var k ckey
+		root, qpath, ok := strings.Cut(strings.TrimSuffix(filepath.Base(name), ".stat"), "-")
+		if !ok {
+			continue
+		}
+
+		k.root, err = strconv.ParseUint(root, 16, 64)
+		if err == nil {
+			k.qpath, err = strconv.ParseUint(qpath, 16, 64)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		d, _, _, err := ninep.UnpackDir(buf, true)
+		st, serr := os.Stat(c.name(k, ".data"))
+		if err != nil || serr != nil || d.Qid.Path != k.qpath {
+			// incomplete entry
+			c.removeFiles(k)
+			continue
+		}
+
+		ls = append(ls, loaded{&centry{key: k, d: d, size: st.Size()}, st.ModTime().UnixNano()})
+	}
+
+	sort.Slice(ls, func(i, j int) bool { return ls[i].mtime > ls[j].mtime })
+	for _, l := range ls {
+		l.e.elem = c.lru.PushBack(l.e)
+		c.entries[l.e.key] = l.e
+		c.size += l.e.size
+	}
+
+	f, err := os.Open(filepath.Join(c.Dir, "roots"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// each line is the Qid path, auth or noauth, and the attach name
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		if qpath, err := strconv.ParseUint(fields[0], 16, 64); err == nil {
+			c.roots[fields[2]] = croot{qpath, fields[1] == "noauth"}
+		}
+	}
+
+	return s.Err()
+}
+
+func (c *Cache) removeFiles(k ckey) {
+	os.Remove(c.name(k, ".data"))
+	os.Remove(c.name(k, ".stat"))
+}
+
+// Removes the entry. Should be called with c locked.
+func (c *Cache) remove(e *centry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	c.removeFiles(e.key)
+}
+
+// Returns true if the cached data of the file is up to date.
+func valid(e *centry, d *ninep.Dir) bool {
+	return e.d.Qid.Version == d.Qid.Version && e.d.Mtime == d.Mtime
+}
+
+// Opens the cached data of the file, if it's valid for the stat d.
+// If d is nil, the data is returned even if it's stale. Returns the
+// stat of the cached file too.
+func (c *Cache) open(k ckey, d *ninep.Dir) (*os.File, *ninep.Dir) {
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[k]
+	if e == nil {
+		return nil, nil
+	}
+
+	if d != nil && !valid(e, d) {
+		c.remove(e)
+		return nil, nil
+	}
+
+	f, err := os.Open(c.name(k, ".data"))
+	if err != nil {
+		c.remove(e)
+		return nil, nil
+	}
+
+	c.lru.MoveToFront(e.elem)
+	return f, e.d
+}
+
+// Returns true if the data of a file of that size can be cached.
+func (c *Cache) fits(size uint64) bool {
+	return c.MaxSize == 0 || size <= uint64(c.MaxSize)
+}
+
+// Returns true if the data of the file can be cached: a regular file
+// with a length that fits in the cache. The length of the synthetic
+// files is usually 0, and their data may change on each read.
+func (c *Cache) cacheable(d *ninep.Dir) bool {
+	special := uint32(ninep.DMAPPEND | ninep.DMEXCL | ninep.DMDEVICE | ninep.DMNAMEDPIPE | ninep.DMSOCKET)
+	return d.Qid.Type == ninep.QTFILE && d.Mode&special == 0 && d.Length > 0 && c.fits(d.Length)
+}
+
+// Caches the data of the file with the stat d under the root, read
+// from r. Evicts the least recently used files if the cache is over
+// its size limit.
+func (c *Cache) put(root uint64, d *ninep.Dir, r io.Reader) error {
+	tmp, err := os.CreateTemp(c.Dir, "tmp")
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return c.commit(root, d, tmp, size)
+}
+
+// Moves the temporary file with the data of the file with the stat d
+// under the root to the cache. Closes tmp.
+func (c *Cache) commit(root uint64, d *ninep.Dir, tmp *os.File, size int64) error {
+	k := ckey{root, d.Qid.Path}
+	tmp.Close()
+	if !c.fits(uint64(size)) {
+		os.Remove(tmp.Name())
+		return &ninep.Error{"file too large for the cache", ninep.ENOSPC}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e := c.entries[k]; e != nil {
+		c.remove(e)
+	}
+
+	err := os.WriteFile(c.name(k, ".stat"), ninep.PackDir(d, true), 0600)
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.name(k, ".data"))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		c.removeFiles(k)
+		return err
+	}
+
+	e := &centry{key: k, d: d, size: size}
+	e.elem = c.lru.PushFront(e)
+	c.entries[k] = e
+	c.size += size
+	for c.MaxSize > 0 && c.size > c.MaxSize && c.lru.Back() != e.elem {
+		c.remove(c.lru.Back().Value.(*centry))
+	}
+
+	return nil
+}
+
+// The data of a file that is cached as the client reads it from the
+// upstream server.
+type cfill struct {
+	root uint64     // Qid path of the root of the attach
+	d    *ninep.Dir // stat of the file when it was opened
+	tmp  *os.File
+	off  uint64 // offset of the next read
+}
+
+// Starts caching the data of the file with the stat d under the root.
+// Returns nil if the temporary file can't be created.
+func (c *Cache) startFill(root uint64, d *ninep.Dir) *cfill {
+	tmp, err := os.CreateTemp(c.Dir, "tmp")
+	if err != nil {
+		return nil
+	}
+
+	return &cfill{root: root, d: d, tmp: tmp}
+}
+
+// Adds the data read from the upstream server at the offset. The file
+// is cached when all of it is read in order. Returns true if the fill
+// is over, either because the file was cached, or because it can't be
+// (the reads were out of order, or the length of the file changed).
+func (c *Cache) fill(fl *cfill, offset uint64, data []byte) bool {
+	if offset != fl.off || len(data) == 0 || fl.off+uint64(len(data)) > fl.d.Length {
+		c.abort(fl)
+		return true
+	}
+
+	if _, err := fl.tmp.Write(data); err != nil {
+		c.abort(fl)
+		return true
+	}
+
+	fl.off += uint64(len(data))
+	if fl.off < fl.d.Length {
+		return false
+	}
+
+	c.commit(fl.root, fl.d, fl.tmp, int64(fl.off))
+	return true
+}
+
+// Removes the data of an incomplete fill.
+func (c *Cache) abort(fl *cfill) {
+	fl.tmp.Close()
+	os.Remove(fl.tmp.Name())
+}
+
+// Removes the cached data of the file.
+func (c *Cache) invalidate(k ckey) {
+	c.Lock()
+	defer c.Unlock()
+	if e := c.entries[k]; e != nil {
+		c.remove(e)
+	}
+}
+
+// Records the Qid path of the root of the attach name, and if the
+// upstream server allowed attaching to it without authentication.
+func (c *Cache) setRoot(aname string, qpath uint64, noauth bool) error {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.roots[aname]
+	if ok && r.qpath == qpath && (r.noauth || !noauth) {
+		return nil
+	}
+
+	c.roots[aname] = croot{qpath, noauth}
+	var b strings.Builder
+	for aname, r := range c.roots {
+		auth := "auth"
+		if r.noauth {
+			auth = "noauth"
+		}
+
+		if !strings.Contains(aname, "\n") {
+			fmt.Fprintf(&b, "%016x %s %s\n", r.qpath, auth, aname)
+		}
+	}
+
+	name := filepath.Join(c.Dir, "roots")
+	if err := os.WriteFile(name+".tmp", []byte(b.String()), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(name+".tmp", name)
+}
+
+// Returns the root of the attach name, if it was recorded.
+func (c *Cache) root(aname string) (croot, bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.roots[aname]
+	return r, ok
+}
+
+// Returns the cached entries of the directory.
+func (c *Cache) readdir(k ckey) ([]*ninep.Dir, error) {
+	f, _ := c.open(k, nil)
+	if f == nil {
+		return nil, Eoffline
+	}
+
+	buf, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []*ninep.Dir
+	for len(buf) > 0 {
+		d, rest, _, err := ninep.UnpackDir(buf, true)
+		if err != nil {
+			return nil, err
+		}
+
+		dirs = append(dirs, d)
+		buf = rest
+	}
+
+	return dirs, nil
+}
+
+// Returns the stat of the file with the path (as in srv.Fid.Path)
+// under the root with the Qid path, looked up in the cached
+// directories.
+func (c *Cache) lookup(root uint64, p string) (*ninep.Dir, error) {
+	c.Lock()
+	var d *ninep.Dir
+	if e := c.entries[ckey{root, root}]; e != nil {
+		d = e.d
+	}
+	c.Unlock()
+	if d == nil {
+		return nil, Eoffline
+	}
+
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return d, nil
+	}
+
+	for _, name := range strings.Split(p[1:], "/") {
+		if d.Mode&ninep.DMDIR == 0 {
+			return nil, srv.Enotdir
+		}
+
+		dirs, err := c.readdir(ckey{root, d.Qid.Path})
+		if err != nil {
+			return nil, err
+		}
+
+		d = nil
+		for _, dd := range dirs {
+			if dd.Name == name {
+				d = dd
+				break
+			}
+		}
+
+		if d == nil {
+			return nil, &ninep.Error{"file not found", ninep.ENOENT}
+		}
+	}
+
+	return d, nil
+}
+
+// Returns true if the upstream server is unreachable and the cached
+// files should be served.
+func (p *Proxy) unreachable() bool {
+	return p.Cache != nil && p.Cache.Offline && p.Upstream.Err() != nil
+}
+
+// Returns true if the user has the permissions (one or more of
+// ninep.DMREAD, ninep.DMWRITE and ninep.DMEXEC) on the cached file.
+// The groups of the user aren't known, so the group permissions are
+// never granted.
+func permitted(u ninep.User, d *ninep.Dir, perm uint32) bool {
+	mode := d.Mode & 7
+	if u != nil {
+		owner := u.Name() != "" && u.Name() == d.Uid
+		owner = owner || (u.Id() != int(ninep.NOUID) && uint32(u.Id()) == d.Uidnum)
+		if owner {
+			mode |= (d.Mode >> 6) & 7
+		}
+	}
+
+	return mode&perm == perm
+}
+
+// Packs the directory entries in the dialect.
+func packDirs(dirs []*ninep.Dir, dotu bool) []byte {
+	buf := []byte{}
+	for _, d := range dirs {
+		buf = append(buf, ninep.PackDir(d, dotu)...)
+	}
+
+	return buf
+}
+
+// Called when the upstream file is opened for reading. Checks if the
+// cached data is up to date. The data of the file is read from the
+// cache afterwards. If it isn't cached, the file is read from the
+// upstream server, and cached as it is read. The entries of a
+// directory are cached when it is opened.
+func (p *Proxy) cacheOpen(ctx context.Context, f *Fid, uf *clnt.Fid, dotu bool) {
+	c := p.Cache
+	d, err := p.Upstream.StatContext(ctx, uf)
+	if err != nil {
+		return
+	}
+
+	k := ckey{f.root, d.Qid.Path}
+	if d.Mode&ninep.DMDIR != 0 {
+		var dirs []*ninep.Dir
+		if cf, _ := c.open(k, d); cf != nil {
+			cf.Close()
+			if dirs, err = c.readdir(k); err != nil {
+				return
+			}
+		} else {
+			dirs, err = clnt.NewFile(uf, 0).ReaddirContext(ctx, 0)
+			if err != nil && err != io.EOF {
+				return
+			}
+
+			c.put(f.root, d, bytes.NewReader(packDirs(dirs, true)))
+		}
+
+		f.Lock()
+		f.cdir = packDirs(dirs, dotu)
+		f.Unlock()
+		return
+	}
+
+	if !c.cacheable(d) {
+		c.invalidate(k)
+		return
+	}
+
+	var fl *cfill
+	cf, _ := c.open(k, d)
+	if cf == nil {
+		fl = c.startFill(f.root, d)
+	}
+
+	f.Lock()
+	f.cf, f.fill = cf, fl
+	f.Unlock()
+}
+
+// Returns the cached entries of the open directory at the offset. The
+// offset is either 0 or the end of the entries read before. Should be
+// called with f locked.
+func (f *Fid) readCachedDir(offset uint64, count uint32) ([]byte, error) {
+	if offset != 0 && offset != f.doff {
+		return nil, srv.Ebadoffset
+	}
+
+	b := f.cdir[offset:]
+	n := srv.DirEntries(b, count)
+	if n == 0 && len(b) > 0 {
+		return nil, Etoosmall
+	}
+
+	f.doff = offset + uint64(n)
+	return b[0:n], nil
+}
+
+// Serves the read from the cache if the open file is cached. Returns
+// false if it isn't.
+func (p *Proxy) readCached(req *srv.Req, f *Fid) bool {
+	tc := req.Tc
+	f.Lock()
+	cf := f.cf
+	if f.cdir != nil {
+		data, err := f.readCachedDir(tc.Offset, tc.Count)
+		f.Unlock()
+		if err != nil {
+			req.RespondError(err)
+		} else {
+			req.RespondRread(data)
+		}
+
+		return true
+	}
+	f.Unlock()
+
+	if cf == nil {
+		return false
+	}
+
+	buf := make([]byte, tc.Count)
+	n, err := cf.ReadAt(buf, int64(tc.Offset))
+	if err != nil && err != io.EOF {
+		req.RespondError(err)
+	} else {
+		req.RespondRread(buf[0:n])
+	}
+
+	return true
+}
+
+// Adds the data read from the upstream server to the cache, if the
+// open file is being cached.
+func (p *Proxy) fillCache(f *Fid, offset uint64, data []byte) {
+	f.Lock()
+	defer f.Unlock()
+	if f.fill != nil && p.Cache.fill(f.fill, offset, data) {
+		f.fill = nil
+	}
+}
+
+func (p *Proxy) attachOffline(req *srv.Req) {
+	root, ok := p.Cache.root(req.Tc.Aname)
+	if p.Auth == nil && !root.noauth {
+		// the authentication is forwarded, it can't be checked
+		req.RespondError(Eauthoffline)
+		return
+	}
+
+	if !ok {
+		req.RespondError(Eoffline)
+		return
+	}
+
+	d, err := p.Cache.lookup(root.qpath, "/")
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = &Fid{root: root.qpath, offline: true}
+	req.RespondRattach(&d.Qid)
+}
+
+func (p *Proxy) walkOffline(req *srv.Req, f *Fid) {
+	var wqids []ninep.Qid
+	fpath := req.Fid.Pathname()
+	d, err := p.Cache.lookup(f.root, fpath)
+	for _, name := range req.Tc.Wname {
+		if err == nil && !permitted(req.Fid.User, d, ninep.DMEXEC) {
+			err = srv.Eperm
+		}
+
+		if err == nil {
+			fpath = path.Join(fpath, name)
+			d, err = p.Cache.lookup(f.root, fpath)
+		}
+
+		if err != nil {
+			if len(wqids) == 0 {
+				req.RespondError(err)
+			} else {
+				req.RespondRwalk(wqids)
+			}
+
+			return
+		}
+
+		wqids = append(wqids, d.Qid)
+	}
+
+	if req.Newfid == req.Fid {
+		f.Lock()
+		f.offline = true
+		f.Unlock()
+	} else {
+		req.Newfid.Aux = &Fid{root: f.root, offline: true}
+	}
+
+	req.RespondRwalk(wqids)
+}
+
+func (p *Proxy) openOffline(req *srv.Req, f *Fid) {
+	mode := req.Tc.Mode
+	if mode&3 != ninep.OREAD || mode&(ninep.OTRUNC|ninep.ORCLOSE) != 0 {
+		req.RespondError(srv.Erofs)
+		return
+	}
+
+	d, err := p.Cache.lookup(f.root, req.Fid.Pathname())
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if !permitted(req.Fid.User, d, ninep.DMREAD) {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	var cf *os.File
+	var cdir []byte
+	if d.Mode&ninep.DMDIR != 0 {
+		dirs, err := p.Cache.readdir(ckey{f.root, d.Qid.Path})
+		if err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		cdir = packDirs(dirs, req.Conn.Dotu)
+	} else if cf, _ = p.Cache.open(ckey{f.root, d.Qid.Path}, nil); cf == nil {
+		req.RespondError(Eoffline)
+		return
+	}
+
+	f.Lock()
+	f.offline = true
+	f.cf, f.cdir = cf, cdir
+	f.Unlock()
+	req.RespondRopen(&d.Qid, 0)
+}
+
+func (p *Proxy) statOffline(req *srv.Req, f *Fid) {
+	d, err := p.Cache.lookup(f.root, req.Fid.Pathname())
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRstat(d)
+}
@@ -0,0 +1,556 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The proxy package implements a file server that forwards the requests
+// of its clients to another 9P file server. All clients share the
+// connection to the upstream server (a clnt.Clnt), each of their fids
+// is backed by a fid of the upstream connection.
+//
+// The proxy speaks 9P2000 or 9P2000.u with its clients, independently
+// of the dialect of the upstream connection. The stat messages and
+// the directory entries are translated between them.
+//
+// The interceptors of the server (see srv.Interceptor) see the
+// requests before they are forwarded, so the proxy can add access
+// control or logging in front of servers that don't support it:
+//
+//	c, err := clnt.Connect(conn, 8192+ninep.IOHDRSZ, true)
+//	...
+//	p := proxy.New(c)
+//	p.Use(&srv.AccessLog{}, srv.ReadOnly{})
+//	p.Start(p)
+//	p.StartNetListener("tcp", ":5640")
+//
+// A request flushed by the client is flushed on the upstream
+// connection too. If the upstream server completes the request before
+// the flush, the client gets the response before Rflush, as the
+// protocol requires.
+//
+// If the server has no AuthOps (Srv.Auth), the authentication is
+// forwarded to the upstream server too.
+//
+// If the proxy has a Cache, the files read through the proxy are copied
+// to local disk and read from there while they don't change. The cache
+// can serve the files it has when the upstream server is unreachable.
+package proxy
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+var Etoosmall = &ninep.Error{"count too small for the directory entry", ninep.EINVAL}
+
+// Per-fid data
+type Fid struct {
+	sync.Mutex
+	fid *clnt.Fid // the upstream fid, nil after clunk or remove
+
+	// Translated directory entries, used only if the dialects differ.
+	// The offsets of the client don't match the offsets of the
+	// upstream server.
+	doff   uint64 // next offset of the client
+	uoff   uint64 // next offset of the upstream server
+	dirbuf []byte // translated entries, not read by the client yet
+
+	root    uint64   // Qid path of the root of the attach, used to look up the cached files
+	offline bool     // the fid is served from the cache
+	cf      *os.File // cached data of the open file
+	fill    *cfill   // data of the open file, cached as it is read
+	cdir    []byte   // cached entries of the open directory, in the client's dialect
+}
+
+// The Proxy type is a file server that forwards the requests to the
+// upstream server.
+type Proxy struct {
+	srv.Srv
+	Upstream *clnt.Clnt
+	Cache    *Cache // If set, the files read through the proxy are cached
+}
+
+// Creates a proxy to the upstream server. The maximum message size
+// of the proxy is the one of the upstream connection. The users
+// aren't looked up, the user names and ids from the clients are passed
+// to the upstream server as is.
+func New(c *clnt.Clnt) *Proxy {
+	p := new(Proxy)
+	p.Upstream = c
+	p.Msize = c.Msize
+	p.Dotu = true
+	p.Upool = users{}
+	return p
+}
+
+// Returns the data of the request's fid and its upstream fid. If the
+// fid has no upstream fid (e.g. it's an authentication fid), responds
+// with an error and returns nil. The upstream fid of the fids served
+// from the cache is nil.
+func upfid(req *srv.Req) (*Fid, *clnt.Fid) {
+	f, ok := req.Fid.Aux.(*Fid)
+	if !ok {
+		req.RespondError(srv.Ebaduse)
+		return nil, nil
+	}
+
+	f.Lock()
+	uf := f.fid
+	offline := f.offline
+	f.Unlock()
+	if offline {
+		return f, nil
+	}
+
+	if uf == nil {
+		req.RespondError(srv.Eunknownfid)
+		return nil, nil
+	}
+
+	return f, uf
+}
+
+// Responds with the error. The errors from the upstream server are
+// passed to the client as they are.
+func respondError(req *srv.Req, err error) {
+	e, ok := err.(*ninep.Error)
+	if !ok || req.Conn.Dotl {
+		req.RespondError(err)
+		return
+	}
+
+	ninep.PackRerror(req.Rc, e.Err, e.Errornum, req.Conn.Dotu)
+	req.Respond()
+}
+
+// The largest count of a read or write on the upstream fid.
+func (p *Proxy) iounit(f *clnt.Fid) uint32 {
+	n := p.Upstream.Msize - ninep.IOHDRSZ
+	if f.Iounit != 0 && f.Iounit < n {
+		n = f.Iounit
+	}
+
+	return n
+}
+
+func (p *Proxy) FidDestroy(fid *srv.Fid) {
+	f, ok := fid.Aux.(*Fid)
+	if !ok {
+		return
+	}
+
+	f.Lock()
+	uf, cf, fl := f.fid, f.cf, f.fill
+	f.fid, f.cf, f.fill = nil, nil, nil
+	f.Unlock()
+	if cf != nil {
+		cf.Close()
+	}
+
+	if fl != nil {
+		p.Cache.abort(fl)
+	}
+
+	if uf != nil {
+		p.Upstream.Clunk(uf)
+	}
+}
+
+func (p *Proxy) Attach(req *srv.Req) {
+	var afid *clnt.Fid
+	if req.Afid != nil {
+		afid, _ = req.Afid.Aux.(*clnt.Fid)
+	}
+
+	// pass both the name and the id the client sent
+	tc := req.Tc
+	u := &user{tc.Uname, int(tc.Unamenum)}
+	if !req.Conn.Dotu {
+		u.id = int(ninep.NOUID)
+	}
+
+	req.Fid.User = u
+	uf, err := p.Upstream.AttachContext(req.Context(), afid, u, tc.Aname)
+	if err != nil {
+		if p.unreachable() {
+			p.attachOffline(req)
+		} else {
+			respondError(req, err)
+		}
+
+		return
+	}
+
+	if p.Cache != nil {
+		p.Cache.setRoot(tc.Aname, uf.Qid.Path, afid == nil)
+	}
+
+	req.Fid.Aux = &Fid{fid: uf, root: uf.Qid.Path}
+	req.RespondRattach(&uf.Qid)
+}
+
+func (p *Proxy) Walk(req *srv.Req) {
+	c := p.Upstream
+	tc := req.Tc
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		p.walkOffline(req, f)
+		return
+	}
+
+	nf := c.FidAlloc()
+	wqids, err := c.WalkContext(req.Context(), uf, nf, tc.Wname)
+	if err != nil {
+		c.Clunk(nf)
+		if p.unreachable() {
+			p.walkOffline(req, f)
+		} else {
+			respondError(req, err)
+		}
+
+		return
+	}
+
+	if len(wqids) != len(tc.Wname) {
+		// the upstream newfid wasn't created
+		c.Clunk(nf)
+		req.RespondRwalk(wqids)
+		return
+	}
+
+	if len(wqids) > 0 {
+		nf.Qid = wqids[len(wqids)-1]
+	} else {
+		nf.Qid = uf.Qid
+	}
+
+	if req.Newfid == req.Fid {
+		f.Lock()
+		f.fid = nf
+		f.Unlock()
+		c.Clunk(uf)
+	} else {
+		req.Newfid.Aux = &Fid{fid: nf, root: f.root}
+	}
+
+	req.RespondRwalk(wqids)
+}
+
+func (p *Proxy) Open(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		p.openOffline(req, f)
+		return
+	}
+
+	mode := req.Tc.Mode
+	if err := p.Upstream.OpenContext(req.Context(), uf, mode); err != nil {
+		if p.unreachable() {
+			p.openOffline(req, f)
+		} else {
+			respondError(req, err)
+		}
+
+		return
+	}
+
+	if p.Cache != nil && mode == ninep.OREAD {
+		p.cacheOpen(req.Context(), f, uf, req.Conn.Dotu)
+	}
+
+	req.RespondRopen(&uf.Qid, p.iounit(uf))
+}
+
+func (p *Proxy) Create(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		req.RespondError(srv.Erofs)
+		return
+	}
+
+	tc := req.Tc
+	if err := p.Upstream.CreateContext(req.Context(), uf, tc.Name, tc.Perm, tc.Mode, tc.Ext); err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRcreate(&uf.Qid, p.iounit(uf))
+}
+
+func (p *Proxy) Read(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil || p.readCached(req, f) {
+		return
+	}
+
+	tc := req.Tc
+	count := tc.Count
+	if n := p.iounit(uf); count > n {
+		count = n
+	}
+
+	var data []byte
+	var err error
+	if req.Fid.Type&ninep.QTDIR != 0 && req.Conn.Dotu != p.Upstream.Dotu {
+		data, err = p.readdir(req.Context(), f, uf, tc.Offset, count, req.Conn.Dotu)
+	} else {
+		data, err = p.Upstream.ReadContext(req.Context(), uf, tc.Offset, count)
+	}
+
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	p.fillCache(f, tc.Offset, data)
+	req.RespondRread(data)
+}
+
+// Reads the directory entries from the upstream server and translates
+// them to the client's dialect. The translated entries may be larger
+// than the original ones, the ones that don't fit in count are
+// returned by the next read.
+func (p *Proxy) readdir(ctx context.Context, f *Fid, uf *clnt.Fid, offset uint64, count uint32, dotu bool) ([]byte, error) {
+	c := p.Upstream
+
+	f.Lock()
+	defer f.Unlock()
+	if offset == 0 {
+		f.doff, f.uoff, f.dirbuf = 0, 0, nil
+	} else if offset != f.doff {
+		return nil, srv.Ebadoffset
+	}
+
+	if len(f.dirbuf) == 0 {
+		data, err := c.ReadContext(ctx, uf, f.uoff, count)
+		if err != nil {
+			return nil, err
+		}
+
+		f.uoff += uint64(len(data))
+		for len(data) > 0 {
+			d, rest, _, err := ninep.UnpackDir(data, c.Dotu)
+			if err != nil {
+				return nil, err
+			}
+
+			f.dirbuf = append(f.dirbuf, ninep.PackDir(d, dotu)...)
+			data = rest
+		}
+	}
+
+	n := srv.DirEntries(f.dirbuf, count)
+	if n == 0 && len(f.dirbuf) > 0 {
+		return nil, Etoosmall
+	}
+
+	b := f.dirbuf[0:n]
+	f.dirbuf = f.dirbuf[n:]
+	f.doff += uint64(n)
+	return b, nil
+}
+
+func (p *Proxy) Write(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		req.RespondError(srv.Erofs)
+		return
+	}
+
+	tc := req.Tc
+	data := tc.Data
+	if n := p.iounit(uf); uint32(len(data)) > n {
+		data = data[0:n]
+	}
+
+	n, err := p.Upstream.WriteContext(req.Context(), uf, data, tc.Offset)
+	if p.Cache != nil {
+		p.Cache.invalidate(ckey{f.root, uf.Qid.Path})
+	}
+
+	if err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+// The fid is clunked even if the upstream server returns an error.
+func (p *Proxy) Clunk(req *srv.Req) {
+	f, ok := req.Fid.Aux.(*Fid)
+	if !ok {
+		req.RespondRclunk()
+		return
+	}
+
+	f.Lock()
+	uf, cf, fl := f.fid, f.cf, f.fill
+	f.fid, f.cf, f.fill = nil, nil, nil
+	f.Unlock()
+	if cf != nil {
+		cf.Close()
+	}
+
+	if fl != nil {
+		p.Cache.abort(fl)
+	}
+
+	if uf == nil {
+		req.RespondRclunk()
+		return
+	}
+
+	if err := p.Upstream.ClunkContext(req.Context(), uf); err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRclunk()
+}
+
+func (p *Proxy) Remove(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		req.RespondError(srv.Erofs)
+		return
+	}
+
+	f.Lock()
+	f.fid = nil
+	f.Unlock()
+
+	if p.Cache != nil {
+		p.Cache.invalidate(ckey{f.root, uf.Qid.Path})
+	}
+
+	if err := p.Upstream.RemoveContext(req.Context(), uf); err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (p *Proxy) Stat(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		p.statOffline(req, f)
+		return
+	}
+
+	d, err := p.Upstream.StatContext(req.Context(), uf)
+	if err != nil {
+		if p.unreachable() {
+			p.statOffline(req, f)
+		} else {
+			respondError(req, err)
+		}
+
+		return
+	}
+
+	req.RespondRstat(d)
+}
+
+func (p *Proxy) Wstat(req *srv.Req) {
+	f, uf := upfid(req)
+	if f == nil {
+		return
+	} else if uf == nil {
+		req.RespondError(srv.Erofs)
+		return
+	}
+
+	if p.Cache != nil {
+		p.Cache.invalidate(ckey{f.root, uf.Qid.Path})
+	}
+
+	if err := p.Upstream.WstatContext(req.Context(), uf, &req.Tc.Dir); err != nil {
+		respondError(req, err)
+		return
+	}
+
+	req.RespondRwstat()
+}
+
+// The authentication fids are the upstream authentication fids, the
+// upstream server checks them when the user attaches.
+func (p *Proxy) AuthInit(afid *srv.Fid, aname string) (*ninep.Qid, error) {
+	uf, err := p.Upstream.Auth(afid.User, aname)
+	if err != nil {
+		return nil, err
+	}
+
+	afid.Aux = uf
+	return &uf.Qid, nil
+}
+
+func (p *Proxy) AuthDestroy(afid *srv.Fid) {
+	if uf, ok := afid.Aux.(*clnt.Fid); ok {
+		p.Upstream.Clunk(uf)
+	}
+}
+
+func (p *Proxy) AuthCheck(fid *srv.Fid, afid *srv.Fid, aname string) error {
+	return nil
+}
+
+func (p *Proxy) AuthRead(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	buf, err := p.Upstream.Read(afid.Aux.(*clnt.Fid), offset, uint32(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(data, buf), nil
+}
+
+func (p *Proxy) AuthWrite(afid *srv.Fid, offset uint64, data []byte) (int, error) {
+	return p.Upstream.Write(afid.Aux.(*clnt.Fid), data, offset)
+}
+
+// Users known only by their names and ids, the upstream server looks
+// them up.
+type users struct{}
+
+type user struct {
+	name string
+	id   int
+}
+
+func (u *user) Name() string                { return u.name }
+func (u *user) Id() int                     { return u.id }
+func (u *user) Groups() []ninep.Group       { return nil }
+func (u *user) IsMember(g ninep.Group) bool { return false }
+
+type group struct {
+	name string
+	id   int
+}
+
+func (g *group) Name() string          { return g.name }
+func (g *group) Id() int               { return g.id }
+func (g *group) Members() []ninep.User { return nil }
+
+func (users) Uid2User(uid int) ninep.User        { return &user{"", uid} }
+func (users) Uname2User(uname string) ninep.User { return &user{uname, int(ninep.NOUID)} }
+func (users) Gid2Group(gid int) ninep.Group      { return &group{"", gid} }
+func (users) Gname2Group(gname string) ninep.Group {
+	return &group{gname, int(ninep.NOUID)}
+}
@@ -0,0 +1,604 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+	"github.com/lionkov/ninep/srv/ufs"
+)
+
+var versions = map[bool]string{false: ninep.Version, true: ninep.VersionU}
+
+// Connects to a server running in the same process.
+func connect(t *testing.T, s *srv.Srv, dotu bool) *clnt.Clnt {
+	c1, c2 := net.Pipe()
+	s.NewConn(c1)
+	c, err := clnt.ConnectVersion(c2, s.Msize, versions[dotu])
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	return c
+}
+
+// Starts the proxy and attaches to it.
+func mount(t *testing.T, p *Proxy, dotu bool, user ninep.User) *clnt.Clnt {
+	p.Id = "proxy"
+	if !p.Start(p) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go p.StartListener(l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+
+	c, err := clnt.ConnectVersion(conn, 8192+ninep.IOHDRSZ, versions[dotu])
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	if _, err := c.Attach(nil, user, "/"); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	return c
+}
+
+func TestProxy(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	dir := t.TempDir()
+	for i := 0; i < 200; i++ {
+		// long names, the entries don't fit in one read
+		name := fmt.Sprintf("file-with-a-rather-long-name-%03d", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	u := ufs.New()
+	u.Dotu = true
+	u.Id = "ufs"
+	u.Root = dir
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	for _, updotu := range []bool{false, true} {
+		for _, dotu := range []bool{false, true} {
+			t.Run(fmt.Sprintf("upstream=%v,client=%v", versions[updotu], versions[dotu]), func(t *testing.T) {
+				p := New(connect(t, &u.Srv, updotu))
+				c := mount(t, p, dotu, user)
+				defer c.Unmount()
+				if c.Dotu != dotu {
+					t.Fatalf("client dialect: want .u %v, got %v", dotu, c.Dotu)
+				}
+
+				f, err := c.FOpen("/", ninep.OREAD)
+				if err != nil {
+					t.Fatalf("FOpen: %v", err)
+				}
+
+				dirs, err := f.Readdir(0)
+				f.Close()
+				if err != nil && err != io.EOF {
+					t.Fatalf("Readdir: %v", err)
+				}
+
+				var names []string
+				for _, d := range dirs {
+					names = append(names, d.Name)
+				}
+
+				sort.Strings(names)
+				if len(names) != 200 || names[0] != "file-with-a-rather-long-name-000" || names[199] != "file-with-a-rather-long-name-199" {
+					t.Fatalf("Readdir: got %d entries %v", len(names), names)
+				}
+
+				f, err = c.FOpen("file-with-a-rather-long-name-007", ninep.OREAD)
+				if err != nil {
+					t.Fatalf("FOpen: %v", err)
+				}
+
+				b, err := io.ReadAll(f)
+				f.Close()
+				if err != nil || string(b) != "file-with-a-rather-long-name-007" {
+					t.Errorf("Read: got %q, %v", b, err)
+				}
+
+				name := "new-" + versions[updotu] + versions[dotu]
+				f, err = c.FCreate(name, 0644, ninep.OWRITE)
+				if err != nil {
+					t.Fatalf("FCreate: %v", err)
+				}
+
+				if _, err := f.Write([]byte("data")); err != nil {
+					t.Errorf("Write: %v", err)
+				}
+				f.Close()
+
+				st, err := c.FStat(name)
+				if err != nil {
+					t.Fatalf("FStat: %v", err)
+				}
+
+				if st.Name != name || st.Length != 4 {
+					t.Errorf("FStat: got %v", st)
+				}
+
+				// the upstream errors are passed as they are
+				_, err = c.FStat("nonexistent")
+				if e, ok := err.(*ninep.Error); !ok || e.Err != "file not found: 2" {
+					t.Errorf("FStat of a nonexistent file: want the upstream error, got %v", err)
+				}
+
+				if err := c.FRemove(name); err != nil {
+					t.Errorf("FRemove: %v", err)
+				}
+
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("removed file exists: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// A file whose reads block until they are flushed.
+type blocker struct {
+	srv.File
+	started chan bool
+	flushed chan bool
+}
+
+func (b *blocker) ReadContext(ctx context.Context, fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	b.started <- true
+	<-ctx.Done()
+	b.flushed <- true
+	return 0, ctx.Err()
+}
+
+func TestFlush(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	root := new(srv.File)
+	if err := root.Add(nil, "/", user, nil, ninep.DMDIR|0555, nil); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	b := &blocker{started: make(chan bool, 1), flushed: make(chan bool, 1)}
+	if err := b.Add(root, "block", user, nil, 0444, b); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	fs := srv.NewFileSrv(root)
+	fs.Dotu = true
+	if !fs.Start(fs) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	p := New(connect(t, &fs.Srv, true))
+	c := mount(t, p, true, user)
+	defer c.Unmount()
+
+	f, err := c.FOpen("block", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := f.ReadContext(ctx, make([]byte, 10))
+		errc <- err
+	}()
+
+	<-b.started
+	cancel()
+	select {
+	case <-b.flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the upstream request wasn't flushed")
+	}
+
+	// the proxy may respond before Rflush
+	if err := <-errc; err == nil {
+		t.Errorf("flushed ReadContext succeeded")
+	}
+
+	// the connections still work
+	if _, err := c.FStat("block"); err != nil {
+		t.Errorf("FStat: %v", err)
+	}
+}
+
+// Counts the reads of the upstream server.
+type readCounter struct {
+	sync.Mutex
+	n int
+}
+
+func (rc *readCounter) Request(req *srv.Req) {
+	if req.Tc.Type == ninep.Tread {
+		rc.Lock()
+		rc.n++
+		rc.Unlock()
+	}
+}
+
+func (rc *readCounter) Response(req *srv.Req) {}
+
+func (rc *readCounter) count() int {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.n
+}
+
+func readFile(c *clnt.Clnt, name string) (string, error) {
+	f, err := c.FOpen(name, ninep.OREAD)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+func TestCache(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "cached"), []byte("cached"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "private"), []byte("private"), 0600)
+	os.WriteFile(filepath.Join(dir, "uncached"), []byte("uncached"), 0644)
+
+	u := ufs.New()
+	u.Dotu = true
+	u.Id = "ufs"
+	u.Root = dir
+	rc := new(readCounter)
+	u.Use(rc)
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	c1, c2 := net.Pipe()
+	u.NewConn(c1)
+	up, err := clnt.Connect(c2, u.Msize, true)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	cache, err := NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	cache.Offline = true
+	p := New(up)
+	p.Cache = cache
+	c := mount(t, p, true, user)
+	defer c.Unmount()
+
+	for i := 0; i < 2; i++ {
+		n := rc.count()
+		if s, err := readFile(c, "sub/cached"); err != nil || s != "cached" {
+			t.Fatalf("read %d: got %q, %v", i, s, err)
+		}
+
+		if i == 1 && rc.count() != n {
+			t.Errorf("the cached file was read from the upstream server")
+		}
+	}
+
+	// the modified file is read again
+	name := filepath.Join(dir, "sub", "cached")
+	os.WriteFile(name, []byte("modified"), 0644)
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(name, mtime, mtime)
+	if s, err := readFile(c, "sub/cached"); err != nil || s != "modified" {
+		t.Errorf("modified file: got %q, %v", s, err)
+	}
+
+	if _, err := readFile(c, "sub/private"); err != nil {
+		t.Fatalf("read sub/private: %v", err)
+	}
+
+	// read the directories, so the files can be found offline
+	if _, err := readFile(c, "/"); err != nil {
+		t.Fatalf("read /: %v", err)
+	}
+
+	if _, err := readFile(c, "sub"); err != nil {
+		t.Fatalf("read sub: %v", err)
+	}
+
+	// break the upstream connection
+	c1.Close()
+	for up.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the clients that attached before fall back to the cache
+	if s, err := readFile(c, "sub/cached"); err != nil || s != "modified" {
+		t.Errorf("offline read: got %q, %v", s, err)
+	}
+
+	p = New(up)
+	p.Cache = cache
+	oc := mount(t, p, true, user)
+	defer oc.Unmount()
+	if s, err := readFile(oc, "sub/cached"); err != nil || s != "modified" {
+		t.Errorf("offline read: got %q, %v", s, err)
+	}
+
+	if st, err := oc.FStat("sub/cached"); err != nil || st.Length != 8 {
+		t.Errorf("offline FStat: %v %v", st, err)
+	}
+
+	if _, err := readFile(oc, "uncached"); err == nil {
+		t.Errorf("offline read of an uncached file succeeded")
+	}
+
+	if _, err := oc.FOpen("sub/cached", ninep.OWRITE); err == nil {
+		t.Errorf("offline FOpen for writing succeeded")
+	}
+
+	f, err := oc.FOpen("/", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("offline FOpen /: %v", err)
+	}
+
+	dirs, _ := f.Readdir(0)
+	f.Close()
+	if len(dirs) != 2 {
+		t.Errorf("offline Readdir: want 2 entries, got %v", dirs)
+	}
+
+	// the cached directory is read only at the offsets of its entries
+	other := users{}.Uname2User("other")
+	root, err := oc.Attach(nil, other, "/")
+	if err != nil {
+		t.Fatalf("offline Attach: %v", err)
+	}
+
+	fid := oc.FidAlloc()
+	if _, err := oc.Walk(root, fid, []string{"sub"}); err != nil {
+		t.Fatalf("offline Walk: %v", err)
+	}
+
+	if err := oc.Open(fid, ninep.OREAD); err != nil {
+		t.Fatalf("offline Open: %v", err)
+	}
+
+	if _, err := oc.Read(fid, 1, 8192); err == nil {
+		t.Errorf("offline read at a bad directory offset succeeded")
+	}
+
+	b, err := oc.Read(fid, 0, 8192)
+	if err != nil || len(b) == 0 {
+		t.Fatalf("offline directory read: %v", err)
+	}
+
+	if b, err := oc.Read(fid, uint64(len(b)), 8192); err != nil || len(b) != 0 {
+		t.Errorf("offline directory read at the end: %d, %v", len(b), err)
+	}
+
+	if _, err := oc.Read(fid, 0, 10); err == nil {
+		t.Errorf("offline directory read with a small count succeeded")
+	}
+
+	// the other users can't read the private file
+	fid = oc.FidAlloc()
+	if _, err := oc.Walk(root, fid, []string{"sub", "private"}); err != nil {
+		t.Fatalf("offline Walk: %v", err)
+	}
+
+	if err := oc.Open(fid, ninep.OREAD); err == nil {
+		t.Errorf("offline open of a private file by another user succeeded")
+	}
+
+	// the users can't attach if the upstream server authenticated them
+	cache.Lock()
+	cache.roots["/"] = croot{cache.roots["/"].qpath, false}
+	cache.Unlock()
+	if _, err := oc.Attach(nil, other, "/"); err == nil {
+		t.Errorf("offline attach without authentication succeeded")
+	}
+}
+
+func TestCacheFill(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "data"), []byte("0123456789"), 0644)
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+
+	u := ufs.New()
+	u.Dotu = true
+	u.Id = "ufs"
+	u.Root = dir
+	rc := new(readCounter)
+	u.Use(rc)
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	cache, err := NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	p := New(connect(t, &u.Srv, true))
+	p.Cache = cache
+	c := mount(t, p, true, user)
+	defer c.Unmount()
+
+	// the file isn't read when it's opened
+	n := rc.count()
+	f, err := c.FOpen("data", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	if rc.count() != n {
+		t.Errorf("the file was read on open")
+	}
+
+	// a file read out of order isn't cached
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 5); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	f.Close()
+	n = rc.count()
+	if s, err := readFile(c, "data"); err != nil || s != "0123456789" {
+		t.Fatalf("read: got %q, %v", s, err)
+	}
+
+	if rc.count() == n {
+		t.Errorf("a partially read file was cached")
+	}
+
+	// the file read in order is cached
+	n = rc.count()
+	if s, err := readFile(c, "data"); err != nil || s != "0123456789" {
+		t.Fatalf("read: got %q, %v", s, err)
+	}
+
+	if rc.count() != n {
+		t.Errorf("the cached file was read from the upstream server")
+	}
+
+	// the empty files may be synthetic, and aren't cached
+	readFile(c, "empty")
+	n = rc.count()
+	readFile(c, "empty")
+	if rc.count() == n {
+		t.Errorf("the empty file was cached")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 25)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	put := func(qpath uint64) {
+		d := ninep.NewWstatDir()
+		d.Qid.Path = qpath
+		if err := cache.put(0, d, strings.NewReader("0123456789")); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	cached := func(qpath uint64) bool {
+		f, _ := cache.open(ckey{0, qpath}, nil)
+		if f != nil {
+			f.Close()
+		}
+
+		return f != nil
+	}
+
+	put(1)
+	put(2)
+	cached(1)
+	put(3)
+	if !cached(1) || cached(2) || !cached(3) {
+		t.Errorf("the least recently used file wasn't evicted")
+	}
+
+	d := ninep.NewWstatDir()
+	if err := cache.put(0, d, strings.NewReader(strings.Repeat("x", 26))); err == nil {
+		t.Errorf("put of a file larger than the cache succeeded")
+	}
+
+	// the entries are loaded again
+	cache, err = NewCache(dir, 25)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	if !cached(1) || cached(2) || !cached(3) {
+		t.Errorf("the cache wasn't loaded")
+	}
+}
+
+func TestCacheRoots(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	// the trees of the attach names have files with the same Qid path
+	for root, data := range map[uint64]string{1: "first", 2: "second"} {
+		d := ninep.NewWstatDir()
+		d.Qid.Path = 3
+		if err := cache.put(root, d, strings.NewReader(data)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	check := func() {
+		for root, data := range map[uint64]string{1: "first", 2: "second"} {
+			f, _ := cache.open(ckey{root, 3}, nil)
+			if f == nil {
+				t.Fatalf("the file of root %d isn't cached", root)
+			}
+
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil || string(b) != data {
+				t.Errorf("data of root %d: %q %v, expected %q", root, b, err, data)
+			}
+		}
+	}
+
+	check()
+	cache.invalidate(ckey{1, 3})
+	if f, _ := cache.open(ckey{1, 3}, nil); f != nil {
+		f.Close()
+		t.Errorf("the invalidated file is still cached")
+	}
+
+	d := ninep.NewWstatDir()
+	d.Qid.Path = 3
+	if err := cache.put(1, d, strings.NewReader("first")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	// the entries are loaded again
+	cache, err = NewCache(dir, 0)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	check()
+}
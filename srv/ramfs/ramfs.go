@@ -0,0 +1,520 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ramfs package provides a 9P2000 file server that keeps its files
+// in memory. The files can be created, removed, renamed and modified by
+// the clients, and their Qid versions change with every modification.
+//
+// The size of the tree and the size of the files owned by each user can
+// be limited. Only the lengths of the files are counted, the directories
+// are free. A write that would go over a limit fails with ENOSPC.
+//
+// The whole tree can be saved to a file with Snapshot, and loaded back
+// with Restore:
+//
+//	r := ramfs.New(user, group, 8192)
+//	r.MaxSize = 1 << 30
+//	r.Quotas = map[string]int64{"glenda": 1 << 20}
+//	r.Start(r)
+//	...
+//	err := r.Snapshot("/var/lib/ramfs.snap")
+package ramfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+// The Ramfs type is a file server with its files in memory. MaxSize,
+// Quotas and Admin should be set before the server is started.
+//
+// Only the admin can change the owner of a file, as the file counts
+// toward the quota of the new owner. The owner of a file, or the leader
+// of its group (the first member of the group), can change its group to
+// a group the owner is a member of.
+type Ramfs struct {
+	srv.Fsrv
+	MaxSize int64            // limit of the tree size in bytes, 0 for no limit
+	Quotas  map[string]int64 // limits of the users' file sizes, by user name
+	Admin   string           // name of the user that can change the owners, "" for none
+
+	tree    sync.RWMutex // held for writing by Snapshot and Restore
+	mu      sync.Mutex   // guards size and usage
+	size    int64
+	usage   map[string]int64
+	blksz   int
+	blkchan chan []byte
+	zero    []byte // blksz array of zeroes
+}
+
+// The File type is a file (or directory) of a Ramfs.
+type File struct {
+	srv.File
+	fs      *Ramfs
+	data    map[uint64][]byte // blocks by number, the missing blocks read as zeroes
+	removed bool
+}
+
+var Enospc = &ninep.Error{"file system full", ninep.ENOSPC}
+var Equota = &ninep.Error{"quota exceeded", ninep.ENOSPC}
+var Ebadname = &ninep.Error{"bad file name", ninep.EINVAL}
+
+// Verify that we correctly implement the file operations
+var _ interface {
+	srv.FReadOp
+	srv.FWriteOp
+	srv.FOpenOp
+	srv.FCreateOp
+	srv.FRemoveOp
+	srv.FWstatOp
+} = &File{}
+
+// Creates a file server with an empty root directory owned by user and
+// group. The file data is kept in blocks of blksz bytes. Only the blocks
+// that were written are kept, the files can be sparse.
+func New(user ninep.User, group ninep.Group, blksz int) *Ramfs {
+	r := new(Ramfs)
+	r.usage = make(map[string]int64)
+	r.blksz = blksz
+	r.blkchan = make(chan []byte, 2048)
+	r.zero = make([]byte, blksz)
+
+	root := r.newFile()
+	root.Add(nil, "/", user, group, ninep.DMDIR|0777, root)
+	r.Root = &root.File
+	return r
+}
+
+func (r *Ramfs) newFile() *File {
+	return &File{fs: r}
+}
+
+// Returns the size of the tree in bytes.
+func (r *Ramfs) Size() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+// Returns the size of the files owned by the user in bytes.
+func (r *Ramfs) Usage(user string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.usage[user]
+}
+
+// Changes the accounting of a file of length olen owned by ouid to a
+// file of length nlen owned by nuid. Returns an error if that goes over
+// the limits.
+func (r *Ramfs) charge(ouid string, olen int64, nuid string, nlen int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if nlen < 0 {
+		// the length doesn't fit in int64
+		return Enospc
+	}
+
+	size := r.size - olen + nlen
+	if r.MaxSize > 0 && nlen > olen && size > r.MaxSize {
+		return Enospc
+	}
+
+	usage := r.usage[nuid] + nlen
+	if ouid == nuid {
+		usage -= olen
+	}
+
+	if q, ok := r.Quotas[nuid]; ok && (ouid != nuid || nlen > olen) && usage > q {
+		return Equota
+	}
+
+	r.size = size
+	r.usage[ouid] -= olen
+	r.usage[nuid] += nlen
+	return nil
+}
+
+// Returns true if the user is the leader of the group, the first of its
+// members.
+func (r *Ramfs) leader(user ninep.User, gname string, gid uint32) bool {
+	g := r.Upool.Gid2Group(int(gid))
+	if gname != "" {
+		g = r.Upool.Gname2Group(gname)
+	}
+
+	if user == nil || g == nil {
+		return false
+	}
+
+	members := g.Members()
+	return len(members) > 0 && members[0].Name() == user.Name()
+}
+
+func (r *Ramfs) getBlock() []byte {
+	var blk []byte
+
+	select {
+	case blk = <-r.blkchan:
+		copy(blk, r.zero)
+	default:
+		blk = make([]byte, r.blksz)
+	}
+
+	return blk
+}
+
+func (r *Ramfs) putBlock(blk []byte) {
+	select {
+	case r.blkchan <- blk:
+	default:
+	}
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Marks the file as modified. Called with f locked.
+func (f *File) touch(user ninep.User) {
+	f.Qid.Version++
+	f.Mtime = uint32(time.Now().Unix())
+	f.Atime = f.Mtime
+	if user != nil {
+		f.Muid = user.Name()
+	}
+}
+
+// Marks the directory as modified.
+func (f *File) touchDir(user ninep.User) {
+	f.Lock()
+	f.touch(user)
+	f.Unlock()
+}
+
+func (f *File) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if offset > f.Length {
+		return 0, nil
+	}
+
+	count := uint32(len(buf))
+	if offset+uint64(count) > f.Length {
+		count = uint32(f.Length - offset)
+	}
+
+	blksz := uint64(f.fs.blksz)
+	for n, off, b := offset/blksz, offset%blksz, buf[0:count]; len(b) > 0; n++ {
+		m := int(blksz - off)
+		if m > len(b) {
+			m = len(b)
+		}
+
+		blk, ok := f.data[n]
+		if !ok {
+			blk = f.fs.zero
+		}
+
+		copy(b, blk[off:off+uint64(m)])
+		b = b[m:]
+		off = 0
+	}
+
+	return int(count), nil
+}
+
+func (f *File) Write(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
+	f.Lock()
+	defer f.Unlock()
+
+	if f.removed {
+		return 0, srv.Enoent
+	}
+
+	sz := offset + uint64(len(buf))
+	if sz < offset {
+		return 0, Enospc
+	}
+
+	if f.Length < sz {
+		if err := f.fs.charge(f.Uid, int64(f.Length), f.Uid, int64(sz)); err != nil {
+			return 0, err
+		}
+
+		f.expand(sz)
+	}
+
+	if f.data == nil {
+		f.data = make(map[uint64][]byte)
+	}
+
+	count := 0
+	blksz := uint64(f.fs.blksz)
+	for n, off := offset/blksz, offset%blksz; len(buf) > 0; n++ {
+		blk, ok := f.data[n]
+		if !ok {
+			blk = f.fs.getBlock()
+			f.data[n] = blk
+		}
+
+		m := copy(blk[off:], buf)
+		buf = buf[m:]
+		count += m
+		off = 0
+	}
+
+	f.touch(fid.Fid.User)
+	return count, nil
+}
+
+func (f *File) Open(fid *srv.FFid, mode uint8) error {
+	if mode&ninep.OTRUNC == 0 || f.Mode&ninep.DMDIR != 0 {
+		return nil
+	}
+
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Length != 0 {
+		f.fs.charge(f.Uid, int64(f.Length), f.Uid, 0)
+		f.trunc(0)
+		f.touch(fid.Fid.User)
+	}
+
+	return nil
+}
+
+func (f *File) Create(fid *srv.FFid, name string, perm uint32) (*srv.File, error) {
+	if !validName(name) {
+		return nil, Ebadname
+	}
+
+	if perm&(ninep.DMNAMEDPIPE|ninep.DMSYMLINK|ninep.DMLINK|ninep.DMDEVICE|ninep.DMSOCKET) != 0 {
+		return nil, srv.Eperm
+	}
+
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
+
+	// the permissions are limited by the directory's
+	f.Lock()
+	if perm&ninep.DMDIR != 0 {
+		perm &= ^uint32(0777) | f.Mode&0777
+	} else {
+		perm &= ^uint32(0666) | f.Mode&0666
+	}
+	gid, gidnum := f.Gid, f.Gidnum
+	f.Unlock()
+
+	user := fid.Fid.User
+	ff := f.fs.newFile()
+	if err := ff.Add(&f.File, name, user, nil, perm, ff); err != nil {
+		return nil, err
+	}
+
+	ff.Lock()
+	ff.Gid, ff.Gidnum = gid, gidnum
+	ff.Unlock()
+	f.touchDir(user)
+	return &ff.File, nil
+}
+
+func (f *File) Remove(fid *srv.FFid) error {
+	p := f.Parent
+	if p == &f.File {
+		return srv.Eperm
+	}
+
+	user := fid.Fid.User
+	if !p.CheckPerm(user, ninep.DMWRITE) {
+		return srv.Eperm
+	}
+
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
+	f.release()
+	f.File.Remove()
+	p.Ops.(*File).touchDir(user)
+	return nil
+}
+
+// Frees the data of a removed file.
+func (f *File) release() {
+	f.Lock()
+	f.fs.charge(f.Uid, int64(f.Length), f.Uid, 0)
+	f.trunc(0)
+	f.removed = true
+	f.Unlock()
+}
+
+func (f *File) Wstat(fid *srv.FFid, dir *ninep.Dir) error {
+	r := f.fs
+	user := fid.Fid.User
+
+	r.tree.RLock()
+	defer r.tree.RUnlock()
+	f.Lock()
+	owner := user != nil && f.Uid == user.Name()
+	ouid, ogid := f.Uid, f.Gid
+	ouidnum, ogidnum := f.Uidnum, f.Gidnum
+	uid, gid := ouid, ogid
+	uidnum, gidnum := ouidnum, ogidnum
+	length := f.Length
+	isdir := f.Mode&ninep.DMDIR != 0
+	f.Unlock()
+
+	if dir.Uidnum != ninep.NOUID || dir.Uid != "" {
+		u := r.Upool.Uid2User(int(dir.Uidnum))
+		if dir.Uid != "" {
+			u = r.Upool.Uname2User(dir.Uid)
+		}
+
+		if u == nil {
+			return srv.Enouser
+		}
+
+		uid, uidnum = u.Name(), uint32(u.Id())
+	}
+
+	var g ninep.Group
+	if dir.Gidnum != ninep.NOUID || dir.Gid != "" {
+		g = r.Upool.Gid2Group(int(dir.Gidnum))
+		if dir.Gid != "" {
+			g = r.Upool.Gname2Group(dir.Gid)
+		}
+
+		if g == nil {
+			return srv.Enouser
+		}
+
+		gid, gidnum = g.Name(), uint32(g.Id())
+	}
+
+	admin := user != nil && r.Admin != "" && user.Name() == r.Admin
+	if (uid != ouid || uidnum != ouidnum) && !admin {
+		return srv.Eperm
+	}
+
+	if (gid != ogid || gidnum != ogidnum) && !admin {
+		if !owner && !r.leader(user, ogid, ogidnum) {
+			return srv.Eperm
+		}
+
+		if u := r.Upool.Uname2User(uid); u == nil || !u.IsMember(g) {
+			return srv.Eperm
+		}
+	}
+
+	// only the owner and the admin can change the mode and times
+	if (dir.Mode != 0xFFFFFFFF || dir.Mtime != 0xFFFFFFFF) && !owner && !admin {
+		return srv.Eperm
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		if isdir && dir.Length != 0 || !f.CheckPerm(user, ninep.DMWRITE) {
+			return srv.Eperm
+		}
+
+		length = dir.Length
+	}
+
+	rename := dir.Name != "" && dir.Name != f.Name
+	if rename {
+		if !validName(dir.Name) {
+			return Ebadname
+		}
+
+		if f.Parent == &f.File || !f.Parent.CheckPerm(user, ninep.DMWRITE) {
+			return srv.Eperm
+		}
+
+		if f.Parent.Find(dir.Name) != nil {
+			return srv.Eexist
+		}
+	}
+
+	f.Lock()
+	if err := r.charge(f.Uid, int64(f.Length), uid, int64(length)); err != nil {
+		f.Unlock()
+		return err
+	}
+
+	f.Uid, f.Uidnum = uid, uidnum
+	f.Gid, f.Gidnum = gid, gidnum
+	if dir.Mode != 0xFFFFFFFF {
+		f.Mode = (f.Mode &^ 0777) | (dir.Mode & 0777)
+	}
+
+	if dir.Mtime != 0xFFFFFFFF {
+		f.Mtime = dir.Mtime
+	}
+
+	if length != f.Length {
+		f.trunc(length)
+		f.touch(user)
+	}
+	f.Unlock()
+
+	if rename {
+		if err := f.Rename(dir.Name); err != nil {
+			return err
+		}
+
+		f.Parent.Ops.(*File).touchDir(user)
+	}
+
+	return nil
+}
+
+// called with f locked
+func (f *File) trunc(sz uint64) {
+	if f.Length == sz {
+		return
+	}
+
+	if f.Length > sz {
+		f.shrink(sz)
+	} else {
+		f.expand(sz)
+	}
+}
+
+// called with f locked
+func (f *File) shrink(sz uint64) {
+	blksz := uint64(f.fs.blksz)
+	blknum := sz / blksz
+	off := sz % blksz
+	if off > 0 {
+		if blk, ok := f.data[blknum]; ok {
+			copy(blk[off:], f.fs.zero)
+		}
+
+		blknum++
+	}
+
+	for n, blk := range f.data {
+		if n >= blknum {
+			f.fs.putBlock(blk)
+			delete(f.data, n)
+		}
+	}
+
+	f.Length = sz
+}
+
+// The blocks past the old end are missing, and read as zeroes. Called
+// with f locked.
+func (f *File) expand(sz uint64) {
+	f.Length = sz
+}
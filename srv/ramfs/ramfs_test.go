@@ -0,0 +1,385 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bytes"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+)
+
+func setup(t *testing.T, r *Ramfs) (*clnt.Clnt, ninep.User) {
+	r.Dotu = true
+	r.Id = "ramfs"
+	if !r.Start(r) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go r.StartListener(l)
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c, user
+}
+
+func newRamfs() *Ramfs {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	group := ninep.OsUsers.Gid2Group(os.Getegid())
+	return New(user, group, 16)
+}
+
+func create(c *clnt.Clnt, name string, data []byte) error {
+	f, err := c.FCreate(name, 0644, ninep.OWRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Writen(data, 0)
+	return err
+}
+
+func mkdir(t *testing.T, c *clnt.Clnt, name string) {
+	t.Helper()
+	f, err := c.FCreate(name, ninep.DMDIR|0755, ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FCreate %s: %v", name, err)
+	}
+	f.Close()
+}
+
+func readFile(t *testing.T, c *clnt.Clnt, name string) []byte {
+	t.Helper()
+	b, err := fs.ReadFile(clnt.NewFS(c), name)
+	if err != nil {
+		t.Fatalf("ReadFile %s: %v", name, err)
+	}
+
+	return b
+}
+
+func TestRamfs(t *testing.T) {
+	r := newRamfs()
+	c, _ := setup(t, r)
+	defer c.Unmount()
+
+	// data spanning several blocks, and a sparse file
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	mkdir(t, c, "dir")
+	if err := create(c, "dir/file", data); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	f, err := c.FCreate("sparse", 0644, ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+	f.Writen([]byte("end"), 40)
+	f.Close()
+
+	if err := create(c, "dir/file", nil); err == nil {
+		t.Errorf("created an existing file")
+	}
+
+	if err := fstest.TestFS(clnt.NewFS(c), "dir/file", "sparse"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := readFile(t, c, "dir/file"); !bytes.Equal(b, data) {
+		t.Errorf("dir/file: got %q", b)
+	}
+
+	if b := readFile(t, c, "sparse"); !bytes.Equal(b, append(make([]byte, 40), "end"...)) {
+		t.Errorf("sparse: got %q", b)
+	}
+
+	// writes change the Qid version
+	d1, err := c.FStat("dir/file")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	f, err = c.FOpen("dir/file", ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	f.Writen([]byte("x"), 0)
+	f.Close()
+
+	d2, err := c.FStat("dir/file")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if d2.Qid.Version == d1.Qid.Version || d2.Qid.Path != d1.Qid.Path {
+		t.Errorf("Qid after write: %v, before: %v", d2.Qid, d1.Qid)
+	}
+
+	// rename and truncate
+	fid, err := c.FWalk("dir/file")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+
+	st := ninep.NewWstatDir()
+	st.Name = "renamed"
+	st.Length = 5
+	if err := c.Wstat(fid, st); err != nil {
+		t.Fatalf("Wstat: %v", err)
+	}
+	c.Clunk(fid)
+
+	if _, err := c.FStat("dir/file"); err == nil {
+		t.Errorf("dir/file exists after rename")
+	}
+
+	if b := readFile(t, c, "dir/renamed"); string(b) != "x1234" {
+		t.Errorf("dir/renamed: got %q", b)
+	}
+
+	if r.Size() != 5+43 {
+		t.Errorf("size: got %d", r.Size())
+	}
+
+	// remove
+	if err := c.FRemove("dir"); err == nil {
+		t.Errorf("removed a non-empty directory")
+	}
+
+	for _, name := range []string{"dir/renamed", "dir", "sparse"} {
+		if err := c.FRemove(name); err != nil {
+			t.Fatalf("FRemove %s: %v", name, err)
+		}
+	}
+
+	if r.Size() != 0 {
+		t.Errorf("size after remove: got %d", r.Size())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	r := newRamfs()
+	r.MaxSize = 100
+	c, user := setup(t, r)
+	defer c.Unmount()
+
+	r.Quotas = map[string]int64{user.Name(): 50}
+	if err := create(c, "a", make([]byte, 40)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := create(c, "b", make([]byte, 20)); err == nil {
+		t.Errorf("wrote over the user's quota")
+	}
+
+	if n := r.Usage(user.Name()); n != 40 {
+		t.Errorf("usage: got %d", n)
+	}
+
+	// the tree limit applies to all users
+	r.Quotas = nil
+	if err := create(c, "c", make([]byte, 70)); err == nil {
+		t.Errorf("wrote over the tree limit")
+	}
+
+	// truncating and removing frees the space
+	f, err := c.FOpen("a", ninep.OWRITE|ninep.OTRUNC)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+	f.Close()
+
+	if err := create(c, "d", make([]byte, 90)); err != nil {
+		t.Errorf("create after truncate: %v", err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c.FRemove(name)
+	}
+
+	if r.Size() != 0 || r.Usage(user.Name()) != 0 {
+		t.Errorf("size after remove: %d, usage: %d", r.Size(), r.Usage(user.Name()))
+	}
+}
+
+func TestSparse(t *testing.T) {
+	r := newRamfs()
+	c, _ := setup(t, r)
+	defer c.Unmount()
+
+	if err := create(c, "a", nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	fid, err := c.FWalk("a")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+
+	if err := c.Open(fid, ninep.ORDWR); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// only the written blocks are kept
+	if _, err := c.Write(fid, []byte("end"), 1<<62); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if b, err := c.Read(fid, 1<<62-2, 5); string(b) != "\x00\x00end" {
+		t.Errorf("Read: got %q, %v", b, err)
+	}
+
+	if _, err := c.Write(fid, []byte("x"), 1<<64-1); err == nil {
+		t.Errorf("Write past the largest length succeeded")
+	}
+
+	st := ninep.NewWstatDir()
+	st.Length = 1 << 63
+	if err := c.Wstat(fid, st); err == nil {
+		t.Errorf("Wstat with a length past the largest succeeded")
+	}
+
+	st.Length = 1 << 61
+	if err := c.Wstat(fid, st); err != nil {
+		t.Errorf("Wstat: %v", err)
+	}
+
+	if r.Size() != 1<<61 {
+		t.Errorf("size: got %d", r.Size())
+	}
+}
+
+func TestChown(t *testing.T) {
+	r := newRamfs()
+	c, user := setup(t, r)
+	defer c.Unmount()
+
+	nobody := ninep.OsUsers.Uname2User("nobody")
+	if nobody == nil {
+		t.Skip("no user nobody")
+	}
+
+	if err := create(c, "a", make([]byte, 10)); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	fid, err := c.FWalk("a")
+	if err != nil {
+		t.Fatalf("FWalk: %v", err)
+	}
+	defer c.Clunk(fid)
+
+	// the owner can't give the file away
+	st := ninep.NewWstatDir()
+	st.Uid = nobody.Name()
+	if err := c.Wstat(fid, st); err == nil {
+		t.Errorf("the owner changed the owner")
+	}
+
+	// nor change the group to one the owner isn't a member of
+	st = ninep.NewWstatDir()
+	st.Gidnum = uint32(os.Getegid()) + 1
+	if err := c.Wstat(fid, st); err == nil {
+		t.Errorf("changed the group to one the owner isn't a member of")
+	}
+
+	// the admin can
+	r.Admin = user.Name()
+	st = ninep.NewWstatDir()
+	st.Uid = nobody.Name()
+	if err := c.Wstat(fid, st); err != nil {
+		t.Fatalf("Wstat by the admin: %v", err)
+	}
+
+	if r.Usage(user.Name()) != 0 || r.Usage(nobody.Name()) != 10 {
+		t.Errorf("usage after chown: %d, %d", r.Usage(user.Name()), r.Usage(nobody.Name()))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := newRamfs()
+	c, user := setup(t, r)
+	defer c.Unmount()
+
+	data := bytes.Repeat([]byte("snapshot"), 10)
+	mkdir(t, c, "dir")
+	mkdir(t, c, "dir/empty")
+	create(c, "dir/file", data)
+	create(c, "top", []byte("top"))
+
+	d1, err := c.FStat("dir/file")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	name := filepath.Join(t.TempDir(), "snap")
+	if err := r.Snapshot(name); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	c.FRemove("top")
+	create(c, "new", []byte("new"))
+
+	// a bad snapshot doesn't change the tree
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad")
+	os.WriteFile(bad, b[0:len(b)-10], 0644)
+	if err := r.Restore(bad); err == nil {
+		t.Errorf("restored a truncated snapshot")
+	}
+
+	if _, err := c.FStat("new"); err != nil {
+		t.Errorf("tree changed by a bad snapshot: %v", err)
+	}
+
+	if err := r.Restore(name); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	if err := fstest.TestFS(clnt.NewFS(c), "dir/file", "dir/empty", "top"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.FStat("new"); err == nil {
+		t.Errorf("new exists after restore")
+	}
+
+	if b := readFile(t, c, "dir/file"); !bytes.Equal(b, data) {
+		t.Errorf("dir/file: got %q", b)
+	}
+
+	d2, err := c.FStat("dir/file")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if d2.Qid.Version != d1.Qid.Version || d2.Uid != d1.Uid || d2.Mode != d1.Mode {
+		t.Errorf("stat after restore: %v, before: %v", d2, d1)
+	}
+
+	if n := r.Usage(user.Name()); n != int64(len(data)+3) {
+		t.Errorf("usage after restore: got %d", n)
+	}
+}
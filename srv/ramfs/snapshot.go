@@ -0,0 +1,266 @@
+// Copyright 2009 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ramfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lionkov/ninep"
+)
+
+// A snapshot starts with the magic string, followed by the root
+// directory. Each file is stored as its packed (9P2000.u) stat, followed
+// by the file data for files, or by the number of files (4 bytes,
+// little-endian) and the files for directories.
+const magic = "ramfs snapshot 1\n"
+
+var Ebadsnap = &ninep.Error{"bad snapshot", ninep.EINVAL}
+
+// Saves the tree to the file. The file is replaced atomically, it
+// contains either the old, or the new snapshot.
+func (r *Ramfs) Snapshot(name string) error {
+	r.tree.Lock()
+	defer r.tree.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	io.WriteString(w, magic)
+	err = r.Root.Ops.(*File).save(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// Called with r.tree locked.
+func (f *File) save(w *bufio.Writer) error {
+	if _, err := w.Write(ninep.PackDir(&f.Dir, true)); err != nil {
+		return err
+	}
+
+	if f.Mode&ninep.DMDIR == 0 {
+		blksz := uint64(f.fs.blksz)
+		for i := uint64(0); i*blksz < f.Length; i++ {
+			blk, ok := f.data[i]
+			if !ok {
+				blk = f.fs.zero
+			}
+
+			if n := f.Length - i*blksz; n < blksz {
+				blk = blk[0:n]
+			}
+
+			if _, err := w.Write(blk); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	files := f.Children()
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(files))); err != nil {
+		return err
+	}
+
+	for _, c := range files {
+		if err := c.Ops.(*File).save(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A file read from a snapshot.
+type node struct {
+	dir   *ninep.Dir
+	data  map[uint64][]byte
+	files []*node
+}
+
+// Replaces the tree with the one saved in the file. The tree isn't
+// changed if the snapshot can't be read. The open files of the old tree
+// stay open, but they can't be written to anymore.
+func (r *Ramfs) Restore(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(rd, buf); err != nil || string(buf) != magic {
+		return Ebadsnap
+	}
+
+	root, err := r.load(rd)
+	if err != nil {
+		return err
+	}
+
+	if root.dir.Mode&ninep.DMDIR == 0 {
+		return Ebadsnap
+	}
+
+	r.tree.Lock()
+	defer r.tree.Unlock()
+
+	rf := r.Root.Ops.(*File)
+	for _, c := range r.Root.Children() {
+		c.Ops.(*File).drop()
+	}
+
+	r.mu.Lock()
+	r.size = 0
+	r.usage = make(map[string]int64)
+	r.mu.Unlock()
+
+	rf.Lock()
+	rf.setDir(root.dir)
+	rf.Unlock()
+	return rf.build(root.files)
+}
+
+// Reads a file, and the files in it for directories.
+func (r *Ramfs) load(rd *bufio.Reader) (*node, error) {
+	var sz uint16
+
+	if err := binary.Read(rd, binary.LittleEndian, &sz); err != nil {
+		return nil, Ebadsnap
+	}
+
+	buf := make([]byte, 2+int(sz))
+	binary.LittleEndian.PutUint16(buf, sz)
+	if _, err := io.ReadFull(rd, buf[2:]); err != nil {
+		return nil, Ebadsnap
+	}
+
+	d, _, _, err := ninep.UnpackDir(buf, true)
+	if err != nil {
+		return nil, Ebadsnap
+	}
+
+	n := &node{dir: d}
+	if d.Mode&ninep.DMDIR == 0 {
+		// read the data a block at a time, a bad length fails at
+		// the end of the snapshot
+		n.data = make(map[uint64][]byte)
+		for left := d.Length; left > 0; {
+			blk := make([]byte, r.blksz)
+			m := uint64(r.blksz)
+			if left < m {
+				m = left
+			}
+
+			if _, err := io.ReadFull(rd, blk[0:m]); err != nil {
+				return nil, Ebadsnap
+			}
+
+			n.data[uint64(len(n.data))] = blk
+			left -= m
+		}
+
+		return n, nil
+	}
+
+	d.Length = 0
+	var count uint32
+	if err := binary.Read(rd, binary.LittleEndian, &count); err != nil {
+		return nil, Ebadsnap
+	}
+
+	names := make(map[string]bool)
+	for i := uint32(0); i < count; i++ {
+		c, err := r.load(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		if !validName(c.dir.Name) || names[c.dir.Name] {
+			return nil, Ebadsnap
+		}
+
+		names[c.dir.Name] = true
+		n.files = append(n.files, c)
+	}
+
+	return n, nil
+}
+
+// Removes the file, and the files in it, from the tree. Called with
+// r.tree locked.
+func (f *File) drop() {
+	for _, c := range f.Children() {
+		c.Ops.(*File).drop()
+	}
+
+	f.Lock()
+	f.trunc(0)
+	f.removed = true
+	f.Unlock()
+	f.File.Remove()
+}
+
+// Sets the stat of the file from a snapshot, except its Qid path. Called
+// with f locked.
+func (f *File) setDir(d *ninep.Dir) {
+	qpath := f.Qid.Path
+	f.Dir = *d
+	f.Qid.Path = qpath
+}
+
+// Adds the files to the directory. Called with r.tree locked.
+func (f *File) build(files []*node) error {
+	r := f.fs
+	for _, n := range files {
+		ff := r.newFile()
+		if err := ff.Add(&f.File, n.dir.Name, nil, nil, n.dir.Mode, ff); err != nil {
+			return err
+		}
+
+		ff.Lock()
+		ff.setDir(n.dir)
+		ff.data = n.data
+		ff.Unlock()
+
+		r.mu.Lock()
+		r.size += int64(n.dir.Length)
+		r.usage[n.dir.Uid] += int64(n.dir.Length)
+		r.mu.Unlock()
+
+		if err := ff.build(n.files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -7,8 +7,20 @@ package srv
 import "fmt"
 import "github.com/lionkov/ninep"
 
-// Respond to the request with Rerror message
+// Respond to the request with Rerror message (Rlerror if the
+// connection speaks 9P2000.L)
 func (req *Req) RespondError(err interface{}) {
+	if req.Conn.Dotl {
+		ecode := uint32(ninep.EIO)
+		if e, ok := err.(*ninep.Error); ok && e.Errornum != 0 {
+			ecode = e.Errornum
+		}
+
+		ninep.PackRlerror(req.Rc, ecode)
+		req.Respond()
+		return
+	}
+
 	switch e := err.(type) {
 	case *ninep.Error:
 		ninep.PackRerror(req.Rc, e.Error(), uint32(e.Errornum), req.Conn.Dotu)
@@ -150,3 +162,193 @@ func (req *Req) RespondRwstat() {
 		req.Respond()
 	}
 }
+
+// Respond to the request with Rstatfs message
+func (req *Req) RespondRstatfs(st *ninep.Statfs) {
+	err := ninep.PackRstatfs(req.Rc, st)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlopen message
+func (req *Req) RespondRlopen(qid *ninep.Qid, iounit uint32) {
+	err := ninep.PackRlopen(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlcreate message
+func (req *Req) RespondRlcreate(qid *ninep.Qid, iounit uint32) {
+	err := ninep.PackRlcreate(req.Rc, qid, iounit)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsymlink message
+func (req *Req) RespondRsymlink(qid *ninep.Qid) {
+	err := ninep.PackRsymlink(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmknod message
+func (req *Req) RespondRmknod(qid *ninep.Qid) {
+	err := ninep.PackRmknod(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrename message
+func (req *Req) RespondRrename() {
+	err := ninep.PackRrename(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreadlink message
+func (req *Req) RespondRreadlink(target string) {
+	err := ninep.PackRreadlink(req.Rc, target)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetattr message
+func (req *Req) RespondRgetattr(attr *ninep.Attr) {
+	err := ninep.PackRgetattr(req.Rc, attr)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rsetattr message
+func (req *Req) RespondRsetattr() {
+	err := ninep.PackRsetattr(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrwalk message
+func (req *Req) RespondRxattrwalk(size uint64) {
+	err := ninep.PackRxattrwalk(req.Rc, size)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rxattrcreate message
+func (req *Req) RespondRxattrcreate() {
+	err := ninep.PackRxattrcreate(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rreaddir message
+func (req *Req) RespondRreaddir(data []byte) {
+	err := ninep.PackRreaddir(req.Rc, data)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rfsync message
+func (req *Req) RespondRfsync() {
+	err := ninep.PackRfsync(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlock message
+func (req *Req) RespondRlock(status uint8) {
+	err := ninep.PackRlock(req.Rc, status)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rgetlock message
+func (req *Req) RespondRgetlock(lock *ninep.Flock) {
+	err := ninep.PackRgetlock(req.Rc, lock)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rlink message
+func (req *Req) RespondRlink() {
+	err := ninep.PackRlink(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rmkdir message
+func (req *Req) RespondRmkdir(qid *ninep.Qid) {
+	err := ninep.PackRmkdir(req.Rc, qid)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Rrenameat message
+func (req *Req) RespondRrenameat() {
+	err := ninep.PackRrenameat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
+
+// Respond to the request with Runlinkat message
+func (req *Req) RespondRunlinkat() {
+	err := ninep.PackRunlinkat(req.Rc)
+	if err != nil {
+		req.RespondError(err)
+	} else {
+		req.Respond()
+	}
+}
@@ -7,10 +7,14 @@
 package srv
 
 import (
+	"context"
 	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/metrics"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type reqStatus int
@@ -24,8 +28,8 @@ const (
 
 // Debug flags
 const (
-	DbgPrintFcalls  = (1 << iota) // print all 9P messages on stderr
-	DbgPrintPackets               // print the raw packets on stderr
+	DbgPrintFcalls  = (1 << iota) // print all 9P messages on stderr (or log them on Slog)
+	DbgPrintPackets               // print the raw packets on stderr (or add them to the Slog records)
 	DbgLogFcalls                  // keep the last N 9P messages (can be accessed over http)
 	DbgLogPackets                 // keep the last N 9P messages (can be accessed over http)
 )
@@ -39,9 +43,13 @@ var Enotdir error = &ninep.Error{"not a directory", ninep.ENOTDIR}
 var Eperm error = &ninep.Error{"permission denied", ninep.EPERM}
 var Etoolarge error = &ninep.Error{"i/o count too large", ninep.EINVAL}
 var Ebadoffset error = &ninep.Error{"bad offset in directory read", ninep.EINVAL}
+var Etoosmall error = &ninep.Error{"count too small for the directory entry", ninep.EINVAL}
 var Edirchange error = &ninep.Error{"cannot convert between files and directories", ninep.EINVAL}
 var Enouser error = &ninep.Error{"unknown user", ninep.EINVAL}
 var Enotimpl error = &ninep.Error{"not implemented", ninep.EINVAL}
+var Eclosed error = &ninep.Error{"server closed", ninep.EIO}
+var Eintr error = &ninep.Error{"interrupted", ninep.EINTR}
+var Erofs error = &ninep.Error{"read-only file system", ninep.EROFS}
 
 // Authentication operations. The file server should implement them if
 // it requires user authentication. The authentication in 9P2000 is
@@ -70,7 +78,7 @@ type AuthOps interface {
 	AuthRead(afid *Fid, offset uint64, data []byte) (count int, err error)
 
 	// AuthWrite is called when the user attempts to write data to an
-	// authentication fid.
+	// authentication fid. The data is reused after the call.
 	AuthWrite(afid *Fid, offset uint64, data []byte) (count int, err error)
 }
 
@@ -111,7 +119,8 @@ type ReqProcessOps interface {
 
 // Flush operation. This interface should be implemented if the file server
 // can flush pending requests. If the interface is not implemented, requests
-// that were passed to the file server implementation won't be flushed.
+// that were passed to the file server implementation are flushed only by
+// cancelling their context (see (*Req) Context()).
 // The flush method should call the (req *Req) srv.Flush() method if the flush
 // was successful so the request can be marked appropriately.
 type FlushOp interface {
@@ -133,6 +142,36 @@ type ReqOps interface {
 	Wstat(*Req)
 }
 
+// 9P2000.L operations. This interface should be implemented by the file
+// servers that support the 9P2000.L dialect (see the Dotl field of Srv).
+// The operations correspond directly to the 9P2000.L message types. The
+// Tread, Twrite, Tclunk, Tremove, Twalk, Tattach, Tauth and Tflush messages
+// are still handled by the ReqOps and AuthOps operations.
+type ReqOpsL interface {
+	Statfs(*Req)
+	Lopen(*Req)
+	Lcreate(*Req)
+	Symlink(*Req)
+	Mknod(*Req)
+	Rename(*Req)
+	Readlink(*Req)
+	Getattr(*Req)
+	Setattr(*Req)
+	Xattrwalk(*Req)
+	Xattrcreate(*Req)
+	Readdir(*Req)
+	Fsync(*Req)
+
+	// Flock handles Tlock. It is not called Lock so it doesn't collide
+	// with the sync.Mutex embedded in Srv.
+	Flock(*Req)
+	Getlock(*Req)
+	Link(*Req)
+	Mkdir(*Req)
+	Renameat(*Req)
+	Unlinkat(*Req)
+}
+
 type StatsOps interface {
 	statsRegister()
 	statsUnregister()
@@ -148,14 +187,26 @@ type Srv struct {
 	Id         string      // Used for debugging and stats
 	Msize      uint32      // Maximum size of the 9P2000 messages supported by the server
 	Dotu       bool        // If true, the server supports the 9P2000.u extension
+	Dotl       bool        // If true, the server supports the 9P2000.L extension (ops must implement ReqOpsL)
 	Debuglevel int         // debug level
 	Upool      ninep.Users // Interface for finding users and groups known to the file server
 	Maxpend    int         // Maximum pending outgoing requests
+	Maxreqs    int         // Maximum number of in-flight requests per connection (0 means no limit)
+	Workers    int         // Number of goroutines processing the requests of all connections (0 means one per request)
 	Log        *ninep.Logger
-	Versioned  uint32 // How many times we've been Tversioned. Versioned > 0 is required before any other operations.
-
-	ops   interface{}     // operations
-	conns map[*Conn]*Conn // List of connections
+	Versioned  uint32           // How many times we've been Tversioned. Versioned > 0 is required before any other operations.
+	Auth       AuthOps          // If set, used instead of the AuthOps implemented by the file server
+	Metrics    *metrics.Metrics // If set, records the statistics of the requests
+	Slog       *slog.Logger     // If set, used for the structured log records (see Debuglevel)
+
+	ops          interface{}           // operations
+	conns        map[*Conn]*Conn       // List of connections
+	listeners    map[net.Listener]bool // Listeners started with StartListener
+	interceptors []Interceptor         // Added by Use
+	shutdown     bool                  // Shutdown was called
+	work         chan *Req             // Requests for the workers
+	workers      sync.WaitGroup        // Running workers
+	nbusy        int32                 // Number of workers processing a request
 }
 
 // The Conn type represents a connection from a client to the file server
@@ -164,16 +215,24 @@ type Conn struct {
 	Srv        *Srv
 	Msize      uint32 // maximum size of 9P2000 messages for the connection
 	Dotu       bool   // if true, both the client and the server speak 9P2000.u
+	Dotl       bool   // if true, both the client and the server speak 9P2000.L
 	Id         string // used for debugging and stats
 	Debuglevel int
+	Slog       *slog.Logger // Srv.Slog with the connection's attributes, can be replaced in ConnOpened
 
 	conn    net.Conn
 	Fidpool map[uint32]*Fid
 	Reqs    map[uint16]*Req // all outstanding requests
 
-	Reqout chan *Req
-	rchan  chan *ninep.Fcall
-	done   chan bool
+	Reqout   chan *Req
+	done     chan bool      // closed to stop the sender
+	forced   chan bool      // closed to stop waiting for the in-flight requests
+	closed   chan bool      // closed after the connection is closed
+	inflight sync.WaitGroup // requests that are read, but not responded yet
+	stopped  bool           // Shutdown stopped reading requests
+	slots    chan bool      // One value for each in-flight request, if Maxreqs is set
+	ctx      context.Context
+	cancel   context.CancelFunc
 
 	// stats
 	nreqs   int    // number of requests processed by the server
@@ -199,6 +258,7 @@ type Fid struct {
 	Omode     uint8       // Open mode (ninep.O* flags), if the fid is opened
 	Type      uint8       // Fid type (ninep.QT* flags)
 	Diroffset uint64      // If directory, the next valid read position
+	Path      string      // Path the Fid was walked to from the attach root (not updated on renames, guarded by the Fid's lock, see Pathname)
 	User      ninep.User  // The Fid's user
 	Aux       interface{} // Can be used by the file server implementation for per-Fid data
 }
@@ -208,18 +268,29 @@ type Fid struct {
 // override the default behavior, the implementation initializes Fid,
 // Afid and Newfid values and automatically keeps track on when the Fids
 // should be destroyed.
+//
+// Tc and Rc are returned to a pool after the response is sent, and
+// reused for other messages. The file server shouldn't keep them, or
+// slices of their data (like Tc.Data), after responding; the data it
+// needs later has to be copied.
 type Req struct {
 	sync.Mutex
 	Tc     *ninep.Fcall // Incoming 9P2000 message
 	Rc     *ninep.Fcall // Outgoing 9P2000 response
 	Fid    *Fid         // The Fid value for all messages that contain fid[4]
 	Afid   *Fid         // The Fid value for the messages that contain afid[4] (Tauth and Tattach)
-	Newfid *Fid         // The Fid value for the messages that contain newfid[4] (Twalk)
+	Newfid *Fid         // The Fid value for the messages that contain newfid[4] (Twalk, Txattrwalk)
+	Dfid   *Fid         // The Fid value for the destination directory (Tlink, Trename, Trenameat)
 	Conn   *Conn        // Connection that the request belongs to
 
 	status     reqStatus
 	flushreq   *Req
 	prev, next *Req
+	ctx        context.Context
+	cancel     context.CancelFunc
+	slot       bool      // the request holds one of the connection's slots
+	start      time.Time // when the request was received
+	nicpt      int       // number of interceptors called for the request
 }
 
 // The Start method should be called once the file server implementor
@@ -246,6 +317,14 @@ func (srv *Srv) Start(ops interface{}) bool {
 		srv.Log = ninep.NewLogger(1024)
 	}
 
+	if srv.Workers > 0 {
+		srv.work = make(chan *Req)
+		srv.workers.Add(srv.Workers)
+		for i := 0; i < srv.Workers; i++ {
+			go srv.worker(srv.work)
+		}
+	}
+
 	if sop, ok := (interface{}(srv)).(StatsOps); ok {
 		sop.statsRegister()
 	}
@@ -253,6 +332,31 @@ func (srv *Srv) Start(ops interface{}) bool {
 	return true
 }
 
+// Returns the authentication operations, if any.
+func (srv *Srv) authOps() AuthOps {
+	if srv.Auth != nil {
+		return srv.Auth
+	}
+
+	if aop, ok := (srv.ops).(AuthOps); ok {
+		return aop
+	}
+
+	return nil
+}
+
+// Processes the requests handed over by the connections, until the
+// channel is closed. The channel is passed, Shutdown clears srv.work
+// before the worker may have started.
+func (srv *Srv) worker(work chan *Req) {
+	defer srv.workers.Done()
+	for req := range work {
+		atomic.AddInt32(&srv.nbusy, 1)
+		req.process()
+		atomic.AddInt32(&srv.nbusy, -1)
+	}
+}
+
 func (srv *Srv) String() string {
 	return srv.Id
 }
@@ -267,6 +371,7 @@ func (req *Req) process() {
 
 	if flushed {
 		req.Respond()
+		return
 	}
 
 	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
@@ -302,7 +407,27 @@ func (req *Req) Process() {
 			return
 		}
 	}
+
+	if conn.Dotl {
+		switch tc.Type {
+		case ninep.Tlink, ninep.Trename, ninep.Trenameat:
+			if req.Dfid = conn.FidGet(tc.Dfid); req.Dfid == nil {
+				req.RespondError(Eunknownfid)
+				return
+			}
+		}
+	}
+
+	if srv.interceptors != nil && !req.intercept() {
+		return
+	}
+
 	if atomic.LoadUint32(&srv.Versioned) > 0 {
+		if conn.Dotl && tc.Type < ninep.Tversion {
+			srv.processL(req)
+			return
+		}
+
 		switch req.Tc.Type {
 		default:
 			req.RespondError(&ninep.Error{"unknown message type", ninep.EINVAL})
@@ -404,6 +529,18 @@ func (req *Req) PostProcess() {
 
 	case ninep.Tremove:
 		srv.removePost(req)
+
+	case ninep.Tlopen:
+		srv.lopenPost(req)
+
+	case ninep.Tlcreate:
+		srv.lcreatePost(req)
+
+	case ninep.Txattrwalk:
+		srv.xattrwalkPost(req)
+
+	case ninep.Txattrcreate:
+		srv.xattrcreatePost(req)
 	}
 
 	if req.Fid != nil {
@@ -420,6 +557,11 @@ func (req *Req) PostProcess() {
 		req.Newfid.DecRef()
 		req.Newfid = nil
 	}
+
+	if req.Dfid != nil {
+		req.Dfid.DecRef()
+		req.Dfid = nil
+	}
 }
 
 // The Respond method sends response back to the client. The req.Rc value
@@ -466,14 +608,28 @@ func (req *Req) Respond() {
 	}
 	conn.Unlock()
 
+	if req.nicpt > 0 {
+		req.interceptResponse()
+	}
+
 	if rop, ok := (req.Conn.Srv.ops).(ReqProcessOps); ok {
 		rop.ReqRespond(req)
 	} else {
 		req.PostProcess()
 	}
 
+	if req.cancel != nil {
+		req.cancel()
+	}
+
 	if (status & reqFlush) == 0 {
-		conn.Reqout <- req
+		select {
+		case conn.Reqout <- req:
+		case <-conn.done:
+			conn.reqDone(req)
+		}
+	} else {
+		conn.reqDone(req)
 	}
 
 	// process the next request with the same tag (if available)
@@ -489,6 +645,18 @@ func (req *Req) Respond() {
 	}
 }
 
+// Returns the context of the request. The context is cancelled when
+// the client flushes the request, when the connection is closed, or
+// when the server is forcibly shut down. Operations that may block
+// should abort and respond with an error (e.g. Eintr) when it's done.
+func (req *Req) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+
+	return req.ctx
+}
+
 // Should be called to cancel a request. Should only be called
 // from the Flush operation if the FlushOp is implemented.
 func (req *Req) Flush() {
@@ -538,6 +706,20 @@ func (conn *Conn) String() string {
 	return conn.Srv.Id + "/" + conn.Id
 }
 
+// Returns the fid's path. Walks and creates change the path while
+// other requests may use the fid.
+func (fid *Fid) Pathname() string {
+	fid.Lock()
+	defer fid.Unlock()
+	return fid.Path
+}
+
+func (fid *Fid) setPath(p string) {
+	fid.Lock()
+	fid.Path = p
+	fid.Unlock()
+}
+
 // Increase the reference count for the fid.
 func (fid *Fid) IncRef() {
 	fid.Lock()
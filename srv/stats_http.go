@@ -11,6 +11,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/lionkov/ninep"
 )
@@ -49,6 +50,15 @@ func (srv *Srv) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<html><body><h1>Server %s</h1>", srv.Id))
 	defer io.WriteString(c, "</body></html>")
 
+	// limits
+	if srv.Workers > 0 {
+		io.WriteString(c, fmt.Sprintf("<p>Busy workers: %d of %d", atomic.LoadInt32(&srv.nbusy), srv.Workers))
+	}
+
+	if srv.Maxreqs > 0 {
+		io.WriteString(c, fmt.Sprintf("<p>Maximum in-flight requests per connection: %d", srv.Maxreqs))
+	}
+
 	// connections
 	io.WriteString(c, "<h2>Connections</h2><p>")
 	srv.Lock()
@@ -81,6 +91,9 @@ func (conn *Conn) ServeHTTP(c http.ResponseWriter, r *http.Request) {
 	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", conn.rsz))
 	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", conn.tsz))
 	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", conn.npend, conn.maxpend))
+	if conn.slots != nil {
+		io.WriteString(c, fmt.Sprintf("<br>In-flight requests: %d of %d", len(conn.slots), cap(conn.slots)))
+	}
 	io.WriteString(c, fmt.Sprintf("<br>Number of reads: %d", conn.nreads))
 	io.WriteString(c, fmt.Sprintf("<br>Number of writes: %d", conn.nwrites))
 	conn.Unlock()
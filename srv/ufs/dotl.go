@@ -0,0 +1,673 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Linux open(2) flags as sent in Tlopen and Tlcreate. They are
+// translated explicitly so the server works on non-Linux hosts too.
+const (
+	lO_ACCMODE = 03
+	lO_CREAT   = 0100
+	lO_EXCL    = 0200
+	lO_TRUNC   = 01000
+	lO_APPEND  = 02000
+	lO_SYNC    = 04010000
+)
+
+// Linux d_type values for Rreaddir entries
+const (
+	dtFIFO = 1
+	dtCHR  = 2
+	dtDIR  = 4
+	dtBLK  = 6
+	dtREG  = 8
+	dtLNK  = 10
+	dtSOCK = 12
+)
+
+var Enotsup = &ninep.Error{"operation not supported", ninep.ENOTSUP}
+var Ebadname = &ninep.Error{"invalid file name", ninep.EINVAL}
+
+// Verify that we correctly implement ReqOpsL
+var _ = srv.ReqOpsL(&Ufs{})
+
+func lflags2uflags(flags uint32) int {
+	ret := int(0)
+	switch flags & lO_ACCMODE {
+	case syscall.O_RDONLY:
+		ret = os.O_RDONLY
+
+	case syscall.O_WRONLY:
+		ret = os.O_WRONLY
+
+	case syscall.O_RDWR:
+		ret = os.O_RDWR
+	}
+
+	if flags&lO_TRUNC != 0 {
+		ret |= os.O_TRUNC
+	}
+
+	if flags&lO_APPEND != 0 {
+		ret |= os.O_APPEND
+	}
+
+	if flags&lO_SYNC == lO_SYNC {
+		ret |= os.O_SYNC
+	}
+
+	return ret
+}
+
+func dir2Dtype(d os.FileInfo) uint8 {
+	mode := d.Mode()
+	switch {
+	case mode.IsDir():
+		return dtDIR
+	case mode&os.ModeSymlink != 0:
+		return dtLNK
+	case mode&os.ModeNamedPipe != 0:
+		return dtFIFO
+	case mode&os.ModeSocket != 0:
+		return dtSOCK
+	case mode&os.ModeCharDevice != 0:
+		return dtCHR
+	case mode&os.ModeDevice != 0:
+		return dtBLK
+	}
+
+	return dtREG
+}
+
+func dir2Attr(d os.FileInfo, mask uint64) (*ninep.Attr, error) {
+	sysif := d.Sys()
+	if sysif == nil {
+		return nil, &os.PathError{"dir2Attr", d.Name(), nil}
+	}
+
+	stat, ok := sysif.(*syscall.Stat_t)
+	if !ok {
+		return nil, &os.PathError{"dir2Attr: sysif has wrong type", d.Name(), nil}
+	}
+
+	at, mt, ct := atime(stat), mtime(stat), ctime(stat)
+	attr := &ninep.Attr{
+		Valid:     ninep.GetattrBasic & mask,
+		Qid:       *dir2Qid(d),
+		Mode:      uint32(stat.Mode),
+		Uid:       stat.Uid,
+		Gid:       stat.Gid,
+		Nlink:     uint64(stat.Nlink),
+		Rdev:      uint64(stat.Rdev),
+		Size:      uint64(stat.Size),
+		Blksize:   uint64(stat.Blksize),
+		Blocks:    uint64(stat.Blocks),
+		Atime:     uint64(at.Unix()),
+		AtimeNsec: uint64(at.Nanosecond()),
+		Mtime:     uint64(mt.Unix()),
+		MtimeNsec: uint64(mt.Nanosecond()),
+		Ctime:     uint64(ct.Unix()),
+		CtimeNsec: uint64(ct.Nanosecond()),
+	}
+
+	// the Qid is always sent
+	attr.Valid |= ninep.GetattrIno
+	return attr, nil
+}
+
+// Sets the group of a newly created file, if requested. Failures are
+// ignored, the file keeps the group of the server process.
+func setGid(path string, gid uint32) {
+	if gid != ninep.NOUID {
+		os.Lchown(path, -1, int(gid))
+	}
+}
+
+// Returns the path of the file with the name in the directory. The name
+// must be a single path element, so the path can't leave the root. If
+// it isn't, responds with an error and returns false.
+func childPath(req *srv.Req, dir, name string) (string, bool) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		req.RespondError(Ebadname)
+		return "", false
+	}
+
+	return path.Join(dir, name), true
+}
+
+// Returns the Qid of a newly created file.
+func newQid(req *srv.Req, path string, gid uint32) (*ninep.Qid, bool) {
+	setGid(path, gid)
+	st, err := os.Lstat(path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return nil, false
+	}
+
+	return dir2Qid(st), true
+}
+
+func (*Ufs) Statfs(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	st, err := statfs(fid.path)
+	if err != nil {
+		req.RespondError(toError(err))
+		return
+	}
+
+	req.RespondRstatfs(st)
+}
+
+func (u *Ufs) Lopen(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	flags := lflags2uflags(tc.Flags)
+	if err := u.accessPath(req.Fid.User, fid.path, uflags2perm(flags)); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	var e error
+	fid.file, e = u.open(req.Context(), req.Fid.User, fid, flags)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlopen(dir2Qid(fid.st), 0)
+}
+
+func (u *Ufs) Lcreate(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if err := u.accessDir(req.Fid.User, fid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+	excl := tc.Flags&lO_EXCL != 0
+	file, created, e := u.create(req.Fid.User, path, lflags2uflags(tc.Flags), os.FileMode(tc.Perm&0777), excl)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	// an existing file keeps its mode and owner
+	if created {
+		if tc.Perm&(syscall.S_ISUID|syscall.S_ISGID|syscall.S_ISVTX) != 0 {
+			syscall.Chmod(path, tc.Perm&07777)
+		}
+
+		setGid(path, tc.Ngid)
+		u.setOwner(req.Fid.User, path, tc.Ngid)
+	}
+
+	fid.path = path
+	fid.file = file
+	err := fid.stat()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRlcreate(dir2Qid(fid.st), 0)
+}
+
+func (u *Ufs) Symlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if err := u.accessDir(req.Fid.User, fid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+	if e := os.Symlink(tc.Target, path); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	u.setOwner(req.Fid.User, path, tc.Ngid)
+	if qid, ok := newQid(req, path, tc.Ngid); ok {
+		req.RespondRsymlink(qid)
+	}
+}
+
+func (u *Ufs) Mknod(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if err := u.accessDir(req.Fid.User, fid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+	if e := syscall.Mknod(path, tc.Perm, mkdev(tc.Major, tc.Minor)); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	u.setOwner(req.Fid.User, path, tc.Ngid)
+	if qid, ok := newQid(req, path, tc.Ngid); ok {
+		req.RespondRmknod(qid)
+	}
+}
+
+func (u *Ufs) Rename(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	if err := fid.stat(); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if err := u.accessRemove(req.Fid.User, path.Dir(fid.path), fid.st); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	newpath := path.Join(dfid.path, path.Join("/", req.Tc.Name))
+	if err := u.accessTarget(req.Fid.User, newpath); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if e := os.Rename(fid.path, newpath); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	fid.path = newpath
+	req.RespondRrename()
+}
+
+func (*Ufs) Readlink(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	target, e := os.Readlink(fid.path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRreadlink(target)
+}
+
+func (*Ufs) Getattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if err := fid.stat(); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	attr, err := dir2Attr(fid.st, req.Tc.Mask)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRgetattr(attr)
+}
+
+func (u *Ufs) Setattr(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	sa := &req.Tc.Setattr
+	if err := fid.stat(); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if err := u.setattrAccess(req.Fid.User, fid.st, sa); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if sa.Valid&ninep.SetattrMode != 0 {
+		if e := syscall.Chmod(fid.path, sa.Mode&07777); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&(ninep.SetattrUid|ninep.SetattrGid) != 0 {
+		uid, gid := -1, -1
+		if sa.Valid&ninep.SetattrUid != 0 {
+			uid = int(sa.Uid)
+		}
+
+		if sa.Valid&ninep.SetattrGid != 0 {
+			gid = int(sa.Gid)
+		}
+
+		if e := os.Lchown(fid.path, uid, gid); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&ninep.SetattrSize != 0 {
+		var e error
+		if fid.file != nil {
+			e = fid.file.Truncate(int64(sa.Size))
+		} else {
+			e = os.Truncate(fid.path, int64(sa.Size))
+		}
+
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if sa.Valid&(ninep.SetattrAtime|ninep.SetattrMtime) != 0 {
+		now := time.Now()
+		at, mt := atime(fid.st.Sys().(*syscall.Stat_t)), fid.st.ModTime()
+		if sa.Valid&ninep.SetattrAtime != 0 {
+			at = now
+			if sa.Valid&ninep.SetattrAtimeSet != 0 {
+				at = time.Unix(int64(sa.Atime), int64(sa.AtimeNsec))
+			}
+		}
+
+		if sa.Valid&ninep.SetattrMtime != 0 {
+			mt = now
+			if sa.Valid&ninep.SetattrMtimeSet != 0 {
+				mt = time.Unix(int64(sa.Mtime), int64(sa.MtimeNsec))
+			}
+		}
+
+		if e := os.Chtimes(fid.path, at, mt); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	req.RespondRsetattr()
+}
+
+func (*Ufs) Xattrwalk(req *srv.Req) { req.RespondError(Enotsup) }
+
+func (*Ufs) Xattrcreate(req *srv.Req) { req.RespondError(Enotsup) }
+
+// Readdir returns the directory entries starting from the entry with
+// index tc.Offset. The offset of each entry is the index of the entry
+// after it, so the client can resume reading with any returned offset.
+// The directory is re-read when the offset is 0.
+func (u *Ufs) Readdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	rc := req.Rc
+
+	if tc.Offset == 0 || fid.dirs == nil {
+		if err := fid.readdirL(u.Root); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	ninep.InitRreaddir(rc, tc.Count)
+	count := 0
+	b := rc.Data
+	for i := tc.Offset; i < uint64(len(fid.dirs)); i++ {
+		d := fid.dirs[i]
+		de := &ninep.Dirent{Qid: *dir2Qid(d), Offset: i + 1, Type: dir2Dtype(d), Name: d.Name()}
+		if i == 0 {
+			de.Name = "."
+		} else if i == 1 {
+			de.Name = ".."
+		}
+
+		nd := ninep.PackDirent(de)
+		if len(nd) > len(b) {
+			break
+		}
+
+		copy(b, nd)
+		b = b[len(nd):]
+		count += len(nd)
+	}
+
+	if count == 0 && tc.Offset < uint64(len(fid.dirs)) {
+		req.RespondError(&ninep.Error{"too small read size for dir entry", ninep.EINVAL})
+		return
+	}
+
+	ninep.SetRreadCount(rc, uint32(count))
+	req.Respond()
+}
+
+// Reads the content of the directory into fid.dirs. The first two
+// entries are the directory itself and its parent (the root is its
+// own parent).
+func (fid *Fid) readdirL(root string) *ninep.Error {
+	if err := fid.stat(); err != nil {
+		return err
+	}
+
+	parent := fid.st
+	if path.Clean(fid.path) != path.Clean(root) {
+		st, e := os.Lstat(path.Dir(fid.path))
+		if e != nil {
+			return toError(e)
+		}
+
+		parent = st
+	}
+
+	f, e := os.Open(fid.path)
+	if e != nil {
+		return toError(e)
+	}
+	defer f.Close()
+
+	dirs, e := f.Readdir(-1)
+	if e != nil {
+		return toError(e)
+	}
+
+	fid.dirs = append([]os.FileInfo{fid.st, parent}, dirs...)
+	return nil
+}
+
+func (*Ufs) Fsync(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(&ninep.Error{"file not open", ninep.EBADF})
+		return
+	}
+
+	if e := fid.file.Sync(); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRfsync()
+}
+
+// All fids are opened by the server process, so the POSIX record locks
+// on the host wouldn't conflict with each other. The locks are kept on
+// the open files instead (open file description locks), a fid that
+// isn't open can't be locked.
+func (*Ufs) Flock(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	status, e := setLock(fid.file, &req.Tc.Flock)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlock(status)
+}
+
+func (*Ufs) Getlock(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	if fid.file == nil {
+		req.RespondError(srv.Ebaduse)
+		return
+	}
+
+	lock, e := getLock(fid.file, &req.Tc.Flock)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRgetlock(lock)
+}
+
+func (u *Ufs) Link(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	if err := u.accessDir(req.Fid.User, dfid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	st, e := os.Lstat(fid.path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	if err := u.accessLink(req.Fid.User, st); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	newpath, ok := childPath(req, dfid.path, req.Tc.Name)
+	if !ok {
+		return
+	}
+
+	if e := os.Link(fid.path, newpath); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRlink()
+}
+
+func (u *Ufs) Mkdir(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	if err := u.accessDir(req.Fid.User, fid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+	if e := syscall.Mkdir(path, tc.Perm&07777); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	u.setOwner(req.Fid.User, path, tc.Ngid)
+	if qid, ok := newQid(req, path, tc.Ngid); ok {
+		req.RespondRmkdir(qid)
+	}
+}
+
+func (u *Ufs) Renameat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	dfid := req.Dfid.Aux.(*Fid)
+	tc := req.Tc
+	oldpath, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+
+	newpath, ok := childPath(req, dfid.path, tc.Newname)
+	if !ok {
+		return
+	}
+
+	st, e := os.Lstat(oldpath)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	if err := u.accessRemove(req.Fid.User, fid.path, st); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if err := u.accessTarget(req.Fid.User, newpath); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if e := os.Rename(oldpath, newpath); e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRrenameat()
+}
+
+func (u *Ufs) Unlinkat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
+	st, e := os.Lstat(path)
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	if err := u.accessRemove(req.Fid.User, fid.path, st); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	if tc.Flags&ninep.AT_REMOVEDIR != 0 {
+		e = syscall.Rmdir(path)
+	} else {
+		e = syscall.Unlink(path)
+	}
+
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.RespondRunlinkat()
+}
@@ -0,0 +1,360 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Permission bits, as in the "other" part of the file mode
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+var Eaccess = &ninep.Error{"permission denied", ninep.EACCES}
+
+// Returns the permissions needed to open a file with the 9P mode.
+func omode2perm(mode uint8) uint32 {
+	var perm uint32
+	switch mode & 3 {
+	case ninep.OREAD:
+		perm = permRead
+	case ninep.OWRITE:
+		perm = permWrite
+	case ninep.ORDWR:
+		perm = permRead | permWrite
+	case ninep.OEXEC:
+		perm = permExec
+	}
+
+	if mode&ninep.OTRUNC != 0 {
+		perm |= permWrite
+	}
+
+	return perm
+}
+
+// Returns the permissions needed to open a file with the Unix flags.
+func uflags2perm(flags int) uint32 {
+	var perm uint32
+	switch flags & syscall.O_ACCMODE {
+	case os.O_RDONLY:
+		perm = permRead
+	case os.O_WRONLY:
+		perm = permWrite
+	case os.O_RDWR:
+		perm = permRead | permWrite
+	}
+
+	if flags&os.O_TRUNC != 0 {
+		perm |= permWrite
+	}
+
+	return perm
+}
+
+// Returns true if the user is a member of the group.
+func (u *Ufs) inGroup(user ninep.User, gid uint32) bool {
+	for _, g := range user.Groups() {
+		if g != nil && g.Id() == int(gid) {
+			return true
+		}
+	}
+
+	if g := u.Upool.Gid2Group(int(gid)); g != nil {
+		return user.IsMember(g)
+	}
+
+	return false
+}
+
+// Checks if the user has the perm permissions for the file st according
+// to its owner, group and other permission bits. Root has all permissions,
+// except to execute files that nobody can execute. Always succeeds if
+// the permission checks are off.
+func (u *Ufs) access(user ninep.User, st os.FileInfo, perm uint32) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	sys := st.Sys().(*syscall.Stat_t)
+	mode := uint32(sys.Mode)
+	switch {
+	case user == nil:
+		return Eaccess
+
+	case user.Id() == 0:
+		if perm&permExec != 0 && !st.IsDir() && mode&0111 == 0 {
+			return Eaccess
+		}
+
+		return nil
+
+	case uint32(user.Id()) == sys.Uid:
+		mode >>= 6
+
+	case u.inGroup(user, uint32(sys.Gid)):
+		mode >>= 3
+	}
+
+	if mode&perm != perm {
+		return Eaccess
+	}
+
+	return nil
+}
+
+// Like access, but for the file with the specified path.
+func (u *Ufs) accessPath(user ninep.User, path string, perm uint32) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	st, e := os.Stat(path)
+	if e != nil {
+		return toError(e)
+	}
+
+	return u.access(user, st, perm)
+}
+
+// Checks if the user can create or remove files in the directory.
+func (u *Ufs) accessDir(user ninep.User, dir string) *ninep.Error {
+	return u.accessPath(user, dir, permWrite|permExec)
+}
+
+// Checks if the user can remove the file st from the directory dir, or
+// rename it. The user needs write permission for the directory, and
+// if the directory is sticky, has to own the file or the directory.
+func (u *Ufs) accessRemove(user ninep.User, dir string, st os.FileInfo) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	dst, e := os.Stat(dir)
+	if e != nil {
+		return toError(e)
+	}
+
+	if err := u.access(user, dst, permWrite|permExec); err != nil {
+		return err
+	}
+
+	if dst.Mode()&os.ModeSticky == 0 || user.Id() == 0 {
+		return nil
+	}
+
+	uid := uint32(user.Id())
+	if uid != st.Sys().(*syscall.Stat_t).Uid && uid != dst.Sys().(*syscall.Stat_t).Uid {
+		return Eaccess
+	}
+
+	return nil
+}
+
+// Checks if the user can rename a file to newpath, replacing the file
+// that is there, if any.
+func (u *Ufs) accessTarget(user ninep.User, newpath string) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	if st, e := os.Lstat(newpath); e == nil {
+		return u.accessRemove(user, path.Dir(newpath), st)
+	}
+
+	return u.accessDir(user, path.Dir(newpath))
+}
+
+// Checks if the user can make a hard link to the file. Like with the
+// Linux protected_hardlinks, the user has to own the file, or be able
+// to read and write it.
+func (u *Ufs) accessLink(user ninep.User, st os.FileInfo) *ninep.Error {
+	if !u.Perms || u.owner(user, st) == nil {
+		return nil
+	}
+
+	return u.access(user, st, permRead|permWrite)
+}
+
+// Checks if the user can change the attributes of the file, i.e.
+// if the user is its owner or root.
+func (u *Ufs) owner(user ninep.User, st os.FileInfo) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	if user == nil || (user.Id() != 0 && uint32(user.Id()) != st.Sys().(*syscall.Stat_t).Uid) {
+		return Eaccess
+	}
+
+	return nil
+}
+
+// Gives a newly created file to the user if the server runs as root,
+// but doesn't switch the fsuid. The file gets the group of the
+// directory it is created in, unless gid is specified.
+func (u *Ufs) setOwner(user ninep.User, file string, gid uint32) {
+	if !u.Perms || u.Fsuid || user == nil || os.Geteuid() != 0 {
+		return
+	}
+
+	if gid == ninep.NOUID {
+		if st, e := os.Stat(path.Dir(file)); e == nil {
+			gid = st.Sys().(*syscall.Stat_t).Gid
+		}
+	}
+
+	os.Lchown(file, user.Id(), int(gid))
+}
+
+// Returns the user of the fid the request operates on.
+func reqUser(req *srv.Req) ninep.User {
+	tc := req.Tc
+	if tc.Fid == ninep.NOFID || tc.Type == ninep.Tattach || tc.Type == ninep.Tversion {
+		return nil
+	}
+
+	fid := req.Conn.FidGet(tc.Fid)
+	if fid == nil {
+		return nil
+	}
+
+	user := fid.User
+	fid.DecRef()
+	return user
+}
+
+// Switches the fsuid and fsgid of the current thread to the user's, if
+// the Fsuid field is set and the server runs as root. The fsgid is the
+// first group of the user, the kernel doesn't know about the others.
+// The goroutine is locked to the thread until the returned function
+// restores the ids. If they can't be restored, the goroutine stays
+// locked, and the thread is terminated with it.
+func (u *Ufs) setUser(user ninep.User) (func(), error) {
+	if !u.Fsuid || os.Geteuid() != 0 || user == nil {
+		return func() {}, nil
+	}
+
+	gid := -1
+	if groups := user.Groups(); len(groups) > 0 && groups[0] != nil {
+		gid = groups[0].Id()
+	}
+
+	// the fsuid is per thread
+	runtime.LockOSThread()
+	restore, e := setfsid(user.Id(), gid)
+	if e != nil {
+		runtime.UnlockOSThread()
+		return nil, e
+	}
+
+	return func() {
+		if restore() == nil {
+			runtime.UnlockOSThread()
+		}
+	}, nil
+}
+
+// Processes each request with the fsuid and fsgid of the user (see
+// setUser).
+func (u *Ufs) ReqProcess(req *srv.Req) {
+	restore, e := u.setUser(reqUser(req))
+	if e != nil {
+		req.RespondError(toError(e))
+		return
+	}
+
+	req.Process()
+	restore()
+}
+
+func (*Ufs) ReqRespond(req *srv.Req) {
+	req.PostProcess()
+}
+
+// Checks if the user can change the owner and the group of the file to
+// uid and gid (ninep.NOUID if unchanged). Only root can give a file away,
+// the owner can change the group to one the owner is a member of.
+func (u *Ufs) chownAccess(user ninep.User, st os.FileInfo, uid, gid uint32) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	if err := u.owner(user, st); err != nil {
+		return err
+	}
+
+	if user.Id() == 0 {
+		return nil
+	}
+
+	sys := st.Sys().(*syscall.Stat_t)
+	if uid != ninep.NOUID && uid != sys.Uid {
+		return Eaccess
+	}
+
+	if gid != ninep.NOUID && gid != uint32(sys.Gid) && !u.inGroup(user, gid) {
+		return Eaccess
+	}
+
+	return nil
+}
+
+// Checks if the user can change the attributes of the file as requested
+// by the Tsetattr message. Like utimensat(2), setting the times to the
+// current time requires write permission only.
+func (u *Ufs) setattrAccess(user ninep.User, st os.FileInfo, sa *ninep.SetAttr) *ninep.Error {
+	if !u.Perms {
+		return nil
+	}
+
+	if sa.Valid&ninep.SetattrMode != 0 {
+		if err := u.owner(user, st); err != nil {
+			return err
+		}
+	}
+
+	uid, gid := ninep.NOUID, ninep.NOUID
+	if sa.Valid&ninep.SetattrUid != 0 {
+		uid = sa.Uid
+	}
+
+	if sa.Valid&ninep.SetattrGid != 0 {
+		gid = sa.Gid
+	}
+
+	if uid != ninep.NOUID || gid != ninep.NOUID {
+		if err := u.chownAccess(user, st, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if sa.Valid&ninep.SetattrSize != 0 {
+		if err := u.access(user, st, permWrite); err != nil {
+			return err
+		}
+	}
+
+	if sa.Valid&(ninep.SetattrAtimeSet|ninep.SetattrMtimeSet) != 0 {
+		if err := u.owner(user, st); err != nil {
+			return err
+		}
+	} else if sa.Valid&(ninep.SetattrAtime|ninep.SetattrMtime) != 0 {
+		if u.owner(user, st) != nil {
+			return u.access(user, st, permWrite)
+		}
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@
 package ufs
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -35,7 +37,9 @@ type Fid struct {
 
 type Ufs struct {
 	srv.Srv
-	Root string
+	Root  string
+	Perms bool // If true, check the permissions of the fid's user for each operation
+	Fsuid bool // If true and running as root, switch fsuid/fsgid to the fid's user for each request (Linux only)
 }
 
 var root = flag.String("root", "/", "root filesystem")
@@ -44,6 +48,10 @@ var Enoent = &ninep.Error{"file not found", ninep.ENOENT}
 func toError(err error) *ninep.Error {
 	var ecode uint32
 
+	if e, ok := err.(*ninep.Error); ok {
+		return e
+	}
+
 	ename := err.Error()
 	if e, ok := err.(syscall.Errno); ok {
 		ecode = uint32(e)
@@ -85,6 +93,119 @@ func (fid *Fid) stat() *ninep.Error {
 	return nil
 }
 
+// Returns true if the fid's file is a FIFO.
+func (fid *Fid) isFifo() bool {
+	return fid.st != nil && fid.st.Mode()&os.ModeNamedPipe != 0
+}
+
+// Opens the fid's file for the user. Like on Unix, opening a FIFO waits
+// for the other end to be opened, but the wait is interrupted when ctx
+// is done.
+func (u *Ufs) open(ctx context.Context, user ninep.User, fid *Fid, flags int) (*os.File, error) {
+	if fid.isFifo() {
+		return u.openFifo(ctx, user, fid.path, flags)
+	}
+
+	return os.OpenFile(fid.path, flags, 0)
+}
+
+// Opens a FIFO for the user, waiting for the other end until ctx is
+// done. The opened file is non-blocking (the os package sets it), so
+// the I/O can be interrupted too.
+func (u *Ufs) openFifo(ctx context.Context, user ninep.User, path string, flags int) (*os.File, error) {
+	type result struct {
+		file *os.File
+		err  error
+	}
+
+	// the open waits in another goroutine, on a thread with the
+	// user's fsuid too
+	ch := make(chan result, 1)
+	go func() {
+		restore, e := u.setUser(user)
+		if e != nil {
+			ch <- result{nil, e}
+			return
+		}
+
+		f, e := os.OpenFile(path, flags, 0)
+		restore()
+		ch <- result{f, e}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.file, r.err
+	case <-ctx.Done():
+	}
+
+	// open the other end for a moment, so the waiting open returns
+	// and doesn't keep the thread, and close what it opens
+	other := os.O_RDONLY
+	if flags&syscall.O_ACCMODE == os.O_RDONLY {
+		other = os.O_WRONLY
+	}
+
+	if f, e := os.OpenFile(path, other|syscall.O_NONBLOCK, 0); e == nil {
+		f.Close()
+	}
+
+	go func() {
+		if r := <-ch; r.file != nil {
+			r.file.Close()
+		}
+	}()
+
+	return nil, srv.Eintr
+}
+
+// Reads from or writes to a FIFO, which can't seek. The operation is
+// interrupted when ctx is done.
+func (fid *Fid) fifoIO(ctx context.Context, buf []byte, write bool) (int, error) {
+	f := fid.file
+	stop := context.AfterFunc(ctx, func() { f.SetDeadline(time.Now()) })
+
+	var n int
+	var e error
+	if write {
+		n, e = f.Write(buf)
+	} else {
+		n, e = f.Read(buf)
+	}
+
+	if !stop() {
+		f.SetDeadline(time.Time{})
+		if errors.Is(e, os.ErrDeadlineExceeded) {
+			if n > 0 {
+				return n, nil
+			}
+
+			return 0, srv.Eintr
+		}
+	}
+
+	return n, e
+}
+
+// Creates the file. The file is created with O_EXCL, so an existing
+// file isn't truncated or given to the user. If the file exists and
+// excl isn't set, it is opened instead, with the permission checks of
+// an open. Returns true if the file was created.
+func (u *Ufs) create(user ninep.User, path string, flags int, mode os.FileMode, excl bool) (*os.File, bool, error) {
+	flags &^= os.O_CREATE | os.O_EXCL
+	file, e := os.OpenFile(path, flags|os.O_CREATE|os.O_EXCL, mode)
+	if e == nil || excl || !errors.Is(e, os.ErrExist) {
+		return file, e == nil, e
+	}
+
+	if err := u.accessPath(user, path, uflags2perm(flags)); err != nil {
+		return nil, false, err
+	}
+
+	file, e = os.OpenFile(path, flags, 0)
+	return file, false, e
+}
+
 func omode2uflags(mode uint8) int {
 	ret := int(0)
 	switch mode & 3 {
@@ -284,7 +405,7 @@ func (*Ufs) FidDestroy(sfid *srv.Fid) {
 }
 
 func (u *Ufs) Attach(req *srv.Req) {
-	if req.Afid != nil {
+	if req.Afid != nil && u.Auth == nil {
 		req.RespondError(srv.Enoauth)
 		return
 	}
@@ -308,9 +429,7 @@ func (u *Ufs) Attach(req *srv.Req) {
 	req.RespondRattach(qid)
 }
 
-func (*Ufs) Flush(req *srv.Req) {}
-
-func (*Ufs) Walk(req *srv.Req) {
+func (u *Ufs) Walk(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 
@@ -329,6 +448,15 @@ func (*Ufs) Walk(req *srv.Req) {
 	path := fid.path
 	i := 0
 	for ; i < len(tc.Wname); i++ {
+		if err := u.accessPath(req.Fid.User, path, permExec); err != nil {
+			if i == 0 {
+				req.RespondError(err)
+				return
+			}
+
+			break
+		}
+
 		p := path + "/" + tc.Wname[i]
 		st, err := os.Lstat(p)
 		if err != nil {
@@ -348,7 +476,7 @@ func (*Ufs) Walk(req *srv.Req) {
 	req.RespondRwalk(wqids[0:i])
 }
 
-func (*Ufs) Open(req *srv.Req) {
+func (u *Ufs) Open(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 	err := fid.stat()
@@ -357,8 +485,13 @@ func (*Ufs) Open(req *srv.Req) {
 		return
 	}
 
+	if err := u.accessPath(req.Fid.User, fid.path, omode2perm(tc.Mode)); err != nil {
+		req.RespondError(err)
+		return
+	}
+
 	var e error
-	fid.file, e = os.OpenFile(fid.path, omode2uflags(tc.Mode), 0)
+	fid.file, e = u.open(req.Context(), req.Fid.User, fid, omode2uflags(tc.Mode))
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -367,7 +500,7 @@ func (*Ufs) Open(req *srv.Req) {
 	req.RespondRopen(dir2Qid(fid.st), 0)
 }
 
-func (*Ufs) Create(req *srv.Req) {
+func (u *Ufs) Create(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	tc := req.Tc
 	err := fid.stat()
@@ -376,7 +509,15 @@ func (*Ufs) Create(req *srv.Req) {
 		return
 	}
 
-	path := fid.path + "/" + tc.Name
+	if err := u.accessDir(req.Fid.User, fid.path); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	path, ok := childPath(req, fid.path, tc.Name)
+	if !ok {
+		return
+	}
 	var e error = nil
 	var file *os.File = nil
 	switch {
@@ -387,8 +528,8 @@ func (*Ufs) Create(req *srv.Req) {
 		e = os.Symlink(tc.Ext, path)
 
 	case tc.Perm&ninep.DMLINK != 0:
-		n, e := strconv.ParseUint(tc.Ext, 10, 0)
-		if e != nil {
+		var n uint64
+		if n, e = strconv.ParseUint(tc.Ext, 10, 0); e != nil {
 			break
 		}
 
@@ -398,13 +539,50 @@ func (*Ufs) Create(req *srv.Req) {
 			return
 		}
 
-		e = os.Link(ofid.Aux.(*Fid).path, path)
+		opath := ofid.Aux.(*Fid).path
 		ofid.DecRef()
+		var st os.FileInfo
+		if st, e = os.Lstat(opath); e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+
+		if err := u.accessLink(req.Fid.User, st); err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		e = os.Link(opath, path)
 
 	case tc.Perm&ninep.DMNAMEDPIPE != 0:
+		if e = syscall.Mkfifo(path, tc.Perm&0777); e == nil {
+			// the FIFO stays if the open is interrupted
+			u.setOwner(req.Fid.User, path, ninep.NOUID)
+			file, e = u.openFifo(req.Context(), req.Fid.User, path, omode2uflags(tc.Mode))
+		}
+
 	case tc.Perm&ninep.DMDEVICE != 0:
-		req.RespondError(&ninep.Error{"not implemented", ninep.EIO})
-		return
+		var mode uint32
+		var major, minor uint32
+		var t byte
+		if _, e = fmt.Sscanf(tc.Ext, "%c %d %d", &t, &major, &minor); e != nil {
+			req.RespondError(&ninep.Error{"invalid device", ninep.EINVAL})
+			return
+		}
+
+		switch t {
+		case 'b':
+			mode = syscall.S_IFBLK
+		case 'c':
+			mode = syscall.S_IFCHR
+		default:
+			req.RespondError(&ninep.Error{"invalid device", ninep.EINVAL})
+			return
+		}
+
+		if e = syscall.Mknod(path, mode|(tc.Perm&0777), mkdev(major, minor)); e == nil {
+			file, e = os.OpenFile(path, omode2uflags(tc.Mode)|syscall.O_NONBLOCK, 0)
+		}
 
 	default:
 		var mode uint32 = tc.Perm & 0777
@@ -416,7 +594,7 @@ func (*Ufs) Create(req *srv.Req) {
 				mode |= syscall.S_ISGID
 			}
 		}
-		file, e = os.OpenFile(path, omode2uflags(tc.Mode)|os.O_CREATE, os.FileMode(mode))
+		file, _, e = u.create(req.Fid.User, path, omode2uflags(tc.Mode), os.FileMode(mode), true)
 	}
 
 	if file == nil && e == nil {
@@ -428,6 +606,10 @@ func (*Ufs) Create(req *srv.Req) {
 		return
 	}
 
+	if tc.Perm&ninep.DMLINK == 0 {
+		u.setOwner(req.Fid.User, path, ninep.NOUID)
+	}
+
 	fid.path = path
 	fid.file = file
 	err = fid.stat()
@@ -527,7 +709,12 @@ func (u *Ufs) Read(req *srv.Req) {
 		}
 		copy(rc.Data, fid.dirents[tc.Offset:int(tc.Offset)+count])
 	} else {
-		count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
+		if fid.isFifo() {
+			count, e = fid.fifoIO(req.Context(), rc.Data, false)
+		} else {
+			count, e = fid.file.ReadAt(rc.Data, int64(tc.Offset))
+		}
+
 		if e != nil && e != io.EOF {
 			req.RespondError(toError(e))
 			return
@@ -547,7 +734,14 @@ func (*Ufs) Write(req *srv.Req) {
 		return
 	}
 
-	n, e := fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	var n int
+	var e error
+	if fid.isFifo() {
+		n, e = fid.fifoIO(req.Context(), tc.Data, true)
+	} else {
+		n, e = fid.file.WriteAt(tc.Data, int64(tc.Offset))
+	}
+
 	if e != nil {
 		req.RespondError(toError(e))
 		return
@@ -558,7 +752,7 @@ func (*Ufs) Write(req *srv.Req) {
 
 func (*Ufs) Clunk(req *srv.Req) { req.RespondRclunk() }
 
-func (*Ufs) Remove(req *srv.Req) {
+func (u *Ufs) Remove(req *srv.Req) {
 	fid := req.Fid.Aux.(*Fid)
 	err := fid.stat()
 	if err != nil {
@@ -566,6 +760,11 @@ func (*Ufs) Remove(req *srv.Req) {
 		return
 	}
 
+	if err := u.accessRemove(req.Fid.User, path.Dir(fid.path), fid.st); err != nil {
+		req.RespondError(err)
+		return
+	}
+
 	e := os.Remove(fid.path)
 	if e != nil {
 		req.RespondError(toError(e))
@@ -618,25 +817,8 @@ func (u *Ufs) Wstat(req *srv.Req) {
 		return
 	}
 
+	user := req.Fid.User
 	dir := &req.Tc.Dir
-	if dir.Mode != 0xFFFFFFFF {
-		changed = true
-		mode := dir.Mode & 0777
-		if req.Conn.Dotu {
-			if dir.Mode&ninep.DMSETUID > 0 {
-				mode |= syscall.S_ISUID
-			}
-			if dir.Mode&ninep.DMSETGID > 0 {
-				mode |= syscall.S_ISGID
-			}
-		}
-		e := os.Chmod(fid.path, os.FileMode(mode))
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
 	uid, gid := ninep.NOUID, ninep.NOUID
 	if req.Conn.Dotu {
 		uid = dir.Uidnum
@@ -645,7 +827,6 @@ func (u *Ufs) Wstat(req *srv.Req) {
 
 	// Try to find local uid, gid by name.
 	if (dir.Uid != "" || dir.Gid != "") && !req.Conn.Dotu {
-		changed = true
 		uid, err = lookup(dir.Uid, false)
 		if err != nil {
 			req.RespondError(err)
@@ -662,21 +843,12 @@ func (u *Ufs) Wstat(req *srv.Req) {
 		}
 	}
 
-	if uid != ninep.NOUID || gid != ninep.NOUID {
-		changed = true
-		e := os.Chown(fid.path, int(uid), int(gid))
-		if e != nil {
-			req.RespondError(toError(e))
-			return
-		}
-	}
-
+	var newname string
 	if dir.Name != "" {
-		changed = true
 		// If we path.Join dir.Name to / before adding it to
 		// the fid path, that ensures nobody gets to walk out of the
 		// root of this server.
-		newname := path.Join(path.Dir(fid.path), path.Join("/", dir.Name))
+		newname = path.Join(path.Dir(fid.path), path.Join("/", dir.Name))
 
 		// absolute renaming. Ufs can do this, so let's support it.
 		// We'll allow an absolute path in the Name and, if it is,
@@ -685,7 +857,72 @@ func (u *Ufs) Wstat(req *srv.Req) {
 		if filepath.IsAbs(dir.Name) {
 			newname = path.Join(u.Root, dir.Name)
 		}
+	}
+
+	// check all the permissions before changing anything, so a
+	// wstat that fails doesn't change the file
+	if dir.Mode != 0xFFFFFFFF || dir.Mtime != ^uint32(0) || dir.Atime != ^uint32(0) {
+		if err := u.owner(user, fid.st); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
 
+	if uid != ninep.NOUID || gid != ninep.NOUID {
+		if err := u.chownAccess(user, fid.st, uid, gid); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if dir.Name != "" {
+		if err := u.accessRemove(user, path.Dir(fid.path), fid.st); err != nil {
+			req.RespondError(err)
+			return
+		}
+
+		if err := u.accessTarget(user, newname); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if dir.Length != 0xFFFFFFFFFFFFFFFF {
+		if err := u.access(user, fid.st, permWrite); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	if dir.Mode != 0xFFFFFFFF {
+		changed = true
+		mode := dir.Mode & 0777
+		if req.Conn.Dotu {
+			if dir.Mode&ninep.DMSETUID > 0 {
+				mode |= syscall.S_ISUID
+			}
+			if dir.Mode&ninep.DMSETGID > 0 {
+				mode |= syscall.S_ISGID
+			}
+		}
+		e := os.Chmod(fid.path, os.FileMode(mode))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if uid != ninep.NOUID || gid != ninep.NOUID {
+		changed = true
+		e := os.Chown(fid.path, int(uid), int(gid))
+		if e != nil {
+			req.RespondError(toError(e))
+			return
+		}
+	}
+
+	if dir.Name != "" {
+		changed = true
 		err := syscall.Rename(fid.path, newname)
 		if err != nil {
 			req.RespondError(toError(err))
@@ -5,10 +5,60 @@
 package ufs
 
 import (
+	"os"
 	"syscall"
 	"time"
+
+	"github.com/lionkov/ninep"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atimespec.Unix())
 }
+
+func mtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Mtimespec.Unix())
+}
+
+func ctime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctimespec.Unix())
+}
+
+func mkdev(major, minor uint32) int {
+	return int(major<<24 | minor&0xFFFFFF)
+}
+
+func statfs(path string) (*ninep.Statfs, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+
+	return &ninep.Statfs{
+		Type:    st.Type,
+		Bsize:   st.Bsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		Namelen: 255,
+	}, nil
+}
+
+// Darwin has no fsuid, the permission checks are done by the server only.
+func setfsid(uid, gid int) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+// Darwin has no open file description locks, and the process locks
+// don't conflict between the fids.
+func setLock(f *os.File, lk *ninep.Flock) (uint8, error) {
+	return ninep.LockError, Enotsup
+}
+
+func getLock(f *os.File, lk *ninep.Flock) (*ninep.Flock, error) {
+	return nil, Enotsup
+}
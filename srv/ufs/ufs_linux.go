@@ -5,10 +5,138 @@
 package ufs
 
 import (
+	"os"
 	"syscall"
 	"time"
+
+	"github.com/lionkov/ninep"
 )
 
 func atime(stat *syscall.Stat_t) time.Time {
 	return time.Unix(stat.Atim.Unix())
 }
+
+func mtime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Mtim.Unix())
+}
+
+func ctime(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctim.Unix())
+}
+
+func mkdev(major, minor uint32) int {
+	dev := uint64(minor&0xff) | uint64(major&0xfff)<<8
+	dev |= uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+	return int(dev)
+}
+
+func statfs(path string) (*ninep.Statfs, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+
+	return &ninep.Statfs{
+		Type:    uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		Namelen: uint32(st.Namelen),
+	}, nil
+}
+
+// Switches the fsuid and fsgid of the current thread, if gid isn't -1.
+// Returns a function that restores them.
+func setfsid(uid, gid int) (func() error, error) {
+	euid, egid := os.Geteuid(), os.Getegid()
+	if gid != -1 {
+		if err := syscall.Setfsgid(gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := syscall.Setfsuid(uid); err != nil {
+		syscall.Setfsgid(egid)
+		return nil, err
+	}
+
+	return func() error {
+		if err := syscall.Setfsuid(euid); err != nil {
+			return err
+		}
+
+		return syscall.Setfsgid(egid)
+	}, nil
+}
+
+// The open file description locks, owned by the open file rather than
+// by the process, so the locks of the fids conflict with each other.
+const (
+	fOFD_GETLK = 36
+	fOFD_SETLK = 37
+)
+
+// Converts the 9P2000.L lock to a fcntl lock, with the offsets from
+// the start of the file.
+func lock2Flock(lk *ninep.Flock) *syscall.Flock_t {
+	fl := &syscall.Flock_t{Type: int16(lk.Type)}
+	fl.Start = int64(lk.Start)
+	if lk.Length <= 1<<63-1 {
+		fl.Len = int64(lk.Length)
+	}
+
+	return fl
+}
+
+// Runs the fcntl lock command on the open file. The file descriptor
+// isn't taken with Fd, which would make the FIFOs blocking.
+func fcntlLock(f *os.File, cmd int, fl *syscall.Flock_t) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	cerr := rc.Control(func(fd uintptr) { err = syscall.FcntlFlock(fd, cmd, fl) })
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// Sets or releases the lock on the open file. The lock doesn't wait,
+// the clients retry the blocking locks.
+func setLock(f *os.File, lk *ninep.Flock) (uint8, error) {
+	err := fcntlLock(f, fOFD_SETLK, lock2Flock(lk))
+	switch err {
+	case nil:
+		return ninep.LockSuccess, nil
+	case syscall.EAGAIN, syscall.EACCES:
+		return ninep.LockBlocked, nil
+	}
+
+	return ninep.LockError, err
+}
+
+// Returns the lock that conflicts with the lock on the open file, or
+// the lock with the type LockTypeUnlck if there isn't any.
+func getLock(f *os.File, lk *ninep.Flock) (*ninep.Flock, error) {
+	fl := lock2Flock(lk)
+	if err := fcntlLock(f, fOFD_GETLK, fl); err != nil {
+		return nil, err
+	}
+
+	l := *lk
+	l.Type = uint8(fl.Type)
+	if fl.Type != syscall.F_UNLCK {
+		l.Start, l.Length = uint64(fl.Start), uint64(fl.Len)
+		l.ProcId = 0
+	}
+
+	return &l, nil
+}
@@ -0,0 +1,587 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ufs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+)
+
+// Starts a ufs exporting a temporary directory and connects to it
+// with the 9P2000.L dialect.
+func setupL(t *testing.T) (*clnt.Clnt, string) {
+	dir, err := ioutil.TempDir("", "ufs")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	u := New()
+	u.Dotu = true
+	u.Dotl = true
+	u.Id = "ufs"
+	u.Root = dir
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	go u.StartListener(l)
+
+	c, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+
+	cl, err := clnt.ConnectVersion(c, 8192+ninep.IOHDRSZ, ninep.VersionL)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	if !cl.Dotl {
+		t.Fatalf("Connect: 9P2000.L not negotiated")
+	}
+
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	if _, err = cl.Attach(nil, user, "/"); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	return cl, dir
+}
+
+func rpc(t *testing.T, cl *clnt.Clnt, pack func(tc *ninep.Fcall) error) *ninep.Fcall {
+	tc := cl.NewFcall()
+	if err := pack(tc); err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+
+	rc, err := cl.Rpc(tc)
+	if err != nil {
+		t.Fatalf("%v: %v", tc, err)
+	}
+
+	return rc
+}
+
+func walk(t *testing.T, cl *clnt.Clnt, names ...string) *clnt.Fid {
+	fid := cl.FidAlloc()
+	if _, err := cl.Walk(cl.Root, fid, names); err != nil {
+		t.Fatalf("Walk %v: %v", names, err)
+	}
+
+	return fid
+}
+
+func TestDotl(t *testing.T) {
+	cl, dir := setupL(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	root := cl.Root.Fid
+	rc := rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTmkdir(tc, root, "dir", 0755, ninep.NOUID)
+	})
+	if rc.Qid.Type&ninep.QTDIR == 0 {
+		t.Errorf("Rmkdir: want a directory qid, got %v", rc.Qid)
+	}
+
+	rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTsymlink(tc, root, "link", "file", ninep.NOUID)
+	})
+
+	link := walk(t, cl, "link")
+	rc = rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTreadlink(tc, link.Fid) })
+	if rc.Target != "file" {
+		t.Errorf("Rreadlink: want file, got %v", rc.Target)
+	}
+
+	file := walk(t, cl, "file")
+	rc = rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTgetattr(tc, file.Fid, ninep.GetattrAll)
+	})
+	if rc.Attr.Size != 5 || rc.Attr.Mode&0777 != 0644 {
+		t.Errorf("Rgetattr: want size 5 mode 0644, got %d %o", rc.Attr.Size, rc.Attr.Mode)
+	}
+
+	sa := &ninep.SetAttr{
+		Valid:     ninep.SetattrSize | ninep.SetattrMtime | ninep.SetattrMtimeSet,
+		Size:      2,
+		Mtime:     1000000000,
+		MtimeNsec: 123456789,
+	}
+	rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTsetattr(tc, file.Fid, sa) })
+	rc = rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTgetattr(tc, file.Fid, ninep.GetattrBasic)
+	})
+	if rc.Attr.Size != 2 || rc.Attr.Mtime != sa.Mtime || rc.Attr.MtimeNsec != sa.MtimeNsec {
+		t.Errorf("Rgetattr after Tsetattr: got size %d mtime %d.%09d", rc.Attr.Size, rc.Attr.Mtime, rc.Attr.MtimeNsec)
+	}
+
+	rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTlopen(tc, file.Fid, 2) })
+	rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTfsync(tc, file.Fid, 0) })
+
+	rc = rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTstatfs(tc, root) })
+	if rc.Statfs.Bsize == 0 {
+		t.Errorf("Rstatfs: zero block size")
+	}
+
+	rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTrenameat(tc, root, "file", root, "file2")
+	})
+	if _, err := os.Stat(path.Join(dir, "file2")); err != nil {
+		t.Errorf("Trenameat: %v", err)
+	}
+
+	rpc(t, cl, func(tc *ninep.Fcall) error {
+		return ninep.PackTunlinkat(tc, root, "dir", ninep.AT_REMOVEDIR)
+	})
+	if _, err := os.Stat(path.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("Tunlinkat: dir still exists")
+	}
+}
+
+func TestDotlReaddir(t *testing.T) {
+	cl, dir := setupL(t)
+	defer os.RemoveAll(dir)
+
+	names := map[string]bool{".": true, "..": true}
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		if err := ioutil.WriteFile(path.Join(dir, n), nil, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		names[n] = true
+	}
+
+	d := walk(t, cl)
+	rpc(t, cl, func(tc *ninep.Fcall) error { return ninep.PackTlopen(tc, d.Fid, 0) })
+
+	// read with a small count to make the client resume from
+	// the returned offsets
+	seen := map[string]bool{}
+	var offset uint64
+	for {
+		rc := rpc(t, cl, func(tc *ninep.Fcall) error {
+			return ninep.PackTreaddir(tc, d.Fid, offset, 40)
+		})
+		if len(rc.Data) == 0 {
+			break
+		}
+
+		for b := rc.Data; len(b) > 0; {
+			de, rest, _, err := ninep.UnpackDirent(b)
+			if err != nil {
+				t.Fatalf("UnpackDirent: %v", err)
+			}
+
+			if seen[de.Name] {
+				t.Errorf("Rreaddir: %v returned twice", de.Name)
+			}
+			seen[de.Name] = true
+			offset = de.Offset
+			b = rest
+		}
+	}
+
+	if len(seen) != len(names) {
+		t.Errorf("Rreaddir: want %v, got %v", names, seen)
+	}
+}
+
+// Users for the permission tests: glenda (1000) is a member of the
+// group of the server process (her primary group) and of group 1000.
+type testUser struct {
+	name   string
+	id     int
+	groups []ninep.Group
+}
+
+type testGroup struct{ id int }
+
+type testUsers struct{}
+
+func (u *testUser) Name() string          { return u.name }
+func (u *testUser) Id() int               { return u.id }
+func (u *testUser) Groups() []ninep.Group { return u.groups }
+func (u *testUser) IsMember(g ninep.Group) bool {
+	for _, ug := range u.groups {
+		if ug.Id() == g.Id() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *testGroup) Name() string          { return "" }
+func (g *testGroup) Id() int               { return g.id }
+func (g *testGroup) Members() []ninep.User { return nil }
+
+var glenda = &testUser{"glenda", 1000, []ninep.Group{&testGroup{os.Getegid()}, &testGroup{1000}}}
+
+func (testUsers) Uid2User(uid int) ninep.User {
+	if uid == glenda.id {
+		return glenda
+	}
+
+	return nil
+}
+
+func (testUsers) Uname2User(uname string) ninep.User {
+	if uname == glenda.name {
+		return glenda
+	}
+
+	return nil
+}
+
+func (testUsers) Gid2Group(gid int) ninep.Group        { return &testGroup{gid} }
+func (testUsers) Gname2Group(gname string) ninep.Group { return nil }
+
+func TestPerms(t *testing.T) {
+	for _, fsuid := range []bool{false, true} {
+		dir := t.TempDir()
+		os.Chmod(path.Dir(dir), 0755)
+		os.Chmod(dir, 0755)
+		os.WriteFile(path.Join(dir, "private"), []byte("x"), 0600)
+		os.WriteFile(path.Join(dir, "group"), []byte("x"), 0640)
+		os.WriteFile(path.Join(dir, "public"), []byte("x"), 0644)
+		os.Mkdir(path.Join(dir, "closed"), 0700)
+		os.WriteFile(path.Join(dir, "closed", "file"), []byte("x"), 0644)
+		os.Mkdir(path.Join(dir, "tmp"), 0777)
+		os.Chmod(path.Join(dir, "tmp"), 0777|os.ModeSticky)
+		os.WriteFile(path.Join(dir, "tmp", "other"), []byte("x"), 0666)
+
+		u := New()
+		u.Dotu = true
+		u.Id = "ufs"
+		u.Root = dir
+		u.Upool = testUsers{}
+		u.Perms = true
+		u.Fsuid = fsuid
+		if !u.Start(u) {
+			t.Fatalf("Starting the server failed")
+		}
+
+		l, err := net.Listen("unix", "")
+		if err != nil {
+			t.Fatalf("net.Listen: %v", err)
+		}
+
+		go u.StartListener(l)
+		cl, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, glenda)
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		check := func(what string, err error, ok bool) {
+			if ok && err != nil {
+				t.Errorf("fsuid %v: %s: %v", fsuid, what, err)
+			} else if !ok && err == nil {
+				t.Errorf("fsuid %v: %s succeeded", fsuid, what)
+			}
+		}
+
+		open := func(name string, mode uint8) error {
+			f, err := cl.FOpen(name, mode)
+			if err == nil {
+				f.Close()
+			}
+
+			return err
+		}
+
+		wstat := func(name string, d *ninep.Dir) error {
+			fid, err := cl.FWalk(name)
+			if err != nil {
+				return err
+			}
+			defer cl.Clunk(fid)
+
+			return cl.Wstat(fid, d)
+		}
+
+		chmod := func(name string, mode uint32) error {
+			d := ninep.NewWstatDir()
+			d.Mode = mode
+			return wstat(name, d)
+		}
+
+		rename := func(name, newname string) error {
+			d := ninep.NewWstatDir()
+			d.Name = newname
+			return wstat(name, d)
+		}
+
+		check("read private", open("private", ninep.OREAD), false)
+		check("read group", open("group", ninep.OREAD), true)
+		check("write group", open("group", ninep.OWRITE), false)
+		check("read public", open("public", ninep.OREAD), true)
+		check("truncate public", open("public", ninep.OREAD|ninep.OTRUNC), false)
+		check("walk closed", open("closed/file", ninep.OREAD), false)
+		check("remove public", cl.FRemove("public"), false)
+
+		_, err = cl.FCreate("new", 0644, ninep.OWRITE)
+		check("create in root", err, false)
+
+		f, err := cl.FCreate("tmp/new", 0644, ninep.OWRITE)
+		check("create in tmp", err, true)
+		if err == nil {
+			f.Close()
+			if os.Geteuid() == 0 {
+				st, _ := os.Stat(path.Join(dir, "tmp", "new"))
+				if st.Sys().(*syscall.Stat_t).Uid != uint32(glenda.id) {
+					t.Errorf("fsuid %v: created file is not owned by the user", fsuid)
+				}
+			}
+
+			// a wstat that fails doesn't change anything
+			d := ninep.NewWstatDir()
+			d.Mode = 0600
+			d.Uidnum = 0
+			check("chmod and give away own file", wstat("tmp/new", d), false)
+			if st, _ := os.Stat(path.Join(dir, "tmp", "new")); st.Mode().Perm() != 0644 {
+				t.Errorf("fsuid %v: failed wstat changed the mode to %v", fsuid, st.Mode())
+			}
+
+			check("chmod own file", chmod("tmp/new", 0600), true)
+			check("rename over a file in a sticky directory", rename("tmp/new", "other"), false)
+			check("remove own file", cl.FRemove("tmp/new"), true)
+		}
+
+		// the other files in a sticky directory can't be changed
+		_, err = cl.FCreate("tmp/other", 0644, ninep.OWRITE)
+		check("create an existing file", err, false)
+		if b, _ := os.ReadFile(path.Join(dir, "tmp", "other")); string(b) != "x" {
+			t.Errorf("fsuid %v: create truncated an existing file", fsuid)
+		}
+
+		check("remove in a sticky directory", cl.FRemove("tmp/other"), false)
+		check("rename in a sticky directory", rename("tmp/other", "mine"), false)
+
+		// and the files the user can't write can't be linked to
+		ofid, err := cl.FWalk("private")
+		if err != nil {
+			t.Fatalf("FWalk: %v", err)
+		}
+
+		dfid, err := cl.FWalk("tmp")
+		if err != nil {
+			t.Fatalf("FWalk: %v", err)
+		}
+
+		err = cl.Create(dfid, "link", ninep.DMLINK, ninep.OREAD, fmt.Sprint(ofid.Fid))
+		check("link to private", err, false)
+		cl.Clunk(ofid)
+		cl.Clunk(dfid)
+
+		check("chmod public", chmod("public", 0666), false)
+		cl.Unmount()
+	}
+}
+
+func TestFifoFlush(t *testing.T) {
+	cl, dir := setupL(t)
+	defer os.RemoveAll(dir)
+
+	fifo := path.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+
+	// the open waits for a writer, until it is flushed
+	fid := walk(t, cl, "fifo")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cl.OpenContext(ctx, fid, ninep.OREAD); err == nil {
+		t.Fatalf("Open of a FIFO without a writer succeeded")
+	}
+
+	oerr := make(chan error, 1)
+	go func() { oerr <- cl.Open(fid, ninep.OREAD) }()
+	w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer w.Close()
+
+	if err := <-oerr; err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// the read blocks until it is flushed
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cl.ReadContext(ctx, fid, 0, 16); err == nil {
+		t.Errorf("Read of an empty FIFO succeeded")
+	}
+
+	w.Write([]byte("hello"))
+	b, err := cl.Read(fid, 0, 16)
+	if err != nil || string(b) != "hello" {
+		t.Errorf("Read: want hello, got %q, %v", b, err)
+	}
+}
+
+func TestFifoFsuid(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the fsuid can be switched only by root")
+	}
+
+	dir := t.TempDir()
+	os.Chmod(path.Dir(dir), 0755)
+	os.Chmod(dir, 0755)
+	fifo := path.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+
+	// keep both ends open, so the opens don't wait
+	f, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	u := New()
+	u.Dotu = true
+	u.Id = "ufs"
+	u.Root = dir
+	u.Upool = testUsers{}
+	u.Fsuid = true
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	go u.StartListener(l)
+	cl, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, glenda)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	defer cl.Unmount()
+
+	if ff, err := cl.FOpen("fifo", ninep.OREAD); err == nil {
+		ff.Close()
+		t.Errorf("open of a private FIFO as another user succeeded")
+	}
+}
+
+func TestDotlNames(t *testing.T) {
+	cl, dir := setupL(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("x"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	outside := path.Base(dir) + "-outside"
+	defer os.RemoveAll(path.Join(path.Dir(dir), outside))
+	bad := []string{"", ".", "..", "../" + outside, "a/../../" + outside}
+	for _, name := range bad {
+		root := walk(t, cl)
+		if err := cl.Lcreate(root, name, syscall.O_RDWR, 0644, ninep.NOUID); err == nil {
+			t.Errorf("Lcreate %q succeeded", name)
+		}
+		cl.Clunk(root)
+
+		if _, err := cl.Mkdir(cl.Root, name, 0755, ninep.NOUID); err == nil {
+			t.Errorf("Mkdir %q succeeded", name)
+		}
+
+		if _, err := cl.Symlink(cl.Root, name, "file", ninep.NOUID); err == nil {
+			t.Errorf("Symlink %q succeeded", name)
+		}
+
+		file := walk(t, cl, "file")
+		if err := cl.Link(cl.Root, file, name); err == nil {
+			t.Errorf("Link %q succeeded", name)
+		}
+		cl.Clunk(file)
+
+		if err := cl.Renameat(cl.Root, "file", cl.Root, name); err == nil {
+			t.Errorf("Renameat to %q succeeded", name)
+		}
+
+		if err := cl.Unlinkat(cl.Root, name, 0); err == nil {
+			t.Errorf("Unlinkat %q succeeded", name)
+		}
+	}
+
+	if _, err := os.Lstat(path.Join(path.Dir(dir), outside)); err == nil {
+		t.Errorf("a file was created outside the root")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "file")); err != nil {
+		t.Errorf("file: %v", err)
+	}
+}
+
+func TestDotlLock(t *testing.T) {
+	cl, dir := setupL(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	f1, f2 := walk(t, cl, "file"), walk(t, cl, "file")
+	wrlck := &ninep.Flock{Type: ninep.LockTypeWrlck, Length: 0, ClientId: "test"}
+	if _, err := cl.Flock(f1, wrlck); err == nil {
+		t.Errorf("Flock of a fid that isn't open succeeded")
+	}
+
+	for _, f := range []*clnt.Fid{f1, f2} {
+		if err := cl.Lopen(f, syscall.O_RDWR); err != nil {
+			t.Fatalf("Lopen: %v", err)
+		}
+	}
+
+	if st, err := cl.Flock(f1, wrlck); err != nil || st != ninep.LockSuccess {
+		t.Fatalf("Flock: %d, %v", st, err)
+	}
+
+	// the lock conflicts with the lock of the other fid
+	if st, err := cl.Flock(f2, wrlck); err != nil || st != ninep.LockBlocked {
+		t.Errorf("Flock of a locked file: %d, %v", st, err)
+	}
+
+	if lk, err := cl.Getlock(f2, wrlck); err != nil || lk.Type != ninep.LockTypeWrlck {
+		t.Errorf("Getlock of a locked file: %v, %v", lk, err)
+	}
+
+	unlck := &ninep.Flock{Type: ninep.LockTypeUnlck, ClientId: "test"}
+	if st, err := cl.Flock(f1, unlck); err != nil || st != ninep.LockSuccess {
+		t.Fatalf("Flock unlock: %d, %v", st, err)
+	}
+
+	if lk, err := cl.Getlock(f2, wrlck); err != nil || lk.Type != ninep.LockTypeUnlck {
+		t.Errorf("Getlock of an unlocked file: %v, %v", lk, err)
+	}
+
+	if st, err := cl.Flock(f2, wrlck); err != nil || st != ninep.LockSuccess {
+		t.Errorf("Flock after unlock: %d, %v", st, err)
+	}
+}
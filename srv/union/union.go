@@ -0,0 +1,842 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The union package implements a file server that stitches the file
+// trees of other 9P file servers into a single namespace, like the
+// Plan 9 mount and bind commands.
+//
+// The file servers are accessed as clients (clnt.Clnt). A file server
+// running in the same process can be connected with Connect:
+//
+//	data := ufs.New()
+//	data.Start(data)
+//	c, err := union.Connect(&data.Srv, "/", user)
+//	...
+//	u := union.New()
+//	u.Bind("/data", c, union.MREPL)
+//	u.Start(u)
+//
+// The files are accessed as the user the client attached as. Binding
+// more than one file server at the same path creates a union
+// directory. Walks in a union directory try its members in order, and
+// reading it returns the entries of all members, without duplicate
+// names. The directories leading to the mount points are created as
+// needed.
+package union
+
+import (
+	"context"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+)
+
+// Bind flags
+const (
+	MREPL   = 0x0000 // replace the old file
+	MBEFORE = 0x0001 // the new file goes before the old one in the union
+	MAFTER  = 0x0002 // the new file goes after the old one in the union
+	MCREATE = 0x0004 // files can be created in the new directory
+)
+
+var Enoent = &ninep.Error{"file not found", ninep.ENOENT}
+var Enocreate = &ninep.Error{"no directory to create the file in", ninep.EPERM}
+var Etoomany = &ninep.Error{"too many file servers", ninep.EINVAL}
+
+// The low bits of the Qid paths of the files of a file server are
+// kept, the high bits identify the file server. The Qid paths with
+// any of the high bits set are remapped.
+const (
+	srcShift = 56
+	maxSrcs  = 255
+)
+
+// A file server bound in the namespace
+type source struct {
+	id int // the high bits of the Qid paths
+	c  *clnt.Clnt
+}
+
+// A member of a mount point
+type binding struct {
+	src    *source // nil for the file that was at the mount point before
+	create bool    // MCREATE
+}
+
+// A file in the namespace. A union directory has more than one,
+// the directories leading to mount points are synthetic (src is nil).
+type loc struct {
+	src    *source
+	fid    *clnt.Fid
+	qid    ninep.Qid // translated Qid
+	create bool      // files can be created in the directory
+}
+
+// Per-fid data
+type Fid struct {
+	sync.Mutex
+	path   string // path in the namespace
+	locs   []*loc
+	dirbuf []byte // merged directory entries not read yet
+	doff   uint64 // offset of the next directory read
+}
+
+// The Union type is a file server that serves a namespace built from
+// other file servers.
+type Union struct {
+	srv.Srv
+
+	ns     sync.RWMutex
+	mounts map[string][]*binding // mount points
+	srcs   map[*clnt.Clnt]*source
+
+	qlock sync.Mutex
+	qids  map[qkey]uint64 // remapped Qid paths
+	spath map[string]uint64
+	qnext uint64
+}
+
+type qkey struct {
+	src  int
+	path uint64
+}
+
+// Creates an empty namespace.
+func New() *Union {
+	u := new(Union)
+	u.mounts = make(map[string][]*binding)
+	u.srcs = make(map[*clnt.Clnt]*source)
+	u.qids = make(map[qkey]uint64)
+	u.spath = make(map[string]uint64)
+	return u
+}
+
+// Connects to a file server that runs in the same process and
+// attaches to it. The returned client can be bound in the namespace.
+func Connect(s *srv.Srv, aname string, user ninep.User) (*clnt.Clnt, error) {
+	c1, c2 := net.Pipe()
+	s.NewConn(c1)
+	return clnt.MountConn(c2, aname, s.Msize-ninep.IOHDRSZ, user)
+}
+
+// Binds the root of the client's file server (c.Root) at name. The
+// flag specifies how it's combined with the file already at name:
+// MREPL replaces it, MBEFORE and MAFTER create a union directory. If
+// MCREATE is set, the files created in the union directory are
+// created in the bound directory.
+func (u *Union) Bind(name string, c *clnt.Clnt, flag int) error {
+	u.ns.Lock()
+	defer u.ns.Unlock()
+
+	src := u.srcs[c]
+	if src == nil {
+		if len(u.srcs) >= maxSrcs {
+			return Etoomany
+		}
+
+		src = &source{id: len(u.srcs) + 1, c: c}
+		u.srcs[c] = src
+	}
+
+	name = path.Join("/", name)
+	b := &binding{src: src, create: flag&MCREATE != 0}
+	old := u.mounts[name]
+	if old == nil {
+		old = []*binding{{}}
+	}
+
+	var bs []*binding
+	switch {
+	case flag&MBEFORE != 0:
+		bs = append([]*binding{b}, old...)
+	case flag&MAFTER != 0:
+		bs = append(old, b)
+	default:
+		bs = []*binding{b}
+	}
+
+	u.mounts[name] = bs
+	return nil
+}
+
+// Removes the client's file server from the mount point name. If c is
+// nil, removes the mount point. The files that are already walked to
+// are not affected.
+func (u *Union) Unbind(name string, c *clnt.Clnt) error {
+	u.ns.Lock()
+	defer u.ns.Unlock()
+
+	name = path.Join("/", name)
+	old, ok := u.mounts[name]
+	if !ok {
+		return Enoent
+	}
+
+	var bs []*binding
+	if c != nil {
+		for _, b := range old {
+			if b.src == nil || b.src.c != c {
+				bs = append(bs, b)
+			}
+		}
+	}
+
+	if len(bs) == len(old) {
+		return Enoent
+	}
+
+	if len(bs) == 0 || (len(bs) == 1 && bs[0].src == nil) {
+		delete(u.mounts, name)
+	} else {
+		u.mounts[name] = bs
+	}
+
+	return nil
+}
+
+// Returns the Qid of a file of the source in the namespace.
+func (u *Union) qid(src *source, q ninep.Qid) ninep.Qid {
+	if q.Path>>srcShift == 0 {
+		q.Path |= uint64(src.id) << srcShift
+		return q
+	}
+
+	u.qlock.Lock()
+	defer u.qlock.Unlock()
+	k := qkey{src.id, q.Path}
+	p, ok := u.qids[k]
+	if !ok {
+		u.qnext++
+		p = u.qnext
+		u.qids[k] = p
+	}
+
+	q.Path = p
+	return q
+}
+
+// Returns the Qid of a synthetic directory.
+func (u *Union) synthQid(p string) ninep.Qid {
+	u.qlock.Lock()
+	defer u.qlock.Unlock()
+	qp, ok := u.spath[p]
+	if !ok {
+		u.qnext++
+		qp = u.qnext
+		u.spath[p] = qp
+	}
+
+	return ninep.Qid{Type: ninep.QTDIR, Path: qp}
+}
+
+// Returns the names of the entries of the synthetic directory p,
+// the first elements of the mount points under it. Should be called
+// with ns locked.
+func (u *Union) synthNames(p string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for mp := range u.mounts {
+		if mp == p || !strings.HasPrefix(mp, prefix) {
+			continue
+		}
+
+		name := mp[len(prefix):]
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name = name[0:i]
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Returns true if there are mount points under p. Should be called
+// with ns locked.
+func (u *Union) implied(p string) bool {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for mp := range u.mounts {
+		if mp != p && strings.HasPrefix(mp, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Walks from the file to name with a new fid. If name is empty, the
+// new fid points to the same file.
+func walk1(ctx context.Context, l *loc, name string) (*clnt.Fid, *ninep.Qid, error) {
+	c := l.src.c
+	fid := c.FidAlloc()
+	fid.User = l.fid.User
+	var wnames []string
+	if name != "" {
+		wnames = []string{name}
+	}
+
+	qids, err := c.WalkContext(ctx, l.fid, fid, wnames)
+	if err == nil && len(qids) != len(wnames) {
+		err = Enoent
+	}
+
+	if err != nil {
+		c.Clunk(fid)
+		return nil, nil, err
+	}
+
+	if len(qids) == 0 {
+		fid.Qid = l.fid.Qid
+	} else {
+		fid.Qid = qids[0]
+	}
+
+	return fid, &fid.Qid, nil
+}
+
+func clunkLocs(locs []*loc) {
+	for _, l := range locs {
+		if l.src != nil && l.fid != nil {
+			l.src.c.Clunk(l.fid)
+			l.fid = nil
+		}
+	}
+}
+
+// Returns copies of the files, with new fids.
+func (u *Union) clone(ctx context.Context, locs []*loc) ([]*loc, error) {
+	nlocs := make([]*loc, 0, len(locs))
+	for _, l := range locs {
+		nl := *l
+		if l.src != nil {
+			fid, _, err := walk1(ctx, l, "")
+			if err != nil {
+				clunkLocs(nlocs)
+				return nil, err
+			}
+
+			nl.fid = fid
+		}
+
+		nlocs = append(nlocs, &nl)
+	}
+
+	return nlocs, nil
+}
+
+// Returns the files at the mount point p. under returns the file that
+// was at the mount point before.
+func (u *Union) mounted(ctx context.Context, p string, under func() ([]*loc, error)) ([]*loc, error) {
+	u.ns.RLock()
+	bs := u.mounts[p]
+	u.ns.RUnlock()
+
+	var locs []*loc
+	for _, b := range bs {
+		if b.src == nil {
+			// it's fine if there was nothing
+			ul, _ := under()
+			locs = append(locs, ul...)
+			continue
+		}
+
+		root := &loc{src: b.src, fid: b.src.c.Root}
+		fid, qid, err := walk1(ctx, root, "")
+		if err != nil {
+			clunkLocs(locs)
+			return nil, err
+		}
+
+		locs = append(locs, &loc{src: b.src, fid: fid, qid: u.qid(b.src, *qid), create: b.create})
+	}
+
+	return locs, nil
+}
+
+// Adds the synthetic directory p if there are mount points under it,
+// and the files don't start with a file that is not a directory.
+func (u *Union) addSynth(p string, locs []*loc) []*loc {
+	u.ns.RLock()
+	implied := u.implied(p)
+	u.ns.RUnlock()
+
+	if implied && (len(locs) == 0 || locs[0].qid.Type&ninep.QTDIR != 0) {
+		locs = append(locs, &loc{qid: u.synthQid(p)})
+	}
+
+	return locs
+}
+
+// Returns the files at the root of the namespace.
+func (u *Union) root(ctx context.Context) ([]*loc, error) {
+	locs, err := u.mounted(ctx, "/", func() ([]*loc, error) { return nil, nil })
+	if err != nil {
+		return nil, err
+	}
+
+	locs = u.addSynth("/", locs)
+	if len(locs) == 0 {
+		// the root always exists
+		locs = append(locs, &loc{qid: u.synthQid("/")})
+	}
+
+	return locs, nil
+}
+
+// Walks from the files at p (a directory) to name. Walks of ".." start
+// again from the root of the namespace.
+func (u *Union) step(ctx context.Context, p string, locs []*loc, name string) (string, []*loc, error) {
+	if name == ".." {
+		np := path.Dir(p)
+		nlocs, err := u.root(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+
+		cp := "/"
+		for _, name := range strings.Split(np, "/") {
+			if name == "" {
+				continue
+			}
+
+			var wlocs []*loc
+			cp, wlocs, err = u.step(ctx, cp, nlocs, name)
+			clunkLocs(nlocs)
+			if err != nil {
+				return "", nil, err
+			}
+
+			nlocs = wlocs
+		}
+
+		return np, nlocs, nil
+	}
+
+	np := path.Join(p, name)
+	under := func() ([]*loc, error) {
+		// the first member of the union that has the file
+		var ferr error = Enoent
+		for _, l := range locs {
+			if l.src == nil || l.fid == nil {
+				continue
+			}
+
+			fid, qid, err := walk1(ctx, l, name)
+			if err == nil {
+				return []*loc{{src: l.src, fid: fid, qid: u.qid(l.src, *qid)}}, nil
+			}
+
+			if ferr == Enoent {
+				ferr = err
+			}
+		}
+
+		return nil, ferr
+	}
+
+	u.ns.RLock()
+	_, mp := u.mounts[np]
+	u.ns.RUnlock()
+
+	var nlocs []*loc
+	var err error
+	if mp {
+		nlocs, err = u.mounted(ctx, np, under)
+	} else {
+		nlocs, err = under()
+	}
+
+	if nlocs = u.addSynth(np, nlocs); len(nlocs) == 0 {
+		return "", nil, err
+	}
+
+	return np, nlocs, nil
+}
+
+func (u *Union) FidDestroy(sfid *srv.Fid) {
+	if sfid.Aux == nil {
+		return
+	}
+
+	fid := sfid.Aux.(*Fid)
+	fid.Lock()
+	clunkLocs(fid.locs)
+	fid.Unlock()
+}
+
+func (u *Union) Attach(req *srv.Req) {
+	if req.Afid != nil {
+		req.RespondError(srv.Enoauth)
+		return
+	}
+
+	locs, err := u.root(req.Context())
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.Fid.Aux = &Fid{path: "/", locs: locs}
+	req.RespondRattach(&locs[0].qid)
+}
+
+func (u *Union) Walk(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+	ctx := req.Context()
+
+	fid.Lock()
+	p, locs := fid.path, fid.locs
+	fid.Unlock()
+
+	var err error
+	var wqids []ninep.Qid
+	owned := false // locs were created by the walk
+	for _, name := range tc.Wname {
+		var np string
+		var nlocs []*loc
+		np, nlocs, err = u.step(ctx, p, locs, name)
+		if owned {
+			clunkLocs(locs)
+		}
+
+		if err != nil {
+			locs = nil
+			break
+		}
+
+		p, locs, owned = np, nlocs, true
+		wqids = append(wqids, locs[0].qid)
+	}
+
+	if len(wqids) < len(tc.Wname) {
+		if len(wqids) == 0 {
+			req.RespondError(err)
+		} else {
+			req.RespondRwalk(wqids)
+		}
+
+		return
+	}
+
+	if req.Newfid == req.Fid {
+		if owned {
+			fid.Lock()
+			clunkLocs(fid.locs)
+			fid.path, fid.locs, fid.dirbuf, fid.doff = p, locs, nil, 0
+			fid.Unlock()
+		}
+
+		req.RespondRwalk(wqids)
+		return
+	}
+
+	if !owned {
+		if locs, err = u.clone(ctx, locs); err != nil {
+			req.RespondError(err)
+			return
+		}
+	}
+
+	req.Newfid.Aux = &Fid{path: p, locs: locs}
+	req.RespondRwalk(wqids)
+}
+
+// The requests are responded without holding the fid's lock, the
+// post processing of the response may destroy the fid.
+func (u *Union) Open(req *srv.Req) {
+	qid, err := u.open(req.Context(), req.Fid.Aux.(*Fid), req.Tc.Mode)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRopen(qid, 0)
+}
+
+func (u *Union) open(ctx context.Context, fid *Fid, mode uint8) (*ninep.Qid, error) {
+	fid.Lock()
+	defer fid.Unlock()
+	locs := fid.locs
+	if locs[0].qid.Type&ninep.QTDIR == 0 {
+		// only the first file is used
+		locs = locs[0:1]
+	}
+
+	for i, l := range locs {
+		if l.src == nil {
+			continue
+		}
+
+		if err := l.src.c.OpenContext(ctx, l.fid, mode); err != nil {
+			if i == 0 {
+				return nil, err
+			}
+
+			// the directory can't be read, leave it out of the union
+			l.src.c.Clunk(l.fid)
+			l.fid = nil
+		}
+	}
+
+	return &locs[0].qid, nil
+}
+
+// Returns the first file in the union directory where files can be
+// created.
+func createLoc(locs []*loc) *loc {
+	if len(locs) == 1 && locs[0].src != nil {
+		return locs[0]
+	}
+
+	for _, l := range locs {
+		if l.create && l.src != nil {
+			return l
+		}
+	}
+
+	return nil
+}
+
+func (u *Union) Create(req *srv.Req) {
+	qid, err := u.create(req.Context(), req.Fid.Aux.(*Fid), req.Tc)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRcreate(qid, 0)
+}
+
+func (u *Union) create(ctx context.Context, fid *Fid, tc *ninep.Fcall) (*ninep.Qid, error) {
+	fid.Lock()
+	defer fid.Unlock()
+	l := createLoc(fid.locs)
+	if l == nil {
+		return nil, Enocreate
+	}
+
+	nfid, _, err := walk1(ctx, l, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.src.c.CreateContext(ctx, nfid, tc.Name, tc.Perm, tc.Mode, tc.Ext); err != nil {
+		l.src.c.Clunk(nfid)
+		return nil, err
+	}
+
+	nl := &loc{src: l.src, fid: nfid, qid: u.qid(l.src, nfid.Qid)}
+	clunkLocs(fid.locs)
+	fid.path = path.Join(fid.path, tc.Name)
+	fid.locs = []*loc{nl}
+	fid.dirbuf, fid.doff = nil, 0
+	return &nl.qid, nil
+}
+
+// Returns the directory entries of the union directory, without
+// duplicate names.
+func (u *Union) readdir(ctx context.Context, fid *Fid, dotu bool) ([]byte, error) {
+	var buf []byte
+	seen := make(map[string]bool)
+	add := func(d *ninep.Dir) {
+		if !seen[d.Name] {
+			seen[d.Name] = true
+			buf = append(buf, ninep.PackDir(d, dotu)...)
+		}
+	}
+
+	for i, l := range fid.locs {
+		if l.src == nil {
+			u.ns.RLock()
+			names := u.synthNames(fid.path)
+			u.ns.RUnlock()
+			for _, name := range names {
+				add(u.synthDir(path.Join(fid.path, name)))
+			}
+
+			continue
+		}
+
+		if l.fid == nil {
+			continue
+		}
+
+		dirs, err := clnt.NewFile(l.fid, 0).ReaddirContext(ctx, 0)
+		if err != nil && err != io.EOF {
+			if i == 0 {
+				return nil, err
+			}
+
+			continue
+		}
+
+		for _, d := range dirs {
+			d.Qid = u.qid(l.src, d.Qid)
+			add(d)
+		}
+	}
+
+	return buf, nil
+}
+
+// Returns the stat of a synthetic directory.
+func (u *Union) synthDir(p string) *ninep.Dir {
+	d := new(ninep.Dir)
+	d.Qid = u.synthQid(p)
+	d.Mode = ninep.DMDIR | 0555
+	d.Name = path.Base(p)
+	d.Uid = "none"
+	d.Gid = "none"
+	d.Muid = "none"
+	d.Uidnum = ninep.NOUID
+	d.Gidnum = ninep.NOUID
+	d.Muidnum = ninep.NOUID
+	return d
+}
+
+func (u *Union) Read(req *srv.Req) {
+	data, err := u.read(req.Context(), req.Fid.Aux.(*Fid), req.Tc, req.Conn.Dotu)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRread(data)
+}
+
+func (u *Union) read(ctx context.Context, fid *Fid, tc *ninep.Fcall, dotu bool) ([]byte, error) {
+	fid.Lock()
+	defer fid.Unlock()
+	l := fid.locs[0]
+	if l.qid.Type&ninep.QTDIR == 0 {
+		count := tc.Count
+		if count > l.fid.Iounit {
+			count = l.fid.Iounit
+		}
+
+		return l.src.c.ReadContext(ctx, l.fid, tc.Offset, count)
+	}
+
+	// the entries are merged when the directory is read from
+	// offset 0, the next reads continue where the last one ended
+	if tc.Offset == 0 {
+		buf, err := u.readdir(ctx, fid, dotu)
+		if err != nil {
+			return nil, err
+		}
+
+		fid.dirbuf, fid.doff = buf, 0
+	} else if tc.Offset != fid.doff {
+		return nil, srv.Ebadoffset
+	}
+
+	n := srv.DirEntries(fid.dirbuf, tc.Count)
+	if n == 0 && len(fid.dirbuf) > 0 {
+		return nil, srv.Etoosmall
+	}
+
+	b := fid.dirbuf[0:n]
+	fid.dirbuf = fid.dirbuf[n:]
+	fid.doff += uint64(n)
+	return b, nil
+}
+
+func (u *Union) Write(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+	tc := req.Tc
+
+	fid.Lock()
+	l := fid.locs[0]
+	fid.Unlock()
+	data := tc.Data
+	if uint32(len(data)) > l.fid.Iounit {
+		data = data[0:l.fid.Iounit]
+	}
+
+	n, err := l.src.c.WriteContext(req.Context(), l.fid, data, tc.Offset)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRwrite(uint32(n))
+}
+
+func (u *Union) Clunk(req *srv.Req) { req.RespondRclunk() }
+
+func (u *Union) Remove(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	fid.Lock()
+	l := fid.locs[0]
+	if l.src == nil {
+		fid.Unlock()
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	err := l.src.c.RemoveContext(req.Context(), l.fid)
+	l.fid = nil
+	fid.Unlock()
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRremove()
+}
+
+func (u *Union) Stat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	fid.Lock()
+	p, l := fid.path, fid.locs[0]
+	fid.Unlock()
+	if l.src == nil {
+		req.RespondRstat(u.synthDir(p))
+		return
+	}
+
+	d, err := l.src.c.StatContext(req.Context(), l.fid)
+	if err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	d.Qid = l.qid
+	d.Name = path.Base(p)
+	req.RespondRstat(d)
+}
+
+func (u *Union) Wstat(req *srv.Req) {
+	fid := req.Fid.Aux.(*Fid)
+
+	fid.Lock()
+	l := fid.locs[0]
+	fid.Unlock()
+	if l.src == nil {
+		req.RespondError(srv.Eperm)
+		return
+	}
+
+	if err := l.src.c.WstatContext(req.Context(), l.fid, &req.Tc.Dir); err != nil {
+		req.RespondError(err)
+		return
+	}
+
+	req.RespondRwstat()
+}
@@ -0,0 +1,312 @@
+// Copyright 2012 The Ninep Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package union
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lionkov/ninep"
+	"github.com/lionkov/ninep/clnt"
+	"github.com/lionkov/ninep/srv"
+	"github.com/lionkov/ninep/srv/ufs"
+)
+
+// Creates a directory with the files (name -> content, names ending
+// with / are directories), and connects to a ufs exporting it.
+func ufsDir(t *testing.T, user ninep.User, files map[string]string) (*clnt.Clnt, string) {
+	dir, err := ioutil.TempDir("", "union")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(p, 0755)
+		} else {
+			err = ioutil.WriteFile(p, []byte(data), 0644)
+		}
+
+		if err != nil {
+			t.Fatalf("creating %v: %v", name, err)
+		}
+	}
+
+	u := ufs.New()
+	u.Dotu = true
+	u.Id = "ufs"
+	u.Root = dir
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	c, err := Connect(&u.Srv, "/", user)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	return c, dir
+}
+
+// Starts the union server and mounts it.
+func mount(t *testing.T, u *Union, user ninep.User) *clnt.Clnt {
+	u.Dotu = true
+	u.Id = "union"
+	if !u.Start(u) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	l, err := net.Listen("unix", "")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	go u.StartListener(l)
+
+	c, err := clnt.Mount("unix", l.Addr().String(), "/", 8192, user)
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	return c
+}
+
+func readFile(t *testing.T, c *clnt.Clnt, name string) string {
+	f, err := c.FOpen(name, ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen %v: %v", name, err)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read %v: %v", name, err)
+	}
+
+	return string(b)
+}
+
+func readDir(t *testing.T, c *clnt.Clnt, name string) ([]string, []*ninep.Dir) {
+	f, err := c.FOpen(name, ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen %v: %v", name, err)
+	}
+	defer f.Close()
+
+	dirs, err := f.Readdir(0)
+	if err != nil && err != io.EOF {
+		t.Fatalf("Readdir %v: %v", name, err)
+	}
+
+	var names []string
+	for _, d := range dirs {
+		names = append(names, d.Name)
+	}
+
+	sort.Strings(names)
+	return names, dirs
+}
+
+func TestUnion(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	a, adir := ufsDir(t, user, map[string]string{"a": "a", "common": "from a", "sub/": ""})
+	defer os.RemoveAll(adir)
+	b, bdir := ufsDir(t, user, map[string]string{"b": "b", "common": "from b"})
+	defer os.RemoveAll(bdir)
+
+	u := New()
+	if err := u.Bind("/", a, MREPL); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	u.Bind("/", b, MAFTER)
+	u.Bind("/data", b, MREPL)
+	u.Bind("/x/y/before", a, MREPL)
+	u.Bind("/x/y/before", b, MBEFORE|MCREATE)
+
+	c := mount(t, u, user)
+	defer c.Unmount()
+
+	names, _ := readDir(t, c, "/")
+	if want := "a b common data sub x"; strings.Join(names, " ") != want {
+		t.Errorf("Readdir /: want %v, got %v", want, names)
+	}
+
+	// the directory reads continue where the last one ended
+	f, err := c.FOpen("/", ninep.OREAD)
+	if err != nil {
+		t.Fatalf("FOpen: %v", err)
+	}
+
+	b1, err := c.Read(f.Fid(), 0, 100)
+	if err != nil || len(b1) == 0 {
+		t.Fatalf("Read: %d bytes, %v", len(b1), err)
+	}
+
+	if _, err := c.Read(f.Fid(), uint64(len(b1))-1, 100); err == nil {
+		t.Errorf("Read at a bad offset succeeded")
+	}
+
+	if _, err := c.Read(f.Fid(), uint64(len(b1)), 100); err != nil {
+		t.Errorf("Read at the next offset: %v", err)
+	}
+
+	if _, err := c.Read(f.Fid(), 0, 10); err == nil {
+		t.Errorf("Read with a count too small for an entry succeeded")
+	}
+	f.Close()
+
+	if s := readFile(t, c, "common"); s != "from a" {
+		t.Errorf("common: want 'from a', got %q", s)
+	}
+
+	if s := readFile(t, c, "b"); s != "b" {
+		t.Errorf("b: want 'b', got %q", s)
+	}
+
+	if s := readFile(t, c, "data/common"); s != "from b" {
+		t.Errorf("data/common: want 'from b', got %q", s)
+	}
+
+	if s := readFile(t, c, "x/y/before/common"); s != "from b" {
+		t.Errorf("x/y/before/common: want 'from b', got %q", s)
+	}
+
+	if s := readFile(t, c, "x/y/../y/before/a"); s != "a" {
+		t.Errorf("x/y/../y/before/a: want 'a', got %q", s)
+	}
+
+	if s := readFile(t, c, "data/../a"); s != "a" {
+		t.Errorf("data/../a: want 'a', got %q", s)
+	}
+
+	if _, err := c.FOpen("nonexistent", ninep.OREAD); err == nil {
+		t.Errorf("FOpen of a nonexistent file succeeded")
+	}
+
+	// the files are created in the MCREATE member of the union
+	f, err = c.FCreate("x/y/before/new", 0644, ninep.OWRITE)
+	if err != nil {
+		t.Fatalf("FCreate: %v", err)
+	}
+
+	if _, err := f.Write([]byte("new")); err != nil {
+		t.Errorf("Write: %v", err)
+	}
+	f.Close()
+
+	if data, err := ioutil.ReadFile(filepath.Join(bdir, "new")); err != nil || string(data) != "new" {
+		t.Errorf("created file: want 'new', got %q, %v", data, err)
+	}
+
+	if _, err := c.FCreate("x/y/new", 0644, ninep.OWRITE); err == nil {
+		t.Errorf("FCreate in a synthetic directory succeeded")
+	}
+
+	// a is bound twice, but its files must have different Qids
+	st1, err := c.FStat("a")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	st2, err := c.FStat("x/y/before/a")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	st3, err := c.FStat("b")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	if st1.Qid.Path != st2.Qid.Path {
+		t.Errorf("same file has different Qids: %v %v", st1.Qid, st2.Qid)
+	}
+
+	if st1.Qid.Path == st3.Qid.Path || st1.Qid.Path>>srcShift == 0 {
+		t.Errorf("bad Qids: %v %v", st1.Qid, st3.Qid)
+	}
+
+	if st, err := c.FStat("x/y"); err != nil || st.Name != "y" || st.Mode&ninep.DMDIR == 0 {
+		t.Errorf("FStat x/y: %v %v", st, err)
+	}
+
+	if err := c.FRemove("data/b"); err != nil {
+		t.Errorf("FRemove: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(bdir, "b")); !os.IsNotExist(err) {
+		t.Errorf("removed file exists: %v", err)
+	}
+
+	if err := u.Unbind("/data", b); err != nil {
+		t.Errorf("Unbind: %v", err)
+	}
+
+	names, _ = readDir(t, c, "/")
+	if want := "a common new sub x"; strings.Join(names, " ") != want {
+		t.Errorf("Readdir / after Unbind: want %v, got %v", want, names)
+	}
+}
+
+// The Qids of a file server that uses the high bits of the Qid path
+// are remapped.
+func TestQids(t *testing.T) {
+	user := ninep.OsUsers.Uid2User(os.Geteuid())
+	root := new(srv.File)
+	err := root.Add(nil, "/", user, nil, ninep.DMDIR|0555, nil)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	fs := srv.NewFileSrv(root)
+	fs.Dotu = true
+	if !fs.Start(fs) {
+		t.Fatalf("Starting the server failed")
+	}
+
+	for _, name := range []string{"f1", "f2"} {
+		f := new(srv.File)
+		if err := f.Add(root, name, user, nil, 0444, nil); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+
+		f.Qid.Path |= 0xff << srcShift
+	}
+
+	c, err := Connect(&fs.Srv, "", user)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	u := New()
+	u.Bind("/", c, MREPL)
+	uc := mount(t, u, user)
+	defer uc.Unmount()
+
+	_, dirs := readDir(t, uc, "/")
+	if len(dirs) != 2 {
+		t.Fatalf("Readdir: want 2 entries, got %v", dirs)
+	}
+
+	st, err := uc.FStat("f2")
+	if err != nil {
+		t.Fatalf("FStat: %v", err)
+	}
+
+	q1, q2 := dirs[0].Qid.Path, dirs[1].Qid.Path
+	if q1 == q2 || q1>>srcShift != 0 || q2>>srcShift != 0 {
+		t.Errorf("bad Qids: %x %x", q1, q2)
+	}
+
+	if st.Qid.Path != q1 && st.Qid.Path != q2 {
+		t.Errorf("Stat and Readdir Qids differ: %x, %x %x", st.Qid.Path, q1, q2)
+	}
+}
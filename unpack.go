@@ -9,19 +9,44 @@ import (
 )
 
 // Creates a Fcall value from the on-the-wire representation. If
-// dotu is true, reads 9P2000.u messages. Returns the unpacked message,
-// error and how many bytes from the buffer were used by the message.
+// dotu is true, reads 9P2000.u messages. The 9P2000.L messages are
+// always recognized, 9P2000.L connections should set dotu to true as
+// Tauth and Tattach are the same as in 9P2000.u. Returns the unpacked
+// message, error and how many bytes from the buffer were used by the
+// message.
 func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
+	fc = fcpool.Get().(*Fcall)
+	fcsz, err = UnpackFcall(fc, buf, dotu)
+	if err != nil {
+		return nil, err, 0
+	}
+
+	return fc, nil, fcsz
+}
+
+// Like Unpack, but decodes the message into an existing Fcall, so a
+// single value can be reused for all messages read from a connection.
+// The slices in fc (Wname, Wqid) are reused, and so are the strings
+// recently decoded into it. The Pkt and Data fields point into buf,
+// the data isn't copied.
+func UnpackFcall(fc *Fcall, buf []byte, dotu bool) (fcsz int, err error) {
 	var m uint16
 
 	if len(buf) < 7 {
-		return nil, &Error{"buffer too short", EINVAL}, 0
+		return 0, &Error{"buffer too short", EINVAL}
 	}
 
-	fc = new(Fcall)
+	if fc.strs == nil {
+		fc.strs = new(strcache)
+	}
+
+	old := *fc
+	*fc = Fcall{Buf: old.Buf, pooled: old.pooled, strs: old.strs,
+		Wname: old.Wname[0:0], Wqid: old.Wqid[0:0]}
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
+	fc.Dfid = NOFID
 
 	p := buf
 	fc.Size, p = gint32(p)
@@ -29,24 +54,27 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	fc.Tag, p = gint16(p)
 
 	if int(fc.Size) > len(buf) || fc.Size < 7 {
-		return nil, &Error{fmt.Sprintf("buffer too short: %d expected %d",
-				len(buf), fc.Size),
-				EINVAL},
-			0
+		return 0, &Error{fmt.Sprintf("buffer too short: %d expected %d",
+			len(buf), fc.Size), EINVAL}
 	}
 
 	p = p[0 : fc.Size-7]
 	fc.Pkt = buf[0:fc.Size]
 	fcsz = int(fc.Size)
-	if fc.Type < Tversion || fc.Type >= Tlast {
-		return nil, &Error{"invalid id", EINVAL}, 0
-	}
-
 	var sz uint32
-	if dotu {
-		sz = minFcusize[fc.Type-Tversion]
-	} else {
-		sz = minFcsize[fc.Type-Tversion]
+	switch {
+	case fc.Type >= Tversion && fc.Type < Tlast:
+		if dotu {
+			sz = minFcusize[fc.Type-Tversion]
+		} else {
+			sz = minFcsize[fc.Type-Tversion]
+		}
+
+	case int(fc.Type) < len(minFclsize):
+		sz = minFclsize[fc.Type] + 7 /* size[4] id[1] tag[2] */
+
+	default:
+		return 0, &Error{"invalid id", EINVAL}
 	}
 
 	if fc.Size < sz {
@@ -56,23 +84,23 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	err = nil
 	switch fc.Type {
 	default:
-		return nil, &Error{"invalid message id", EINVAL}, 0
+		return 0, &Error{"invalid message id", EINVAL}
 
 	case Tversion, Rversion:
 		fc.Msize, p = gint32(p)
-		fc.Version, p = gstr(p)
+		fc.Version, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
 
 	case Tauth:
 		fc.Afid, p = gint32(p)
-		fc.Uname, p = gstr(p)
+		fc.Uname, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
 
-		fc.Aname, p = gstr(p)
+		fc.Aname, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
@@ -91,12 +119,12 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	case Tattach:
 		fc.Fid, p = gint32(p)
 		fc.Afid, p = gint32(p)
-		fc.Uname, p = gstr(p)
+		fc.Uname, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
 
-		fc.Aname, p = gstr(p)
+		fc.Aname, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
@@ -107,7 +135,7 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		}
 
 	case Rerror:
-		fc.Error, p = gstr(p)
+		fc.Error, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
@@ -121,19 +149,22 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		fc.Fid, p = gint32(p)
 		fc.Newfid, p = gint32(p)
 		m, p = gint16(p)
-		fc.Wname = make([]string, m)
 		for i := 0; i < int(m); i++ {
-			fc.Wname[i], p = gstr(p)
+			var name string
+			name, p = gstrs(p, fc.strs)
 			if p == nil {
 				goto szerror
 			}
+
+			fc.Wname = append(fc.Wname, name)
 		}
 
 	case Rwalk:
 		m, p = gint16(p)
-		fc.Wqid = make([]Qid, m)
 		for i := 0; i < int(m); i++ {
-			p = gqid(p, &fc.Wqid[i])
+			var qid Qid
+			p = gqid(p, &qid)
+			fc.Wqid = append(fc.Wqid, qid)
 		}
 
 	case Topen:
@@ -146,14 +177,14 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 
 	case Tcreate:
 		fc.Fid, p = gint32(p)
-		fc.Name, p = gstr(p)
+		fc.Name, p = gstrs(p, fc.strs)
 		if p == nil {
 			goto szerror
 		}
 		fc.Perm, p = gint32(p)
 		fc.Mode, p = gint8(p)
 		if dotu {
-			fc.Ext, p = gstr(p)
+			fc.Ext, p = gstrs(p, fc.strs)
 			if p == nil {
 				goto szerror
 			}
@@ -176,14 +207,11 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 		fc.Fid, p = gint32(p)
 		fc.Offset, p = gint64(p)
 		fc.Count, p = gint32(p)
-		if len(p) != int(fc.Count) {
-			fc.Data = make([]byte, fc.Count)
-			copy(fc.Data, p)
-			p = p[len(p):]
-		} else {
-			fc.Data = p
-			p = p[fc.Count:]
+		if len(p) < int(fc.Count) {
+			goto szerror
 		}
+		fc.Data = p[0:fc.Count]
+		p = p[len(p):]
 
 	case Rwrite:
 		fc.Count, p = gint32(p)
@@ -193,17 +221,239 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 
 	case Rstat:
 		m, p = gint16(p)
-		p, err = gstat(p, &fc.Dir, dotu)
+		p, err = gstat(p, &fc.Dir, dotu, fc.strs)
 		if err != nil {
-			return nil, err, 0
+			return 0, err
 		}
 
 	case Twstat:
 		fc.Fid, p = gint32(p)
 		m, p = gint16(p)
-		p, _ = gstat(p, &fc.Dir, dotu)
+		p, _ = gstat(p, &fc.Dir, dotu, fc.strs)
 
 	case Rflush, Rclunk, Rremove, Rwstat:
+
+	/* 9P2000.L messages */
+	case Rlerror:
+		fc.Errornum, p = gint32(p)
+
+	case Tstatfs, Treadlink:
+		fc.Fid, p = gint32(p)
+
+	case Rstatfs:
+		fc.Statfs.Type, p = gint32(p)
+		fc.Statfs.Bsize, p = gint32(p)
+		fc.Statfs.Blocks, p = gint64(p)
+		fc.Statfs.Bfree, p = gint64(p)
+		fc.Statfs.Bavail, p = gint64(p)
+		fc.Statfs.Files, p = gint64(p)
+		fc.Statfs.Ffree, p = gint64(p)
+		fc.Statfs.Fsid, p = gint64(p)
+		fc.Statfs.Namelen, p = gint32(p)
+
+	case Tlopen:
+		fc.Fid, p = gint32(p)
+		fc.Flags, p = gint32(p)
+
+	case Rlopen, Rlcreate:
+		p = gqid(p, &fc.Qid)
+		fc.Iounit, p = gint32(p)
+
+	case Tlcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Flags, p = gint32(p)
+		fc.Perm, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Tsymlink:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+		fc.Target, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Ngid, p = gint32(p)
+
+	case Rsymlink, Rmknod, Rmkdir:
+		p = gqid(p, &fc.Qid)
+
+	case Tmknod:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 16 {
+			goto szerror
+		}
+		fc.Perm, p = gint32(p)
+		fc.Major, p = gint32(p)
+		fc.Minor, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Trename:
+		fc.Fid, p = gint32(p)
+		fc.Dfid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rreadlink:
+		fc.Target, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tgetattr:
+		fc.Fid, p = gint32(p)
+		fc.Mask, p = gint64(p)
+
+	case Rgetattr:
+		a := &fc.Attr
+		a.Valid, p = gint64(p)
+		p = gqid(p, &a.Qid)
+		a.Mode, p = gint32(p)
+		a.Uid, p = gint32(p)
+		a.Gid, p = gint32(p)
+		a.Nlink, p = gint64(p)
+		a.Rdev, p = gint64(p)
+		a.Size, p = gint64(p)
+		a.Blksize, p = gint64(p)
+		a.Blocks, p = gint64(p)
+		a.Atime, p = gint64(p)
+		a.AtimeNsec, p = gint64(p)
+		a.Mtime, p = gint64(p)
+		a.MtimeNsec, p = gint64(p)
+		a.Ctime, p = gint64(p)
+		a.CtimeNsec, p = gint64(p)
+		a.Btime, p = gint64(p)
+		a.BtimeNsec, p = gint64(p)
+		a.Gen, p = gint64(p)
+		a.DataVersion, p = gint64(p)
+
+	case Tsetattr:
+		a := &fc.Setattr
+		fc.Fid, p = gint32(p)
+		a.Valid, p = gint32(p)
+		a.Mode, p = gint32(p)
+		a.Uid, p = gint32(p)
+		a.Gid, p = gint32(p)
+		a.Size, p = gint64(p)
+		a.Atime, p = gint64(p)
+		a.AtimeNsec, p = gint64(p)
+		a.Mtime, p = gint64(p)
+		a.MtimeNsec, p = gint64(p)
+
+	case Txattrwalk:
+		fc.Fid, p = gint32(p)
+		fc.Newfid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rxattrwalk:
+		fc.Xattrsize, p = gint64(p)
+
+	case Txattrcreate:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 12 {
+			goto szerror
+		}
+		fc.Xattrsize, p = gint64(p)
+		fc.Flags, p = gint32(p)
+
+	case Treaddir:
+		fc.Fid, p = gint32(p)
+		fc.Offset, p = gint64(p)
+		fc.Count, p = gint32(p)
+
+	case Rreaddir:
+		fc.Count, p = gint32(p)
+		if len(p) < int(fc.Count) {
+			goto szerror
+		}
+		fc.Data = p
+		p = p[fc.Count:]
+
+	case Tfsync:
+		fc.Fid, p = gint32(p)
+		if len(p) >= 4 {
+			fc.Datasync, p = gint32(p)
+		}
+
+	case Tlock:
+		fc.Fid, p = gint32(p)
+		fc.Flock.Type, p = gint8(p)
+		fc.Flock.Flags, p = gint32(p)
+		fc.Flock.Start, p = gint64(p)
+		fc.Flock.Length, p = gint64(p)
+		fc.Flock.ProcId, p = gint32(p)
+		fc.Flock.ClientId, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Rlock:
+		fc.Status, p = gint8(p)
+
+	case Tgetlock, Rgetlock:
+		if fc.Type == Tgetlock {
+			fc.Fid, p = gint32(p)
+		}
+		fc.Flock.Type, p = gint8(p)
+		fc.Flock.Start, p = gint64(p)
+		fc.Flock.Length, p = gint64(p)
+		fc.Flock.ProcId, p = gint32(p)
+		fc.Flock.ClientId, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tlink:
+		fc.Dfid, p = gint32(p)
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tmkdir:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 8 {
+			goto szerror
+		}
+		fc.Perm, p = gint32(p)
+		fc.Ngid, p = gint32(p)
+
+	case Trenameat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 6 {
+			goto szerror
+		}
+		fc.Dfid, p = gint32(p)
+		fc.Newname, p = gstrs(p, fc.strs)
+		if p == nil {
+			goto szerror
+		}
+
+	case Tunlinkat:
+		fc.Fid, p = gint32(p)
+		fc.Name, p = gstrs(p, fc.strs)
+		if p == nil || len(p) < 4 {
+			goto szerror
+		}
+		fc.Flags, p = gint32(p)
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
 	}
 
 	if len(p) > 0 {
@@ -213,5 +463,5 @@ func Unpack(buf []byte, dotu bool) (fc *Fcall, err error, fcsz int) {
 	return
 
 szerror:
-	return nil, &Error{"invalid size", EINVAL}, 0
+	return 0, &Error{"invalid size", EINVAL}
 }